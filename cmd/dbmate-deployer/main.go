@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/alecthomas/kong"
+	"github.com/tokuhirom/dbmate-deployer/internal/doctor"
+	"github.com/tokuhirom/dbmate-deployer/internal/listversions"
 	"github.com/tokuhirom/dbmate-deployer/internal/once"
+	"github.com/tokuhirom/dbmate-deployer/internal/prune"
 	"github.com/tokuhirom/dbmate-deployer/internal/push"
+	"github.com/tokuhirom/dbmate-deployer/internal/rollback"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared"
+	"github.com/tokuhirom/dbmate-deployer/internal/verify"
 	"github.com/tokuhirom/dbmate-deployer/internal/version"
 	"github.com/tokuhirom/dbmate-deployer/internal/wait"
 	"github.com/tokuhirom/dbmate-deployer/internal/watch"
@@ -20,49 +30,211 @@ var (
 
 // CLI represents command line arguments
 type CLI struct {
-	S3EndpointURL string `help:"S3 endpoint URL (for S3-compatible services)" env:"S3_ENDPOINT_URL" name:"s3-endpoint-url"`
-	MetricsAddr   string `help:"Prometheus metrics endpoint address (e.g. ':9090')" env:"METRICS_ADDR"`
+	Config           kong.ConfigFlag `help:"Load flag values from a JSON config file (keys are flag names in snake_case)" type:"existingfile"`
+	S3EndpointURL    string          `help:"S3 endpoint URL (for S3-compatible services)" env:"S3_ENDPOINT_URL" name:"s3-endpoint-url"`
+	S3Region         string          `help:"S3 region, overriding AWS_REGION and the shared config (e.g. 'auto' for Cloudflare R2)" env:"S3_REGION" name:"s3-region"`
+	S3ForcePathStyle *bool           `help:"Use path-style S3 requests (default: true with --s3-endpoint-url, false otherwise)" env:"S3_FORCE_PATH_STYLE" name:"s3-force-path-style"`
+	AWSProfile       string          `help:"AWS shared config profile for S3 access (e.g. an SSO profile), instead of the default credential chain" name:"aws-profile"`
+	AWSConfigFile    string          `help:"Shared AWS config file to read instead of ~/.aws/config" name:"aws-config-file" type:"existingfile"`
+	AWSCredsFile     string          `help:"Shared AWS credentials file to read instead of ~/.aws/credentials" name:"aws-credentials-file" type:"existingfile"`
+	AssumeRoleARN    string          `help:"IAM role ARN to assume for S3 access (e.g. a bucket in another account)" env:"ASSUME_ROLE_ARN" name:"assume-role-arn"`
+	ExternalID       string          `help:"External ID used when assuming --assume-role-arn" env:"ASSUME_ROLE_EXTERNAL_ID" name:"external-id"`
+	S3CABundle       string          `help:"PEM file of extra CA certificates trusted for the S3 endpoint" env:"S3_CA_BUNDLE" name:"s3-ca-bundle" type:"existingfile"`
+	S3InsecureSkip   bool            `help:"Skip TLS certificate verification for S3 (development only)" env:"S3_INSECURE_SKIP_VERIFY" name:"s3-insecure-skip-verify"`
+	S3MaxAttempts    int             `help:"Maximum attempts for each S3 call on transient errors (5xx, throttling, timeouts)" env:"S3_MAX_ATTEMPTS" name:"s3-max-attempts" default:"3"`
+	S3RetryBaseDelay time.Duration   `help:"Upper bound of the random delay before the first S3 retry; it doubles after each retry" env:"S3_RETRY_BASE_DELAY" name:"s3-retry-base-delay" default:"200ms"`
+	S3RetryMaxDelay  time.Duration   `help:"Cap for the doubling S3 retry delay bound" env:"S3_RETRY_MAX_DELAY" name:"s3-retry-max-delay" default:"20s"`
+	S3RetryMaxTotal  time.Duration   `help:"Stop retrying an S3 call once the next delay would end this long after its first attempt (0 for no limit)" env:"S3_RETRY_MAX_ELAPSED" name:"s3-retry-max-elapsed" default:"0s"`
+	MigrationsSubdir string          `help:"Folder under each version holding the migration files (empty: directly under the version)" env:"MIGRATIONS_SUBDIR" name:"migrations-subdir" default:"migrations"`
+	MigrationsTable  string          `help:"Table dbmate records applied migrations in, optionally schema-qualified (schema.table); give apps sharing a database their own" env:"MIGRATIONS_TABLE" name:"migrations-table" default:"schema_migrations"`
+	VersionFormat    string          `help:"Format of version folders: timestamp (YYYYMMDDHHMMSS), numeric or free (any S3-safe name, natural sort)" env:"VERSION_FORMAT" name:"version-format" enum:"timestamp,numeric,free" default:"timestamp"`
+	SlackTimeout     time.Duration   `help:"HTTP timeout for each Slack, Teams or Google Chat webhook request" env:"SLACK_TIMEOUT" name:"slack-timeout" default:"10s"`
+	SlackMaxAttempts int             `help:"Maximum attempts for each webhook notification on 429, 5xx and network errors" env:"SLACK_MAX_ATTEMPTS" name:"slack-max-attempts" default:"3"`
+	MetricsAddr      string          `help:"Prometheus metrics endpoint address (e.g. ':9090')" env:"METRICS_ADDR"`
+	LogFormat        string          `help:"Log output format (text or json)" env:"LOG_FORMAT" enum:"text,json" default:"text"`
+	LogLevel         string          `help:"Minimum log level (debug, info, warn, error)" env:"LOG_LEVEL" enum:"debug,info,warn,error" default:"info"`
+	LogTimestampFmt  string          `help:"Go time layout of the timestamps in the migration log stored in results (UTC)" env:"LOG_TIMESTAMP_FORMAT" name:"log-timestamp-format" default:"2006-01-02 15:04:05 UTC"`
 
 	Watch         WatchCmd         `cmd:"" help:"Watch S3 for new migrations and apply them"`
 	Once          OnceCmd          `cmd:"" help:"Run once and exit"`
 	Push          PushCmd          `cmd:"" help:"Upload migrations to S3"`
-	WaitAndNotify WaitAndNotifyCmd `cmd:"" help:"Wait for migration result and optionally notify Slack"`
+	WaitAndNotify WaitAndNotifyCmd `cmd:"" help:"Wait for migration result and optionally notify Slack, Teams or Google Chat"`
+	Rollback      RollbackCmd      `cmd:"" help:"Roll back the migrations introduced by a version"`
+	Doctor        DoctorCmd        `cmd:"" help:"Check configuration, S3 access and database connectivity"`
+	Verify        VerifyCmd        `cmd:"" help:"Run the pending migrations in a rolled-back transaction to prove they would apply (PostgreSQL)"`
+	ListVersions  ListVersionsCmd  `cmd:"" help:"List version directories, optionally filtered by result status"`
+	Prune         PruneCmd         `cmd:"" help:"Delete old applied version directories (dry run unless --confirm)"`
 	Version       VersionCmd       `cmd:"" help:"Show version information"`
 }
 
 // WatchCmd watches S3 for new migrations and applies them
 type WatchCmd struct {
-	DatabaseURL  string        `help:"PostgreSQL connection string" env:"DATABASE_URL" required:""`
-	S3Bucket     string        `help:"S3 bucket name" env:"S3_BUCKET" required:"" name:"s3-bucket"`
-	S3PathPrefix string        `help:"S3 path prefix (e.g. 'migrations/')" env:"S3_PATH_PREFIX" required:"" name:"s3-path-prefix"`
-	PollInterval time.Duration `help:"Polling interval for checking new versions" env:"POLL_INTERVAL" default:"30s"`
+	DatabaseURL          string        `help:"Database connection string (postgres:// or mysql://); required unless --database-url-env is set" env:"DATABASE_URL"`
+	DatabaseURLEnv       string        `help:"Name of the environment variable holding the database connection string, instead of DATABASE_URL" env:"DATABASE_URL_ENV" name:"database-url-env"`
+	S3Bucket             string        `help:"S3 bucket name" env:"S3_BUCKET" required:"" name:"s3-bucket"`
+	S3PathPrefix         []string      `help:"S3 path prefix (e.g. 'migrations/'); repeat to watch several migration streams" env:"S3_PATH_PREFIX" required:"" name:"s3-path-prefix"`
+	ResultFile           string        `help:"Name of the per-version result file marking a version as applied" env:"RESULT_FILE" name:"result-file" default:"result.json"`
+	PollInterval         time.Duration `help:"Polling interval for checking new versions" env:"POLL_INTERVAL" default:"30s"`
+	MaxPollInterval      time.Duration `help:"Upper bound for the poll interval, which doubles after each failed check (0 disables backoff)" env:"MAX_POLL_INTERVAL" name:"max-poll-interval" default:"5m"`
+	PollJitter           time.Duration `help:"Wait a random delay up to this long before the first poll and each later one, so replicas started together don't poll in sync (0 disables)" env:"POLL_JITTER" name:"poll-jitter" default:"0s"`
+	CurrentPointer       string        `help:"File name of the pointer to the latest applied version, written at the prefix root (empty to disable)" env:"CURRENT_POINTER" default:"current.json"`
+	EmbedSQL             bool          `help:"Embed migration file contents in result.json" env:"EMBED_SQL" name:"embed-sql"`
+	EmbedSQLMaxBytes     int           `help:"Truncate each embedded migration file to this many bytes (0 for no limit)" env:"EMBED_SQL_MAX_BYTES" name:"embed-sql-max-bytes" default:"0"`
+	IncompletePolicy     string        `help:"What to do when a version's migration set looks incomplete (fail or warn)" env:"INCOMPLETE_POLICY" enum:"fail,warn" default:"fail"`
+	LockTTL              time.Duration `help:"How long a version lock is honored before it is considered stale (0 disables locking)" env:"LOCK_TTL" name:"lock-ttl" default:"30m"`
+	DownloadConcurrency  int           `help:"Number of migration files downloaded in parallel" env:"DOWNLOAD_CONCURRENCY" name:"download-concurrency" default:"8"`
+	WorkDir              string        `help:"Directory in which migrations are downloaded (default: the OS temp directory)" env:"WORK_DIR" name:"work-dir" type:"path"`
+	DryRun               bool          `help:"Download and inspect pending migrations without running them or uploading results" env:"DRY_RUN" name:"dry-run"`
+	MigrationTimeout     time.Duration `help:"Fail a version whose migration runs longer than this (0 for no limit)" env:"MIGRATION_TIMEOUT" name:"migration-timeout" default:"30m"`
+	ShutdownTimeout      time.Duration `help:"How long to wait for an in-flight migration after SIGINT/SIGTERM before cancelling it" env:"SHUTDOWN_TIMEOUT" name:"shutdown-timeout" default:"5m"`
+	SSE                  string        `help:"Server-side encryption for uploaded objects (AES256 or aws:kms, empty for the bucket default)" env:"S3_SSE" name:"sse" enum:",AES256,aws:kms" default:""`
+	SSEKMSKeyID          string        `help:"KMS key ID used with --sse=aws:kms" env:"S3_SSE_KMS_KEY_ID" name:"sse-kms-key-id"`
+	KeepAttempts         bool          `help:"Also keep every result under <version>/attempts/<timestamp>.json" env:"KEEP_ATTEMPTS" name:"keep-attempts"`
+	DumpSchema           bool          `help:"Dump the database schema after a successful migration and upload it as <version>/schema.sql" env:"DUMP_SCHEMA" name:"dump-schema"`
+	FailOnDirty          bool          `help:"Refuse to migrate (status dirty) when schema_migrations has versions missing from the migration files" env:"FAIL_ON_DIRTY" name:"fail-on-dirty"`
+	VerifyApplied        bool          `help:"When nothing is pending, check the newest successful version against schema_migrations and re-apply it if migrations are missing" env:"VERIFY_APPLIED" name:"verify-applied"`
+	TargetVersion        string        `help:"Only apply versions up to and including this version (YYYYMMDDHHMMSS); newer ones are held back" env:"TARGET_VERSION" name:"target-version"`
+	OnFailed             string        `help:"What to do with a version whose result reports a failure: skip it and apply newer versions, block newer versions until it is resolved, or retry it on every run" env:"ON_FAILED" name:"on-failed" enum:"skip,block,retry" default:"skip"`
+	SlackIncomingWebhook string        `help:"Slack incoming webhook URL for startup, failure and recovery alerts (optional)" env:"SLACK_INCOMING_WEBHOOK"`
+	HAMode               bool          `help:"Elect one leader among replicas via leader.json; only the leader applies migrations" env:"HA_MODE" name:"ha-mode"`
+	LeaderTTL            time.Duration `help:"How long a leader's heartbeat is honored before another replica takes over (must exceed the poll interval)" env:"LEADER_TTL" name:"leader-ttl" default:"15m"`
+	HealthAddr           string        `help:"Address for the /healthz and /readyz probe endpoints (e.g. ':8080', optional)" env:"HEALTH_ADDR" name:"health-addr"`
+	EventLogKey          string        `help:"S3 key of an NDJSON log of poll and migration events, written daily to <key>-YYYYMMDD.ndjson (empty disables)" env:"EVENT_LOG_KEY" name:"event-log-key"`
+	EventLogMaxBytes     int           `help:"Size cap of each daily event log object; the oldest events are dropped beyond it" env:"EVENT_LOG_MAX_BYTES" name:"event-log-max-bytes" default:"1048576"`
+	CacheListings        bool          `help:"Between full checks, only probe for a version newer than the newest applied one instead of listing every version and result file" env:"CACHE_LISTINGS" name:"cache-listings"`
+	WriteProgress        bool          `help:"Upload the log of a running migration to <version>/progress.log every few seconds, for wait-and-notify --follow" env:"WRITE_PROGRESS" name:"write-progress"`
+	FailFastOnStart      bool          `help:"Exit with an error if the first poll fails on S3 access or the database connection, instead of logging it and polling on" env:"FAIL_FAST_ON_START" name:"fail-fast-on-start"`
 }
 
 // OnceCmd runs once and exits
 type OnceCmd struct {
-	DatabaseURL  string `help:"PostgreSQL connection string" env:"DATABASE_URL" required:""`
-	S3Bucket     string `help:"S3 bucket name" env:"S3_BUCKET" required:"" name:"s3-bucket"`
-	S3PathPrefix string `help:"S3 path prefix (e.g. 'migrations/')" env:"S3_PATH_PREFIX" required:"" name:"s3-path-prefix"`
+	DatabaseURL         string        `help:"Database connection string (postgres:// or mysql://); required unless --database-url-env is set" env:"DATABASE_URL"`
+	DatabaseURLEnv      string        `help:"Name of the environment variable holding the database connection string, instead of DATABASE_URL" env:"DATABASE_URL_ENV" name:"database-url-env"`
+	S3Bucket            string        `help:"S3 bucket name (optional with --local-migrations-dir)" env:"S3_BUCKET" name:"s3-bucket"`
+	S3PathPrefix        string        `help:"S3 path prefix (e.g. 'migrations/')" env:"S3_PATH_PREFIX" name:"s3-path-prefix"`
+	ResultFile          string        `help:"Name of the per-version result file marking a version as applied" env:"RESULT_FILE" name:"result-file" default:"result.json"`
+	CurrentPointer      string        `help:"File name of the pointer to the latest applied version, written at the prefix root (empty to disable)" env:"CURRENT_POINTER" default:"current.json"`
+	EmbedSQL            bool          `help:"Embed migration file contents in result.json" env:"EMBED_SQL" name:"embed-sql"`
+	EmbedSQLMaxBytes    int           `help:"Truncate each embedded migration file to this many bytes (0 for no limit)" env:"EMBED_SQL_MAX_BYTES" name:"embed-sql-max-bytes" default:"0"`
+	IncompletePolicy    string        `help:"What to do when a version's migration set looks incomplete (fail or warn)" env:"INCOMPLETE_POLICY" enum:"fail,warn" default:"fail"`
+	LockTTL             time.Duration `help:"How long a version lock is honored before it is considered stale (0 disables locking)" env:"LOCK_TTL" name:"lock-ttl" default:"30m"`
+	DownloadConcurrency int           `help:"Number of migration files downloaded in parallel" env:"DOWNLOAD_CONCURRENCY" name:"download-concurrency" default:"8"`
+	WorkDir             string        `help:"Directory in which migrations are downloaded (default: the OS temp directory)" env:"WORK_DIR" name:"work-dir" type:"path"`
+	DryRun              bool          `help:"Download and inspect pending migrations without running them or uploading results" env:"DRY_RUN" name:"dry-run"`
+	MigrationTimeout    time.Duration `help:"Fail a version whose migration runs longer than this (0 for no limit)" env:"MIGRATION_TIMEOUT" name:"migration-timeout" default:"30m"`
+	SSE                 string        `help:"Server-side encryption for uploaded objects (AES256 or aws:kms, empty for the bucket default)" env:"S3_SSE" name:"sse" enum:",AES256,aws:kms" default:""`
+	SSEKMSKeyID         string        `help:"KMS key ID used with --sse=aws:kms" env:"S3_SSE_KMS_KEY_ID" name:"sse-kms-key-id"`
+	KeepAttempts        bool          `help:"Also keep every result under <version>/attempts/<timestamp>.json" env:"KEEP_ATTEMPTS" name:"keep-attempts"`
+	DumpSchema          bool          `help:"Dump the database schema after a successful migration and upload it as <version>/schema.sql" env:"DUMP_SCHEMA" name:"dump-schema"`
+	FailOnDirty         bool          `help:"Refuse to migrate (status dirty) when schema_migrations has versions missing from the migration files" env:"FAIL_ON_DIRTY" name:"fail-on-dirty"`
+	TargetVersion       string        `help:"Only apply versions up to and including this version (YYYYMMDDHHMMSS); newer ones are held back" env:"TARGET_VERSION" name:"target-version"`
+	OnFailed            string        `help:"What to do with a version whose result reports a failure: skip it and apply newer versions, block newer versions until it is resolved, or retry it on every run" env:"ON_FAILED" name:"on-failed" enum:"skip,block,retry" default:"skip"`
+	PushgatewayURL      string        `help:"Prometheus Pushgateway URL to push metrics to before exiting (optional)" env:"PUSHGATEWAY_URL" name:"pushgateway-url"`
+	PushgatewayJob      string        `help:"Job name used when pushing to the Pushgateway" env:"PUSHGATEWAY_JOB" name:"pushgateway-job" default:"dbmate-deployer"`
+	Output              string        `help:"Output format on stdout: text (logs only) or json (a summary object when done)" env:"OUTPUT" name:"output" enum:"text,json" default:"text"`
+	LocalMigrationsDir  string        `help:"Apply the .sql files of this local directory instead of pending S3 versions; the result is uploaded only if --s3-bucket is set" env:"LOCAL_MIGRATIONS_DIR" name:"local-migrations-dir" type:"existingdir"`
+	ExitCodeOnFailure   int           `help:"Exit code when a migration fails; other errors exit 1" env:"EXIT_CODE_ON_FAILURE" name:"exit-code-on-failure" default:"1"`
+	ExitCodeOnNoop      int           `help:"Exit code when there are no versions or all of them are already applied" env:"EXIT_CODE_ON_NOOP" name:"exit-code-on-noop" default:"0"`
+	RetryFailed         bool          `help:"Delete the result of the newest version if it failed, so that it is applied again" env:"RETRY_FAILED" name:"retry-failed"`
 }
 
 // PushCmd uploads migration files to S3
 type PushCmd struct {
-	MigrationsDir string `help:"Local directory containing migration files" required:"" type:"path" name:"migrations-dir" short:"m"`
-	S3Bucket      string `help:"S3 bucket name" env:"S3_BUCKET" required:"" name:"s3-bucket"`
-	S3PathPrefix  string `help:"S3 path prefix (e.g. 'migrations/')" env:"S3_PATH_PREFIX" required:"" name:"s3-path-prefix"`
-	Version       string `help:"Version timestamp (YYYYMMDDHHMMSS)" required:"" name:"version" short:"v"`
-	DryRun        bool   `help:"Show what would be uploaded without uploading" name:"dry-run"`
-	Validate      bool   `help:"Validate migration files before upload" default:"true" name:"validate"`
+	MigrationsDir string   `help:"Local directory containing migration files" required:"" type:"path" name:"migrations-dir" short:"m"`
+	S3Bucket      string   `help:"S3 bucket name" env:"S3_BUCKET" required:"" name:"s3-bucket"`
+	S3PathPrefix  string   `help:"S3 path prefix (e.g. 'migrations/')" env:"S3_PATH_PREFIX" required:"" name:"s3-path-prefix"`
+	ResultFile    string   `help:"Name of the per-version result file marking a version as applied" env:"RESULT_FILE" name:"result-file" default:"result.json"`
+	Version       string   `help:"Version timestamp (YYYYMMDDHHMMSS)" required:"" name:"version" short:"v"`
+	DryRun        bool     `help:"Show what would be uploaded without uploading" name:"dry-run"`
+	Validate      bool     `help:"Validate migration files before upload" default:"true" name:"validate"`
+	Force         bool     `help:"Replace migration files already uploaded for this version" name:"force"`
+	IfChanged     bool     `help:"Upload only missing or modified migration files, succeeding without changes if the uploaded set is identical" name:"if-changed"`
+	Compress      bool     `help:"Gzip each migration file and upload it as .sql.gz" name:"compress"`
+	Bundle        bool     `help:"Upload the migration files as a single migrations.tar.gz instead of one object per file" name:"bundle"`
+	PinVersions   bool     `help:"Record the S3 VersionId of each migration file in files.json so deployers download exactly those object versions (requires a versioned bucket)" env:"S3_PIN_VERSIONS" name:"pin-versions"`
+	Recursive     bool     `help:"Also upload .sql files from subdirectories, flattened into one version folder" name:"recursive"`
+	ValidateSQL   bool     `help:"Run each migration in a rolled-back transaction against --database-url to catch SQL errors (PostgreSQL only)" name:"validate-sql"`
+	DatabaseURL   string   `help:"Database used by --validate-sql; use a scratch or staging database" env:"DATABASE_URL" name:"database-url"`
+	SSE           string   `help:"Server-side encryption for uploaded objects (AES256 or aws:kms, empty for the bucket default)" env:"S3_SSE" name:"sse" enum:",AES256,aws:kms" default:""`
+	SSEKMSKeyID   string   `help:"KMS key ID used with --sse=aws:kms" env:"S3_SSE_KMS_KEY_ID" name:"sse-kms-key-id"`
+	S3Tags        []string `help:"Object tag applied to every uploaded object (key=value, repeatable)" env:"S3_TAGS" name:"s3-tags"`
+	AllowPatterns []string `help:"Regex an up-section statement must match to pass validation, case-insensitive (repeatable; none allows every statement)" env:"SQL_ALLOW_PATTERN" name:"allow-patterns" sep:"none"`
+	DenyPatterns  []string `help:"Regex failing validation when an up-section statement matches it, case-insensitive (repeatable)" env:"SQL_DENY_PATTERN" name:"deny-patterns" sep:"none"`
+	WarnPatterns  []string `help:"Regex logging a warning when an up-section statement matches it, case-insensitive (repeatable)" env:"SQL_WARN_PATTERN" name:"warn-patterns" sep:"none"`
+	NoSQLDefaults bool     `help:"Drop the built-in SQL policy rules (TRUNCATE, DROP DATABASE, DELETE without WHERE, DROP TABLE without IF EXISTS)" env:"NO_SQL_DEFAULTS" name:"no-sql-defaults"`
 }
 
-// WaitAndNotifyCmd waits for migration completion and optionally sends Slack notification
+// WaitAndNotifyCmd waits for migration completion and optionally sends a chat notification
 type WaitAndNotifyCmd struct {
 	S3Bucket             string        `help:"S3 bucket name" env:"S3_BUCKET" required:"" name:"s3-bucket"`
 	S3PathPrefix         string        `help:"S3 path prefix (e.g. 'migrations/')" env:"S3_PATH_PREFIX" required:"" name:"s3-path-prefix"`
-	MigrationVersion     string        `help:"Migration version to wait for (YYYYMMDDHHMMSS)" short:"v" required:""`
+	ResultFile           string        `help:"Name of the per-version result file marking a version as applied" env:"RESULT_FILE" name:"result-file" default:"result.json"`
+	MigrationVersion     []string      `help:"Migration version to wait for (YYYYMMDDHHMMSS); repeat to wait for a batch" short:"v" required:""`
 	SlackIncomingWebhook string        `help:"Slack incoming webhook URL (optional)" env:"SLACK_INCOMING_WEBHOOK"`
-	Timeout              time.Duration `help:"Maximum wait time" default:"10m"`
+	WebhookURL           string        `help:"Chat webhook URL for Slack, Microsoft Teams or Google Chat (optional, overrides --slack-incoming-webhook)" env:"WEBHOOK_URL" name:"webhook-url"`
+	Notifier             string        `help:"Notification service (auto detects it from the webhook URL)" env:"NOTIFIER" enum:"auto,slack,teams,googlechat" default:"auto"`
+	SlackLogChars        int           `help:"Number of characters from the end of the migration log included in the notification" env:"SLACK_LOG_CHARS" name:"slack-log-chars" default:"1000"`
+	SlackTemplate        string        `help:"Go text/template file rendering the Slack webhook JSON payload instead of the built-in layout (Slack only)" env:"SLACK_TEMPLATE" name:"slack-template" type:"existingfile"`
+	PresignResults       bool          `help:"Link a presigned URL for result.json in the notification instead of its s3:// location" env:"PRESIGN_RESULTS" name:"presign-results"`
+	PresignExpiry        time.Duration `help:"How long the presigned result URL stays valid (at most 7 days)" env:"PRESIGN_EXPIRY" name:"presign-expiry" default:"24h"`
+	NotifyOn             string        `help:"Which results are notified: always, failure or success" env:"NOTIFY_ON" name:"notify-on" enum:"always,failure,success" default:"always"`
+	PushTimeout          time.Duration `help:"Maximum wait for the versions' migrations to appear in S3 before waiting for results (0 skips this phase)" env:"PUSH_TIMEOUT" name:"push-timeout" default:"5m"`
+	Timeout              time.Duration `help:"Maximum wait time for the results once the versions are pushed" default:"10m"`
 	PollInterval         time.Duration `help:"Polling interval" default:"5s"`
+	OnlyIfRecent         time.Duration `help:"Fail if a version's result is older than this, e.g. left over from an earlier deploy cycle (0 disables)" env:"ONLY_IF_RECENT" name:"only-if-recent" default:"0s"`
+	Follow               bool          `help:"Print the migration log while waiting, as the daemon uploads it with --write-progress" env:"FOLLOW" name:"follow"`
+}
+
+// RollbackCmd rolls back the migrations introduced by a specific version
+type RollbackCmd struct {
+	DatabaseURL  string `help:"Database connection string (postgres:// or mysql://)" env:"DATABASE_URL" required:""`
+	S3Bucket     string `help:"S3 bucket name" env:"S3_BUCKET" required:"" name:"s3-bucket"`
+	S3PathPrefix string `help:"S3 path prefix (e.g. 'migrations/')" env:"S3_PATH_PREFIX" required:"" name:"s3-path-prefix"`
+	ResultFile   string `help:"Name of the per-version result file marking a version as applied" env:"RESULT_FILE" name:"result-file" default:"result.json"`
+	Version      string `help:"Version to roll back (YYYYMMDDHHMMSS)" required:"" name:"version" short:"v"`
+	SSE          string `help:"Server-side encryption for uploaded objects (AES256 or aws:kms, empty for the bucket default)" env:"S3_SSE" name:"sse" enum:",AES256,aws:kms" default:""`
+	SSEKMSKeyID  string `help:"KMS key ID used with --sse=aws:kms" env:"S3_SSE_KMS_KEY_ID" name:"sse-kms-key-id"`
+}
+
+// DoctorCmd checks configuration and connectivity before the deployer is enabled
+type DoctorCmd struct {
+	DatabaseURL  string        `help:"Database connection string (postgres:// or mysql://)" env:"DATABASE_URL" required:""`
+	S3Bucket     string        `help:"S3 bucket name" env:"S3_BUCKET" required:"" name:"s3-bucket"`
+	S3PathPrefix string        `help:"S3 path prefix (e.g. 'migrations/')" env:"S3_PATH_PREFIX" required:"" name:"s3-path-prefix"`
+	ResultFile   string        `help:"Name of the per-version result file marking a version as applied" env:"RESULT_FILE" name:"result-file" default:"result.json"`
+	Timeout      time.Duration `help:"Timeout for each connectivity check" name:"timeout" default:"10s"`
+}
+
+// VerifyCmd runs the pending migrations in a rolled-back transaction
+type VerifyCmd struct {
+	DatabaseURL         string `help:"Database to verify against (PostgreSQL); use a throwaway or staging database" env:"DATABASE_URL" required:""`
+	S3Bucket            string `help:"S3 bucket name" env:"S3_BUCKET" required:"" name:"s3-bucket"`
+	S3PathPrefix        string `help:"S3 path prefix (e.g. 'migrations/')" env:"S3_PATH_PREFIX" required:"" name:"s3-path-prefix"`
+	ResultFile          string `help:"Name of the per-version result file marking a version as applied" env:"RESULT_FILE" name:"result-file" default:"result.json"`
+	Version             string `help:"Version to verify (default: the newest version without a result)" name:"version" short:"v"`
+	DownloadConcurrency int    `help:"Number of migration files downloaded in parallel" env:"DOWNLOAD_CONCURRENCY" name:"download-concurrency" default:"8"`
+	WorkDir             string `help:"Directory in which migrations are downloaded (default: the OS temp directory)" env:"WORK_DIR" name:"work-dir" type:"path"`
+}
+
+// ListVersionsCmd prints the version directories of a prefix
+type ListVersionsCmd struct {
+	S3Bucket     string `help:"S3 bucket name" env:"S3_BUCKET" required:"" name:"s3-bucket"`
+	S3PathPrefix string `help:"S3 path prefix (e.g. 'migrations/')" env:"S3_PATH_PREFIX" required:"" name:"s3-path-prefix"`
+	ResultFile   string `help:"Name of the per-version result file marking a version as applied" env:"RESULT_FILE" name:"result-file" default:"result.json"`
+	Applied      bool   `help:"Only list versions with a successful result" name:"applied"`
+	Pending      bool   `help:"Only list versions without a result" name:"pending"`
+	Failed       bool   `help:"Only list versions with a failed result" name:"failed"`
+	JSON         bool   `help:"Print a JSON array instead of one version per line" name:"json"`
+}
+
+// PruneCmd deletes old applied version directories
+type PruneCmd struct {
+	S3Bucket     string `help:"S3 bucket name" env:"S3_BUCKET" required:"" name:"s3-bucket"`
+	S3PathPrefix string `help:"S3 path prefix (e.g. 'migrations/')" env:"S3_PATH_PREFIX" required:"" name:"s3-path-prefix"`
+	ResultFile   string `help:"Name of the per-version result file marking a version as applied" env:"RESULT_FILE" name:"result-file" default:"result.json"`
+	KeepDays     int    `help:"Keep versions applied within this many days (0 disables)" name:"keep-days"`
+	KeepLast     int    `help:"Keep the newest N applied versions (0 disables)" name:"keep-last"`
+	Confirm      bool   `help:"Delete the versions; without it, only print what would be deleted" name:"confirm"`
 }
 
 // VersionCmd shows version information
@@ -70,47 +242,215 @@ type VersionCmd struct {
 }
 
 // Run() forwarders for each command (required by kong)
-func (c *WatchCmd) Run(cli *CLI) error {
+func (c *WatchCmd) Run(ctx context.Context, cli *CLI, level *slog.LevelVar) error {
 	cmd := &watch.Cmd{
-		DatabaseURL:  c.DatabaseURL,
-		S3Bucket:     c.S3Bucket,
-		S3PathPrefix: c.S3PathPrefix,
-		PollInterval: c.PollInterval,
+		DatabaseURL:          c.DatabaseURL,
+		DatabaseURLEnv:       c.DatabaseURLEnv,
+		S3Bucket:             c.S3Bucket,
+		S3PathPrefix:         c.S3PathPrefix,
+		ResultFile:           c.ResultFile,
+		PollInterval:         c.PollInterval,
+		CurrentPointer:       c.CurrentPointer,
+		EmbedSQL:             c.EmbedSQL,
+		EmbedSQLMaxBytes:     c.EmbedSQLMaxBytes,
+		IncompletePolicy:     c.IncompletePolicy,
+		LockTTL:              c.LockTTL,
+		DownloadConcurrency:  c.DownloadConcurrency,
+		WorkDir:              c.WorkDir,
+		DryRun:               c.DryRun,
+		MigrationTimeout:     c.MigrationTimeout,
+		ShutdownTimeout:      c.ShutdownTimeout,
+		ConfigFile:           string(cli.Config),
+		DeployerVersion:      Version,
+		SSE:                  c.SSE,
+		SSEKMSKeyID:          c.SSEKMSKeyID,
+		KeepAttempts:         c.KeepAttempts,
+		DumpSchema:           c.DumpSchema,
+		FailOnDirty:          c.FailOnDirty,
+		VerifyApplied:        c.VerifyApplied,
+		SlackIncomingWebhook: c.SlackIncomingWebhook,
+		MaxPollInterval:      c.MaxPollInterval,
+		PollJitter:           c.PollJitter,
+		HAMode:               c.HAMode,
+		LeaderTTL:            c.LeaderTTL,
+		HealthAddr:           c.HealthAddr,
+		EventLogKey:          c.EventLogKey,
+		EventLogMaxBytes:     c.EventLogMaxBytes,
+		CacheListings:        c.CacheListings,
+		WriteProgress:        c.WriteProgress,
+		FailFastOnStart:      c.FailFastOnStart,
+		TargetVersion:        c.TargetVersion,
+		OnFailed:             c.OnFailed,
+		Settings:             cli.settings(),
+		MigrationsTable:      cli.MigrationsTable,
+		LogTimestampFormat:   cli.LogTimestampFmt,
+		Webhook:              cli.webhookOptions(),
+		LogLevel:             level,
 	}
-	return watch.Execute(cmd, cli.S3EndpointURL, cli.MetricsAddr)
+	return watch.Execute(ctx, cmd, cli.s3Options(), cli.MetricsAddr)
 }
 
-func (c *OnceCmd) Run(cli *CLI) error {
+func (c *OnceCmd) Run(ctx context.Context, cli *CLI) error {
 	cmd := &once.Cmd{
-		DatabaseURL:  c.DatabaseURL,
-		S3Bucket:     c.S3Bucket,
-		S3PathPrefix: c.S3PathPrefix,
+		DatabaseURL:         c.DatabaseURL,
+		DatabaseURLEnv:      c.DatabaseURLEnv,
+		S3Bucket:            c.S3Bucket,
+		S3PathPrefix:        c.S3PathPrefix,
+		ResultFile:          c.ResultFile,
+		CurrentPointer:      c.CurrentPointer,
+		EmbedSQL:            c.EmbedSQL,
+		EmbedSQLMaxBytes:    c.EmbedSQLMaxBytes,
+		IncompletePolicy:    c.IncompletePolicy,
+		LockTTL:             c.LockTTL,
+		DownloadConcurrency: c.DownloadConcurrency,
+		WorkDir:             c.WorkDir,
+		DryRun:              c.DryRun,
+		MigrationTimeout:    c.MigrationTimeout,
+		SSE:                 c.SSE,
+		SSEKMSKeyID:         c.SSEKMSKeyID,
+		KeepAttempts:        c.KeepAttempts,
+		DumpSchema:          c.DumpSchema,
+		FailOnDirty:         c.FailOnDirty,
+		PushgatewayURL:      c.PushgatewayURL,
+		PushgatewayJob:      c.PushgatewayJob,
+		Output:              c.Output,
+		TargetVersion:       c.TargetVersion,
+		OnFailed:            c.OnFailed,
+		LocalMigrationsDir:  c.LocalMigrationsDir,
+		ExitCodeOnFailure:   c.ExitCodeOnFailure,
+		ExitCodeOnNoop:      c.ExitCodeOnNoop,
+		RetryFailed:         c.RetryFailed,
+		DeployerVersion:     Version,
+		Settings:            cli.settings(),
+		MigrationsTable:     cli.MigrationsTable,
+		LogTimestampFormat:  cli.LogTimestampFmt,
 	}
-	return once.Execute(cmd, cli.S3EndpointURL, cli.MetricsAddr)
+	return once.Execute(ctx, cmd, cli.s3Options(), cli.MetricsAddr)
 }
 
 func (c *PushCmd) Run(cli *CLI) error {
 	cmd := &push.Cmd{
-		MigrationsDir: c.MigrationsDir,
-		S3Bucket:      c.S3Bucket,
-		S3PathPrefix:  c.S3PathPrefix,
-		Version:       c.Version,
-		DryRun:        c.DryRun,
-		Validate:      c.Validate,
+		MigrationsDir:   c.MigrationsDir,
+		S3Bucket:        c.S3Bucket,
+		S3PathPrefix:    c.S3PathPrefix,
+		ResultFile:      c.ResultFile,
+		Version:         c.Version,
+		DryRun:          c.DryRun,
+		Validate:        c.Validate,
+		Force:           c.Force,
+		IfChanged:       c.IfChanged,
+		Compress:        c.Compress,
+		Bundle:          c.Bundle,
+		PinVersions:     c.PinVersions,
+		Recursive:       c.Recursive,
+		ValidateSQL:     c.ValidateSQL,
+		DatabaseURL:     c.DatabaseURL,
+		SSE:             c.SSE,
+		SSEKMSKeyID:     c.SSEKMSKeyID,
+		S3Tags:          c.S3Tags,
+		AllowPatterns:   c.AllowPatterns,
+		DenyPatterns:    c.DenyPatterns,
+		WarnPatterns:    c.WarnPatterns,
+		NoSQLDefaults:   c.NoSQLDefaults,
+		Settings:        cli.settings(),
+		MigrationsTable: cli.MigrationsTable,
 	}
-	return push.Execute(cmd, cli.S3EndpointURL, cli.MetricsAddr)
+	return push.Execute(cmd, cli.s3Options(), cli.MetricsAddr)
 }
 
-func (c *WaitAndNotifyCmd) Run(cli *CLI) error {
+func (c *WaitAndNotifyCmd) Run(ctx context.Context, cli *CLI) error {
 	cmd := &wait.Cmd{
 		S3Bucket:             c.S3Bucket,
 		S3PathPrefix:         c.S3PathPrefix,
+		ResultFile:           c.ResultFile,
 		MigrationVersion:     c.MigrationVersion,
 		SlackIncomingWebhook: c.SlackIncomingWebhook,
+		WebhookURL:           c.WebhookURL,
+		Notifier:             c.Notifier,
+		PushTimeout:          c.PushTimeout,
 		Timeout:              c.Timeout,
 		PollInterval:         c.PollInterval,
+		SlackLogChars:        c.SlackLogChars,
+		SlackTemplate:        c.SlackTemplate,
+		PresignResults:       c.PresignResults,
+		PresignExpiry:        c.PresignExpiry,
+		NotifyOn:             c.NotifyOn,
+		OnlyIfRecent:         c.OnlyIfRecent,
+		Follow:               c.Follow,
+		Settings:             cli.settings(),
+		Webhook:              cli.webhookOptions(),
 	}
-	return wait.Execute(cmd, cli.S3EndpointURL, cli.MetricsAddr)
+	return wait.Execute(ctx, cmd, cli.s3Options(), cli.MetricsAddr)
+}
+
+func (c *RollbackCmd) Run(cli *CLI) error {
+	cmd := &rollback.Cmd{
+		DatabaseURL:        c.DatabaseURL,
+		S3Bucket:           c.S3Bucket,
+		S3PathPrefix:       c.S3PathPrefix,
+		ResultFile:         c.ResultFile,
+		Version:            c.Version,
+		SSE:                c.SSE,
+		SSEKMSKeyID:        c.SSEKMSKeyID,
+		Settings:           cli.settings(),
+		MigrationsTable:    cli.MigrationsTable,
+		LogTimestampFormat: cli.LogTimestampFmt,
+	}
+	return rollback.Execute(cmd, cli.s3Options(), cli.MetricsAddr)
+}
+
+func (c *DoctorCmd) Run(cli *CLI) error {
+	cmd := &doctor.Cmd{
+		DatabaseURL:  c.DatabaseURL,
+		S3Bucket:     c.S3Bucket,
+		S3PathPrefix: c.S3PathPrefix,
+		ResultFile:   c.ResultFile,
+		Timeout:      c.Timeout,
+		Settings:     cli.settings(),
+	}
+	return doctor.Execute(cmd, cli.s3Options())
+}
+
+func (c *VerifyCmd) Run(ctx context.Context, cli *CLI) error {
+	cmd := &verify.Cmd{
+		DatabaseURL:         c.DatabaseURL,
+		S3Bucket:            c.S3Bucket,
+		S3PathPrefix:        c.S3PathPrefix,
+		ResultFile:          c.ResultFile,
+		Version:             c.Version,
+		DownloadConcurrency: c.DownloadConcurrency,
+		WorkDir:             c.WorkDir,
+		Settings:            cli.settings(),
+		MigrationsTable:     cli.MigrationsTable,
+	}
+	return verify.Execute(ctx, cmd, cli.s3Options())
+}
+
+func (c *ListVersionsCmd) Run(cli *CLI) error {
+	cmd := &listversions.Cmd{
+		S3Bucket:     c.S3Bucket,
+		S3PathPrefix: c.S3PathPrefix,
+		ResultFile:   c.ResultFile,
+		Applied:      c.Applied,
+		Pending:      c.Pending,
+		Failed:       c.Failed,
+		JSON:         c.JSON,
+		Settings:     cli.settings(),
+	}
+	return listversions.Execute(cmd, cli.s3Options())
+}
+
+func (c *PruneCmd) Run(cli *CLI) error {
+	cmd := &prune.Cmd{
+		S3Bucket:     c.S3Bucket,
+		S3PathPrefix: c.S3PathPrefix,
+		ResultFile:   c.ResultFile,
+		KeepDays:     c.KeepDays,
+		KeepLast:     c.KeepLast,
+		Confirm:      c.Confirm,
+		Settings:     cli.settings(),
+	}
+	return prune.Execute(cmd, cli.s3Options())
 }
 
 func (c *VersionCmd) Run(cli *CLI) error {
@@ -118,16 +458,92 @@ func (c *VersionCmd) Run(cli *CLI) error {
 	return version.Execute(cmd, Version)
 }
 
+// s3Options returns the S3 client options given by the global flags
+func (cli *CLI) s3Options() shared.S3ClientOptions {
+	return shared.S3ClientOptions{
+		EndpointURL:        cli.S3EndpointURL,
+		Region:             cli.S3Region,
+		ForcePathStyle:     cli.S3ForcePathStyle,
+		Profile:            cli.AWSProfile,
+		ConfigFile:         cli.AWSConfigFile,
+		CredentialsFile:    cli.AWSCredsFile,
+		AssumeRoleARN:      cli.AssumeRoleARN,
+		ExternalID:         cli.ExternalID,
+		CABundle:           cli.S3CABundle,
+		InsecureSkipVerify: cli.S3InsecureSkip,
+	}
+}
+
+// settings returns the S3 layout, version format and S3 retry settings given by the global flags
+func (cli *CLI) settings() shared.Settings {
+	return shared.Settings{
+		MigrationsSubdir: cli.MigrationsSubdir,
+		VersionFormat:    cli.VersionFormat,
+		Retry: shared.S3RetryOptions{
+			MaxAttempts: cli.S3MaxAttempts,
+			BaseDelay:   cli.S3RetryBaseDelay,
+			MaxDelay:    cli.S3RetryMaxDelay,
+			MaxElapsed:  cli.S3RetryMaxTotal,
+		},
+	}
+}
+
+// webhookOptions returns the webhook notification options given by the global flags
+func (cli *CLI) webhookOptions() shared.WebhookOptions {
+	return shared.WebhookOptions{
+		Timeout:     cli.SlackTimeout,
+		MaxAttempts: cli.SlackMaxAttempts,
+	}
+}
+
 func main() {
 	var cli CLI
 	ctx := kong.Parse(&cli,
 		kong.Name("dbmate-deployer"),
 		kong.Description("Database migration deployment tool using dbmate with S3-based version management"),
 		kong.UsageOnError(),
+		kong.Configuration(kong.JSON),
 	)
 
-	if err := ctx.Run(&cli); err != nil {
+	level, err := shared.SetupLogging(cli.LogFormat, cli.LogLevel)
+	if err != nil {
+		ctx.FatalIfErrorf(err)
+	}
+	if err := shared.ValidateLogTimestampFormat(cli.LogTimestampFmt); err != nil {
+		ctx.FatalIfErrorf(err)
+	}
+	if err := shared.ValidateMigrationsTable(cli.MigrationsTable); err != nil {
+		ctx.FatalIfErrorf(err)
+	}
+
+	shutdownTracing, err := shared.SetupTracing(context.Background())
+	if err != nil {
+		ctx.FatalIfErrorf(err)
+	}
+
+	// Commands receive a context cancelled on SIGINT/SIGTERM
+	runCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	ctx.BindTo(runCtx, (*context.Context)(nil))
+	ctx.Bind(level)
+	err = ctx.Run(&cli)
+	stop()
+
+	// Flush spans before exiting; os.Exit skips deferred calls
+	if err := shutdownTracing(context.Background()); err != nil {
+		slog.Warn("Failed to flush traces", "error", err)
+	}
+
+	if err != nil {
+		// once may ask for a specific exit code, without an error when nothing was applied
+		code := 1
+		var exitErr *once.ExitError
+		if errors.As(err, &exitErr) {
+			code = exitErr.Code
+			if exitErr.Err == nil {
+				os.Exit(code)
+			}
+		}
 		slog.Error("Command failed", "error", err)
-		os.Exit(1)
+		os.Exit(code)
 	}
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/alecthomas/kong"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// parseCLI parses args like main does, without running the command
+func parseCLI(t *testing.T, args ...string) *CLI {
+	t.Helper()
+	var cli CLI
+	parser, err := kong.New(&cli, kong.Name("dbmate-deployer"))
+	require.NoError(t, err)
+	_, err = parser.Parse(args)
+	require.NoError(t, err)
+	return &cli
+}
+
+func TestMigrationsSubdir(t *testing.T) {
+	listArgs := []string{"list-versions", "--s3-bucket", "test-bucket", "--s3-path-prefix", "migrations/"}
+
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		wantKey string
+	}{
+		{
+			name:    "default",
+			args:    listArgs,
+			wantKey: "migrations/20240101000000/migrations/001_a.sql",
+		},
+		{
+			name:    "custom subdir",
+			args:    append([]string{"--migrations-subdir", "sql"}, listArgs...),
+			wantKey: "migrations/20240101000000/sql/001_a.sql",
+		},
+		{
+			name:    "empty flag means directly under the version",
+			args:    append([]string{"--migrations-subdir="}, listArgs...),
+			wantKey: "migrations/20240101000000/001_a.sql",
+		},
+		{
+			name:    "empty environment variable means directly under the version",
+			args:    listArgs,
+			env:     map[string]string{"MIGRATIONS_SUBDIR": ""},
+			wantKey: "migrations/20240101000000/001_a.sql",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cli := parseCLI(t, tt.args...)
+			assert.Equal(t, tt.wantKey, cli.settings().MigrationKey("migrations/", "20240101000000", "001_a.sql"))
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package doctor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared"
+)
+
+// Cmd checks configuration and connectivity before the deployer is enabled
+type Cmd struct {
+	DatabaseURL  string        `help:"Database connection string (postgres:// or mysql://)" env:"DATABASE_URL" required:""`
+	S3Bucket     string        `help:"S3 bucket name" env:"S3_BUCKET" required:"" name:"s3-bucket"`
+	S3PathPrefix string        `help:"S3 path prefix (e.g. 'migrations/')" env:"S3_PATH_PREFIX" required:"" name:"s3-path-prefix"`
+	ResultFile   string        `help:"Name of the per-version result file marking a version as applied" env:"RESULT_FILE" name:"result-file" default:"result.json"`
+	Timeout      time.Duration `help:"Timeout for each connectivity check" name:"timeout" default:"10s"`
+
+	// Settings holds the S3 layout, version format and S3 retry settings
+	Settings shared.Settings `kong:"-"`
+}
+
+// check is a single preflight check. A failed critical check makes the command fail;
+// other checks only warn.
+type check struct {
+	name     string
+	critical bool
+	run      func(ctx context.Context) (string, error)
+}
+
+// Execute runs the preflight checks and reports each as PASS, WARN or FAIL
+func Execute(c *Cmd, s3Opts shared.S3ClientOptions) error {
+	ctx := context.Background()
+
+	// Ensure prefix ends with /
+	s3Prefix := c.S3PathPrefix
+	if !strings.HasSuffix(s3Prefix, "/") {
+		s3Prefix += "/"
+	}
+
+	var s3Client *s3.Client
+	checks := []check{
+		{
+			name:     "AWS credentials",
+			critical: true,
+			run: func(ctx context.Context) (string, error) {
+				client, err := shared.CreateS3Client(ctx, s3Opts)
+				if err != nil {
+					return "", err
+				}
+				s3Client = client
+				if client.Options().Credentials == nil {
+					return "", fmt.Errorf("no credentials configured")
+				}
+				creds, err := client.Options().Credentials.Retrieve(ctx)
+				if err != nil {
+					return "", fmt.Errorf("failed to resolve credentials: %w", err)
+				}
+				return fmt.Sprintf("resolved from %s", creds.Source), nil
+			},
+		},
+		{
+			name:     "S3 bucket and prefix",
+			critical: true,
+			run: func(ctx context.Context) (string, error) {
+				if s3Client == nil {
+					return "", fmt.Errorf("skipped, no S3 client")
+				}
+				empty, err := shared.CheckBucketAccess(ctx, s3Client, c.Settings, c.S3Bucket, s3Prefix)
+				if err != nil {
+					return "", err
+				}
+				if empty {
+					return fmt.Sprintf("s3://%s/%s is listable but empty, check the prefix if versions were pushed", c.S3Bucket, s3Prefix), nil
+				}
+				return fmt.Sprintf("s3://%s/%s is listable", c.S3Bucket, s3Prefix), nil
+			},
+		},
+		{
+			name:     "Pending versions",
+			critical: false,
+			run: func(ctx context.Context) (string, error) {
+				if s3Client == nil {
+					return "", fmt.Errorf("skipped, no S3 client")
+				}
+				versions, err := shared.FindUnappliedVersions(ctx, s3Client, c.Settings, c.S3Bucket, s3Prefix, c.ResultFile)
+				if err != nil {
+					if errors.Is(err, shared.ErrNoUnappliedVersions) || errors.Is(err, shared.ErrNoVersions) {
+						return err.Error(), nil
+					}
+					return "", err
+				}
+				return fmt.Sprintf("%d pending: %s", len(versions), strings.Join(versions, ", ")), nil
+			},
+		},
+		{
+			name:     "DATABASE_URL",
+			critical: true,
+			run: func(ctx context.Context) (string, error) {
+				if err := shared.ValidateDatabaseURL(c.DatabaseURL); err != nil {
+					return "", err
+				}
+				return "valid", nil
+			},
+		},
+		{
+			name:     "Database connection",
+			critical: true,
+			run: func(ctx context.Context) (string, error) {
+				if err := shared.PingDatabase(ctx, c.DatabaseURL); err != nil {
+					return "", err
+				}
+				return "ping succeeded", nil
+			},
+		},
+	}
+
+	return runChecks(ctx, os.Stdout, c.Timeout, checks)
+}
+
+// runChecks runs checks in order, printing one line per check, and returns an error
+// if any critical check failed
+func runChecks(ctx context.Context, w io.Writer, timeout time.Duration, checks []check) error {
+	failed := 0
+	for _, chk := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, timeout)
+		detail, err := chk.run(checkCtx)
+		cancel()
+
+		switch {
+		case err == nil:
+			_, _ = fmt.Fprintf(w, "[PASS] %s: %s\n", chk.name, detail)
+		case chk.critical:
+			failed++
+			_, _ = fmt.Fprintf(w, "[FAIL] %s: %v\n", chk.name, err)
+		default:
+			_, _ = fmt.Fprintf(w, "[WARN] %s: %v\n", chk.name, err)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	_, _ = fmt.Fprintln(w, "All checks passed")
+	return nil
+}
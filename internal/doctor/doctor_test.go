@@ -0,0 +1,44 @@
+package doctor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunChecks(t *testing.T) {
+	pass := func(ctx context.Context) (string, error) { return "ok", nil }
+	fail := func(ctx context.Context) (string, error) { return "", errors.New("unreachable") }
+
+	var out bytes.Buffer
+	err := runChecks(context.Background(), &out, time.Second, []check{
+		{name: "first", critical: true, run: pass},
+		{name: "optional", critical: false, run: fail},
+	})
+	assert.NoError(t, err, "a failed non-critical check only warns")
+	assert.Equal(t, "[PASS] first: ok\n[WARN] optional: unreachable\nAll checks passed\n", out.String())
+
+	out.Reset()
+	err = runChecks(context.Background(), &out, time.Second, []check{
+		{name: "first", critical: true, run: fail},
+		{name: "second", critical: true, run: pass},
+	})
+	assert.EqualError(t, err, "1 of 2 checks failed")
+	assert.Equal(t, "[FAIL] first: unreachable\n[PASS] second: ok\n", out.String())
+}
+
+func TestRunChecks_Timeout(t *testing.T) {
+	var out bytes.Buffer
+	err := runChecks(context.Background(), &out, 10*time.Millisecond, []check{
+		{name: "slow", critical: true, run: func(ctx context.Context) (string, error) {
+			<-ctx.Done()
+			return "", ctx.Err()
+		}},
+	})
+	assert.Error(t, err)
+	assert.Contains(t, out.String(), "[FAIL] slow: context deadline exceeded")
+}
@@ -0,0 +1,123 @@
+package listversions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/tokuhirom/dbmate-deployer/internal/shared"
+)
+
+// Cmd prints the version directories of a prefix
+type Cmd struct {
+	S3Bucket     string `help:"S3 bucket name" env:"S3_BUCKET" required:"" name:"s3-bucket"`
+	S3PathPrefix string `help:"S3 path prefix (e.g. 'migrations/')" env:"S3_PATH_PREFIX" required:"" name:"s3-path-prefix"`
+	ResultFile   string `help:"Name of the per-version result file marking a version as applied" env:"RESULT_FILE" name:"result-file" default:"result.json"`
+	Applied      bool   `help:"Only list versions with a successful result" name:"applied"`
+	Pending      bool   `help:"Only list versions without a result" name:"pending"`
+	Failed       bool   `help:"Only list versions with a failed result" name:"failed"`
+	JSON         bool   `help:"Print a JSON array instead of one version per line" name:"json"`
+
+	// Settings holds the S3 layout, version format and S3 retry settings
+	Settings shared.Settings `kong:"-"`
+}
+
+// Version states used by the filters
+const (
+	stateApplied = "applied"
+	statePending = "pending"
+	stateFailed  = "failed"
+)
+
+// Execute prints the matching versions to stdout
+func Execute(c *Cmd, s3Opts shared.S3ClientOptions) error {
+	ctx := context.Background()
+
+	// Ensure prefix ends with /
+	s3Prefix := c.S3PathPrefix
+	if !strings.HasSuffix(s3Prefix, "/") {
+		s3Prefix += "/"
+	}
+
+	// Create S3 client
+	s3Client, err := shared.CreateS3Client(ctx, s3Opts)
+	if err != nil {
+		return fmt.Errorf("failed to create S3 client: %w", err)
+	}
+
+	versions, err := listVersions(ctx, s3Client, c, s3Prefix)
+	if err != nil {
+		return err
+	}
+	return writeVersions(os.Stdout, versions, c.JSON)
+}
+
+// listVersions returns the sorted versions of prefix matching the state filters.
+// Several filters match any of their states; without filters every version matches
+// and no result file is read.
+func listVersions(ctx context.Context, client shared.S3API, c *Cmd, prefix string) ([]string, error) {
+	versions, err := shared.ListVersions(ctx, client, c.Settings, c.S3Bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.Applied && !c.Pending && !c.Failed {
+		return versions, nil
+	}
+	wanted := map[string]bool{
+		stateApplied: c.Applied,
+		statePending: c.Pending,
+		stateFailed:  c.Failed,
+	}
+
+	matched := []string{}
+	for _, version := range versions {
+		state, err := versionState(ctx, client, c.Settings, c.S3Bucket, prefix, version, c.ResultFile)
+		if err != nil {
+			return nil, err
+		}
+		if wanted[state] {
+			matched = append(matched, version)
+		}
+	}
+	return matched, nil
+}
+
+// versionState classifies a version by its result file
+func versionState(ctx context.Context, client shared.S3API, settings shared.Settings, bucket, prefix, version, resultFile string) (string, error) {
+	exists, err := shared.CheckResultExists(ctx, client, settings, bucket, prefix, version, resultFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to check result for version %s: %w", version, err)
+	}
+	if !exists {
+		return statePending, nil
+	}
+
+	result, err := shared.DownloadResult(ctx, client, settings, bucket, prefix, version, resultFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read result for version %s: %w", version, err)
+	}
+	if result.Status == "success" {
+		return stateApplied, nil
+	}
+	return stateFailed, nil
+}
+
+// writeVersions prints versions one per line, or as a JSON array
+func writeVersions(w io.Writer, versions []string, asJSON bool) error {
+	if asJSON {
+		if versions == nil {
+			versions = []string{}
+		}
+		return json.NewEncoder(w).Encode(versions)
+	}
+	for _, version := range versions {
+		if _, err := fmt.Fprintln(w, version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package listversions
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared/testhelpers"
+)
+
+func TestListVersions(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+
+	for _, version := range []string{"20240103000000", "20240101000000", "20240102000000"} {
+		_, _ = mock.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String("migrations/" + version + "/migrations/001_a.sql"),
+			Body:   bytes.NewReader([]byte("-- migrate:up")),
+		})
+	}
+	require.NoError(t, shared.UploadResult(ctx, mock, shared.DefaultSettings(), "test-bucket", "migrations/", "20240101000000", "", &shared.Result{Status: "success"}, nil, shared.PutOptions{}))
+	require.NoError(t, shared.UploadResult(ctx, mock, shared.DefaultSettings(), "test-bucket", "migrations/", "20240102000000", "", &shared.Result{Status: "failed"}, nil, shared.PutOptions{}))
+
+	tests := []struct {
+		name string
+		cmd  Cmd
+		want []string
+	}{
+		{"all", Cmd{}, []string{"20240101000000", "20240102000000", "20240103000000"}},
+		{"applied", Cmd{Applied: true}, []string{"20240101000000"}},
+		{"failed", Cmd{Failed: true}, []string{"20240102000000"}},
+		{"pending", Cmd{Pending: true}, []string{"20240103000000"}},
+		{"pending or failed", Cmd{Pending: true, Failed: true}, []string{"20240102000000", "20240103000000"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cmd.S3Bucket = "test-bucket"
+			tt.cmd.Settings = shared.DefaultSettings()
+			versions, err := listVersions(ctx, mock, &tt.cmd, "migrations/")
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, versions)
+		})
+	}
+}
+
+func TestListVersions_Empty(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+
+	versions, err := listVersions(context.Background(), mock, &Cmd{S3Bucket: "test-bucket"}, "migrations/")
+	require.NoError(t, err)
+	assert.Empty(t, versions)
+}
+
+func TestWriteVersions(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeVersions(&buf, []string{"20240101000000", "20240102000000"}, false))
+	assert.Equal(t, "20240101000000\n20240102000000\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, writeVersions(&buf, []string{"20240101000000"}, true))
+	assert.Equal(t, "[\"20240101000000\"]\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, writeVersions(&buf, nil, true))
+	assert.Equal(t, "[]\n", buf.String())
+}
@@ -2,28 +2,150 @@ package once
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"os"
 	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/tokuhirom/dbmate-deployer/internal/shared"
+	"github.com/tokuhirom/dbmate-deployer/pkg/deployer"
 )
 
 // Cmd runs once and exits
 type Cmd struct {
-	DatabaseURL  string `help:"PostgreSQL connection string" env:"DATABASE_URL" required:""`
-	S3Bucket     string `help:"S3 bucket name" env:"S3_BUCKET" required:"" name:"s3-bucket"`
-	S3PathPrefix string `help:"S3 path prefix (e.g. 'migrations/')" env:"S3_PATH_PREFIX" required:"" name:"s3-path-prefix"`
+	DatabaseURL         string        `help:"Database connection string (postgres:// or mysql://); required unless --database-url-env is set" env:"DATABASE_URL"`
+	DatabaseURLEnv      string        `help:"Name of the environment variable holding the database connection string, instead of DATABASE_URL" env:"DATABASE_URL_ENV" name:"database-url-env"`
+	S3Bucket            string        `help:"S3 bucket name (optional with --local-migrations-dir)" env:"S3_BUCKET" name:"s3-bucket"`
+	S3PathPrefix        string        `help:"S3 path prefix (e.g. 'migrations/')" env:"S3_PATH_PREFIX" name:"s3-path-prefix"`
+	ResultFile          string        `help:"Name of the per-version result file marking a version as applied" env:"RESULT_FILE" name:"result-file" default:"result.json"`
+	CurrentPointer      string        `help:"File name of the pointer to the latest applied version, written at the prefix root (empty to disable)" env:"CURRENT_POINTER" default:"current.json"`
+	EmbedSQL            bool          `help:"Embed migration file contents in result.json" env:"EMBED_SQL" name:"embed-sql"`
+	EmbedSQLMaxBytes    int           `help:"Truncate each embedded migration file to this many bytes (0 for no limit)" env:"EMBED_SQL_MAX_BYTES" name:"embed-sql-max-bytes" default:"0"`
+	IncompletePolicy    string        `help:"What to do when a version's migration set looks incomplete (fail or warn)" env:"INCOMPLETE_POLICY" enum:"fail,warn" default:"fail"`
+	LockTTL             time.Duration `help:"How long a version lock is honored before it is considered stale (0 disables locking)" env:"LOCK_TTL" name:"lock-ttl" default:"30m"`
+	DownloadConcurrency int           `help:"Number of migration files downloaded in parallel" env:"DOWNLOAD_CONCURRENCY" name:"download-concurrency" default:"8"`
+	WorkDir             string        `help:"Directory in which migrations are downloaded (default: the OS temp directory)" env:"WORK_DIR" name:"work-dir" type:"path"`
+	DryRun              bool          `help:"Download and inspect pending migrations without running them or uploading results" env:"DRY_RUN" name:"dry-run"`
+	MigrationTimeout    time.Duration `help:"Fail a version whose migration runs longer than this (0 for no limit)" env:"MIGRATION_TIMEOUT" name:"migration-timeout" default:"30m"`
+	SSE                 string        `help:"Server-side encryption for uploaded objects (AES256 or aws:kms, empty for the bucket default)" env:"S3_SSE" name:"sse" enum:",AES256,aws:kms" default:""`
+	SSEKMSKeyID         string        `help:"KMS key ID used with --sse=aws:kms" env:"S3_SSE_KMS_KEY_ID" name:"sse-kms-key-id"`
+	KeepAttempts        bool          `help:"Also keep every result under <version>/attempts/<timestamp>.json" env:"KEEP_ATTEMPTS" name:"keep-attempts"`
+	DumpSchema          bool          `help:"Dump the database schema after a successful migration and upload it as <version>/schema.sql" env:"DUMP_SCHEMA" name:"dump-schema"`
+	FailOnDirty         bool          `help:"Refuse to migrate (status dirty) when schema_migrations has versions missing from the migration files" env:"FAIL_ON_DIRTY" name:"fail-on-dirty"`
+	TargetVersion       string        `help:"Only apply versions up to and including this version (YYYYMMDDHHMMSS); newer ones are held back" env:"TARGET_VERSION" name:"target-version"`
+	OnFailed            string        `help:"What to do with a version whose result reports a failure: skip it and apply newer versions, block newer versions until it is resolved, or retry it on every run" env:"ON_FAILED" name:"on-failed" enum:"skip,block,retry" default:"skip"`
+	PushgatewayURL      string        `help:"Prometheus Pushgateway URL to push metrics to before exiting (optional)" env:"PUSHGATEWAY_URL" name:"pushgateway-url"`
+	PushgatewayJob      string        `help:"Job name used when pushing to the Pushgateway" env:"PUSHGATEWAY_JOB" name:"pushgateway-job" default:"dbmate-deployer"`
+	Output              string        `help:"Output format on stdout: text (logs only) or json (a summary object when done)" env:"OUTPUT" name:"output" enum:"text,json" default:"text"`
+	LocalMigrationsDir  string        `help:"Apply the .sql files of this local directory instead of pending S3 versions; the result is uploaded only if --s3-bucket is set" env:"LOCAL_MIGRATIONS_DIR" name:"local-migrations-dir" type:"existingdir"`
+	ExitCodeOnFailure   int           `help:"Exit code when a migration fails; other errors exit 1" env:"EXIT_CODE_ON_FAILURE" name:"exit-code-on-failure" default:"1"`
+	ExitCodeOnNoop      int           `help:"Exit code when there are no versions or all of them are already applied" env:"EXIT_CODE_ON_NOOP" name:"exit-code-on-noop" default:"0"`
+	RetryFailed         bool          `help:"Delete the result of the newest version if it failed, so that it is applied again" env:"RETRY_FAILED" name:"retry-failed"`
+
+	// DeployerVersion is the build version recorded in each result
+	DeployerVersion string `kong:"-"`
+	// Settings holds the S3 layout, version format and S3 retry settings
+	Settings shared.Settings `kong:"-"`
+	// MigrationsTable is the table dbmate records applied migrations in (empty for the dbmate default)
+	MigrationsTable string `kong:"-"`
+	// LogTimestampFormat is the Go time layout of the migration log timestamps (empty for the default)
+	LogTimestampFormat string `kong:"-"`
+}
+
+// ExitError is returned by Execute to make the process exit with Code. Err is nil when
+// nothing went wrong and only the exit code matters.
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("exit code %d", e.Code)
+	}
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// validateExitCodes rejects exit codes the shell reserves or can't represent
+func (c *Cmd) validateExitCodes() error {
+	if c.ExitCodeOnFailure < 1 || c.ExitCodeOnFailure > 125 {
+		return fmt.Errorf("--exit-code-on-failure must be between 1 and 125, got %d", c.ExitCodeOnFailure)
+	}
+	if c.ExitCodeOnNoop < 0 || c.ExitCodeOnNoop > 125 {
+		return fmt.Errorf("--exit-code-on-noop must be between 0 and 125, got %d", c.ExitCodeOnNoop)
+	}
+	return nil
+}
+
+// migrationFailed marks err, the error of a failed migration, with --exit-code-on-failure
+func (c *Cmd) migrationFailed(err error) error {
+	if c.ExitCodeOnFailure <= 1 {
+		return err
+	}
+	return &ExitError{Code: c.ExitCodeOnFailure, Err: err}
+}
+
+// noop returns the outcome of a run with nothing to apply, carrying --exit-code-on-noop
+func (c *Cmd) noop() error {
+	if c.ExitCodeOnNoop == 0 {
+		return nil
+	}
+	return &ExitError{Code: c.ExitCodeOnNoop}
+}
+
+// summary is the run summary printed to stdout with --output json
+type summary struct {
+	Version           string  `json:"version"`
+	Status            string  `json:"status"`
+	MigrationsApplied int     `json:"migrations_applied"`
+	DurationSeconds   float64 `json:"duration_seconds"`
+	DeployerVersion   string  `json:"deployer_version"`
+	Error             string  `json:"error,omitempty"`
+}
+
+// writeSummary writes s as a single line of JSON
+func writeSummary(w io.Writer, s *summary) error {
+	return json.NewEncoder(w).Encode(s)
+}
+
+// putOptions returns the settings applied to uploaded objects
+func (c *Cmd) putOptions() shared.PutOptions {
+	return shared.PutOptions{ServerSideEncryption: c.SSE, SSEKMSKeyID: c.SSEKMSKeyID}
 }
 
 // Execute runs the migration check once and exits
-func Execute(c *Cmd, s3EndpointURL, metricsAddr string) error {
-	ctx := context.Background()
+func Execute(ctx context.Context, c *Cmd, s3Opts shared.S3ClientOptions, metricsAddr string) (err error) {
+	// Status is "up-to-date" unless a version is attempted; the summary is printed even on error
+	sum := &summary{Status: "up-to-date", DeployerVersion: c.DeployerVersion}
+	if c.Output == "json" {
+		startTime := time.Now()
+		defer func() {
+			sum.DurationSeconds = time.Since(startTime).Seconds()
+			var exitErr *ExitError
+			if err != nil && !(errors.As(err, &exitErr) && exitErr.Err == nil) {
+				sum.Status = "failed"
+				sum.Error = err.Error()
+			}
+			if err := writeSummary(os.Stdout, sum); err != nil {
+				slog.Warn("Failed to write summary", "error", err)
+			}
+		}()
+	}
 
 	// Start metrics server if address is specified
+	registry := shared.NewMetricsRegistry()
+	metrics := shared.NewMetrics(registry)
 	if metricsAddr != "" {
-		go shared.StartMetricsServer(metricsAddr)
+		go shared.StartMetricsServer(metricsAddr, registry)
 	}
 
 	// Ensure prefix ends with /
@@ -31,57 +153,299 @@ func Execute(c *Cmd, s3EndpointURL, metricsAddr string) error {
 	if !strings.HasSuffix(s3Prefix, "/") {
 		s3Prefix += "/"
 	}
+	metrics = metrics.WithPrefix(s3Prefix)
+
+	// The process exits right away, so push the metrics instead of waiting for a scrape
+	if c.PushgatewayURL != "" {
+		defer func() {
+			if err := metrics.Push(ctx, c.PushgatewayURL, c.PushgatewayJob, s3Prefix); err != nil {
+				slog.Warn("Failed to push metrics", "error", err)
+			}
+		}()
+	}
+
+	if c.TargetVersion != "" {
+		if err := c.Settings.ValidateVersion(c.TargetVersion); err != nil {
+			return fmt.Errorf("invalid --target-version: %w", err)
+		}
+	}
+
+	if err := c.validateExitCodes(); err != nil {
+		return err
+	}
+
+	databaseURL, err := shared.ResolveDatabaseURL(c.DatabaseURL, c.DatabaseURLEnv)
+	if err != nil {
+		return err
+	}
+	c.DatabaseURL = databaseURL
+
+	// Fail fast on a DATABASE_URL no compiled-in driver can handle
+	if err := shared.ValidateDatabaseURL(c.DatabaseURL); err != nil {
+		return err
+	}
+
+	// Fail fast on a work directory migrations can't be downloaded to
+	if err := shared.ValidateWorkDir(c.WorkDir); err != nil {
+		return err
+	}
+
+	// Fail fast on inconsistent encryption settings
+	if err := c.putOptions().Validate(); err != nil {
+		return err
+	}
+
+	// S3 is only optional when migrations come from a local directory
+	if c.S3Bucket == "" && c.LocalMigrationsDir == "" {
+		return fmt.Errorf("--s3-bucket is required unless --local-migrations-dir is set")
+	}
+	if c.S3Bucket != "" && c.S3PathPrefix == "" {
+		return fmt.Errorf("--s3-path-prefix is required with --s3-bucket")
+	}
+
+	if c.LocalMigrationsDir != "" {
+		return applyLocal(ctx, c, s3Opts, metrics, s3Prefix, sum)
+	}
 
 	// Create S3 client
-	s3Client, err := shared.CreateS3Client(ctx, s3EndpointURL)
+	s3Client, err := shared.CreateS3Client(ctx, s3Opts)
 	if err != nil {
 		return fmt.Errorf("failed to create S3 client: %w", err)
 	}
 
+	// A wrong bucket would otherwise look like a prefix with nothing to apply
+	empty, err := shared.CheckBucketAccess(ctx, s3Client, c.Settings, c.S3Bucket, s3Prefix)
+	if err != nil {
+		return err
+	}
+	if empty {
+		slog.Warn("Nothing has been pushed under the S3 prefix yet, check S3_PATH_PREFIX", "bucket", c.S3Bucket, "prefix", s3Prefix)
+	}
+
+	if c.RetryFailed {
+		if err := retryFailed(ctx, c, s3Client, s3Prefix); err != nil {
+			return err
+		}
+	}
+
 	slog.Info("Running migration check once")
 
-	// Find unapplied version
-	version, err := shared.FindUnappliedVersion(ctx, s3Client, c.S3Bucket, s3Prefix)
+	// Find unapplied versions
+	versions, err := shared.FindPendingVersions(ctx, s3Client, c.Settings, c.S3Bucket, s3Prefix, c.ResultFile, c.TargetVersion, c.OnFailed)
 	if err != nil {
-		errMsg := err.Error()
-		if errMsg == "no unapplied versions found" {
+		if errors.Is(err, shared.ErrNoUnappliedVersions) {
+			metrics.RecordPendingVersions(0)
 			slog.Info("All versions are already applied")
-			return nil
+			return c.noop()
 		}
-		if errMsg == "no versions found" {
+		if errors.Is(err, shared.ErrNoVersions) {
+			metrics.RecordPendingVersions(0)
 			slog.Info("No migration versions found in S3")
-			return nil
+			return c.noop()
 		}
-		return fmt.Errorf("failed to find unapplied version: %w", err)
+		return fmt.Errorf("failed to find unapplied versions: %w", err)
 	}
 
-	slog.Info("Found unapplied version", "version", version)
+	slog.Info("Found unapplied versions", "count", len(versions), "versions", versions)
+	metrics.RecordPendingVersions(float64(len(versions)))
+
+	// Apply pending versions in order, stopping at the first failure
+	for i, version := range versions {
+		sum.Version = version
+		result, err := applyVersion(ctx, c, s3Client, metrics, s3Prefix, version)
+		if result != nil {
+			sum.MigrationsApplied += result.MigrationsApplied
+		}
+		if err != nil {
+			if errors.Is(err, deployer.ErrVersionLocked) {
+				slog.Info("Version is being applied by another deployer, stopping", "version", version)
+				sum.Status = "locked"
+				return nil
+			}
+			if result != nil && result.Status != "success" {
+				return c.migrationFailed(err)
+			}
+			return err
+		}
+		if c.DryRun {
+			sum.Status = "dry-run"
+		} else {
+			sum.Status = "success"
+			metrics.RecordPendingVersions(float64(len(versions) - i - 1))
+		}
+	}
+
+	return nil
+}
+
+// applyVersion executes the migration for a single version and uploads its result.
+// The result is nil if the version wasn't run here (dry run, lock held, applied elsewhere).
+func applyVersion(ctx context.Context, c *Cmd, s3Client *s3.Client, metrics *shared.Metrics, prefix, version string) (*shared.Result, error) {
+	if c.DryRun {
+		return nil, dryRunVersion(ctx, c, s3Client, prefix, version)
+	}
+	return c.newDeployer(s3Client, metrics, prefix).Apply(ctx, version)
+}
+
+// newDeployer returns the library deployer applying versions under prefix with the
+// command's settings, recording each result in metrics
+func (c *Cmd) newDeployer(s3Client *s3.Client, metrics *shared.Metrics, prefix string) *deployer.Deployer {
+	return deployer.NewWithClient(s3Client, deployer.Config{
+		Bucket:         c.S3Bucket,
+		Prefix:         prefix,
+		Settings:       &c.Settings,
+		DatabaseURL:    c.DatabaseURL,
+		ResultFile:     c.ResultFile,
+		CurrentPointer: c.CurrentPointer,
+		LockTTL:        c.LockTTL,
+		TargetVersion:  c.TargetVersion,
+		OnFailed:       c.OnFailed,
+		KeepAttempts:   c.KeepAttempts,
+		Migration: shared.MigrationOptions{
+			EmbedSQL:            c.EmbedSQL,
+			EmbedSQLMaxBytes:    c.EmbedSQLMaxBytes,
+			IncompletePolicy:    c.IncompletePolicy,
+			DownloadConcurrency: c.DownloadConcurrency,
+			Timeout:             c.MigrationTimeout,
+			WorkDir:             c.WorkDir,
+			DeployerVersion:     c.DeployerVersion,
+			MigrationsTable:     c.MigrationsTable,
+			LogTimestampFormat:  c.LogTimestampFormat,
+			DumpSchema:          c.DumpSchema,
+			FailOnDirty:         c.FailOnDirty,
+		},
+		Put: c.putOptions(),
+		OnStart: func(version string) {
+			metrics.RecordMigrationStarted(float64(time.Now().Unix()))
+		},
+		OnResult: func(version string, result *shared.Result, duration time.Duration) {
+			metrics.RecordMigrationFinished()
+			metrics.RecordMigrationDuration(duration.Seconds())
+			metrics.RecordMigrationFileDurations(result.Durations)
+			metrics.RecordLastMigrationTimestamp(float64(time.Now().Unix()))
+			if result.Status == "success" {
+				metrics.RecordMigrationAttempt("success", "")
+				metrics.RecordCurrentVersion(version)
+			} else {
+				metrics.RecordMigrationAttempt("failed", result.ErrorType)
+			}
+		},
+	})
+}
+
+// applyLocal applies the migrations of --local-migrations-dir without looking for pending S3
+// versions. The result is labelled with the current time as its version and uploaded only if
+// a bucket is configured.
+func applyLocal(ctx context.Context, c *Cmd, s3Opts shared.S3ClientOptions, metrics *shared.Metrics, prefix string, sum *summary) error {
+	version := time.Now().UTC().Format("20060102150405")
+	sum.Version = version
+	slog.Info("Applying local migrations", "dir", c.LocalMigrationsDir, "version", version)
 
-	// Execute migration with timing
 	startTime := time.Now()
-	result := shared.ExecuteMigration(ctx, s3Client, c.S3Bucket, s3Prefix, version, c.DatabaseURL)
-	duration := time.Since(startTime).Seconds()
+	if !c.DryRun {
+		metrics.RecordMigrationStarted(float64(startTime.Unix()))
+	}
+	result := shared.ExecuteLocalMigration(ctx, c.LocalMigrationsDir, version, c.DatabaseURL, shared.MigrationOptions{
+		EmbedSQL:           c.EmbedSQL,
+		EmbedSQLMaxBytes:   c.EmbedSQLMaxBytes,
+		Timeout:            c.MigrationTimeout,
+		DryRun:             c.DryRun,
+		WorkDir:            c.WorkDir,
+		DeployerVersion:    c.DeployerVersion,
+		MigrationsTable:    c.MigrationsTable,
+		LogTimestampFormat: c.LogTimestampFormat,
+		DumpSchema:         c.DumpSchema,
+		FailOnDirty:        c.FailOnDirty,
+	})
+	sum.MigrationsApplied = result.MigrationsApplied
+
+	if c.DryRun {
+		if result.Status != "dry-run" {
+			return fmt.Errorf("dry run failed for %s: %s", c.LocalMigrationsDir, result.Error)
+		}
+		sum.Status = "dry-run"
+		slog.Info("Dry run: local migrations would be applied", "dir", c.LocalMigrationsDir)
+		return nil
+	}
 
-	// Record metrics
-	shared.RecordMigrationDuration(duration)
-	shared.RecordLastMigrationTimestamp(float64(time.Now().Unix()))
+	metrics.RecordMigrationFinished()
+	metrics.RecordMigrationDuration(time.Since(startTime).Seconds())
+	metrics.RecordMigrationFileDurations(result.Durations)
+	metrics.RecordLastMigrationTimestamp(float64(time.Now().Unix()))
 	if result.Status == "success" {
-		shared.RecordMigrationAttempt("success")
-		shared.RecordCurrentVersion(version)
+		metrics.RecordMigrationAttempt("success", "")
 	} else {
-		shared.RecordMigrationAttempt("failed")
+		metrics.RecordMigrationAttempt("failed", result.ErrorType)
 	}
 
-	// Upload result (both success and failure)
-	if err := shared.UploadResult(ctx, s3Client, c.S3Bucket, s3Prefix, version, result); err != nil {
-		slog.Error("Failed to upload result", "error", err)
-		return err
+	if c.S3Bucket != "" {
+		s3Client, err := shared.CreateS3Client(ctx, s3Opts)
+		if err != nil {
+			return fmt.Errorf("failed to create S3 client: %w", err)
+		}
+		if err := shared.UploadResult(ctx, s3Client, c.Settings, c.S3Bucket, prefix, version, c.ResultFile, result, shared.ResultMetadata(result), c.putOptions()); err != nil {
+			slog.Error("Failed to upload result", "error", err)
+			return err
+		}
+		if result.Status == "success" && result.Schema != "" {
+			if err := shared.UploadSchema(ctx, s3Client, c.Settings, c.S3Bucket, prefix, version, result.Schema, c.putOptions()); err != nil {
+				slog.Warn("Failed to upload schema", "error", err)
+			}
+		}
+	} else {
+		slog.Info("No S3 bucket configured, result not uploaded")
 	}
 
 	if result.Status != "success" {
-		return fmt.Errorf("migration failed")
+		return c.migrationFailed(fmt.Errorf("migration failed for %s: %s", c.LocalMigrationsDir, result.Error))
+	}
+
+	sum.Status = "success"
+	slog.Info("Local migrations applied successfully", "dir", c.LocalMigrationsDir)
+	return nil
+}
+
+// retryFailed deletes the result of the newest version if it failed, so that the version is
+// pending again and applied in order with the others. A dry run only inspects the version.
+func retryFailed(ctx context.Context, c *Cmd, s3Client *s3.Client, prefix string) error {
+	version, err := shared.FindFailedVersion(ctx, s3Client, c.Settings, c.S3Bucket, prefix, c.ResultFile, c.TargetVersion)
+	if errors.Is(err, shared.ErrNoFailedVersion) || errors.Is(err, shared.ErrNoVersions) {
+		slog.Info("No failed version to retry")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to find a failed version: %w", err)
+	}
+
+	if c.DryRun {
+		slog.Info("Dry run: failed version would be retried, result not deleted", "version", version)
+		return dryRunVersion(ctx, c, s3Client, prefix, version)
+	}
+
+	if err := shared.DeleteResult(ctx, s3Client, c.Settings, c.S3Bucket, prefix, version, c.ResultFile); err != nil {
+		return fmt.Errorf("failed to delete the result of failed version %s: %w", version, err)
+	}
+	slog.Info("Deleted the failed result, retrying the version", "version", version)
+	return nil
+}
+
+// dryRunVersion downloads and inspects a version's migrations without touching the database or S3 results
+func dryRunVersion(ctx context.Context, c *Cmd, s3Client *s3.Client, prefix, version string) error {
+	slog.Info("Dry run: inspecting version", "version", version)
+
+	result := shared.ExecuteMigration(ctx, s3Client, c.Settings, c.S3Bucket, prefix, version, c.DatabaseURL, shared.MigrationOptions{
+		IncompletePolicy:    c.IncompletePolicy,
+		DownloadConcurrency: c.DownloadConcurrency,
+		DryRun:              true,
+		WorkDir:             c.WorkDir,
+		DeployerVersion:     c.DeployerVersion,
+		MigrationsTable:     c.MigrationsTable,
+		LogTimestampFormat:  c.LogTimestampFormat,
+	})
+	if result.Status != "dry-run" {
+		return fmt.Errorf("dry run failed for version %s: %s", version, result.Error)
 	}
 
-	slog.Info("Migration completed successfully", "version", version)
+	slog.Info("Dry run: version would be applied, result not uploaded", "version", version)
 	return nil
 }
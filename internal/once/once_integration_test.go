@@ -10,6 +10,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared"
 	"github.com/tokuhirom/dbmate-deployer/internal/shared/testhelpers"
 )
 
@@ -37,9 +38,10 @@ func TestOnce_Execute_SuccessfulMigration(t *testing.T) {
 		DatabaseURL:  env.DatabaseURL,
 		S3Bucket:     env.S3Bucket,
 		S3PathPrefix: "migrations/",
+		Settings:     shared.DefaultSettings(),
 	}
 
-	err := Execute(cmd, env.S3EndpointURL, "")
+	err := Execute(ctx, cmd, shared.S3ClientOptions{EndpointURL: env.S3EndpointURL}, "")
 	require.NoError(t, err)
 
 	// Verify result was uploaded to S3
@@ -49,6 +51,11 @@ func TestOnce_Execute_SuccessfulMigration(t *testing.T) {
 	result := env.GetResult(ctx, "20240101000000")
 	assert.Equal(t, "success", result["status"])
 	assert.Equal(t, "20240101000000", result["version"])
+	assert.Equal(t, []interface{}{
+		"20240101000000_create_test_table.sql",
+		"20240101120000_add_email_column.sql",
+		"20240102000000_create_products_table.sql",
+	}, result["applied_files"])
 
 	// Verify log contains downloaded file names
 	log, ok := result["log"].(string)
@@ -57,6 +64,11 @@ func TestOnce_Execute_SuccessfulMigration(t *testing.T) {
 	assert.Contains(t, log, "20240101120000_add_email_column.sql", "log should contain migration file name")
 	assert.Contains(t, log, "20240102000000_create_products_table.sql", "log should contain migration file name")
 
+	// Every applied file is timed
+	durations, ok := result["durations"].(map[string]interface{})
+	require.True(t, ok, "durations field should be an object")
+	assert.Len(t, durations, 3)
+
 	// Verify log contains dbmate verbose output (Applying: ...)
 	assert.Contains(t, log, "Applying:", "log should contain dbmate verbose output")
 
@@ -77,9 +89,10 @@ func TestOnce_Execute_NoUnappliedVersions(t *testing.T) {
 		DatabaseURL:  env.DatabaseURL,
 		S3Bucket:     env.S3Bucket,
 		S3PathPrefix: "migrations/",
+		Settings:     shared.DefaultSettings(),
 	}
 
-	err := Execute(cmd, env.S3EndpointURL, "")
+	err := Execute(ctx, cmd, shared.S3ClientOptions{EndpointURL: env.S3EndpointURL}, "")
 
 	// Should return nil when no unapplied versions found
 	assert.NoError(t, err)
@@ -105,10 +118,95 @@ func TestOnce_Execute_AlreadyAppliedVersion(t *testing.T) {
 		DatabaseURL:  env.DatabaseURL,
 		S3Bucket:     env.S3Bucket,
 		S3PathPrefix: "migrations/",
+		Settings:     shared.DefaultSettings(),
 	}
 
-	err := Execute(cmd, env.S3EndpointURL, "")
+	err := Execute(ctx, cmd, shared.S3ClientOptions{EndpointURL: env.S3EndpointURL}, "")
 
 	// Should succeed with message that all versions are applied
 	assert.NoError(t, err)
 }
+
+func TestOnce_Execute_MultiplePendingVersions(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx := context.Background()
+	env := testhelpers.SetupTestEnvironment(ctx, t)
+
+	// Push two versions before either has been applied
+	env.UploadMigration(ctx, "20240101000000", "20240101000000_create_users.sql", testhelpers.ValidMigration("users"))
+	env.UploadMigration(ctx, "20240102000000", "20240101000000_create_users.sql", testhelpers.ValidMigration("users"))
+	env.UploadMigration(ctx, "20240102000000", "20240102000000_create_posts.sql", testhelpers.ValidMigration("posts"))
+
+	cmd := &Cmd{
+		DatabaseURL:  env.DatabaseURL,
+		S3Bucket:     env.S3Bucket,
+		S3PathPrefix: "migrations/",
+		Settings:     shared.DefaultSettings(),
+	}
+
+	err := Execute(ctx, cmd, shared.S3ClientOptions{EndpointURL: env.S3EndpointURL}, "")
+	require.NoError(t, err)
+
+	// Both versions should have their own result
+	assert.Equal(t, "success", env.GetResult(ctx, "20240101000000")["status"])
+	assert.Equal(t, "success", env.GetResult(ctx, "20240102000000")["status"])
+
+	env.AssertTableExists(t, "users")
+	env.AssertTableExists(t, "posts")
+}
+
+func TestOnce_Execute_StopsAtFirstFailure(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx := context.Background()
+	env := testhelpers.SetupTestEnvironment(ctx, t)
+
+	env.UploadMigration(ctx, "20240101000000", "20240101000000_invalid.sql", testhelpers.InvalidMigrationSyntaxError())
+	env.UploadMigration(ctx, "20240102000000", "20240102000000_create_posts.sql", testhelpers.ValidMigration("posts"))
+
+	cmd := &Cmd{
+		DatabaseURL:  env.DatabaseURL,
+		S3Bucket:     env.S3Bucket,
+		S3PathPrefix: "migrations/",
+		Settings:     shared.DefaultSettings(),
+	}
+
+	err := Execute(ctx, cmd, shared.S3ClientOptions{EndpointURL: env.S3EndpointURL}, "")
+	require.Error(t, err)
+
+	// The failed version gets a result, the later one is left pending
+	assert.Equal(t, "failed", env.GetResult(ctx, "20240101000000")["status"])
+	assert.False(t, env.ResultExists(ctx, "20240102000000"))
+	env.AssertTableNotExists(t, "posts")
+}
+
+func TestOnce_Execute_DryRun(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx := context.Background()
+	env := testhelpers.SetupTestEnvironment(ctx, t)
+
+	env.UploadMigration(ctx, "20240101000000", "20240101000000_create_users.sql", testhelpers.ValidMigration("users"))
+
+	cmd := &Cmd{
+		DatabaseURL:  env.DatabaseURL,
+		S3Bucket:     env.S3Bucket,
+		S3PathPrefix: "migrations/",
+		Settings:     shared.DefaultSettings(),
+		DryRun:       true,
+	}
+
+	err := Execute(ctx, cmd, shared.S3ClientOptions{EndpointURL: env.S3EndpointURL}, "")
+	require.NoError(t, err)
+
+	// Nothing is applied or recorded
+	assert.False(t, env.ResultExists(ctx, "20240101000000"))
+	env.AssertTableNotExists(t, "users")
+}
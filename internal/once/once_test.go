@@ -0,0 +1,53 @@
+package once
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteSummary(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeSummary(&buf, &summary{
+		Version:           "20240101000000",
+		Status:            "success",
+		MigrationsApplied: 2,
+		DurationSeconds:   1.5,
+		DeployerVersion:   "v1.2.3",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, `{"version":"20240101000000","status":"success","migrations_applied":2,"duration_seconds":1.5,"deployer_version":"v1.2.3"}`+"\n", buf.String())
+
+	buf.Reset()
+	err = writeSummary(&buf, &summary{Status: "failed", Error: "boom"})
+	require.NoError(t, err)
+	assert.Equal(t, `{"version":"","status":"failed","migrations_applied":0,"duration_seconds":0,"deployer_version":"","error":"boom"}`+"\n", buf.String())
+}
+
+func TestExitCodes(t *testing.T) {
+	failure := errors.New("migration failed for version 20240101000000")
+
+	// The defaults keep the plain exit codes
+	c := &Cmd{ExitCodeOnFailure: 1}
+	assert.Same(t, failure, c.migrationFailed(failure))
+	assert.NoError(t, c.noop())
+
+	c = &Cmd{ExitCodeOnFailure: 2, ExitCodeOnNoop: 3}
+	var exitErr *ExitError
+	require.ErrorAs(t, c.migrationFailed(failure), &exitErr)
+	assert.Equal(t, 2, exitErr.Code)
+	assert.ErrorIs(t, exitErr, failure)
+
+	require.ErrorAs(t, c.noop(), &exitErr)
+	assert.Equal(t, 3, exitErr.Code)
+	assert.NoError(t, exitErr.Err)
+
+	assert.NoError(t, c.validateExitCodes())
+	assert.ErrorContains(t, (&Cmd{ExitCodeOnFailure: 126}).validateExitCodes(), "--exit-code-on-failure")
+	// A failed migration must not exit 0
+	assert.ErrorContains(t, (&Cmd{ExitCodeOnFailure: 0}).validateExitCodes(), "--exit-code-on-failure")
+	assert.ErrorContains(t, (&Cmd{ExitCodeOnFailure: 1, ExitCodeOnNoop: -1}).validateExitCodes(), "--exit-code-on-noop")
+}
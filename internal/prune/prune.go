@@ -0,0 +1,148 @@
+package prune
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tokuhirom/dbmate-deployer/internal/shared"
+)
+
+// Cmd deletes old applied version directories
+type Cmd struct {
+	S3Bucket     string `help:"S3 bucket name" env:"S3_BUCKET" required:"" name:"s3-bucket"`
+	S3PathPrefix string `help:"S3 path prefix (e.g. 'migrations/')" env:"S3_PATH_PREFIX" required:"" name:"s3-path-prefix"`
+	ResultFile   string `help:"Name of the per-version result file marking a version as applied" env:"RESULT_FILE" name:"result-file" default:"result.json"`
+	KeepDays     int    `help:"Keep versions applied within this many days (0 disables)" name:"keep-days"`
+	KeepLast     int    `help:"Keep the newest N applied versions (0 disables)" name:"keep-last"`
+	Confirm      bool   `help:"Delete the versions; without it, only print what would be deleted" name:"confirm"`
+
+	// Settings holds the S3 layout, version format and S3 retry settings
+	Settings shared.Settings `kong:"-"`
+}
+
+// appliedVersion is a version whose result file reports success
+type appliedVersion struct {
+	version   string
+	appliedAt time.Time // zero if the result's timestamp can't be parsed
+}
+
+// Execute deletes, or with a dry run lists, the applied versions outside the retention rules
+func Execute(c *Cmd, s3Opts shared.S3ClientOptions) error {
+	ctx := context.Background()
+
+	if c.KeepDays < 0 || c.KeepLast < 0 {
+		return fmt.Errorf("--keep-days and --keep-last must not be negative")
+	}
+	if c.KeepDays == 0 && c.KeepLast == 0 {
+		return fmt.Errorf("--keep-days or --keep-last is required")
+	}
+
+	// Ensure prefix ends with /
+	s3Prefix := c.S3PathPrefix
+	if !strings.HasSuffix(s3Prefix, "/") {
+		s3Prefix += "/"
+	}
+
+	// Create S3 client
+	s3Client, err := shared.CreateS3Client(ctx, s3Opts)
+	if err != nil {
+		return fmt.Errorf("failed to create S3 client: %w", err)
+	}
+
+	return prune(ctx, s3Client, c, s3Prefix, time.Now(), os.Stdout)
+}
+
+// prune deletes the prunable versions of prefix, or only prints them without --confirm
+func prune(ctx context.Context, client shared.S3API, c *Cmd, prefix string, now time.Time, w io.Writer) error {
+	applied, err := appliedVersions(ctx, client, c, prefix)
+	if err != nil {
+		return err
+	}
+
+	versions := selectPrunable(applied, c.KeepDays, c.KeepLast, now)
+	if len(versions) == 0 {
+		_, _ = fmt.Fprintln(w, "Nothing to prune")
+		return nil
+	}
+
+	if !c.Confirm {
+		for _, version := range versions {
+			_, _ = fmt.Fprintf(w, "Would delete %s\n", version)
+		}
+		_, _ = fmt.Fprintf(w, "%d of %d applied versions would be deleted; rerun with --confirm to delete them\n", len(versions), len(applied))
+		return nil
+	}
+
+	for _, version := range versions {
+		count, err := shared.DeleteVersion(ctx, client, c.Settings, c.S3Bucket, prefix, version, c.ResultFile)
+		if err != nil {
+			return fmt.Errorf("failed to delete version %s: %w", version, err)
+		}
+		slog.Info("Deleted version", "version", version, "objects", count)
+		_, _ = fmt.Fprintf(w, "Deleted %s (%d objects)\n", version, count)
+	}
+	_, _ = fmt.Fprintf(w, "Deleted %d of %d applied versions\n", len(versions), len(applied))
+	return nil
+}
+
+// appliedVersions returns the versions of prefix with a successful result, oldest first.
+// Pending and failed versions are left out, so they can never be pruned.
+func appliedVersions(ctx context.Context, client shared.S3API, c *Cmd, prefix string) ([]appliedVersion, error) {
+	versions, err := shared.ListVersions(ctx, client, c.Settings, c.S3Bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []appliedVersion
+	for _, version := range versions {
+		exists, err := shared.CheckResultExists(ctx, client, c.Settings, c.S3Bucket, prefix, version, c.ResultFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check result for version %s: %w", version, err)
+		}
+		if !exists {
+			continue
+		}
+		result, err := shared.DownloadResult(ctx, client, c.Settings, c.S3Bucket, prefix, version, c.ResultFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read result for version %s: %w", version, err)
+		}
+		if result.Status != "success" {
+			continue
+		}
+
+		appliedAt, err := time.Parse(time.RFC3339, result.Timestamp)
+		if err != nil {
+			slog.Warn("Result has no valid timestamp, --keep-days keeps the version", "version", version, "timestamp", result.Timestamp)
+			appliedAt = time.Time{}
+		}
+		applied = append(applied, appliedVersion{version: version, appliedAt: appliedAt})
+	}
+	return applied, nil
+}
+
+// selectPrunable returns the applied versions (oldest first) that no retention rule keeps.
+// --keep-last keeps the newest keepLast versions and --keep-days those applied within keepDays
+// days; with both, a version kept by either rule stays. The newest applied version holds every
+// migration file and is always kept. --keep-days also keeps a version whose applied time is unknown.
+func selectPrunable(applied []appliedVersion, keepDays, keepLast int, now time.Time) []string {
+	var prunable []string
+	for i, v := range applied {
+		newer := len(applied) - 1 - i
+		if newer == 0 {
+			continue
+		}
+		if keepLast > 0 && newer < keepLast {
+			continue
+		}
+		if keepDays > 0 && (v.appliedAt.IsZero() || now.Sub(v.appliedAt) < time.Duration(keepDays)*24*time.Hour) {
+			continue
+		}
+		prunable = append(prunable, v.version)
+	}
+	return prunable
+}
@@ -0,0 +1,92 @@
+package prune
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared/testhelpers"
+)
+
+func TestSelectPrunable(t *testing.T) {
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	daysAgo := func(days int) time.Time { return now.Add(-time.Duration(days) * 24 * time.Hour) }
+	applied := []appliedVersion{
+		{version: "20240101000000", appliedAt: daysAgo(60)},
+		{version: "20240102000000", appliedAt: daysAgo(50)},
+		{version: "20240103000000"}, // unknown applied time
+		{version: "20240201000000", appliedAt: daysAgo(20)},
+		{version: "20240220000000", appliedAt: daysAgo(5)},
+	}
+
+	tests := []struct {
+		name     string
+		keepDays int
+		keepLast int
+		want     []string
+	}{
+		{name: "keep last", keepLast: 2, want: []string{"20240101000000", "20240102000000", "20240103000000"}},
+		{name: "keep days", keepDays: 30, want: []string{"20240101000000", "20240102000000"}},
+		{name: "either rule keeps", keepDays: 55, keepLast: 2, want: []string{"20240101000000"}},
+		{name: "newest is always kept", keepDays: 1, want: []string{"20240101000000", "20240102000000", "20240201000000"}},
+		{name: "keep more than there are", keepLast: 10, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, selectPrunable(applied, tt.keepDays, tt.keepLast, now))
+		})
+	}
+}
+
+func TestPrune(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+
+	put := func(key string) {
+		_, err := mock.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader([]byte("-- migrate:up")),
+		})
+		require.NoError(t, err)
+	}
+	result := func(version, status string) {
+		require.NoError(t, shared.UploadResult(ctx, mock, shared.DefaultSettings(), "test-bucket", "migrations/", version, "",
+			&shared.Result{Version: version, Status: status, Timestamp: "2024-01-01T00:00:00Z"}, nil, shared.PutOptions{}))
+	}
+	for _, version := range []string{"20240101000000", "20240102000000", "20240103000000", "20240104000000", "20240105000000"} {
+		put("migrations/" + version + "/migrations/001_a.sql")
+	}
+	put("migrations/20240101000000/attempts/20240101000000.json")
+	result("20240101000000", "success")
+	result("20240102000000", "failed")
+	result("20240103000000", "success")
+	result("20240104000000", "success")
+	// 20240105000000 is pending
+
+	c := &Cmd{S3Bucket: "test-bucket", KeepLast: 1, Settings: shared.DefaultSettings()}
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	// Without --confirm nothing is deleted
+	var out bytes.Buffer
+	require.NoError(t, prune(ctx, mock, c, "migrations/", now, &out))
+	assert.Equal(t, "Would delete 20240101000000\nWould delete 20240103000000\n"+
+		"2 of 3 applied versions would be deleted; rerun with --confirm to delete them\n", out.String())
+	assert.True(t, mock.HasObject("test-bucket", "migrations/20240101000000/result.json"))
+
+	c.Confirm = true
+	out.Reset()
+	require.NoError(t, prune(ctx, mock, c, "migrations/", now, &out))
+	assert.Contains(t, out.String(), "Deleted 20240101000000 (3 objects)\n")
+
+	versions, err := shared.ListVersions(ctx, mock, shared.DefaultSettings(), "test-bucket", "migrations/")
+	require.NoError(t, err)
+	// Failed, pending and the newest applied versions are never deleted
+	assert.Equal(t, []string{"20240102000000", "20240104000000", "20240105000000"}, versions)
+}
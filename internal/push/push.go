@@ -6,6 +6,8 @@ import (
 	"log/slog"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/tokuhirom/dbmate-deployer/internal/shared"
@@ -13,27 +15,50 @@ import (
 
 // Cmd uploads migration files to S3
 type Cmd struct {
-	MigrationsDir string `help:"Local directory containing migration files" required:"" type:"path" name:"migrations-dir" short:"m"`
-	S3Bucket      string `help:"S3 bucket name" env:"S3_BUCKET" required:"" name:"s3-bucket"`
-	S3PathPrefix  string `help:"S3 path prefix (e.g. 'migrations/')" env:"S3_PATH_PREFIX" required:"" name:"s3-path-prefix"`
-	Version       string `help:"Version timestamp (YYYYMMDDHHMMSS)" required:"" name:"version" short:"v"`
-	DryRun        bool   `help:"Show what would be uploaded without uploading" name:"dry-run"`
-	Validate      bool   `help:"Validate migration files before upload" default:"true" name:"validate"`
-	NoSourceInfo  bool   `help:"Do not upload push source info (push-info.json)" name:"no-source-info"`
+	MigrationsDir string   `help:"Local directory containing migration files" required:"" type:"path" name:"migrations-dir" short:"m"`
+	S3Bucket      string   `help:"S3 bucket name" env:"S3_BUCKET" required:"" name:"s3-bucket"`
+	S3PathPrefix  string   `help:"S3 path prefix (e.g. 'migrations/')" env:"S3_PATH_PREFIX" required:"" name:"s3-path-prefix"`
+	ResultFile    string   `help:"Name of the per-version result file marking a version as applied" env:"RESULT_FILE" name:"result-file" default:"result.json"`
+	Version       string   `help:"Version timestamp (YYYYMMDDHHMMSS)" required:"" name:"version" short:"v"`
+	DryRun        bool     `help:"Show what would be uploaded without uploading" name:"dry-run"`
+	Validate      bool     `help:"Validate migration files before upload" default:"true" name:"validate"`
+	NoSourceInfo  bool     `help:"Do not upload push source info (push-info.json)" name:"no-source-info"`
+	Force         bool     `help:"Replace migration files already uploaded for this version" name:"force"`
+	IfChanged     bool     `help:"Upload only missing or modified migration files, succeeding without changes if the uploaded set is identical" name:"if-changed"`
+	Compress      bool     `help:"Gzip each migration file and upload it as .sql.gz" name:"compress"`
+	Bundle        bool     `help:"Upload the migration files as a single migrations.tar.gz instead of one object per file" name:"bundle"`
+	PinVersions   bool     `help:"Record the S3 VersionId of each migration file in files.json so deployers download exactly those object versions (requires a versioned bucket)" env:"S3_PIN_VERSIONS" name:"pin-versions"`
+	Recursive     bool     `help:"Also upload .sql files from subdirectories, flattened into one version folder" name:"recursive"`
+	ValidateSQL   bool     `help:"Run each migration in a rolled-back transaction against --database-url to catch SQL errors (PostgreSQL only)" name:"validate-sql"`
+	DatabaseURL   string   `help:"Database used by --validate-sql; use a scratch or staging database" env:"DATABASE_URL" name:"database-url"`
+	SSE           string   `help:"Server-side encryption for uploaded objects (AES256 or aws:kms, empty for the bucket default)" env:"S3_SSE" name:"sse" enum:",AES256,aws:kms" default:""`
+	SSEKMSKeyID   string   `help:"KMS key ID used with --sse=aws:kms" env:"S3_SSE_KMS_KEY_ID" name:"sse-kms-key-id"`
+	S3Tags        []string `help:"Object tag applied to every uploaded object (key=value, repeatable)" env:"S3_TAGS" name:"s3-tags"`
+	AllowPatterns []string `help:"Regex an up-section statement must match to pass validation, case-insensitive (repeatable; none allows every statement)" env:"SQL_ALLOW_PATTERN" name:"allow-patterns" sep:"none"`
+	DenyPatterns  []string `help:"Regex failing validation when an up-section statement matches it, case-insensitive (repeatable)" env:"SQL_DENY_PATTERN" name:"deny-patterns" sep:"none"`
+	WarnPatterns  []string `help:"Regex logging a warning when an up-section statement matches it, case-insensitive (repeatable)" env:"SQL_WARN_PATTERN" name:"warn-patterns" sep:"none"`
+	NoSQLDefaults bool     `help:"Drop the built-in SQL policy rules (TRUNCATE, DROP DATABASE, DELETE without WHERE, DROP TABLE without IF EXISTS)" env:"NO_SQL_DEFAULTS" name:"no-sql-defaults"`
+
+	// Settings holds the S3 layout, version format and S3 retry settings
+	Settings shared.Settings `kong:"-"`
+	// MigrationsTable is the table dbmate records applied migrations in (empty for the dbmate default)
+	MigrationsTable string `kong:"-"`
+}
+
+// putOptions returns the settings applied to uploaded objects
+func (c *Cmd) putOptions() shared.PutOptions {
+	// Tags are validated up front in Execute, so a parse error can't happen here
+	tags, _ := shared.ParseS3Tags(c.S3Tags)
+	return shared.PutOptions{ServerSideEncryption: c.SSE, SSEKMSKeyID: c.SSEKMSKeyID, Tags: tags}
 }
 
 // Execute runs the push command
-func Execute(c *Cmd, s3EndpointURL, metricsAddr string) error {
+func Execute(c *Cmd, s3Opts shared.S3ClientOptions, metricsAddr string) error {
 	ctx := context.Background()
 
 	// Validate version format (14 digits)
-	if len(c.Version) != 14 {
-		return fmt.Errorf("version must be 14 digits (YYYYMMDDHHMMSS): %s", c.Version)
-	}
-	for _, ch := range c.Version {
-		if ch < '0' || ch > '9' {
-			return fmt.Errorf("version must contain only digits: %s", c.Version)
-		}
+	if err := c.Settings.ValidateVersion(c.Version); err != nil {
+		return err
 	}
 
 	// Ensure prefix ends with /
@@ -42,55 +67,127 @@ func Execute(c *Cmd, s3EndpointURL, metricsAddr string) error {
 		s3Prefix += "/"
 	}
 
+	if c.ValidateSQL && c.DatabaseURL == "" {
+		return fmt.Errorf("--validate-sql requires --database-url (or DATABASE_URL)")
+	}
+
+	// A bundle is already compressed and is replaced as a whole
+	if c.Bundle && c.Compress {
+		return fmt.Errorf("--bundle cannot be used with --compress")
+	}
+	if c.Bundle && c.IfChanged {
+		return fmt.Errorf("--bundle cannot be used with --if-changed")
+	}
+
+	if _, err := shared.ParseS3Tags(c.S3Tags); err != nil {
+		return err
+	}
+
+	policy, err := shared.NewSQLPolicy(c.AllowPatterns, c.DenyPatterns, c.WarnPatterns, c.NoSQLDefaults)
+	if err != nil {
+		return err
+	}
+
+	// Fail fast on inconsistent encryption settings
+	if err := c.putOptions().Validate(); err != nil {
+		return err
+	}
+
 	// Create S3 client
-	s3Client, err := shared.CreateS3Client(ctx, s3EndpointURL)
+	s3Client, err := shared.CreateS3Client(ctx, s3Opts)
 	if err != nil {
 		return fmt.Errorf("failed to create S3 client: %w", err)
 	}
 
 	// Check if version already exists
-	exists, err := shared.CheckResultExists(ctx, s3Client, c.S3Bucket, s3Prefix, c.Version)
+	exists, err := shared.CheckResultExists(ctx, s3Client, c.Settings, c.S3Bucket, s3Prefix, c.Version, c.ResultFile)
 	if err != nil {
 		return fmt.Errorf("failed to check if version exists: %w", err)
 	}
-	if exists {
+	// With --if-changed, an applied version is fine as long as its files are unchanged
+	if exists && !c.IfChanged {
 		return fmt.Errorf("version %s already exists", c.Version)
 	}
 
-	// Read and filter migration files
-	entries, err := os.ReadDir(c.MigrationsDir)
+	// Refuse to mix a new file set with one pushed earlier under the same version
+	uploaded, err := shared.ListUploadedMigrations(ctx, s3Client, c.Settings, c.S3Bucket, s3Prefix, c.Version)
 	if err != nil {
-		return fmt.Errorf("failed to read migrations directory: %w", err)
+		return fmt.Errorf("failed to list uploaded migrations: %w", err)
+	}
+	if len(uploaded) > 0 && !c.Force && !c.IfChanged {
+		return fmt.Errorf("version %s already has %d uploaded migration files, use --force or --if-changed to replace them", c.Version, len(uploaded))
 	}
 
-	var sqlFiles []string
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
+	// Find migration files; with --recursive, paths are relative to the migrations directory
+	sqlFiles, err := shared.FindMigrationFiles(c.MigrationsDir, c.Recursive)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Found migration files", "count", len(sqlFiles))
+
+	// Files are uploaded, and listed in the manifest, under their base names
+	fileNames := make([]string, len(sqlFiles))
+	for i, file := range sqlFiles {
+		fileNames[i] = filepath.Base(file)
+	}
+
+	// With --force, objects that the new upload won't overwrite must go. This includes a
+	// file pushed earlier with the other compression setting, which would otherwise be
+	// downloaded twice.
+	objectNames := []string{shared.BundleObjectName}
+	if !c.Bundle {
+		objectNames = make([]string, len(fileNames))
+		for i, fileName := range fileNames {
+			objectNames[i] = shared.MigrationObjectName(fileName, c.Compress)
 		}
-		if strings.HasSuffix(entry.Name(), ".sql") {
-			sqlFiles = append(sqlFiles, entry.Name())
+	}
+	var stale []string
+	for _, name := range uploaded {
+		if !slices.Contains(objectNames, name) {
+			stale = append(stale, name)
 		}
 	}
 
-	if len(sqlFiles) == 0 {
-		return fmt.Errorf("no .sql files found in directory: %s", c.MigrationsDir)
+	// A CI retry re-uploads only what a partial or different earlier push left out
+	uploadFiles := sqlFiles
+	if c.IfChanged {
+		changed, err := shared.ChangedMigrations(ctx, s3Client, c.Settings, c.S3Bucket, s3Prefix, c.Version, c.MigrationsDir, sqlFiles, c.Compress)
+		if err != nil {
+			return fmt.Errorf("failed to compare uploaded migrations: %w", err)
+		}
+		if len(changed) == 0 && len(stale) == 0 {
+			slog.Info("Uploaded migrations are identical to the local files, nothing to push", "version", c.Version, "count", len(sqlFiles))
+			fmt.Printf("Version: %s (unchanged)\n", c.Version)
+			return nil
+		}
+		if exists {
+			return fmt.Errorf("version %s already exists and its uploaded migrations differ from %s", c.Version, c.MigrationsDir)
+		}
+		slog.Info("Uploading changed migration files", "changed", len(changed), "unchanged", len(sqlFiles)-len(changed), "stale", len(stale))
+		uploadFiles = changed
 	}
 
-	slog.Info("Found migration files", "count", len(sqlFiles))
-
 	// Validate migration files if requested
 	if c.Validate {
 		slog.Info("Validating migration files")
-		for _, fileName := range sqlFiles {
-			filePath := path.Join(c.MigrationsDir, fileName)
-			if err := shared.ValidateMigrationFile(filePath); err != nil {
+		for _, file := range sqlFiles {
+			filePath := filepath.Join(c.MigrationsDir, file)
+			if err := c.Settings.ValidateMigrationFile(filePath, policy); err != nil {
 				return fmt.Errorf("validation failed: %w", err)
 			}
 		}
 		slog.Info("All migration files validated successfully")
 	}
 
+	// Execute the SQL without committing, if requested
+	if c.ValidateSQL {
+		slog.Info("Validating migration SQL against database")
+		if err := validateSQL(ctx, c, sqlFiles); err != nil {
+			return fmt.Errorf("validation failed: %w", err)
+		}
+	}
+
 	// Collect push info (unless disabled)
 	var pushInfo *shared.PushInfo
 	if !c.NoSourceInfo {
@@ -100,11 +197,25 @@ func Execute(c *Cmd, s3EndpointURL, metricsAddr string) error {
 
 	// Dry-run mode
 	if c.DryRun {
+		for _, fileName := range stale {
+			s3Key := c.Settings.MigrationKey(s3Prefix, c.Version, fileName)
+			fmt.Printf("Dry-run mode: would delete s3://%s/%s\n", c.S3Bucket, s3Key)
+		}
 		fmt.Println("Dry-run mode: would upload the following files:")
-		for _, fileName := range sqlFiles {
-			s3Key := path.Join(s3Prefix, c.Version, "migrations", fileName)
-			fmt.Printf("  %s -> s3://%s/%s\n", fileName, c.S3Bucket, s3Key)
+		if c.Bundle {
+			s3Key := c.Settings.MigrationKey(s3Prefix, c.Version, shared.BundleObjectName)
+			fmt.Printf("  %d files -> s3://%s/%s\n", len(uploadFiles), c.S3Bucket, s3Key)
 		}
+		for _, file := range uploadFiles {
+			if c.Bundle {
+				fmt.Printf("    %s\n", file)
+				continue
+			}
+			s3Key := c.Settings.MigrationKey(s3Prefix, c.Version, shared.MigrationObjectName(filepath.Base(file), c.Compress))
+			fmt.Printf("  %s -> s3://%s/%s\n", file, c.S3Bucket, s3Key)
+		}
+		s3Key := path.Join(s3Prefix, c.Version, shared.FileManifestName)
+		fmt.Printf("  %s -> s3://%s/%s\n", shared.FileManifestName, c.S3Bucket, s3Key)
 		if pushInfo != nil {
 			s3Key := path.Join(s3Prefix, c.Version, "push-info.json")
 			fmt.Printf("  push-info.json -> s3://%s/%s\n", c.S3Bucket, s3Key)
@@ -114,21 +225,109 @@ func Execute(c *Cmd, s3EndpointURL, metricsAddr string) error {
 		return nil
 	}
 
+	// Remove files left over from an earlier push of this version
+	if err := shared.DeleteUploadedMigrations(ctx, s3Client, c.Settings, c.S3Bucket, s3Prefix, c.Version, stale); err != nil {
+		return fmt.Errorf("failed to delete stale migrations: %w", err)
+	}
+
 	// Upload migrations
-	slog.Info("Uploading migrations to S3", "bucket", c.S3Bucket, "prefix", s3Prefix, "version", c.Version)
-	if err := shared.UploadMigrations(ctx, s3Client, c.S3Bucket, s3Prefix, c.Version, c.MigrationsDir); err != nil {
-		return fmt.Errorf("failed to upload migrations: %w", err)
+	// Only stale files need to go when --if-changed finds every remaining file unchanged
+	versionIDs := make(map[string]string)
+	if c.Bundle {
+		slog.Info("Uploading migration bundle to S3", "bucket", c.S3Bucket, "prefix", s3Prefix, "version", c.Version)
+		id, err := shared.UploadBundle(ctx, s3Client, c.Settings, c.S3Bucket, s3Prefix, c.Version, c.MigrationsDir, uploadFiles, c.putOptions())
+		if err != nil {
+			return fmt.Errorf("failed to upload migrations: %w", err)
+		}
+		if id != "" {
+			versionIDs[shared.BundleObjectName] = id
+		}
+	} else if len(uploadFiles) > 0 || !c.IfChanged {
+		slog.Info("Uploading migrations to S3", "bucket", c.S3Bucket, "prefix", s3Prefix, "version", c.Version)
+		if versionIDs, err = shared.UploadMigrations(ctx, s3Client, c.Settings, c.S3Bucket, s3Prefix, c.Version, c.MigrationsDir, uploadFiles, c.Compress, c.putOptions()); err != nil {
+			return fmt.Errorf("failed to upload migrations: %w", err)
+		}
+	}
+
+	var manifestVersionIDs map[string]string
+	if c.PinVersions && c.Bundle {
+		// The bundle is the only object to pin
+		if versionIDs[shared.BundleObjectName] == "" {
+			return fmt.Errorf("no S3 VersionId for %s: --pin-versions requires versioning to be enabled on bucket %s", shared.BundleObjectName, c.S3Bucket)
+		}
+		manifestVersionIDs = versionIDs
+	} else if c.PinVersions {
+		if manifestVersionIDs, err = c.recordedVersionIDs(ctx, s3Client, s3Prefix, sqlFiles, versionIDs); err != nil {
+			return err
+		}
+	}
+
+	// Upload file manifest so partially pruned versions can be detected
+	if err := shared.UploadFileManifest(ctx, s3Client, c.Settings, c.S3Bucket, s3Prefix, c.Version, fileNames, manifestVersionIDs, c.putOptions()); err != nil {
+		return fmt.Errorf("failed to upload file manifest: %w", err)
 	}
 
 	// Upload push info (unless disabled)
 	if pushInfo != nil {
-		if err := shared.UploadPushInfo(ctx, s3Client, c.S3Bucket, s3Prefix, c.Version, pushInfo); err != nil {
+		if err := shared.UploadPushInfo(ctx, s3Client, c.Settings, c.S3Bucket, s3Prefix, c.Version, pushInfo, c.putOptions()); err != nil {
 			return fmt.Errorf("failed to upload push info: %w", err)
 		}
 	}
 
-	slog.Info("Successfully uploaded migrations", "version", c.Version, "count", len(sqlFiles))
+	slog.Info("Successfully uploaded migrations", "version", c.Version, "count", len(uploadFiles))
 	fmt.Printf("Version: %s\n", c.Version)
 
 	return nil
 }
+
+// recordedVersionIDs returns the S3 VersionId of every migration file for files.json. Uploaded
+// files use the VersionId returned by the upload; files left unchanged by --if-changed are looked up.
+func (c *Cmd) recordedVersionIDs(ctx context.Context, client shared.S3API, s3Prefix string, sqlFiles []string, uploaded map[string]string) (map[string]string, error) {
+	var unchanged []string
+	for _, file := range sqlFiles {
+		if _, ok := uploaded[filepath.Base(file)]; !ok {
+			unchanged = append(unchanged, file)
+		}
+	}
+
+	versionIDs, err := shared.MigrationVersionIDs(ctx, client, c.Settings, c.S3Bucket, s3Prefix, c.Version, unchanged, c.Compress)
+	if err != nil {
+		return nil, err
+	}
+	for fileName, id := range uploaded {
+		versionIDs[fileName] = id
+	}
+
+	for _, file := range sqlFiles {
+		if versionIDs[filepath.Base(file)] == "" {
+			return nil, fmt.Errorf("no S3 VersionId for %s: --pin-versions requires versioning to be enabled on bucket %s", filepath.Base(file), c.S3Bucket)
+		}
+	}
+	return versionIDs, nil
+}
+
+// validateSQL runs shared.ValidateMigrationSQL on the migration files. dbmate only reads a
+// single directory, so files found with --recursive are first copied into a flat temp dir.
+func validateSQL(ctx context.Context, c *Cmd, sqlFiles []string) error {
+	if !c.Recursive {
+		return shared.ValidateMigrationSQL(ctx, c.DatabaseURL, c.MigrationsTable, c.MigrationsDir)
+	}
+
+	dir, err := os.MkdirTemp("", "dbmate-push-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	for _, file := range sqlFiles {
+		content, err := os.ReadFile(filepath.Join(c.MigrationsDir, file))
+		if err != nil {
+			return fmt.Errorf("failed to read file %s: %w", file, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, filepath.Base(file)), content, 0o644); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", file, err)
+		}
+	}
+
+	return shared.ValidateMigrationSQL(ctx, c.DatabaseURL, c.MigrationsTable, dir)
+}
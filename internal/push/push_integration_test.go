@@ -0,0 +1,166 @@
+//go:build integration
+
+package push
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared/testhelpers"
+)
+
+func init() {
+	// Set AWS credentials for the fake S3 server (used by Execute which creates its own S3 client)
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	os.Setenv("AWS_DEFAULT_REGION", "us-east-1")
+}
+
+// setupBucket starts a fake S3 server with an empty bucket and returns the client options
+// reaching it and a client
+func setupBucket(ctx context.Context, t *testing.T) (shared.S3ClientOptions, *s3.Client) {
+	t.Helper()
+
+	server, endpoint, client := testhelpers.SetupFakeS3(ctx, t)
+	t.Cleanup(server.Close)
+
+	_, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String("test-migrations")})
+	require.NoError(t, err, "Failed to create test S3 bucket")
+	return shared.S3ClientOptions{EndpointURL: endpoint}, client
+}
+
+func TestPush_Execute_RecordsPushInfo(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx := context.Background()
+	s3Opts, client := setupBucket(ctx, t)
+
+	t.Setenv("GITHUB_ACTIONS", "true")
+	t.Setenv("GITHUB_REPOSITORY", "example/app")
+	t.Setenv("GITHUB_SHA", "0123456789abcdef")
+
+	cmd := &Cmd{
+		MigrationsDir: filepath.Join("..", "testdata", "migrations", "valid"),
+		S3Bucket:      "test-migrations",
+		S3PathPrefix:  "migrations/",
+		Settings:      shared.DefaultSettings(),
+		ResultFile:    shared.DefaultResultFile,
+		Version:       "20240101000000",
+		Validate:      true,
+	}
+	require.NoError(t, Execute(cmd, s3Opts, ""))
+
+	info, err := shared.DownloadPushInfo(ctx, client, shared.DefaultSettings(), "test-migrations", "migrations/", "20240101000000")
+	require.NoError(t, err)
+	require.NotNil(t, info, "push-info.json should be uploaded with the migrations")
+	assert.Equal(t, "github_actions", info.Source.Type)
+	assert.Equal(t, "example/app", info.Source.Repository)
+	assert.Equal(t, "0123456789abcdef", info.Source.SHA)
+	assert.NotEmpty(t, info.PushedAt)
+}
+
+func TestPush_Execute_SkipsPushInfo(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx := context.Background()
+	s3Opts, client := setupBucket(ctx, t)
+
+	base := Cmd{
+		MigrationsDir: filepath.Join("..", "testdata", "migrations", "valid"),
+		S3Bucket:      "test-migrations",
+		S3PathPrefix:  "migrations/",
+		Settings:      shared.DefaultSettings(),
+		ResultFile:    shared.DefaultResultFile,
+		Validate:      true,
+	}
+
+	// Nothing is written in dry-run mode
+	dryRun := base
+	dryRun.Version = "20240101000000"
+	dryRun.DryRun = true
+	require.NoError(t, Execute(&dryRun, s3Opts, ""))
+
+	info, err := shared.DownloadPushInfo(ctx, client, shared.DefaultSettings(), "test-migrations", "migrations/", "20240101000000")
+	require.NoError(t, err)
+	assert.Nil(t, info)
+
+	// --no-source-info uploads the migrations only
+	noSourceInfo := base
+	noSourceInfo.Version = "20240102000000"
+	noSourceInfo.NoSourceInfo = true
+	require.NoError(t, Execute(&noSourceInfo, s3Opts, ""))
+
+	uploaded, err := shared.ListUploadedMigrations(ctx, client, shared.DefaultSettings(), "test-migrations", "migrations/", "20240102000000")
+	require.NoError(t, err)
+	assert.NotEmpty(t, uploaded)
+
+	info, err = shared.DownloadPushInfo(ctx, client, shared.DefaultSettings(), "test-migrations", "migrations/", "20240102000000")
+	require.NoError(t, err)
+	assert.Nil(t, info)
+}
+
+func TestPush_Execute_IfChanged(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx := context.Background()
+	s3Opts, client := setupBucket(ctx, t)
+
+	dir := t.TempDir()
+	require.NoError(t, testhelpers.WriteFile(dir, "20240101000000_create_users.sql", testhelpers.ValidMigration("users")))
+	require.NoError(t, testhelpers.WriteFile(dir, "20240102000000_create_posts.sql", testhelpers.ValidMigration("posts")))
+
+	cmd := &Cmd{
+		MigrationsDir: dir,
+		S3Bucket:      "test-migrations",
+		S3PathPrefix:  "migrations/",
+		Settings:      shared.DefaultSettings(),
+		ResultFile:    shared.DefaultResultFile,
+		Version:       "20240102000000",
+		Validate:      true,
+		NoSourceInfo:  true,
+	}
+	require.NoError(t, Execute(cmd, s3Opts, ""))
+
+	// Without --if-changed a retry is refused
+	err := Execute(cmd, s3Opts, "")
+	assert.ErrorContains(t, err, "use --force or --if-changed")
+
+	// An identical set is a no-op
+	cmd.IfChanged = true
+	require.NoError(t, Execute(cmd, s3Opts, ""))
+
+	// A changed file is re-uploaded
+	require.NoError(t, testhelpers.WriteFile(dir, "20240102000000_create_posts.sql", testhelpers.ValidMigration("articles")))
+	require.NoError(t, Execute(cmd, s3Opts, ""))
+	changed, err := shared.ChangedMigrations(ctx, client, shared.DefaultSettings(), "test-migrations", "migrations/", "20240102000000", dir,
+		[]string{"20240101000000_create_users.sql", "20240102000000_create_posts.sql"}, false)
+	require.NoError(t, err)
+	assert.Empty(t, changed)
+
+	// Once applied, only an identical set is accepted
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("test-migrations"),
+		Key:    aws.String("migrations/20240102000000/result.json"),
+		Body:   strings.NewReader(testhelpers.SuccessResult("20240102000000", "applied")),
+	})
+	require.NoError(t, err)
+	require.NoError(t, Execute(cmd, s3Opts, ""))
+
+	require.NoError(t, testhelpers.WriteFile(dir, "20240102000000_create_posts.sql", testhelpers.ValidMigration("posts")))
+	err = Execute(cmd, s3Opts, "")
+	assert.ErrorContains(t, err, "already exists and its uploaded migrations differ")
+}
@@ -0,0 +1,101 @@
+package rollback
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/tokuhirom/dbmate-deployer/internal/shared"
+)
+
+// Cmd rolls back the migrations introduced by a specific version
+type Cmd struct {
+	DatabaseURL  string `help:"Database connection string (postgres:// or mysql://)" env:"DATABASE_URL" required:""`
+	S3Bucket     string `help:"S3 bucket name" env:"S3_BUCKET" required:"" name:"s3-bucket"`
+	S3PathPrefix string `help:"S3 path prefix (e.g. 'migrations/')" env:"S3_PATH_PREFIX" required:"" name:"s3-path-prefix"`
+	ResultFile   string `help:"Name of the per-version result file marking a version as applied" env:"RESULT_FILE" name:"result-file" default:"result.json"`
+	Version      string `help:"Version to roll back (YYYYMMDDHHMMSS)" required:"" name:"version" short:"v"`
+	SSE          string `help:"Server-side encryption for uploaded objects (AES256 or aws:kms, empty for the bucket default)" env:"S3_SSE" name:"sse" enum:",AES256,aws:kms" default:""`
+	SSEKMSKeyID  string `help:"KMS key ID used with --sse=aws:kms" env:"S3_SSE_KMS_KEY_ID" name:"sse-kms-key-id"`
+
+	// Settings holds the S3 layout, version format and S3 retry settings
+	Settings shared.Settings `kong:"-"`
+	// MigrationsTable is the table dbmate records applied migrations in (empty for the dbmate default)
+	MigrationsTable string `kong:"-"`
+	// LogTimestampFormat is the Go time layout of the migration log timestamps (empty for the default)
+	LogTimestampFormat string `kong:"-"`
+}
+
+// putOptions returns the settings applied to uploaded objects
+func (c *Cmd) putOptions() shared.PutOptions {
+	return shared.PutOptions{ServerSideEncryption: c.SSE, SSEKMSKeyID: c.SSEKMSKeyID}
+}
+
+// Execute runs the rollback command
+func Execute(c *Cmd, s3Opts shared.S3ClientOptions, metricsAddr string) error {
+	ctx := context.Background()
+
+	// Start metrics server if address is specified
+	if metricsAddr != "" {
+		go shared.StartMetricsServer(metricsAddr, shared.NewMetricsRegistry())
+	}
+
+	// Ensure prefix ends with /
+	s3Prefix := c.S3PathPrefix
+	if !strings.HasSuffix(s3Prefix, "/") {
+		s3Prefix += "/"
+	}
+
+	// Fail fast on a DATABASE_URL no compiled-in driver can handle
+	if err := shared.ValidateDatabaseURL(c.DatabaseURL); err != nil {
+		return err
+	}
+
+	// Fail fast on inconsistent encryption settings
+	if err := c.putOptions().Validate(); err != nil {
+		return err
+	}
+
+	// Create S3 client
+	s3Client, err := shared.CreateS3Client(ctx, s3Opts)
+	if err != nil {
+		return fmt.Errorf("failed to create S3 client: %w", err)
+	}
+
+	// Only roll back versions that were actually applied
+	exists, err := shared.CheckResultExists(ctx, s3Client, c.Settings, c.S3Bucket, s3Prefix, c.Version, c.ResultFile)
+	if err != nil {
+		return fmt.Errorf("failed to check result for version %s: %w", c.Version, err)
+	}
+	if !exists {
+		return fmt.Errorf("version %s has never been applied, refusing to roll back", c.Version)
+	}
+	applied, err := shared.DownloadResult(ctx, s3Client, c.Settings, c.S3Bucket, s3Prefix, c.Version, c.ResultFile)
+	if err != nil {
+		return fmt.Errorf("failed to read result for version %s: %w", c.Version, err)
+	}
+	if applied.Status != "success" {
+		return fmt.Errorf("version %s did not succeed (status: %s), refusing to roll back", c.Version, applied.Status)
+	}
+
+	slog.Info("Rolling back version", "version", c.Version)
+
+	result := shared.RollbackMigration(ctx, s3Client, c.Settings, c.S3Bucket, s3Prefix, c.Version, c.DatabaseURL, shared.MigrationOptions{
+		MigrationsTable:    c.MigrationsTable,
+		LogTimestampFormat: c.LogTimestampFormat,
+	})
+
+	// Upload rollback result (both success and failure)
+	if err := shared.UploadResult(ctx, s3Client, c.Settings, c.S3Bucket, s3Prefix, c.Version, shared.RollbackResultFile, result, nil, c.putOptions()); err != nil {
+		slog.Error("Failed to upload rollback result", "error", err)
+		return err
+	}
+
+	if result.Status != "success" {
+		return fmt.Errorf("rollback failed for version %s: %s", c.Version, result.Error)
+	}
+
+	slog.Info("Rollback completed successfully", "version", c.Version, "rolled_back", result.RolledBack)
+	return nil
+}
@@ -0,0 +1,147 @@
+package shared
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// BundleObjectName is the object holding every migration file of a version as one gzipped
+// tarball, uploaded by push --bundle instead of one object per file
+const BundleObjectName = "migrations.tar.gz"
+
+// isBundleKey reports whether key is the migration bundle of a version
+func isBundleKey(key string) bool {
+	return path.Base(key) == BundleObjectName
+}
+
+// UploadBundle packs the migration files found by FindMigrationFiles into a gzipped tarball,
+// each under its base name, and uploads it as the version's migrations.tar.gz. It returns the
+// S3 VersionId of the bundle, or "" if the bucket is not versioned.
+func UploadBundle(ctx context.Context, client S3API, settings Settings, bucket, prefix, version, localDir string, files []string, opts PutOptions) (string, error) {
+	if len(files) == 0 {
+		return "", fmt.Errorf("no .sql files found in directory: %s", localDir)
+	}
+
+	content, err := buildBundle(localDir, files)
+	if err != nil {
+		return "", err
+	}
+
+	s3Key := settings.MigrationKey(prefix, version, BundleObjectName)
+	output, err := withS3Retry(ctx, settings.Retry, "PutObject", func() (*s3.PutObjectOutput, error) {
+		return client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String(s3Key),
+			Body:                 bytes.NewReader(content),
+			ContentType:          aws.String("application/gzip"),
+			ServerSideEncryption: opts.serverSideEncryption(),
+			SSEKMSKeyId:          opts.kmsKeyID(),
+			Tagging:              opts.tagging(),
+		})
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload %s: %w", BundleObjectName, err)
+	}
+
+	slog.Info("Uploaded migration bundle", "files", len(files), "bytes", len(content), "s3_key", s3Key)
+	return aws.ToString(output.VersionId), nil
+}
+
+// buildBundle returns the gzipped tarball of files (paths relative to localDir). Entries have a
+// fixed mode and time, so the same files always give the same bundle.
+func buildBundle(localDir string, files []string) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	for _, file := range files {
+		content, err := os.ReadFile(filepath.Join(localDir, file))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file %s: %w", file, err)
+		}
+		header := &tar.Header{
+			Name:     filepath.Base(file),
+			Mode:     0o644,
+			Size:     int64(len(content)),
+			ModTime:  time.Unix(0, 0),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return nil, fmt.Errorf("failed to add %s to bundle: %w", file, err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			return nil, fmt.Errorf("failed to add %s to bundle: %w", file, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to create bundle: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress bundle: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// downloadBundle downloads a migration bundle and extracts its files into localDir. A non-empty
+// versionID downloads that version of the bundle. It returns the number of extracted files.
+func downloadBundle(ctx context.Context, client S3API, settings Settings, bucket, key, versionID, localDir string) (int, error) {
+	slog.Info("Downloading migration bundle", "key", key)
+
+	result, err := getMigrationObject(ctx, client, settings, bucket, key, versionID)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = result.Body.Close() }()
+
+	count, err := extractBundle(result.Body, localDir)
+	if err != nil {
+		return count, fmt.Errorf("failed to extract %s: %w", key, err)
+	}
+	slog.Info("Extracted migration bundle", "key", key, "files", count)
+	return count, nil
+}
+
+// extractBundle writes the .sql files of a gzipped tarball into localDir under their base
+// names, so entries can't escape localDir. Other entries are skipped, and two files with the
+// same base name fail the extraction.
+func extractBundle(r io.Reader, localDir string) (int, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = gz.Close() }()
+
+	tr := tar.NewReader(gz)
+	count := 0
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		if header.Typeflag != tar.TypeReg || !strings.HasSuffix(header.Name, ".sql") {
+			continue
+		}
+		if err := writeMigrationFile(localDir, path.Base(header.Name), tr); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
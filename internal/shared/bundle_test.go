@@ -0,0 +1,102 @@
+package shared
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared/testhelpers"
+)
+
+func TestUploadBundle_RoundTrip(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+
+	srcDir := t.TempDir()
+	require.NoError(t, testhelpers.WriteFile(srcDir, "001_create_users.sql", "CREATE TABLE users (id INT);"))
+	require.NoError(t, os.MkdirAll(filepath.Join(srcDir, "posts"), 0o755))
+	require.NoError(t, testhelpers.WriteFile(filepath.Join(srcDir, "posts"), "002_create_posts.sql", "CREATE TABLE posts (id INT);"))
+
+	files := []string{"001_create_users.sql", filepath.Join("posts", "002_create_posts.sql")}
+	_, err := UploadBundle(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", srcDir, files, PutOptions{})
+	require.NoError(t, err)
+	require.True(t, mock.HasObject("test-bucket", "migrations/20240101000000/migrations/migrations.tar.gz"))
+
+	uploaded, err := ListUploadedMigrations(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000")
+	require.NoError(t, err)
+	assert.Equal(t, []string{BundleObjectName}, uploaded)
+
+	// Files are extracted flat, under their base names
+	dstDir := t.TempDir()
+	require.NoError(t, DownloadVersionMigrations(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", dstDir, 0))
+	content, err := os.ReadFile(filepath.Join(dstDir, "001_create_users.sql"))
+	require.NoError(t, err)
+	assert.Equal(t, "CREATE TABLE users (id INT);", string(content))
+	content, err = os.ReadFile(filepath.Join(dstDir, "002_create_posts.sql"))
+	require.NoError(t, err)
+	assert.Equal(t, "CREATE TABLE posts (id INT);", string(content))
+
+	// The same files give the same bundle
+	first, err := buildBundle(srcDir, files)
+	require.NoError(t, err)
+	second, err := buildBundle(srcDir, files)
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+
+	// A bundle next to individual files is ambiguous
+	_, err = mock.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("test-bucket"),
+		Key:    aws.String("migrations/20240101000000/migrations/003_create_tags.sql"),
+		Body:   bytes.NewReader([]byte("CREATE TABLE tags (id INT);")),
+	})
+	require.NoError(t, err)
+	err = DownloadVersionMigrations(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", t.TempDir(), 0)
+	assert.ErrorContains(t, err, "found both migrations.tar.gz and individual migration files")
+}
+
+func TestExtractBundle(t *testing.T) {
+	bundle := func(entries map[string]string) *bytes.Buffer {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		for name, content := range entries {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+			_, err := tw.Write([]byte(content))
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+		require.NoError(t, gz.Close())
+		return &buf
+	}
+
+	// Paths are reduced to base names and non-SQL files are skipped
+	dir := t.TempDir()
+	count, err := extractBundle(bundle(map[string]string{
+		"../../etc/001_init.sql": "-- migrate:up",
+		"README.md":              "docs",
+	}), dir)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "001_init.sql", entries[0].Name())
+
+	// Two entries with the same base name fail
+	_, err = extractBundle(bundle(map[string]string{
+		"a/001_init.sql": "-- migrate:up",
+		"b/001_init.sql": "-- migrate:up",
+	}), t.TempDir())
+	assert.ErrorContains(t, err, "001_init.sql")
+
+	_, err = extractBundle(bytes.NewBufferString("not a tarball"), t.TempDir())
+	assert.Error(t, err)
+}
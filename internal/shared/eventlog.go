@@ -0,0 +1,191 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Lifecycle events recorded in the event log
+const (
+	EventPollStarted        = "poll_started"
+	EventVersionSelected    = "version_selected"
+	EventMigrationStarted   = "migration_started"
+	EventMigrationSucceeded = "migration_succeeded"
+	EventMigrationFailed    = "migration_failed"
+)
+
+// DefaultEventLogMaxBytes is the default size cap of each daily event log object
+const DefaultEventLogMaxBytes = 1 << 20
+
+// eventLogMaxAttempts bounds the read-append-put cycles when replicas write the same object
+const eventLogMaxAttempts = 5
+
+// Event is one line of the event log
+type Event struct {
+	Time            string  `json:"time"`
+	Event           string  `json:"event"`
+	Instance        string  `json:"instance,omitempty"`
+	Prefix          string  `json:"prefix,omitempty"`
+	Version         string  `json:"version,omitempty"`
+	Error           string  `json:"error,omitempty"`
+	ErrorType       string  `json:"error_type,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+}
+
+// EventLog appends daemon events as NDJSON lines to a daily S3 object. S3 has no append,
+// so each event reads the object, appends the line and writes it back, conditional on the
+// ETag so that concurrent replicas don't overwrite each other's events.
+type EventLog struct {
+	client   S3API
+	retry    S3RetryOptions
+	bucket   string
+	key      string
+	maxBytes int
+	opts     PutOptions
+	instance string
+	now      func() time.Time
+
+	mu sync.Mutex
+}
+
+// NewEventLog returns an event log writing to the daily objects derived from key (see
+// EventLogKey). Each object is capped at maxBytes (DefaultEventLogMaxBytes if not positive)
+// by dropping its oldest events.
+func NewEventLog(client S3API, settings Settings, bucket, key string, maxBytes int, opts PutOptions) *EventLog {
+	if maxBytes <= 0 {
+		maxBytes = DefaultEventLogMaxBytes
+	}
+	return &EventLog{
+		client:   client,
+		retry:    settings.Retry,
+		bucket:   bucket,
+		key:      key,
+		maxBytes: maxBytes,
+		opts:     opts,
+		instance: InstanceID(),
+		now:      time.Now,
+	}
+}
+
+// EventLogKey returns the object the events of day t are appended to, e.g.
+// logs/events.ndjson becomes logs/events-20240101.ndjson
+func EventLogKey(key string, t time.Time) string {
+	ext := path.Ext(key)
+	if ext == "" {
+		ext = ".ndjson"
+	}
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(key, path.Ext(key)), t.UTC().Format("20060102"), ext)
+}
+
+// Record appends e to the event log. A nil EventLog records nothing. Failures are only
+// logged, since the event log must never stop the daemon.
+func (l *EventLog) Record(ctx context.Context, e Event) {
+	if l == nil {
+		return
+	}
+	if err := l.append(ctx, e); err != nil {
+		slog.Warn("Failed to record event", "event", e.Event, "error", err)
+	}
+}
+
+// append writes e to the object of the current day, retrying when another writer got in between
+func (l *EventLog) append(ctx context.Context, e Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now().UTC()
+	e.Time = now.Format(time.RFC3339)
+	e.Instance = l.instance
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	line = append(line, '\n')
+
+	key := EventLogKey(l.key, now)
+	for attempt := 0; attempt < eventLogMaxAttempts; attempt++ {
+		existing, etag, err := l.read(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		content := append(existing, line...)
+		if len(content) > l.maxBytes {
+			slog.Warn("Event log reached its size cap, dropping the oldest events", "key", key, "max_bytes", l.maxBytes)
+			content = trimEventLog(content, l.maxBytes)
+		}
+
+		// Create the object only if it's still missing, or replace exactly the version read
+		input := &s3.PutObjectInput{
+			Bucket:               aws.String(l.bucket),
+			Key:                  aws.String(key),
+			Body:                 bytes.NewReader(content),
+			ContentType:          aws.String("application/x-ndjson"),
+			ServerSideEncryption: l.opts.serverSideEncryption(),
+			SSEKMSKeyId:          l.opts.kmsKeyID(),
+			Tagging:              l.opts.tagging(),
+		}
+		if etag == "" {
+			input.IfNoneMatch = aws.String("*")
+		} else {
+			input.IfMatch = aws.String(etag)
+		}
+
+		_, err = l.client.PutObject(ctx, input)
+		if err == nil {
+			return nil
+		}
+		if !strings.Contains(err.Error(), "PreconditionFailed") {
+			return fmt.Errorf("failed to write event log %s: %w", key, err)
+		}
+		slog.Debug("Event log changed during the write, retrying", "key", key, "attempt", attempt+1)
+	}
+	return fmt.Errorf("event log %s kept changing during %d write attempts", key, eventLogMaxAttempts)
+}
+
+// read returns the content and ETag of the event log object, or nil and "" if it doesn't exist yet
+func (l *EventLog) read(ctx context.Context, key string) ([]byte, string, error) {
+	resp, err := withS3Retry(ctx, l.retry, "GetObject", func() (*s3.GetObjectOutput, error) {
+		return l.client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(l.bucket),
+			Key:    aws.String(key),
+		})
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "NotFound") || strings.Contains(err.Error(), "NoSuchKey") {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("failed to read event log %s: %w", key, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read event log %s: %w", key, err)
+	}
+	return content, aws.ToString(resp.ETag), nil
+}
+
+// trimEventLog keeps the newest whole lines of content that fit in maxBytes
+func trimEventLog(content []byte, maxBytes int) []byte {
+	kept := content[len(content)-maxBytes:]
+	if content[len(content)-maxBytes-1] == '\n' {
+		return kept
+	}
+	// Drop the partial line at the start
+	if i := bytes.IndexByte(kept, '\n'); i >= 0 {
+		return kept[i+1:]
+	}
+	return nil
+}
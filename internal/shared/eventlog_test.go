@@ -0,0 +1,107 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared/testhelpers"
+)
+
+func TestEventLogKey(t *testing.T) {
+	day := time.Date(2024, 1, 2, 23, 0, 0, 0, time.UTC)
+	assert.Equal(t, "logs/events-20240102.ndjson", EventLogKey("logs/events.ndjson", day))
+	assert.Equal(t, "events-20240102.ndjson", EventLogKey("events", day))
+	assert.Equal(t, "events-20240102.log", EventLogKey("events.log", day))
+}
+
+// eventLines parses the NDJSON content of an event log object
+func eventLines(t *testing.T, content string) []Event {
+	t.Helper()
+	var events []Event
+	for _, line := range strings.Split(strings.TrimSuffix(content, "\n"), "\n") {
+		var e Event
+		require.NoError(t, json.Unmarshal([]byte(line), &e))
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestEventLog_Record(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+
+	now := time.Date(2024, 1, 2, 23, 59, 0, 0, time.UTC)
+	log := NewEventLog(mock, DefaultSettings(), "test-bucket", "events.ndjson", 0, PutOptions{})
+	log.now = func() time.Time { return now }
+
+	log.Record(ctx, Event{Event: EventPollStarted})
+	log.Record(ctx, Event{Event: EventMigrationFailed, Prefix: "migrations/", Version: "20240101000000", Error: "boom", ErrorType: ErrorTypeSQLError})
+
+	content, found := mock.GetObjectContent("test-bucket", "events-20240102.ndjson")
+	require.True(t, found)
+	events := eventLines(t, content)
+	require.Len(t, events, 2)
+	assert.Equal(t, EventPollStarted, events[0].Event)
+	assert.Equal(t, "2024-01-02T23:59:00Z", events[0].Time)
+	assert.NotEmpty(t, events[0].Instance)
+	assert.Equal(t, Event{
+		Time: "2024-01-02T23:59:00Z", Event: EventMigrationFailed, Instance: events[0].Instance,
+		Prefix: "migrations/", Version: "20240101000000", Error: "boom", ErrorType: ErrorTypeSQLError,
+	}, events[1])
+
+	// A new day starts a new object
+	now = now.Add(2 * time.Minute)
+	log.Record(ctx, Event{Event: EventPollStarted})
+	content, found = mock.GetObjectContent("test-bucket", "events-20240103.ndjson")
+	require.True(t, found)
+	assert.Len(t, eventLines(t, content), 1)
+
+	// A nil log records nothing
+	var disabled *EventLog
+	disabled.Record(ctx, Event{Event: EventPollStarted})
+}
+
+func TestEventLog_SizeCap(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+
+	log := NewEventLog(mock, DefaultSettings(), "test-bucket", "events.ndjson", 300, PutOptions{})
+	log.now = func() time.Time { return time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC) }
+	for _, version := range []string{"20240101000000", "20240102000000", "20240103000000", "20240104000000"} {
+		log.Record(ctx, Event{Event: EventVersionSelected, Version: version})
+	}
+
+	content, found := mock.GetObjectContent("test-bucket", "events-20240102.ndjson")
+	require.True(t, found)
+	assert.LessOrEqual(t, len(content), 300)
+	events := eventLines(t, content)
+	require.NotEmpty(t, events)
+	assert.Less(t, len(events), 4)
+	assert.Equal(t, "20240104000000", events[len(events)-1].Version)
+}
+
+func TestEventLog_ConcurrentWrite(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+
+	// Another replica's write in between makes the first conditional put fail
+	mock.InjectErrors("PutObject", &smithy.GenericAPIError{Code: "PreconditionFailed"})
+	log := NewEventLog(mock, DefaultSettings(), "test-bucket", "events.ndjson", 0, PutOptions{})
+	log.now = func() time.Time { return time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC) }
+	require.NoError(t, log.append(ctx, Event{Event: EventPollStarted}))
+
+	content, found := mock.GetObjectContent("test-bucket", "events-20240102.ndjson")
+	require.True(t, found)
+	assert.Len(t, eventLines(t, content), 1)
+
+	// Other errors are reported
+	mock.InjectErrors("PutObject", &smithy.GenericAPIError{Code: "AccessDenied"})
+	err := log.append(ctx, Event{Event: EventPollStarted})
+	assert.ErrorContains(t, err, "failed to write event log")
+}
@@ -0,0 +1,94 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/amacneil/dbmate/v2/pkg/dbmate"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Optional SQL objects under a version prefix, run around dbmate up and not recorded in
+// schema_migrations
+const (
+	BeforeHookName = "before.sql"
+	AfterHookName  = "after.sql"
+)
+
+// migrationHooks holds the hook SQL of a version; an empty field means no hook
+type migrationHooks struct {
+	before string
+	after  string
+}
+
+// isHookKey reports whether key is a hook object rather than a migration file
+func isHookKey(key string) bool {
+	name := path.Base(key)
+	return name == BeforeHookName || name == AfterHookName
+}
+
+// downloadHooks reads before.sql and after.sql of a version, skipping those that don't exist
+func downloadHooks(ctx context.Context, client S3API, settings Settings, bucket, prefix, version string) (migrationHooks, error) {
+	var hooks migrationHooks
+	var err error
+	if hooks.before, err = downloadHook(ctx, client, settings, bucket, prefix, version, BeforeHookName); err != nil {
+		return hooks, err
+	}
+	if hooks.after, err = downloadHook(ctx, client, settings, bucket, prefix, version, AfterHookName); err != nil {
+		return hooks, err
+	}
+	return hooks, nil
+}
+
+// downloadHook returns the content of a hook object, or "" if the version has none
+func downloadHook(ctx context.Context, client S3API, settings Settings, bucket, prefix, version, name string) (string, error) {
+	key := path.Join(prefix, version, name)
+
+	resp, err := withS3Retry(ctx, settings.Retry, "GetObject", func() (*s3.GetObjectOutput, error) {
+		return client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "NotFound") || strings.Contains(err.Error(), "NoSuchKey") {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get %s from S3: %w", name, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return string(content), nil
+}
+
+// runHook executes hook SQL on its own connection with the dbmate driver for u and returns
+// the number of affected rows. The connection is closed afterwards, so session settings made
+// by the hook don't reach dbmate's connection.
+func runHook(ctx context.Context, u *url.URL, sqlText string) (int64, error) {
+	drv, err := dbmate.New(u).Driver()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get database driver: %w", err)
+	}
+	sqlDB, err := drv.Open()
+	if err != nil {
+		return 0, fmt.Errorf("failed to open database: %w", err)
+	}
+	defer func() { _ = sqlDB.Close() }()
+
+	res, err := sqlDB.ExecContext(ctx, sqlText)
+	if err != nil {
+		return 0, err
+	}
+	// Not every driver reports affected rows for multi-statement SQL
+	rows, _ := res.RowsAffected()
+	return rows, nil
+}
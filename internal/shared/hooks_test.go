@@ -0,0 +1,42 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared/testhelpers"
+)
+
+func TestDownloadHooks(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+
+	// No hooks
+	hooks, err := downloadHooks(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000")
+	require.NoError(t, err)
+	assert.Equal(t, migrationHooks{}, hooks)
+
+	_, err = mock.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("test-bucket"),
+		Key:    aws.String("migrations/20240101000000/before.sql"),
+		Body:   io.NopCloser(bytes.NewBufferString("SET lock_timeout = '5s';")),
+	})
+	require.NoError(t, err)
+
+	hooks, err = downloadHooks(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000")
+	require.NoError(t, err)
+	assert.Equal(t, "SET lock_timeout = '5s';", hooks.before)
+	assert.Empty(t, hooks.after)
+}
+
+func TestIsMigrationKey_Hooks(t *testing.T) {
+	assert.False(t, isMigrationKey("migrations/20240101000000/before.sql"))
+	assert.False(t, isMigrationKey("migrations/20240101000000/after.sql"))
+	assert.True(t, isMigrationKey("migrations/20240101000000/migrations/001_before.sql"))
+}
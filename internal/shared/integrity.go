@@ -0,0 +1,162 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// FileManifestName is the name of the manifest listing a version's migration files
+const FileManifestName = "files.json"
+
+// Incomplete version policies
+const (
+	IncompletePolicyFail = "fail"
+	IncompletePolicyWarn = "warn"
+)
+
+// FileManifest lists the migration files that make up a version
+type FileManifest struct {
+	Files []string `json:"files"`
+	// VersionIDs maps each file to the S3 VersionId it was uploaded as, when recorded with
+	// push --pin-versions. Downloads are then pinned to exactly these object versions.
+	VersionIDs map[string]string `json:"version_ids,omitempty"`
+}
+
+// UploadFileManifest uploads files.json listing the migration files of a version, with the
+// S3 VersionId of each file if versionIDs is not empty
+func UploadFileManifest(ctx context.Context, client S3API, settings Settings, bucket, prefix, version string, files []string, versionIDs map[string]string, opts PutOptions) error {
+	key := path.Join(prefix, version, FileManifestName)
+
+	sorted := append([]string(nil), files...)
+	sort.Strings(sorted)
+
+	jsonData, err := json.MarshalIndent(&FileManifest{Files: sorted, VersionIDs: versionIDs}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal file manifest: %w", err)
+	}
+
+	_, err = withS3Retry(ctx, settings.Retry, "PutObject", func() (*s3.PutObjectOutput, error) {
+		return client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String(key),
+			Body:                 bytes.NewReader(jsonData),
+			ContentType:          aws.String("application/json"),
+			ServerSideEncryption: opts.serverSideEncryption(),
+			SSEKMSKeyId:          opts.kmsKeyID(),
+			Tagging:              opts.tagging(),
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload file manifest: %w", err)
+	}
+
+	slog.Info("File manifest uploaded", "key", key, "count", len(sorted))
+	return nil
+}
+
+// downloadFileManifest downloads files.json for a version; it returns nil if the manifest doesn't exist
+func downloadFileManifest(ctx context.Context, client S3API, settings Settings, bucket, prefix, version string) (*FileManifest, error) {
+	key := path.Join(prefix, version, FileManifestName)
+
+	resp, err := withS3Retry(ctx, settings.Retry, "GetObject", func() (*s3.GetObjectOutput, error) {
+		return client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "NotFound") || strings.Contains(err.Error(), "NoSuchKey") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get file manifest: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var manifest FileManifest
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse file manifest: %w", err)
+	}
+
+	return &manifest, nil
+}
+
+// CheckMigrationSetComplete verifies that the downloaded files form the complete set for a version.
+// If files.json exists, every listed file must be present. Otherwise, since versions are cumulative,
+// every file of the nearest older version must also be present.
+func CheckMigrationSetComplete(ctx context.Context, client S3API, settings Settings, bucket, prefix, version string, files []string) error {
+	have := make(map[string]bool, len(files))
+	for _, f := range files {
+		have[f] = true
+	}
+
+	manifest, err := downloadFileManifest(ctx, client, settings, bucket, prefix, version)
+	if err != nil {
+		return err
+	}
+
+	var expected []string
+	var source string
+	if manifest != nil {
+		expected = manifest.Files
+		source = FileManifestName
+	} else {
+		previous, err := previousVersion(ctx, client, settings, bucket, prefix, version)
+		if err != nil {
+			return err
+		}
+		if previous == "" {
+			return nil
+		}
+		keys, err := listAllObjects(ctx, client, settings, bucket, settings.migrationsPrefix(prefix, previous))
+		if err != nil {
+			return fmt.Errorf("failed to list migrations of version %s: %w", previous, err)
+		}
+		expected = migrationFileNames(keys)
+		source = "version " + previous
+	}
+
+	var missing []string
+	for _, f := range expected {
+		if !have[f] {
+			missing = append(missing, f)
+		}
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("version %s appears partially pruned/incomplete: missing %s (expected from %s)",
+			version, strings.Join(missing, ", "), source)
+	}
+
+	return nil
+}
+
+// previousVersion returns the nearest version older than the given one, or "" if there is none
+func previousVersion(ctx context.Context, client S3API, settings Settings, bucket, prefix, version string) (string, error) {
+	versions, err := listVersions(ctx, client, settings, bucket, prefix)
+	if err != nil {
+		if errors.Is(err, ErrNoVersions) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	previous := ""
+	for _, v := range versions {
+		if CompareVersions(v, version) >= 0 {
+			break
+		}
+		previous = v
+	}
+	return previous, nil
+}
@@ -0,0 +1,99 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared/testhelpers"
+)
+
+func TestCheckMigrationSetComplete(t *testing.T) {
+	putObject := func(mock *testhelpers.MockS3Client, key, body string) {
+		_, _ = mock.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String(key),
+			Body:   io.NopCloser(bytes.NewBufferString(body)),
+		})
+	}
+
+	tests := []struct {
+		name        string
+		setup       func(*testhelpers.MockS3Client)
+		files       []string
+		expectError string
+	}{
+		{
+			name: "manifest matches downloaded files",
+			setup: func(mock *testhelpers.MockS3Client) {
+				putObject(mock, "migrations/20240102000000/files.json", `{"files":["001_a.sql","002_b.sql"]}`)
+			},
+			files: []string{"001_a.sql", "002_b.sql"},
+		},
+		{
+			name: "manifest lists a missing file",
+			setup: func(mock *testhelpers.MockS3Client) {
+				putObject(mock, "migrations/20240102000000/files.json", `{"files":["001_a.sql","002_b.sql"]}`)
+			},
+			files:       []string{"002_b.sql"},
+			expectError: "version 20240102000000 appears partially pruned/incomplete: missing 001_a.sql (expected from files.json)",
+		},
+		{
+			name: "no manifest, previous version files all present",
+			setup: func(mock *testhelpers.MockS3Client) {
+				putObject(mock, "migrations/20240101000000/migrations/001_a.sql", "a")
+				putObject(mock, "migrations/20240102000000/migrations/001_a.sql", "a")
+				putObject(mock, "migrations/20240102000000/migrations/002_b.sql", "b")
+			},
+			files: []string{"001_a.sql", "002_b.sql"},
+		},
+		{
+			name: "no manifest, file from previous version missing",
+			setup: func(mock *testhelpers.MockS3Client) {
+				putObject(mock, "migrations/20240101000000/migrations/001_a.sql", "a")
+				putObject(mock, "migrations/20240102000000/migrations/002_b.sql", "b")
+			},
+			files:       []string{"002_b.sql"},
+			expectError: "version 20240102000000 appears partially pruned/incomplete: missing 001_a.sql (expected from version 20240101000000)",
+		},
+		{
+			name: "no manifest, no previous version",
+			setup: func(mock *testhelpers.MockS3Client) {
+				putObject(mock, "migrations/20240102000000/migrations/002_b.sql", "b")
+			},
+			files: []string{"002_b.sql"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := testhelpers.NewMockS3Client()
+			tt.setup(mock)
+
+			err := CheckMigrationSetComplete(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "20240102000000", tt.files)
+
+			if tt.expectError != "" {
+				assert.EqualError(t, err, tt.expectError)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestUploadFileManifest(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+
+	err := UploadFileManifest(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000",
+		[]string{"002_b.sql", "001_a.sql"}, nil, PutOptions{})
+	require.NoError(t, err)
+
+	content, found := mock.GetObjectContent("test-bucket", "migrations/20240101000000/files.json")
+	require.True(t, found)
+	assert.JSONEq(t, `{"files":["001_a.sql","002_b.sql"]}`, content)
+}
@@ -0,0 +1,141 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// LeaderFileName is the heartbeat file written at the prefix root by the leading watcher
+const LeaderFileName = "leader.json"
+
+// LeaderHeartbeat is the content of leader.json
+type LeaderHeartbeat struct {
+	InstanceID string `json:"instance_id"`
+	Heartbeat  string `json:"heartbeat"`
+}
+
+// InstanceID identifies this process in lock and leader files
+func InstanceID() string {
+	return lockHolder()
+}
+
+// RefreshLeadership makes instanceID the leader of prefix or renews its heartbeat.
+// It returns true if this instance leads. Another instance's leadership is taken over
+// only once its heartbeat is older than ttl. All writes are conditional on the ETag
+// that was read, so two replicas can't both win a takeover.
+func RefreshLeadership(ctx context.Context, client S3API, settings Settings, bucket, prefix, instanceID string, ttl time.Duration, opts PutOptions) (bool, error) {
+	key := path.Join(prefix, LeaderFileName)
+
+	current, etag, err := readLeaderHeartbeat(ctx, client, settings, bucket, key)
+	if err != nil {
+		return false, err
+	}
+
+	if current != nil && current.InstanceID != instanceID {
+		heartbeat, err := time.Parse(time.RFC3339, current.Heartbeat)
+		if err == nil && time.Since(heartbeat) < ttl {
+			slog.Debug("Another instance is the leader", "leader", current.InstanceID, "heartbeat", current.Heartbeat)
+			return false, nil
+		}
+		slog.Warn("Leader heartbeat is stale, taking over", "leader", current.InstanceID, "heartbeat", current.Heartbeat, "ttl", ttl)
+	}
+
+	jsonData, err := json.MarshalIndent(&LeaderHeartbeat{
+		InstanceID: instanceID,
+		Heartbeat:  time.Now().UTC().Format(time.RFC3339),
+	}, "", "  ")
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal leader heartbeat: %w", err)
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(key),
+		Body:                 bytes.NewReader(jsonData),
+		ContentType:          aws.String("application/json"),
+		ServerSideEncryption: opts.serverSideEncryption(),
+		SSEKMSKeyId:          opts.kmsKeyID(),
+		Tagging:              opts.tagging(),
+	}
+	if current == nil {
+		input.IfNoneMatch = aws.String("*")
+	} else {
+		input.IfMatch = aws.String(etag)
+	}
+
+	if _, err := client.PutObject(ctx, input); err != nil {
+		if strings.Contains(err.Error(), "PreconditionFailed") {
+			slog.Info("Lost the leader election to another instance", "key", key)
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to write leader heartbeat: %w", err)
+	}
+
+	if current == nil || current.InstanceID != instanceID {
+		slog.Info("Became the leader", "key", key, "instance_id", instanceID)
+	}
+	return true, nil
+}
+
+// ReleaseLeadership deletes leader.json if instanceID holds it, so another replica can
+// take over without waiting for the heartbeat to go stale
+func ReleaseLeadership(ctx context.Context, client S3API, settings Settings, bucket, prefix, instanceID string) error {
+	key := path.Join(prefix, LeaderFileName)
+
+	current, _, err := readLeaderHeartbeat(ctx, client, settings, bucket, key)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.InstanceID != instanceID {
+		return nil
+	}
+
+	if _, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}); err != nil {
+		return fmt.Errorf("failed to release leadership: %w", err)
+	}
+
+	slog.Info("Released leadership", "key", key)
+	return nil
+}
+
+// readLeaderHeartbeat downloads leader.json and its ETag; it returns nil if there is no leader.
+// An unreadable file is returned as an empty (stale) heartbeat.
+func readLeaderHeartbeat(ctx context.Context, client S3API, settings Settings, bucket, key string) (*LeaderHeartbeat, string, error) {
+	resp, err := withS3Retry(ctx, settings.Retry, "GetObject", func() (*s3.GetObjectOutput, error) {
+		return client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "NotFound") || strings.Contains(err.Error(), "NoSuchKey") {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("failed to read leader heartbeat: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read leader heartbeat: %w", err)
+	}
+
+	var heartbeat LeaderHeartbeat
+	if err := json.Unmarshal(body, &heartbeat); err != nil {
+		return &LeaderHeartbeat{}, aws.ToString(resp.ETag), nil
+	}
+	return &heartbeat, aws.ToString(resp.ETag), nil
+}
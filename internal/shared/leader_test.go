@@ -0,0 +1,71 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared/testhelpers"
+)
+
+func TestRefreshLeadership(t *testing.T) {
+	ctx := context.Background()
+	mock := testhelpers.NewMockS3Client()
+
+	leader, err := RefreshLeadership(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "a", time.Minute, PutOptions{})
+	require.NoError(t, err)
+	assert.True(t, leader)
+	assert.True(t, mock.HasObject("test-bucket", "migrations/leader.json"))
+
+	// The leader renews its own heartbeat
+	leader, err = RefreshLeadership(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "a", time.Minute, PutOptions{})
+	require.NoError(t, err)
+	assert.True(t, leader)
+
+	// Another replica stands by while the heartbeat is fresh
+	leader, err = RefreshLeadership(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "b", time.Minute, PutOptions{})
+	require.NoError(t, err)
+	assert.False(t, leader)
+
+	// Only the leader can release leadership
+	require.NoError(t, ReleaseLeadership(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "b"))
+	assert.True(t, mock.HasObject("test-bucket", "migrations/leader.json"))
+	require.NoError(t, ReleaseLeadership(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "a"))
+	assert.False(t, mock.HasObject("test-bucket", "migrations/leader.json"))
+
+	leader, err = RefreshLeadership(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "b", time.Minute, PutOptions{})
+	require.NoError(t, err)
+	assert.True(t, leader)
+}
+
+func TestRefreshLeadership_StaleTakeover(t *testing.T) {
+	ctx := context.Background()
+	mock := testhelpers.NewMockS3Client()
+
+	data, err := json.Marshal(&LeaderHeartbeat{
+		InstanceID: "a",
+		Heartbeat:  time.Now().Add(-time.Hour).UTC().Format(time.RFC3339),
+	})
+	require.NoError(t, err)
+	_, err = mock.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("test-bucket"),
+		Key:    aws.String("migrations/leader.json"),
+		Body:   bytes.NewReader(data),
+	})
+	require.NoError(t, err)
+
+	leader, err := RefreshLeadership(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "b", time.Minute, PutOptions{})
+	require.NoError(t, err)
+	assert.True(t, leader)
+
+	// The old leader comes back and finds it was replaced
+	leader, err = RefreshLeadership(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "a", time.Minute, PutOptions{})
+	require.NoError(t, err)
+	assert.False(t, leader)
+}
@@ -0,0 +1,171 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// VersionLock is the content of lock.json, held while a version is being applied
+type VersionLock struct {
+	Holder     string `json:"holder"`
+	AcquiredAt string `json:"acquired_at"`
+	ExpiresAt  string `json:"expires_at"`
+}
+
+// lockHolder identifies this process in lock.json
+func lockHolder() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s/%d", hostname, os.Getpid())
+}
+
+// AcquireVersionLock creates version/lock.json with an If-None-Match precondition so only one
+// deployer applies a version at a time. It returns false if another holder has a fresh lock.
+// A lock older than its TTL is considered stale and is taken over with an If-Match
+// precondition on its ETag, so that only one of several deployers racing for it wins.
+// It also returns the ETag of the written lock, which ReleaseVersionLock deletes it by.
+func AcquireVersionLock(ctx context.Context, client S3API, bucket, prefix, version string, ttl time.Duration, opts PutOptions) (bool, string, error) {
+	key := path.Join(prefix, version, "lock.json")
+
+	now := time.Now().UTC()
+	lock := &VersionLock{
+		Holder:     lockHolder(),
+		AcquiredAt: now.Format(time.RFC3339),
+		ExpiresAt:  now.Add(ttl).Format(time.RFC3339),
+	}
+	jsonData, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return false, "", fmt.Errorf("failed to marshal lock: %w", err)
+	}
+
+	// One retry if the lock is released between our PutObject and GetObject
+	for attempt := 0; attempt < 2; attempt++ {
+		out, err := client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String(key),
+			Body:                 bytes.NewReader(jsonData),
+			ContentType:          aws.String("application/json"),
+			IfNoneMatch:          aws.String("*"),
+			ServerSideEncryption: opts.serverSideEncryption(),
+			SSEKMSKeyId:          opts.kmsKeyID(),
+			Tagging:              opts.tagging(),
+		})
+		if err == nil {
+			slog.Info("Acquired version lock", "key", key, "holder", lock.Holder, "expires_at", lock.ExpiresAt)
+			return true, aws.ToString(out.ETag), nil
+		}
+		if !isPreconditionFailed(err) {
+			return false, "", fmt.Errorf("failed to acquire lock: %w", err)
+		}
+
+		existing, etag, err := readVersionLock(ctx, client, bucket, key)
+		if err != nil {
+			return false, "", err
+		}
+		if existing == nil {
+			continue
+		}
+		expiresAt, err := time.Parse(time.RFC3339, existing.ExpiresAt)
+		if err == nil && time.Now().Before(expiresAt) {
+			slog.Info("Version is locked by another deployer", "key", key, "holder", existing.Holder, "expires_at", existing.ExpiresAt)
+			return false, "", nil
+		}
+
+		// Overwrite the stale lock only if nobody has replaced it since we read it
+		slog.Warn("Taking over stale version lock", "key", key, "holder", existing.Holder, "expires_at", existing.ExpiresAt)
+		out, err = client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String(key),
+			Body:                 bytes.NewReader(jsonData),
+			ContentType:          aws.String("application/json"),
+			IfMatch:              aws.String(etag),
+			ServerSideEncryption: opts.serverSideEncryption(),
+			SSEKMSKeyId:          opts.kmsKeyID(),
+			Tagging:              opts.tagging(),
+		})
+		if err != nil {
+			if isPreconditionFailed(err) {
+				slog.Info("Stale version lock was taken over by another deployer", "key", key)
+				return false, "", nil
+			}
+			return false, "", fmt.Errorf("failed to take over stale lock: %w", err)
+		}
+		slog.Info("Acquired version lock", "key", key, "holder", lock.Holder, "expires_at", lock.ExpiresAt)
+		return true, aws.ToString(out.ETag), nil
+	}
+
+	return false, "", nil
+}
+
+// ReleaseVersionLock deletes version/lock.json if it is still the lock written with etag. A
+// holder that outlived its TTL may have been taken over by another deployer meanwhile; that
+// deployer's lock is left in place.
+func ReleaseVersionLock(ctx context.Context, client S3API, bucket, prefix, version, etag string) error {
+	key := path.Join(prefix, version, "lock.json")
+
+	input := &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if etag != "" {
+		input.IfMatch = aws.String(etag)
+	}
+	if _, err := client.DeleteObject(ctx, input); err != nil {
+		if isPreconditionFailed(err) {
+			slog.Warn("Version lock was taken over by another deployer, leaving it in place", "key", key)
+			return nil
+		}
+		return fmt.Errorf("failed to release lock: %w", err)
+	}
+
+	slog.Info("Released version lock", "key", key)
+	return nil
+}
+
+// readVersionLock downloads and parses an existing lock.json and its ETag; it returns nil if the lock is gone
+func readVersionLock(ctx context.Context, client S3API, bucket, key string) (*VersionLock, string, error) {
+	resp, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "NotFound") || strings.Contains(err.Error(), "NoSuchKey") {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("failed to read existing lock: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read existing lock: %w", err)
+	}
+
+	var lock VersionLock
+	if err := json.Unmarshal(body, &lock); err != nil {
+		// An unreadable lock is treated as stale
+		return &VersionLock{}, aws.ToString(resp.ETag), nil
+	}
+	return &lock, aws.ToString(resp.ETag), nil
+}
+
+// isPreconditionFailed reports whether err is S3 rejecting a conditional write
+func isPreconditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed"
+}
@@ -0,0 +1,141 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared/testhelpers"
+)
+
+func TestAcquireVersionLock(t *testing.T) {
+	ctx := context.Background()
+	mock := testhelpers.NewMockS3Client()
+
+	acquired, etag, err := AcquireVersionLock(ctx, mock, "test-bucket", "migrations/", "20240101000000", time.Minute, PutOptions{})
+	require.NoError(t, err)
+	assert.True(t, acquired)
+	assert.NotEmpty(t, etag)
+	assert.True(t, mock.HasObject("test-bucket", "migrations/20240101000000/lock.json"))
+
+	// A second deployer sees the fresh lock and backs off
+	acquired, _, err = AcquireVersionLock(ctx, mock, "test-bucket", "migrations/", "20240101000000", time.Minute, PutOptions{})
+	require.NoError(t, err)
+	assert.False(t, acquired)
+
+	// After release the lock can be taken again
+	require.NoError(t, ReleaseVersionLock(ctx, mock, "test-bucket", "migrations/", "20240101000000", etag))
+	assert.False(t, mock.HasObject("test-bucket", "migrations/20240101000000/lock.json"))
+
+	acquired, _, err = AcquireVersionLock(ctx, mock, "test-bucket", "migrations/", "20240101000000", time.Minute, PutOptions{})
+	require.NoError(t, err)
+	assert.True(t, acquired)
+}
+
+func TestReleaseVersionLock_TakenOver(t *testing.T) {
+	ctx := context.Background()
+	mock := testhelpers.NewMockS3Client()
+
+	acquired, etag, err := AcquireVersionLock(ctx, mock, "test-bucket", "migrations/", "20240101000000", time.Minute, PutOptions{})
+	require.NoError(t, err)
+	require.True(t, acquired)
+
+	// Another deployer took over the lock after it went stale
+	_, err = mock.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("test-bucket"),
+		Key:    aws.String("migrations/20240101000000/lock.json"),
+		Body:   bytes.NewReader([]byte(`{"holder": "other-host/2"}`)),
+	})
+	require.NoError(t, err)
+
+	// The late release leaves the new holder's lock in place
+	require.NoError(t, ReleaseVersionLock(ctx, mock, "test-bucket", "migrations/", "20240101000000", etag))
+	content, found := mock.GetObjectContent("test-bucket", "migrations/20240101000000/lock.json")
+	require.True(t, found)
+	assert.Contains(t, content, "other-host/2")
+}
+
+func TestAcquireVersionLock_Stale(t *testing.T) {
+	ctx := context.Background()
+	mock := testhelpers.NewMockS3Client()
+
+	// A lock left behind by a crashed deployer
+	stale, err := json.Marshal(&VersionLock{
+		Holder:     "crashed-host/1",
+		AcquiredAt: time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339),
+		ExpiresAt:  time.Now().Add(-time.Hour).UTC().Format(time.RFC3339),
+	})
+	require.NoError(t, err)
+	_, _ = mock.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("test-bucket"),
+		Key:    aws.String("migrations/20240101000000/lock.json"),
+		Body:   bytes.NewReader(stale),
+	})
+
+	acquired, etag, err := AcquireVersionLock(ctx, mock, "test-bucket", "migrations/", "20240101000000", time.Minute, PutOptions{})
+	require.NoError(t, err)
+	assert.True(t, acquired)
+
+	// The taken-over lock is released by its new ETag
+	content, found := mock.GetObjectContent("test-bucket", "migrations/20240101000000/lock.json")
+	require.True(t, found)
+	assert.NotContains(t, content, "crashed-host/1")
+	require.NoError(t, ReleaseVersionLock(ctx, mock, "test-bucket", "migrations/", "20240101000000", etag))
+	assert.False(t, mock.HasObject("test-bucket", "migrations/20240101000000/lock.json"))
+}
+
+// raceS3Client runs beforeTakeover once, after the stale lock has been read
+type raceS3Client struct {
+	*testhelpers.MockS3Client
+	beforeTakeover func()
+}
+
+func (c *raceS3Client) GetObject(ctx context.Context, input *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	out, err := c.MockS3Client.GetObject(ctx, input, optFns...)
+	if hook := c.beforeTakeover; hook != nil {
+		c.beforeTakeover = nil
+		hook()
+	}
+	return out, err
+}
+
+func TestAcquireVersionLock_StaleRace(t *testing.T) {
+	ctx := context.Background()
+	mock := testhelpers.NewMockS3Client()
+
+	stale, err := json.Marshal(&VersionLock{
+		Holder:     "crashed-host/1",
+		AcquiredAt: time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339),
+		ExpiresAt:  time.Now().Add(-time.Hour).UTC().Format(time.RFC3339),
+	})
+	require.NoError(t, err)
+	_, _ = mock.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("test-bucket"),
+		Key:    aws.String("migrations/20240101000000/lock.json"),
+		Body:   bytes.NewReader(stale),
+	})
+
+	// Replica A takes over the stale lock after replica B has read it, but before B overwrites it
+	var acquiredA bool
+	client := &raceS3Client{MockS3Client: mock}
+	client.beforeTakeover = func() {
+		var err error
+		acquiredA, _, err = AcquireVersionLock(ctx, mock, "test-bucket", "migrations/", "20240101000000", time.Minute, PutOptions{})
+		require.NoError(t, err)
+	}
+
+	acquiredB, _, err := AcquireVersionLock(ctx, client, "test-bucket", "migrations/", "20240101000000", time.Minute, PutOptions{})
+	require.NoError(t, err)
+	assert.True(t, acquiredA)
+	assert.False(t, acquiredB, "only one replica may take over a stale lock")
+
+	content, found := mock.GetObjectContent("test-bucket", "migrations/20240101000000/lock.json")
+	require.True(t, found)
+	assert.NotContains(t, content, "crashed-host/1")
+}
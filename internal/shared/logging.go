@@ -0,0 +1,66 @@
+package shared
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultLogTimestampFormat is the time layout of the lines in the migration log stored in results
+const DefaultLogTimestampFormat = "2006-01-02 15:04:05 UTC"
+
+// ValidateLogTimestampFormat checks that layout is a Go time layout usable for the timestamps
+// of the migration log captured in Result.Log (see MigrationOptions.LogTimestampFormat)
+func ValidateLogTimestampFormat(layout string) error {
+	// A layout without any time fields formats every time as the layout itself
+	sample := time.Date(2024, time.December, 31, 23, 59, 58, 123456789, time.UTC)
+	if layout == "" || sample.Format(layout) == layout {
+		return fmt.Errorf("invalid log timestamp format %q: must be a Go time layout such as %q", layout, time.RFC3339)
+	}
+	return nil
+}
+
+// logLine formats msg as a line of the migration log captured in Result.Log, with a UTC
+// timestamp in layout (DefaultLogTimestampFormat if empty)
+func logLine(layout, msg string) string {
+	if layout == "" {
+		layout = DefaultLogTimestampFormat
+	}
+	return fmt.Sprintf("[%s] %s\n", time.Now().UTC().Format(layout), msg)
+}
+
+// SetupLogging installs a text or JSON slog handler as the default logger. The returned
+// level can be changed later to adjust the minimum level at runtime.
+func SetupLogging(format, level string) (*slog.LevelVar, error) {
+	parsed, err := ParseLogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(parsed)
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch format {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	case "text", "":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q: must be text or json", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return logLevel, nil
+}
+
+// ParseLogLevel parses a log level name (debug, info, warn, error)
+func ParseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.ToUpper(name))); err != nil {
+		return 0, fmt.Errorf("invalid log level %q: must be debug, info, warn or error", name)
+	}
+	return level, nil
+}
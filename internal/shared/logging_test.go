@@ -0,0 +1,65 @@
+package shared
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected slog.Level
+	}{
+		{"debug", slog.LevelDebug},
+		{"info", slog.LevelInfo},
+		{"WARN", slog.LevelWarn},
+		{"error", slog.LevelError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			level, err := ParseLogLevel(tt.name)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, level)
+		})
+	}
+
+	_, err := ParseLogLevel("verbose")
+	assert.EqualError(t, err, `invalid log level "verbose": must be debug, info, warn or error`)
+}
+
+func TestSetupLogging(t *testing.T) {
+	original := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(original) })
+
+	level, err := SetupLogging("json", "warn")
+	require.NoError(t, err)
+	assert.True(t, slog.Default().Enabled(context.Background(), slog.LevelWarn))
+	assert.False(t, slog.Default().Enabled(context.Background(), slog.LevelInfo))
+
+	// Runtime level changes apply to the installed handler
+	level.Set(slog.LevelDebug)
+	assert.True(t, slog.Default().Enabled(context.Background(), slog.LevelDebug))
+
+	_, err = SetupLogging("xml", "info")
+	assert.EqualError(t, err, `invalid log format "xml": must be text or json`)
+}
+
+func TestLogLine(t *testing.T) {
+	assert.Regexp(t, `^\[\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2} UTC\] hello\n$`, logLine("", "hello"))
+	assert.Regexp(t, `^\[\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}\.\d{3}Z\] hello\n$`, logLine("2006-01-02T15:04:05.000Z07:00", "hello"))
+}
+
+func TestValidateLogTimestampFormat(t *testing.T) {
+	require.NoError(t, ValidateLogTimestampFormat("2006-01-02T15:04:05.000Z07:00"))
+
+	// Layouts without time fields are refused
+	for _, layout := range []string{"", "timestamp"} {
+		err := ValidateLogTimestampFormat(layout)
+		assert.ErrorContains(t, err, "invalid log timestamp format")
+	}
+}
@@ -1,76 +1,216 @@
 package shared
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
 	"net/http"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
 )
 
-var (
-	migrationAttempts = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "dbmate_migration_attempts_total",
-			Help: "Total number of migration attempts",
-		},
-		[]string{"status"}, // success, failed
-	)
+// Metrics holds the migration collectors. Each command creates its own with NewMetrics,
+// so nothing is registered globally and several instances can coexist (e.g. in tests).
+// Every series carries a prefix label naming the migration stream (S3 path prefix).
+type Metrics struct {
+	migrationAttempts      *prometheus.CounterVec
+	migrationDuration      *prometheus.HistogramVec
+	migrationFileDuration  *prometheus.HistogramVec
+	lastMigrationTimestamp *prometheus.GaugeVec
+	migrationInProgress    *prometheus.GaugeVec
+	migrationStarted       *prometheus.GaugeVec
+	pendingVersions        *prometheus.GaugeVec
+	currentVersion         *prometheus.GaugeVec
+	polls                  *prometheus.CounterVec
 
-	migrationDuration = promauto.NewHistogram(
-		prometheus.HistogramOpts{
-			Name:    "dbmate_migration_duration_seconds",
-			Help:    "Duration of migration execution in seconds",
-			Buckets: prometheus.DefBuckets,
-		},
-	)
+	// prefix is the value of the prefix label recorded by this instance
+	prefix string
+}
 
-	lastMigrationTimestamp = promauto.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "dbmate_last_migration_timestamp",
-			Help: "Timestamp of the last migration (unix seconds)",
-		},
-	)
+// NewMetrics creates the migration collectors and registers them with reg
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	factory := promauto.With(reg)
+	return &Metrics{
+		migrationAttempts: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "dbmate_migration_attempts_total",
+				Help: "Total number of migration attempts",
+			},
+			[]string{"prefix", "status", "error_type"}, // status: success, failed; error_type: empty on success
+		),
+
+		migrationDuration: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "dbmate_migration_duration_seconds",
+				Help:    "Duration of migration execution in seconds",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"prefix"},
+		),
+
+		migrationFileDuration: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "dbmate_migration_file_duration_seconds",
+				Help:    "Duration of each migration file in seconds",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"prefix", "file"},
+		),
+
+		lastMigrationTimestamp: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "dbmate_last_migration_timestamp",
+				Help: "Timestamp of the last migration (unix seconds)",
+			},
+			[]string{"prefix"},
+		),
+
+		migrationInProgress: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "dbmate_migration_in_progress",
+				Help: "1 while a migration is running, 0 otherwise",
+			},
+			[]string{"prefix"},
+		),
+
+		migrationStarted: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "dbmate_migration_started_timestamp",
+				Help: "Timestamp at which the last migration started (unix seconds)",
+			},
+			[]string{"prefix"},
+		),
 
-	currentVersion = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "dbmate_current_version",
-			Help: "Current migration version (labeled by version)",
-		},
-		[]string{"version"},
+		pendingVersions: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "dbmate_pending_versions",
+				Help: "Number of versions without a result file as of the last check",
+			},
+			[]string{"prefix"},
+		),
+
+		currentVersion: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "dbmate_current_version",
+				Help: "Current migration version (labeled by version)",
+			},
+			[]string{"prefix", "version"},
+		),
+
+		polls: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "dbmate_poll_total",
+				Help: "Total number of watch polls for unapplied versions",
+			},
+			[]string{"prefix", "outcome"}, // outcome: applied, noop, error
+		),
+	}
+}
+
+// WithPrefix returns metrics sharing m's collectors that record under the prefix label
+func (m *Metrics) WithPrefix(prefix string) *Metrics {
+	withPrefix := *m
+	withPrefix.prefix = prefix
+	return &withPrefix
+}
+
+// NewMetricsRegistry returns a registry with the Go runtime and process collectors,
+// matching what the default registry exposes
+func NewMetricsRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 	)
-)
+	return registry
+}
 
-// RecordMigrationAttempt records a migration attempt
-func RecordMigrationAttempt(status string) {
-	migrationAttempts.WithLabelValues(status).Inc()
+// RecordMigrationAttempt records a migration attempt with the Result.ErrorType of a failure
+func (m *Metrics) RecordMigrationAttempt(status, errorType string) {
+	m.migrationAttempts.WithLabelValues(m.prefix, status, errorType).Inc()
 }
 
 // RecordMigrationDuration records the migration duration
-func RecordMigrationDuration(seconds float64) {
-	migrationDuration.Observe(seconds)
+func (m *Metrics) RecordMigrationDuration(seconds float64) {
+	m.migrationDuration.WithLabelValues(m.prefix).Observe(seconds)
+}
+
+// RecordMigrationFileDurations records the duration of each migration file
+func (m *Metrics) RecordMigrationFileDurations(durations map[string]float64) {
+	for file, seconds := range durations {
+		m.migrationFileDuration.WithLabelValues(m.prefix, file).Observe(seconds)
+	}
 }
 
 // RecordLastMigrationTimestamp records the last migration timestamp
-func RecordLastMigrationTimestamp(timestamp float64) {
-	lastMigrationTimestamp.Set(timestamp)
+func (m *Metrics) RecordLastMigrationTimestamp(timestamp float64) {
+	m.lastMigrationTimestamp.WithLabelValues(m.prefix).Set(timestamp)
+}
+
+// RecordMigrationStarted marks a migration as in progress, started at timestamp
+func (m *Metrics) RecordMigrationStarted(timestamp float64) {
+	m.migrationStarted.WithLabelValues(m.prefix).Set(timestamp)
+	m.migrationInProgress.WithLabelValues(m.prefix).Set(1)
+}
+
+// RecordMigrationFinished marks the running migration as finished, whatever its outcome
+func (m *Metrics) RecordMigrationFinished() {
+	m.migrationInProgress.WithLabelValues(m.prefix).Set(0)
+}
+
+// RecordPendingVersions records the number of versions waiting to be applied
+func (m *Metrics) RecordPendingVersions(n float64) {
+	m.pendingVersions.WithLabelValues(m.prefix).Set(n)
 }
 
 // RecordCurrentVersion records the current version
-func RecordCurrentVersion(version string) {
-	// Reset all version gauges
-	currentVersion.Reset()
+func (m *Metrics) RecordCurrentVersion(version string) {
+	// Reset the version gauges of this prefix
+	m.currentVersion.DeletePartialMatch(prometheus.Labels{"prefix": m.prefix})
 	// Set the current version to 1
-	currentVersion.WithLabelValues(version).Set(1)
+	m.currentVersion.WithLabelValues(m.prefix, version).Set(1)
+}
+
+// RecordPoll records the outcome of a watch poll: "applied" when versions were applied,
+// "noop" when there was nothing to do and "error" when the check or a migration failed
+func (m *Metrics) RecordPoll(outcome string) {
+	m.polls.WithLabelValues(m.prefix, outcome).Inc()
+}
+
+// Push pushes the migration metrics to a Prometheus Pushgateway, for runs that exit
+// before they can be scraped. The S3 prefix is part of the grouping key so that jobs for
+// different prefixes don't overwrite each other.
+func (m *Metrics) Push(ctx context.Context, pushgatewayURL, job, s3Prefix string) error {
+	err := push.New(pushgatewayURL, job).
+		Collector(m.migrationAttempts).
+		Collector(m.migrationDuration).
+		Collector(m.migrationFileDuration).
+		Collector(m.lastMigrationTimestamp).
+		Collector(m.migrationInProgress).
+		Collector(m.migrationStarted).
+		Collector(m.pendingVersions).
+		Collector(m.currentVersion).
+		Grouping("s3_prefix", s3Prefix).
+		PushContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to push metrics to %s: %w", pushgatewayURL, err)
+	}
+
+	slog.Info("Metrics pushed to Pushgateway", "url", pushgatewayURL, "job", job, "s3_prefix", s3Prefix)
+	return nil
 }
 
-// StartMetricsServer starts the Prometheus metrics HTTP server
-func StartMetricsServer(addr string) {
-	http.Handle("/metrics", promhttp.Handler())
+// StartMetricsServer starts the Prometheus metrics HTTP server for the metrics in gatherer
+func StartMetricsServer(addr string, gatherer prometheus.Gatherer) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
 	slog.Info("Starting metrics server", "addr", addr)
 
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	if err := http.ListenAndServe(addr, mux); err != nil {
 		slog.Error("Metrics server failed", "error", err)
 	}
 }
@@ -0,0 +1,132 @@
+package shared
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordPendingVersions(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry()).WithPrefix("migrations/")
+
+	metrics.RecordPendingVersions(3)
+	assert.Equal(t, 3.0, testutil.ToFloat64(metrics.pendingVersions.WithLabelValues("migrations/")))
+
+	metrics.RecordPendingVersions(0)
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.pendingVersions.WithLabelValues("migrations/")))
+}
+
+func TestRecordMigrationStartedAndFinished(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry()).WithPrefix("migrations/")
+
+	metrics.RecordMigrationStarted(1700000000)
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.migrationInProgress.WithLabelValues("migrations/")))
+	assert.Equal(t, 1700000000.0, testutil.ToFloat64(metrics.migrationStarted.WithLabelValues("migrations/")))
+
+	metrics.RecordMigrationFinished()
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.migrationInProgress.WithLabelValues("migrations/")))
+	assert.Equal(t, 1700000000.0, testutil.ToFloat64(metrics.migrationStarted.WithLabelValues("migrations/")))
+}
+
+func TestRecordPoll(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry())
+
+	metrics.RecordPoll("noop")
+	metrics.RecordPoll("noop")
+	metrics.RecordPoll("applied")
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.polls.WithLabelValues("", "noop")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.polls.WithLabelValues("", "applied")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.polls.WithLabelValues("", "error")))
+}
+
+func TestMetrics_WithPrefix(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry())
+	app := metrics.WithPrefix("app-migrations/")
+	analytics := metrics.WithPrefix("analytics-migrations/")
+
+	// Each stream keeps its own current version
+	app.RecordCurrentVersion("20240101000000")
+	analytics.RecordCurrentVersion("20240201000000")
+	app.RecordCurrentVersion("20240102000000")
+	assert.Equal(t, 2, testutil.CollectAndCount(metrics.currentVersion))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.currentVersion.WithLabelValues("app-migrations/", "20240102000000")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.currentVersion.WithLabelValues("analytics-migrations/", "20240201000000")))
+
+	app.RecordPoll("error")
+	analytics.RecordPoll("applied")
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.polls.WithLabelValues("app-migrations/", "error")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.polls.WithLabelValues("analytics-migrations/", "applied")))
+}
+
+func TestNewMetrics_SeparateRegistries(t *testing.T) {
+	// Each registry gets its own collectors instead of a duplicate-registration panic
+	first := NewMetrics(prometheus.NewRegistry())
+	second := NewMetrics(prometheus.NewRegistry())
+
+	first.RecordMigrationAttempt("success", "")
+	assert.Equal(t, 1.0, testutil.ToFloat64(first.migrationAttempts.WithLabelValues("", "success", "")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(second.migrationAttempts.WithLabelValues("", "success", "")))
+
+	// Registering twice with the same registry is still a programming error
+	registry := prometheus.NewRegistry()
+	NewMetrics(registry)
+	assert.Panics(t, func() { NewMetrics(registry) })
+}
+
+func TestNewMetricsRegistry(t *testing.T) {
+	registry := NewMetricsRegistry()
+	// Series appear once a prefix has recorded them
+	NewMetrics(registry).WithPrefix("migrations/").RecordPendingVersions(0)
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	var names []string
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	assert.Contains(t, names, "go_goroutines")
+	assert.Contains(t, names, "dbmate_pending_versions")
+}
+
+func TestPushMetrics(t *testing.T) {
+	var path, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		path = r.URL.Path
+		data, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		body = string(data)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	metrics := NewMetrics(prometheus.NewRegistry())
+	metrics.RecordMigrationAttempt("success", "")
+	metrics.RecordCurrentVersion("20240101000000")
+
+	err := metrics.Push(context.Background(), server.URL, "dbmate-deployer", "migrations/")
+	require.NoError(t, err)
+
+	// Label values containing "/" are base64 encoded by the push package
+	assert.Equal(t, "/metrics/job/dbmate-deployer/s3_prefix@base64/bWlncmF0aW9ucy8", path)
+	assert.Contains(t, body, "dbmate_migration_attempts_total")
+	assert.Contains(t, body, "dbmate_current_version")
+}
+
+func TestPushMetrics_ServerError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	err := NewMetrics(prometheus.NewRegistry()).Push(context.Background(), server.URL, "dbmate-deployer", "migrations/")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to push metrics")
+}
@@ -3,56 +3,163 @@ package shared
 import (
 	"bytes"
 	"context"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
+	"net"
 	"net/url"
 	"os"
 	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/amacneil/dbmate/v2/pkg/dbmate"
+	_ "github.com/amacneil/dbmate/v2/pkg/driver/mysql"
 	_ "github.com/amacneil/dbmate/v2/pkg/driver/postgres"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// RollbackResultFile is the name of the file recording the outcome of a rollback
+const RollbackResultFile = "rollback-result.json"
+
+// supportedDatabaseSchemes are the DATABASE_URL schemes of the dbmate drivers imported above
+var supportedDatabaseSchemes = []string{"mysql", "postgres", "postgresql", "redshift"}
+
+// DefaultMigrationsTable is the table dbmate records applied migrations in by default
+const DefaultMigrationsTable = "schema_migrations"
+
+// migrationsTablePattern accepts a plain or schema-qualified identifier, which dbmate
+// interpolates into its SQL without further escaping
+var migrationsTablePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// ValidateMigrationsTable checks the name of the table dbmate records applied migrations in
+// (see MigrationOptions.MigrationsTable). The name may be schema-qualified (schema.table,
+// PostgreSQL) and is limited to letters, digits and underscores.
+func ValidateMigrationsTable(name string) error {
+	if !migrationsTablePattern.MatchString(name) {
+		return fmt.Errorf("invalid migrations table %q: use letters, digits and underscores, optionally as schema.table", name)
+	}
+	return nil
+}
+
+// newDB returns a dbmate instance for u that records migrations in table
+// (DefaultMigrationsTable if empty)
+func newDB(u *url.URL, table string) *dbmate.DB {
+	db := dbmate.New(u)
+	if table != "" {
+		db.MigrationsTableName = table
+	}
+	return db
+}
+
+// Error types recorded in Result.ErrorType, to tell infrastructure from SQL failures
+const (
+	ErrorTypeDownloadFailed   = "download_failed"
+	ErrorTypeSQLError         = "sql_error"
+	ErrorTypeConnectionFailed = "connection_failed"
+	ErrorTypeTimeout          = "timeout"
+	ErrorTypeValidationFailed = "validation_failed"
+)
+
+// connectionErrorMessages are fragments of driver errors raised before any SQL ran
+var connectionErrorMessages = []string{
+	"connection refused",
+	"connection reset",
+	"no such host",
+	"dial tcp",
+	"password authentication failed",
+	"Access denied for user",
+	"too many connections",
+	"the database system is starting up",
+}
+
+// embeddedSQLWarnBytes is the total embedded SQL size above which a warning is logged
+const embeddedSQLWarnBytes = 256 * 1024
+
+// MigrationOptions holds optional settings for ExecuteMigration
+type MigrationOptions struct {
+	// EmbedSQL embeds the content of each migration file in Result.AppliedSQL
+	EmbedSQL bool
+	// EmbedSQLMaxBytes truncates each embedded file to this many bytes (0 means no limit)
+	EmbedSQLMaxBytes int
+	// IncompletePolicy decides what to do with an incomplete migration set: "fail" (default) or "warn"
+	IncompletePolicy string
+	// DownloadConcurrency is the number of parallel migration file downloads (0 means DefaultDownloadConcurrency)
+	DownloadConcurrency int
+	// Timeout aborts waiting for dbmate after this long and fails the result (0 means no limit)
+	Timeout time.Duration
+	// DryRun downloads and inspects the migrations without running dbmate; the result status is "dry-run"
+	DryRun bool
+	// WorkDir is the parent of the temporary migrations directory (the OS temp directory if empty)
+	WorkDir string
+	// DeployerVersion is the dbmate-deployer build applying the version, recorded in Result.DeployerVersion
+	DeployerVersion string
+	// DumpSchema dumps the database schema into Result.Schema after a successful migration
+	DumpSchema bool
+	// FailOnDirty refuses to migrate, with status "dirty", when schema_migrations records
+	// versions that are not among the migration files
+	FailOnDirty bool
+	// LogWriter, if set, also receives the migration log as it is written, e.g. a ProgressLog
+	LogWriter io.Writer
+	// MigrationsTable is the table dbmate records applied migrations in, so that apps sharing
+	// a database can track their migrations separately (DefaultMigrationsTable if empty)
+	MigrationsTable string
+	// LogTimestampFormat is the Go time layout of the timestamps in Result.Log, always in UTC
+	// (DefaultLogTimestampFormat if empty)
+	LogTimestampFormat string
+}
+
 // ExecuteMigration executes database migration for a specific version
-func ExecuteMigration(ctx context.Context, client *s3.Client, bucket, prefix, version, databaseURL string) *Result {
+func ExecuteMigration(ctx context.Context, client *s3.Client, settings Settings, bucket, prefix, version, databaseURL string, opts MigrationOptions) *Result {
 	timestamp := time.Now().UTC().Format(time.RFC3339)
 	var logBuffer bytes.Buffer
 
 	result := &Result{
-		Version:   version,
-		Timestamp: timestamp,
+		Version:         version,
+		Timestamp:       timestamp,
+		DeployerVersion: opts.DeployerVersion,
 	}
 
+	logOut := migrationLogWriter(&logBuffer, opts.LogWriter)
 	log := func(msg string) {
-		line := fmt.Sprintf("[%s] %s\n", time.Now().UTC().Format("2006-01-02 15:04:05 UTC"), msg)
-		logBuffer.WriteString(line)
+		_, _ = io.WriteString(logOut, logLine(opts.LogTimestampFormat, msg))
 		slog.Info(msg)
 	}
 
 	log("=== Starting database migration ===")
 	log(fmt.Sprintf("Version: %s", version))
+	if opts.DeployerVersion != "" {
+		log(fmt.Sprintf("Deployer version: %s", opts.DeployerVersion))
+	}
 
 	// Create temporary migrations directory
-	migrationsDir, err := os.MkdirTemp("", "migrations-*")
+	migrationsDir, err := os.MkdirTemp(opts.WorkDir, "migrations-*")
 	if err != nil {
 		result.Status = "failed"
 		result.Error = fmt.Sprintf("Failed to create temp directory: %v", err)
+		result.ErrorType = ErrorTypeDownloadFailed
 		result.Log = logBuffer.String()
 		return result
 	}
 	defer func() { _ = os.RemoveAll(migrationsDir) }()
 
 	// Download migrations from S3
-	migrationsPrefix := path.Join(prefix, version, "migrations") + "/"
-	log(fmt.Sprintf("Downloading migrations from s3://%s/%s", bucket, migrationsPrefix))
+	versionMigrationsPrefix := settings.migrationsPrefix(prefix, version)
+	log(fmt.Sprintf("Downloading migrations from s3://%s/%s", bucket, versionMigrationsPrefix))
 
-	if err := DownloadMigrations(ctx, client, bucket, migrationsPrefix, migrationsDir); err != nil {
+	if err := DownloadVersionMigrations(ctx, client, settings, bucket, prefix, version, migrationsDir, opts.DownloadConcurrency); err != nil {
 		log(fmt.Sprintf("✗ Failed to download migrations: %v", err))
 		result.Status = "failed"
 		result.Error = fmt.Sprintf("Failed to download migrations: %v", err)
+		result.ErrorType = ErrorTypeDownloadFailed
 		result.Log = logBuffer.String()
 		return result
 	}
@@ -63,16 +170,137 @@ func ExecuteMigration(ctx context.Context, client *s3.Client, bucket, prefix, ve
 		log(fmt.Sprintf("✗ Failed to read migrations directory: %v", err))
 		result.Status = "failed"
 		result.Error = fmt.Sprintf("Failed to read migrations directory: %v", err)
+		result.ErrorType = ErrorTypeDownloadFailed
 		result.Log = logBuffer.String()
 		return result
 	}
 
+	// Sort by name, the order dbmate applies them in, so the log and file lists are reproducible
+	slices.SortFunc(files, func(a, b os.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
 	migrationCount := len(files)
 	log(fmt.Sprintf("Downloaded %d migration files", migrationCount))
 
 	// List downloaded files
+	fileNames := make([]string, 0, len(files))
 	for _, f := range files {
 		log(fmt.Sprintf("  - %s", f.Name()))
+		fileNames = append(fileNames, f.Name())
+	}
+	result.AppliedFiles = fileNames
+
+	// Refuse to apply a subset of a partially pruned version
+	if err := CheckMigrationSetComplete(ctx, client, settings, bucket, prefix, version, fileNames); err != nil {
+		if opts.IncompletePolicy != IncompletePolicyWarn {
+			log(fmt.Sprintf("✗ %v", err))
+			result.Status = "failed"
+			result.Error = err.Error()
+			result.ErrorType = ErrorTypeValidationFailed
+			result.Log = logBuffer.String()
+			return result
+		}
+		log(fmt.Sprintf("⚠ %v (continuing because incomplete policy is %q)", err, opts.IncompletePolicy))
+	}
+
+	hooks, err := downloadHooks(ctx, client, settings, bucket, prefix, version)
+	if err != nil {
+		log(fmt.Sprintf("✗ Failed to download hooks: %v", err))
+		result.Status = "failed"
+		result.Error = fmt.Sprintf("Failed to download hooks: %v", err)
+		result.ErrorType = ErrorTypeDownloadFailed
+		result.Log = logBuffer.String()
+		return result
+	}
+
+	return runMigrations(ctx, migrationsDir, files, bucket, databaseURL, hooks, opts, result, &logBuffer, log)
+}
+
+// ExecuteLocalMigration applies the .sql files of a local directory like ExecuteMigration,
+// without reading anything from S3. version only labels the result.
+func ExecuteLocalMigration(ctx context.Context, dir, version, databaseURL string, opts MigrationOptions) *Result {
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	var logBuffer bytes.Buffer
+
+	result := &Result{
+		Version:         version,
+		Timestamp:       timestamp,
+		DeployerVersion: opts.DeployerVersion,
+	}
+
+	logOut := migrationLogWriter(&logBuffer, opts.LogWriter)
+	log := func(msg string) {
+		_, _ = io.WriteString(logOut, logLine(opts.LogTimestampFormat, msg))
+		slog.Info(msg)
+	}
+
+	log("=== Starting database migration ===")
+	log(fmt.Sprintf("Version: %s", version))
+	if opts.DeployerVersion != "" {
+		log(fmt.Sprintf("Deployer version: %s", opts.DeployerVersion))
+	}
+	log(fmt.Sprintf("Using local migrations from %s", dir))
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log(fmt.Sprintf("✗ Failed to read migrations directory: %v", err))
+		result.Status = "failed"
+		result.Error = fmt.Sprintf("Failed to read migrations directory: %v", err)
+		result.ErrorType = ErrorTypeValidationFailed
+		result.Log = logBuffer.String()
+		return result
+	}
+
+	// dbmate only picks up .sql files; ReadDir already sorts them by name
+	var files []os.DirEntry
+	fileNames := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".sql") {
+			files = append(files, e)
+			fileNames = append(fileNames, e.Name())
+		}
+	}
+
+	log(fmt.Sprintf("Found %d migration files", len(files)))
+	for _, name := range fileNames {
+		log(fmt.Sprintf("  - %s", name))
+	}
+	result.AppliedFiles = fileNames
+
+	return runMigrations(ctx, dir, files, "", databaseURL, migrationHooks{}, opts, result, &logBuffer, log)
+}
+
+// runMigrations runs dbmate up (or the dry-run inspection) on the migration files in
+// migrationsDir, between the before and after hooks, and completes result. bucket is the S3
+// bucket they came from, if any.
+func runMigrations(ctx context.Context, migrationsDir string, files []os.DirEntry, bucket, databaseURL string, hooks migrationHooks,
+	opts MigrationOptions, result *Result, logBuffer *bytes.Buffer, log func(string)) *Result {
+	migrationCount := len(files)
+
+	// An empty version folder (e.g. left over from a failed push) must not be reported as applied
+	if migrationCount == 0 {
+		msg := fmt.Sprintf("no migration files found for version %s", result.Version)
+		log(fmt.Sprintf("✗ %s", msg))
+		result.Status = "failed"
+		result.Error = msg
+		result.ErrorType = ErrorTypeValidationFailed
+		result.Log = logBuffer.String()
+		return result
+	}
+
+	// Embed migration file contents if requested
+	if opts.EmbedSQL {
+		appliedSQL, err := readMigrationSQL(migrationsDir, files, opts.EmbedSQLMaxBytes)
+		if err != nil {
+			log(fmt.Sprintf("✗ Failed to read migration files: %v", err))
+			result.Status = "failed"
+			result.Error = fmt.Sprintf("Failed to read migration files: %v", err)
+			result.ErrorType = ErrorTypeValidationFailed
+			result.Log = logBuffer.String()
+			return result
+		}
+		result.AppliedSQL = appliedSQL
 	}
 
 	// Run dbmate using library
@@ -83,59 +311,792 @@ func ExecuteMigration(ctx context.Context, client *s3.Client, bucket, prefix, ve
 		log(fmt.Sprintf("✗ Failed to parse DATABASE_URL: %v", err))
 		result.Status = "failed"
 		result.Error = fmt.Sprintf("Invalid DATABASE_URL: %v", err)
+		result.ErrorType = ErrorTypeValidationFailed
 		result.Log = logBuffer.String()
 		return result
 	}
 
-	db := dbmate.New(u)
+	// dbmate picks the driver from the URL scheme (postgres://, mysql://)
+	if err := validateDatabaseScheme(u); err != nil {
+		log(fmt.Sprintf("✗ %v", err))
+		result.Status = "failed"
+		result.Error = err.Error()
+		result.ErrorType = ErrorTypeValidationFailed
+		result.Log = logBuffer.String()
+		return result
+	}
+	log(fmt.Sprintf("Database driver: %s", u.Scheme))
+
+	// dbmate records migrations by version only, so of two files sharing a timestamp it
+	// silently skips whichever comes second once the first is in schema_migrations
+	if collisions := versionCollisions(result.AppliedFiles); len(collisions) > 0 {
+		var applied map[string]bool
+		if !opts.DryRun {
+			if applied, err = AppliedVersions(databaseURL, opts.MigrationsTable); err != nil {
+				log(fmt.Sprintf("⚠ Failed to read schema_migrations: %v", err))
+			}
+		}
+		msg := collisionMessage(collisions, applied)
+		log(fmt.Sprintf("✗ %s", msg))
+		result.Status = "failed"
+		result.Error = msg
+		result.ErrorType = ErrorTypeValidationFailed
+		result.Log = logBuffer.String()
+		return result
+	}
+
+	if opts.DryRun {
+		totalStatements := 0
+		for _, f := range files {
+			count, err := countStatements(path.Join(migrationsDir, f.Name()))
+			if err != nil {
+				log(fmt.Sprintf("✗ Failed to parse %s: %v", f.Name(), err))
+				result.Status = "failed"
+				result.Error = fmt.Sprintf("Failed to parse %s: %v", f.Name(), err)
+				result.ErrorType = ErrorTypeValidationFailed
+				result.Log = logBuffer.String()
+				return result
+			}
+			log(fmt.Sprintf("  - %s: %d statements", f.Name(), count))
+			totalStatements += count
+		}
+		if hooks.before != "" {
+			log(fmt.Sprintf("Dry run: skipping %s", BeforeHookName))
+		}
+		log(fmt.Sprintf("Dry run: skipping dbmate up (%d files, %d statements)", migrationCount, totalStatements))
+		if hooks.after != "" {
+			log(fmt.Sprintf("Dry run: skipping %s", AfterHookName))
+		}
+
+		result.Status = "dry-run"
+		result.Log = logBuffer.String()
+		return result
+	}
+
+	db := newDB(u, opts.MigrationsTable)
 	db.MigrationsDir = []string{migrationsDir}
 	db.AutoDumpSchema = false
 	db.Verbose = true
-	db.Log = &logBuffer
 
-	if err := db.CreateAndMigrate(); err != nil {
+	// Migrations recorded in the database without a file were applied out of band
+	if opts.FailOnDirty {
+		unknown, err := unknownAppliedVersions(db, files)
+		if err != nil {
+			log(fmt.Sprintf("✗ Failed to read schema_migrations: %v", err))
+			result.Status = "failed"
+			result.Error = fmt.Sprintf("Failed to read schema_migrations: %v", err)
+			result.ErrorType = ErrorTypeConnectionFailed
+			result.Log = logBuffer.String()
+			return result
+		}
+		if len(unknown) > 0 {
+			msg := fmt.Sprintf("database has migrations that are not in version %s: %s", result.Version, strings.Join(unknown, ", "))
+			log(fmt.Sprintf("✗ %s", msg))
+			result.Status = "dirty"
+			result.Error = msg
+			result.ErrorType = ErrorTypeValidationFailed
+			result.Log = logBuffer.String()
+			return result
+		}
+		log("schema_migrations matches the migration files")
+	}
+
+	// A failing before hook means the guardrail it sets up is missing, so dbmate must not run
+	if hooks.before != "" {
+		log(fmt.Sprintf("Running %s...", BeforeHookName))
+		rows, err := runHook(ctx, u, hooks.before)
+		if err != nil {
+			log(fmt.Sprintf("✗ %s failed: %v", BeforeHookName, err))
+			result.Status = "failed"
+			result.Error = fmt.Sprintf("%s failed: %v", BeforeHookName, err)
+			result.ErrorType = classifyMigrationError(err)
+			result.Log = logBuffer.String()
+			return result
+		}
+		log(fmt.Sprintf("✓ %s completed (%d rows affected)", BeforeHookName, rows))
+	}
+
+	timer := newMigrationTimer(migrationLogWriter(logBuffer, opts.LogWriter))
+	db.Log = timer
+
+	migrateCtx, span := startSpan(ctx, "CreateAndMigrate",
+		attribute.String("version", result.Version),
+		attribute.String("s3.bucket", bucket),
+		attribute.Int("file_count", len(result.AppliedFiles)),
+		attribute.String("db.system", u.Scheme),
+	)
+	err = runWithTimeout(migrateCtx, opts.Timeout, db.CreateAndMigrate)
+	endSpan(span, err)
+	abandoned := errors.Is(err, errMigrationTimeout) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+	if abandoned {
+		// dbmate can't be interrupted; stop collecting output from the abandoned run
+		timer.detach()
+	}
+	failedFile := timer.running()
+	if durations := timer.finish(); len(durations) > 0 {
+		result.Durations = durations
+	}
+	if err != nil {
 		log(fmt.Sprintf("✗ Migration failed: %v", err))
 		result.Status = "failed"
 		result.Error = fmt.Sprintf("dbmate failed: %v", err)
+		result.ErrorType = classifyMigrationError(err)
+		if abandoned {
+			log("⚠ The database may still be executing the migration until its connection is closed")
+			result.Error = err.Error()
+		} else if failedFile != "" {
+			location, snippet := describeFailure(migrationsDir, failedFile, err)
+			result.Error = fmt.Sprintf("dbmate failed %s: %v", location, err)
+			if snippet != "" {
+				log(fmt.Sprintf("Failed %s:\n%s", location, snippet))
+			}
+		}
 		result.Log = logBuffer.String()
 		return result
 	}
 
 	log("✓ Migration completed successfully")
 
+	// The migrations are applied and recorded by now, so a failing after hook only warns
+	if hooks.after != "" {
+		log(fmt.Sprintf("Running %s...", AfterHookName))
+		rows, err := runHook(ctx, u, hooks.after)
+		if err != nil {
+			log(fmt.Sprintf("⚠ %s failed: %v", AfterHookName, err))
+		} else {
+			log(fmt.Sprintf("✓ %s completed (%d rows affected)", AfterHookName, rows))
+		}
+	}
+
+	if opts.DumpSchema {
+		result.Schema = dumpSchema(db, opts.WorkDir, log)
+	}
+
 	result.Status = "success"
-	result.MigrationsApplied = migrationCount
+	result.MigrationsApplied = len(result.AppliedFiles)
 	result.Log = logBuffer.String()
 
 	return result
 }
 
-// ValidateMigrationFile validates a migration file's format and content
-func ValidateMigrationFile(filePath string) error {
-	// Check filename format: YYYYMMDDHHMMSS_description.sql
-	fileName := path.Base(filePath)
+// migrationLogWriter returns the writer of the migration log: buf, and also extra if set
+func migrationLogWriter(buf *bytes.Buffer, extra io.Writer) io.Writer {
+	if extra == nil {
+		return buf
+	}
+	return io.MultiWriter(buf, extra)
+}
 
-	// Must end with .sql
-	if !strings.HasSuffix(fileName, ".sql") {
-		return fmt.Errorf("file must have .sql extension: %s", fileName)
+// classifyMigrationError returns the Result.ErrorType of an error from dbmate up: a timeout
+// or cancellation, a failure to reach the database, or otherwise an error of the SQL itself
+func classifyMigrationError(err error) string {
+	if errors.Is(err, errMigrationTimeout) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrorTypeTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, driver.ErrBadConn) {
+		return ErrorTypeConnectionFailed
+	}
+	for _, fragment := range connectionErrorMessages {
+		if strings.Contains(err.Error(), fragment) {
+			return ErrorTypeConnectionFailed
+		}
+	}
+	return ErrorTypeSQLError
+}
+
+// dumpSchema dumps the schema of the migrated database through dbmate into a temporary
+// file under workDir and returns its content. This is done after the migration rather than
+// with AutoDumpSchema, so that a driver or environment that can't dump (e.g. no pg_dump or
+// mysqldump in the image) only logs a warning instead of failing an applied migration.
+func dumpSchema(db *dbmate.DB, workDir string, log func(string)) string {
+	f, err := os.CreateTemp(workDir, "schema-*.sql")
+	if err != nil {
+		log(fmt.Sprintf("⚠ Failed to create schema file, schema not dumped: %v", err))
+		return ""
+	}
+	schemaFile := f.Name()
+	_ = f.Close()
+	defer func() { _ = os.Remove(schemaFile) }()
+
+	db.SchemaFile = schemaFile
+	if err := db.DumpSchema(); err != nil {
+		log(fmt.Sprintf("⚠ Failed to dump schema, continuing without schema.sql: %v", err))
+		return ""
+	}
+
+	schema, err := os.ReadFile(schemaFile)
+	if err != nil {
+		log(fmt.Sprintf("⚠ Failed to read dumped schema: %v", err))
+		return ""
+	}
+	log(fmt.Sprintf("Dumped schema (%d bytes)", len(schema)))
+	return string(schema)
+}
+
+// RollbackMigration rolls back the migrations introduced by a specific version.
+// Versions are cumulative, so only files that are not part of the previous version are
+// rolled back, newest first, and only while each one is the most recently applied migration.
+// Of opts, only MigrationsTable and LogTimestampFormat apply.
+func RollbackMigration(ctx context.Context, client *s3.Client, settings Settings, bucket, prefix, version, databaseURL string, opts MigrationOptions) *Result {
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	var logBuffer bytes.Buffer
+
+	result := &Result{
+		Version:   version,
+		Timestamp: timestamp,
+	}
+
+	log := func(msg string) {
+		logBuffer.WriteString(logLine(opts.LogTimestampFormat, msg))
+		slog.Info(msg)
 	}
 
-	// Check if filename starts with timestamp (14 digits)
-	if len(fileName) < 15 { // YYYYMMDDHHMMSS + _ + at least 1 char + .sql
-		return fmt.Errorf("filename too short, expected format: YYYYMMDDHHMMSS_description.sql: %s", fileName)
+	fail := func(msg string) *Result {
+		log(fmt.Sprintf("✗ %s", msg))
+		result.Status = "failed"
+		result.Error = msg
+		result.Log = logBuffer.String()
+		return result
 	}
 
-	// Check first 14 characters are digits
-	timestamp := fileName[:14]
-	for _, c := range timestamp {
-		if c < '0' || c > '9' {
-			return fmt.Errorf("filename must start with 14-digit timestamp (YYYYMMDDHHMMSS): %s", fileName)
+	log("=== Starting database rollback ===")
+	log(fmt.Sprintf("Version: %s", version))
+
+	// Create temporary migrations directory
+	migrationsDir, err := os.MkdirTemp("", "migrations-*")
+	if err != nil {
+		return fail(fmt.Sprintf("Failed to create temp directory: %v", err))
+	}
+	defer func() { _ = os.RemoveAll(migrationsDir) }()
+
+	// Download migrations from S3
+	versionMigrationsPrefix := settings.migrationsPrefix(prefix, version)
+	log(fmt.Sprintf("Downloading migrations from s3://%s/%s", bucket, versionMigrationsPrefix))
+
+	if err := DownloadVersionMigrations(ctx, client, settings, bucket, prefix, version, migrationsDir, DefaultDownloadConcurrency); err != nil {
+		return fail(fmt.Sprintf("Failed to download migrations: %v", err))
+	}
+
+	files, err := os.ReadDir(migrationsDir)
+	if err != nil {
+		return fail(fmt.Sprintf("Failed to read migrations directory: %v", err))
+	}
+	fileNames := make([]string, 0, len(files))
+	for _, f := range files {
+		fileNames = append(fileNames, f.Name())
+	}
+
+	targets, err := versionOwnFiles(ctx, client, settings, bucket, prefix, version, fileNames)
+	if err != nil {
+		return fail(fmt.Sprintf("Failed to determine migrations of version %s: %v", version, err))
+	}
+	if len(targets) == 0 {
+		return fail(fmt.Sprintf("Version %s introduced no new migrations", version))
+	}
+
+	log(fmt.Sprintf("Migrations introduced by this version (%d):", len(targets)))
+	for _, f := range targets {
+		log(fmt.Sprintf("  - %s", f))
+	}
+
+	u, err := url.Parse(databaseURL)
+	if err != nil {
+		return fail(fmt.Sprintf("Invalid DATABASE_URL: %v", err))
+	}
+	if err := validateDatabaseScheme(u); err != nil {
+		return fail(err.Error())
+	}
+
+	db := newDB(u, opts.MigrationsTable)
+	db.MigrationsDir = []string{migrationsDir}
+	db.AutoDumpSchema = false
+	db.Verbose = true
+	db.Log = &logBuffer
+
+	// Roll back newest first
+	for i := len(targets) - 1; i >= 0; i-- {
+		target := targets[i]
+
+		migrations, err := db.FindMigrations()
+		if err != nil {
+			return fail(fmt.Sprintf("Failed to read migration status: %v", err))
+		}
+
+		var latest string
+		targetApplied := false
+		for _, m := range migrations {
+			if m.Applied {
+				latest = m.FileName
+				if m.FileName == target {
+					targetApplied = true
+				}
+			}
+		}
+
+		if !targetApplied {
+			log(fmt.Sprintf("Skipping %s (not applied)", target))
+			continue
+		}
+		if latest != target {
+			return fail(fmt.Sprintf("Cannot roll back %s: newer migration %s is applied; roll back later versions first", target, latest))
+		}
+
+		log(fmt.Sprintf("Rolling back %s...", target))
+		if err := db.Rollback(); err != nil {
+			return fail(fmt.Sprintf("dbmate rollback failed: %v", err))
+		}
+		result.RolledBack = append(result.RolledBack, target)
+	}
+
+	log(fmt.Sprintf("✓ Rollback completed successfully (%d migrations rolled back)", len(result.RolledBack)))
+
+	result.Status = "success"
+	result.Log = logBuffer.String()
+
+	return result
+}
+
+// versionOwnFiles returns the sorted files of a version that are not part of the previous version
+func versionOwnFiles(ctx context.Context, client S3API, settings Settings, bucket, prefix, version string, files []string) ([]string, error) {
+	previous, err := previousVersion(ctx, client, settings, bucket, prefix, version)
+	if err != nil {
+		return nil, err
+	}
+
+	inPrevious := make(map[string]bool)
+	if previous != "" {
+		keys, err := listAllObjects(ctx, client, settings, bucket, settings.migrationsPrefix(prefix, previous))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list migrations of version %s: %w", previous, err)
+		}
+		for _, f := range migrationFileNames(keys) {
+			inPrevious[f] = true
+		}
+	}
+
+	var own []string
+	for _, f := range files {
+		if !inPrevious[f] {
+			own = append(own, f)
+		}
+	}
+	sort.Strings(own)
+	return own, nil
+}
+
+// unknownAppliedVersions returns the sorted versions recorded in schema_migrations that
+// none of files has
+func unknownAppliedVersions(db *dbmate.DB, files []os.DirEntry) ([]string, error) {
+	applied, err := appliedVersions(db)
+	if err != nil {
+		return nil, err
+	}
+	return versionsWithoutFile(applied, files), nil
+}
+
+// AppliedVersions returns the versions recorded in dbmate's migrations table (DefaultMigrationsTable
+// if empty) of the database at databaseURL
+func AppliedVersions(databaseURL, migrationsTable string) (map[string]bool, error) {
+	if err := ValidateDatabaseURL(databaseURL); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(databaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse database URL: %w", err)
+	}
+	return appliedVersions(newDB(u, migrationsTable))
+}
+
+// appliedVersions reads schema_migrations through the dbmate driver. A database or
+// migrations table that doesn't exist yet has no applied versions.
+func appliedVersions(db *dbmate.DB) (map[string]bool, error) {
+	drv, err := db.Driver()
+	if err != nil {
+		return nil, err
+	}
+	exists, err := drv.DatabaseExists()
+	if err != nil || !exists {
+		return map[string]bool{}, err
+	}
+
+	sqlDB, err := drv.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = sqlDB.Close() }()
+
+	exists, err = drv.MigrationsTableExists(sqlDB)
+	if err != nil || !exists {
+		return map[string]bool{}, err
+	}
+	return drv.SelectMigrations(sqlDB, -1)
+}
+
+// versionCollisions returns the migration files grouped by version for the versions that
+// more than one file uses, in file name order
+func versionCollisions(fileNames []string) map[string][]string {
+	byVersion := make(map[string][]string)
+	for _, name := range fileNames {
+		version, _, _ := strings.Cut(name, "_")
+		byVersion[version] = append(byVersion[version], name)
+	}
+	collisions := make(map[string][]string)
+	for version, names := range byVersion {
+		if len(names) > 1 {
+			collisions[version] = names
 		}
 	}
+	return collisions
+}
 
-	// Check underscore after timestamp
-	if fileName[14] != '_' {
-		return fmt.Errorf("filename must have underscore after timestamp: %s", fileName)
+// collisionMessage describes timestamp collisions, noting the versions already recorded in
+// applied (which may be nil if schema_migrations couldn't be read)
+func collisionMessage(collisions map[string][]string, applied map[string]bool) string {
+	versions := slices.Sorted(maps.Keys(collisions))
+	parts := make([]string, 0, len(versions))
+	for _, version := range versions {
+		part := fmt.Sprintf("%s share version %s", strings.Join(collisions[version], " and "), version)
+		if applied[version] {
+			part += " (already in schema_migrations, so dbmate would skip the rest)"
+		}
+		parts = append(parts, part)
+	}
+	return "migration timestamp collision: " + strings.Join(parts, "; ") + "; give each migration a unique timestamp"
+}
+
+// missingFileVersions returns the sorted versions of the migration files that are not in applied
+func missingFileVersions(applied map[string]bool, fileNames []string) []string {
+	var missing []string
+	for _, name := range fileNames {
+		version, _, _ := strings.Cut(name, "_")
+		if !applied[version] {
+			missing = append(missing, version)
+		}
+	}
+	sort.Strings(missing)
+	return slices.Compact(missing)
+}
+
+// VerifyLatestApplied checks the newest version whose result file reports success against
+// the database's migrationsTable. Versions are cumulative, so its files cover every earlier
+// version. It returns that version and the migration versions missing from the database, or
+// an empty version if no version succeeded yet.
+func VerifyLatestApplied(ctx context.Context, client S3API, settings Settings, bucket, prefix, resultFile, databaseURL, migrationsTable string) (string, []string, error) {
+	versions, err := ListVersions(ctx, client, settings, bucket, prefix)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for i := len(versions) - 1; i >= 0; i-- {
+		version := versions[i]
+		exists, err := CheckResultExists(ctx, client, settings, bucket, prefix, version, resultFile)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to check %s for version %s: %w", resultFileName(resultFile), version, err)
+		}
+		if !exists {
+			continue
+		}
+		result, err := downloadResult(ctx, client, settings, bucket, prefix, version, resultFile)
+		if err != nil {
+			return "", nil, err
+		}
+		if result.Status != "success" {
+			continue
+		}
+
+		files, err := ListUploadedMigrations(ctx, client, settings, bucket, prefix, version)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to list migrations of version %s: %w", version, err)
+		}
+		// A bundle hides the file names, which files.json lists instead
+		if slices.Contains(files, BundleObjectName) {
+			manifest, err := downloadFileManifest(ctx, client, settings, bucket, prefix, version)
+			if err != nil {
+				return "", nil, err
+			}
+			if manifest == nil {
+				return "", nil, fmt.Errorf("version %s has a %s but no %s to list its files", version, BundleObjectName, FileManifestName)
+			}
+			files = manifest.Files
+		}
+		applied, err := AppliedVersions(databaseURL, migrationsTable)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+		}
+		return version, missingFileVersions(applied, files), nil
+	}
+
+	return "", nil, nil
+}
+
+// versionsWithoutFile returns the sorted applied versions that none of files has.
+// dbmate takes a migration's version from its file name up to the first underscore.
+func versionsWithoutFile(applied map[string]bool, files []os.DirEntry) []string {
+	known := make(map[string]bool, len(files))
+	for _, f := range files {
+		version, _, _ := strings.Cut(f.Name(), "_")
+		known[version] = true
+	}
+
+	var unknown []string
+	for version := range applied {
+		if !known[version] {
+			unknown = append(unknown, version)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// errMigrationTimeout is returned by runWithTimeout when the migration exceeds its timeout
+var errMigrationTimeout = errors.New("migration exceeded timeout")
+
+// runWithTimeout runs fn, which can't be cancelled, in a goroutine and stops waiting for it
+// when timeout elapses (0 means no limit) or ctx is cancelled
+func runWithTimeout(ctx context.Context, timeout time.Duration, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-deadline:
+		return fmt.Errorf("%w (%s)", errMigrationTimeout, timeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ResolveDatabaseURL returns the database URL to migrate: databaseURL, or with envName set
+// the value of the environment variable it names, so that one image can be pointed at a
+// tenant's database at runtime (e.g. --database-url-env DB_TENANT_A)
+func ResolveDatabaseURL(databaseURL, envName string) (string, error) {
+	if envName == "" {
+		if databaseURL == "" {
+			return "", fmt.Errorf("DATABASE_URL or --database-url-env is required")
+		}
+		return databaseURL, nil
+	}
+	if databaseURL != "" {
+		return "", fmt.Errorf("DATABASE_URL and --database-url-env cannot be used together")
+	}
+	value := os.Getenv(envName)
+	if value == "" {
+		return "", fmt.Errorf("environment variable %s named by --database-url-env is not set", envName)
+	}
+	return value, nil
+}
+
+// ValidateDatabaseURL checks that DATABASE_URL parses and uses a supported scheme
+func ValidateDatabaseURL(databaseURL string) error {
+	u, err := url.Parse(databaseURL)
+	if err != nil {
+		return fmt.Errorf("invalid DATABASE_URL: %w", err)
+	}
+	return validateDatabaseScheme(u)
+}
+
+// ValidateWorkDir checks that dir exists and new files can be created in it.
+// An empty dir means the OS temp directory and is always accepted.
+func ValidateWorkDir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("invalid work directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("invalid work directory: %s is not a directory", dir)
+	}
+
+	f, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return fmt.Errorf("work directory %s is not writable: %w", dir, err)
+	}
+	_ = f.Close()
+	_ = os.Remove(f.Name())
+	return nil
+}
+
+// validateDatabaseScheme returns a friendly error for schemes without a compiled-in driver
+func validateDatabaseScheme(u *url.URL) error {
+	if !slices.Contains(supportedDatabaseSchemes, u.Scheme) {
+		return fmt.Errorf("unsupported database scheme %q (supported: %s)", u.Scheme, strings.Join(supportedDatabaseSchemes, ", "))
+	}
+	return nil
+}
+
+// countStatements returns the number of SQL statements in the up section of a migration file
+func countStatements(filePath string) (int, error) {
+	migration := dbmate.Migration{FileName: path.Base(filePath), FilePath: filePath}
+	parsed, err := migration.Parse()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, stmt := range strings.Split(parsed.Up, ";") {
+		if isStatement(stmt) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// isStatement reports whether stmt has a line that is neither blank nor a comment
+func isStatement(stmt string) bool {
+	for _, line := range strings.Split(stmt, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "--") {
+			return true
+		}
+	}
+	return false
+}
+
+// queryErrorPosition matches the 1-based character offset into the up section that dbmate
+// puts in front of a query error, e.g. "line: 3, column: 1, position: 42: pq: ..."
+var queryErrorPosition = regexp.MustCompile(`position: (\d+):`)
+
+// failureSnippetLines is the number of lines shown before and after a failing line
+const failureSnippetLines = 2
+
+// describeFailure locates where dbmate failed in the migration file, e.g. "in 001_init.sql,
+// statement 2, line 7", and returns the lines around it with the failing one marked. Without
+// a position in err (e.g. MySQL errors) only the file is known and the snippet is empty.
+func describeFailure(migrationsDir, file string, err error) (location, snippet string) {
+	location = "in " + file
+
+	m := queryErrorPosition.FindStringSubmatch(err.Error())
+	if m == nil {
+		return location, ""
+	}
+	position, convErr := strconv.Atoi(m[1])
+	if convErr != nil {
+		return location, ""
+	}
+
+	filePath := path.Join(migrationsDir, file)
+	migration := dbmate.Migration{FileName: file, FilePath: filePath}
+	parsed, parseErr := migration.Parse()
+	if parseErr != nil {
+		return location, ""
+	}
+	up := []rune(parsed.Up)
+	if position < 1 || position > len(up)+1 {
+		return location, ""
+	}
+	before := string(up[:position-1])
+
+	// Statements ending before the position precede the failing one
+	statement := 1
+	pieces := strings.Split(before, ";")
+	for _, piece := range pieces[:len(pieces)-1] {
+		if isStatement(piece) {
+			statement++
+		}
+	}
+
+	// Report the line in the file, falling back to the line in the up section
+	source := parsed.Up
+	line := strings.Count(before, "\n") + 1
+	if content, readErr := os.ReadFile(filePath); readErr == nil {
+		if offset := strings.Index(string(content), parsed.Up); offset >= 0 {
+			source = string(content)
+			line += strings.Count(source[:offset], "\n")
+		}
+	}
+	location = fmt.Sprintf("in %s, statement %d, line %d", file, statement, line)
+
+	lines := strings.Split(source, "\n")
+	var b strings.Builder
+	for n := max(1, line-failureSnippetLines); n <= min(len(lines), line+failureSnippetLines); n++ {
+		marker := " "
+		if n == line {
+			marker = ">"
+		}
+		fmt.Fprintf(&b, "  %s %4d | %s\n", marker, n, lines[n-1])
+	}
+	return location, strings.TrimRight(b.String(), "\n")
+}
+
+// readMigrationSQL reads each migration file, truncating to maxBytes when it is positive
+func readMigrationSQL(dir string, files []os.DirEntry, maxBytes int) (map[string]string, error) {
+	appliedSQL := make(map[string]string, len(files))
+	total := 0
+	for _, f := range files {
+		content, err := os.ReadFile(path.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if maxBytes > 0 && len(content) > maxBytes {
+			content = append(content[:maxBytes:maxBytes], "\n-- (truncated)"...)
+		}
+		appliedSQL[f.Name()] = string(content)
+		total += len(content)
+	}
+
+	if total > embeddedSQLWarnBytes {
+		slog.Warn("Embedded SQL makes the result large; consider --embed-sql-max-bytes",
+			"embedded_bytes", total,
+			"threshold_bytes", embeddedSQLWarnBytes)
+	}
+
+	return appliedSQL, nil
+}
+
+// PingDatabase opens a short-lived connection with the dbmate driver for databaseURL and pings it
+func PingDatabase(ctx context.Context, databaseURL string) error {
+	if err := ValidateDatabaseURL(databaseURL); err != nil {
+		return err
+	}
+
+	u, err := url.Parse(databaseURL)
+	if err != nil {
+		return fmt.Errorf("failed to parse database URL: %w", err)
+	}
+
+	drv, err := dbmate.New(u).Driver()
+	if err != nil {
+		return fmt.Errorf("failed to get database driver: %w", err)
+	}
+	sqlDB, err := drv.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer func() { _ = sqlDB.Close() }()
+
+	if err := sqlDB.PingContext(ctx); err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	return nil
+}
+
+// ValidateMigrationFile validates a migration file's format and content, and checks the
+// statements of its up section against policy unless it is nil
+func (s Settings) ValidateMigrationFile(filePath string, policy *SQLPolicy) error {
+	// Check filename format: YYYYMMDDHHMMSS_description.sql
+	fileName := path.Base(filePath)
+
+	// Must end with .sql
+	if !strings.HasSuffix(fileName, ".sql") {
+		return fmt.Errorf("file must have .sql extension: %s", fileName)
+	}
+
+	if err := s.validateMigrationFileName(fileName); err != nil {
+		return err
 	}
 
 	// Read file content
@@ -156,5 +1117,5 @@ func ValidateMigrationFile(filePath string) error {
 		slog.Warn("Migration file missing '-- migrate:down' marker (not required but recommended)", "file", fileName)
 	}
 
-	return nil
+	return policy.Check(filePath)
 }
@@ -2,27 +2,43 @@ package shared
 
 // Result represents the migration execution result
 type Result struct {
-	Version           string `json:"version"`
-	Status            string `json:"status"`
-	Timestamp         string `json:"timestamp"`
-	MigrationsApplied int    `json:"migrations_applied,omitempty"`
-	Error             string `json:"error,omitempty"`
-	Log               string `json:"log"`
+	Version           string             `json:"version"`
+	Status            string             `json:"status"`
+	Timestamp         string             `json:"timestamp"`
+	MigrationsApplied int                `json:"migrations_applied,omitempty"`
+	AppliedFiles      []string           `json:"applied_files,omitempty"`
+	Durations         map[string]float64 `json:"durations,omitempty"`
+	RolledBack        []string           `json:"rolled_back,omitempty"`
+	Error             string             `json:"error,omitempty"`
+	ErrorType         string             `json:"error_type,omitempty"`
+	Log               string             `json:"log"`
+	AppliedSQL        map[string]string  `json:"applied_sql,omitempty"`
+	DeployerVersion   string             `json:"deployer_version,omitempty"`
+
+	// Schema is the schema dumped after a successful migration with MigrationOptions.DumpSchema.
+	// It is uploaded as schema.sql next to result.json rather than embedded in it.
+	Schema string `json:"-"`
+}
+
+// CurrentPointer records the latest successfully applied version at the prefix root
+type CurrentPointer struct {
+	Version   string `json:"version"`
+	AppliedAt string `json:"applied_at"`
 }
 
 // PushInfo represents metadata about when and where migrations were pushed from
 type PushInfo struct {
-	PushedAt string      `json:"pushed_at"`
-	Source   PushSource  `json:"source"`
+	PushedAt string     `json:"pushed_at"`
+	Source   PushSource `json:"source"`
 }
 
 // PushSource represents the source of the push operation
 type PushSource struct {
-	Type       string `json:"type"`                  // "github_actions" or "local"
-	Repository string `json:"repository,omitempty"` // GitHub repository (owner/repo)
-	Workflow   string `json:"workflow,omitempty"`   // GitHub Actions workflow name
-	RunID      string `json:"run_id,omitempty"`     // GitHub Actions run ID
-	RunURL     string `json:"run_url,omitempty"`    // URL to the GitHub Actions run
+	Type       string `json:"type"`                 // "github_actions", "gitlab_ci", "circleci", "jenkins" or "local"
+	Repository string `json:"repository,omitempty"` // Repository (owner/repo, or the GitLab project path)
+	Workflow   string `json:"workflow,omitempty"`   // GitHub Actions workflow or Jenkins job name
+	RunID      string `json:"run_id,omitempty"`     // CI run or pipeline ID
+	RunURL     string `json:"run_url,omitempty"`    // URL to the CI run or pipeline
 	Actor      string `json:"actor,omitempty"`      // User or app that triggered the workflow
 	SHA        string `json:"sha,omitempty"`        // Git commit SHA
 	Ref        string `json:"ref,omitempty"`        // Git ref (branch or tag)
@@ -47,3 +63,70 @@ type SlackField struct {
 	Value string `json:"value"`
 	Short bool   `json:"short"`
 }
+
+// TeamsMessageCard represents a Microsoft Teams MessageCard payload
+type TeamsMessageCard struct {
+	Type       string         `json:"@type"`
+	Context    string         `json:"@context"`
+	ThemeColor string         `json:"themeColor"`
+	Summary    string         `json:"summary"`
+	Title      string         `json:"title"`
+	Sections   []TeamsSection `json:"sections"`
+}
+
+// TeamsSection represents a section in a Teams MessageCard
+type TeamsSection struct {
+	Facts []TeamsFact `json:"facts"`
+	Text  string      `json:"text,omitempty"`
+}
+
+// TeamsFact represents a name/value pair in a Teams MessageCard section
+type TeamsFact struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// GoogleChatPayload represents a Google Chat cardsV2 webhook payload
+type GoogleChatPayload struct {
+	CardsV2 []GoogleChatCardWithID `json:"cardsV2"`
+}
+
+// GoogleChatCardWithID wraps a card with its identifier
+type GoogleChatCardWithID struct {
+	CardID string         `json:"cardId"`
+	Card   GoogleChatCard `json:"card"`
+}
+
+// GoogleChatCard represents a Google Chat card
+type GoogleChatCard struct {
+	Header   GoogleChatCardHeader `json:"header"`
+	Sections []GoogleChatSection  `json:"sections"`
+}
+
+// GoogleChatCardHeader represents the header of a Google Chat card
+type GoogleChatCardHeader struct {
+	Title    string `json:"title"`
+	Subtitle string `json:"subtitle,omitempty"`
+}
+
+// GoogleChatSection represents a section of a Google Chat card
+type GoogleChatSection struct {
+	Widgets []GoogleChatWidget `json:"widgets"`
+}
+
+// GoogleChatWidget represents a widget in a Google Chat card section
+type GoogleChatWidget struct {
+	DecoratedText *GoogleChatDecoratedText `json:"decoratedText,omitempty"`
+	TextParagraph *GoogleChatTextParagraph `json:"textParagraph,omitempty"`
+}
+
+// GoogleChatDecoratedText represents a labelled text widget
+type GoogleChatDecoratedText struct {
+	TopLabel string `json:"topLabel"`
+	Text     string `json:"text"`
+}
+
+// GoogleChatTextParagraph represents a paragraph widget
+type GoogleChatTextParagraph struct {
+	Text string `json:"text"`
+}
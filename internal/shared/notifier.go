@@ -0,0 +1,220 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// Notifier kinds accepted by NewNotifier
+const (
+	NotifierAuto       = "auto"
+	NotifierSlack      = "slack"
+	NotifierTeams      = "teams"
+	NotifierGoogleChat = "googlechat"
+)
+
+// Notifier sends a migration result to a chat service
+type Notifier interface {
+	Notify(ctx context.Context, version string, result *Result) error
+}
+
+// NotifyOptions controls what a notification includes
+type NotifyOptions struct {
+	// LogChars is the number of trailing log characters included (DefaultNotificationLogChars if 0)
+	LogChars int
+	// ResultURL links to the full result, e.g. its s3:// location (omitted if empty)
+	ResultURL string
+	// PushInfo is the provenance recorded by push; its repository, actor and commit are shown if set
+	PushInfo *PushInfo
+	// SlackTemplate renders the Slack payload instead of the built-in layout (Slack only, see ParseSlackTemplate)
+	SlackTemplate *template.Template
+	// Webhook controls the timeout and retries of the webhook request
+	Webhook WebhookOptions
+}
+
+// notificationFact is a labelled value shown in a notification
+type notificationFact struct {
+	Name  string
+	Value string
+}
+
+// pushInfoFacts returns the repository, actor and commit that pushed a version,
+// skipping the ones that weren't recorded
+func pushInfoFacts(info *PushInfo) []notificationFact {
+	if info == nil {
+		return nil
+	}
+
+	var facts []notificationFact
+	for _, f := range []notificationFact{
+		{Name: "Repository", Value: info.Source.Repository},
+		{Name: "Actor", Value: info.Source.Actor},
+		{Name: "Commit", Value: info.Source.SHA},
+	} {
+		if f.Value != "" {
+			facts = append(facts, f)
+		}
+	}
+	return facts
+}
+
+// NewNotifier returns the notifier for kind. With NotifierAuto (or an empty kind) the
+// service is detected from the webhook URL, falling back to Slack.
+func NewNotifier(kind, webhookURL string, opts NotifyOptions) (Notifier, error) {
+	if kind == "" || kind == NotifierAuto {
+		kind = detectNotifierKind(webhookURL)
+	}
+	if opts.SlackTemplate != nil && kind != NotifierSlack {
+		return nil, fmt.Errorf("a Slack template can't be used with the %s notifier", kind)
+	}
+
+	switch kind {
+	case NotifierSlack:
+		return &SlackNotifier{WebhookURL: webhookURL, Options: opts}, nil
+	case NotifierTeams:
+		return &TeamsNotifier{WebhookURL: webhookURL, Options: opts}, nil
+	case NotifierGoogleChat:
+		return &GoogleChatNotifier{WebhookURL: webhookURL, Options: opts}, nil
+	default:
+		return nil, fmt.Errorf("unknown notifier: %s", kind)
+	}
+}
+
+// detectNotifierKind guesses the chat service from the webhook host
+func detectNotifierKind(webhookURL string) string {
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return NotifierSlack
+	}
+
+	host := strings.ToLower(u.Hostname())
+	switch {
+	case host == "chat.googleapis.com":
+		return NotifierGoogleChat
+	case strings.HasSuffix(host, ".webhook.office.com"),
+		host == "outlook.office.com",
+		strings.HasSuffix(host, ".logic.azure.com"):
+		return NotifierTeams
+	default:
+		return NotifierSlack
+	}
+}
+
+// SlackNotifier posts to a Slack incoming webhook
+type SlackNotifier struct {
+	WebhookURL string
+	Options    NotifyOptions
+}
+
+// TeamsNotifier posts a MessageCard to a Microsoft Teams incoming webhook
+type TeamsNotifier struct {
+	WebhookURL string
+	Options    NotifyOptions
+}
+
+// Notify sends the result as a MessageCard
+func (n *TeamsNotifier) Notify(ctx context.Context, version string, result *Result) error {
+	color := "2EB886"
+	emoji := "✅"
+	if result.Status != "success" {
+		color = "A30200"
+		emoji = "❌"
+	}
+
+	title := fmt.Sprintf("%s Migration %s", emoji, result.Status)
+	facts := []TeamsFact{
+		{Name: "Version", Value: version},
+		{Name: "Status", Value: result.Status},
+	}
+	for _, f := range pushInfoFacts(n.Options.PushInfo) {
+		facts = append(facts, TeamsFact{Name: f.Name, Value: f.Value})
+	}
+	if n.Options.ResultURL != "" {
+		facts = append(facts, TeamsFact{Name: "Full log", Value: n.Options.ResultURL})
+	}
+	payload := TeamsMessageCard{
+		Type:       "MessageCard",
+		Context:    "http://schema.org/extensions",
+		ThemeColor: color,
+		Summary:    title,
+		Title:      title,
+		Sections: []TeamsSection{
+			{
+				Facts: facts,
+				Text:  fmt.Sprintf("<pre>%s</pre>", notificationLogExcerpt(result.Log, n.Options.LogChars)),
+			},
+		},
+	}
+
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal Teams payload: %w", err)
+	}
+
+	if err := postWebhook(ctx, n.Options.Webhook, n.WebhookURL, "Teams", jsonData); err != nil {
+		return err
+	}
+
+	slog.Info("Teams notification sent successfully")
+	return nil
+}
+
+// GoogleChatNotifier posts a cardsV2 message to a Google Chat incoming webhook
+type GoogleChatNotifier struct {
+	WebhookURL string
+	Options    NotifyOptions
+}
+
+// Notify sends the result as a cardsV2 message
+func (n *GoogleChatNotifier) Notify(ctx context.Context, version string, result *Result) error {
+	emoji := "✅"
+	if result.Status != "success" {
+		emoji = "❌"
+	}
+
+	widgets := []GoogleChatWidget{
+		{DecoratedText: &GoogleChatDecoratedText{TopLabel: "Version", Text: version}},
+		{DecoratedText: &GoogleChatDecoratedText{TopLabel: "Status", Text: result.Status}},
+	}
+	for _, f := range pushInfoFacts(n.Options.PushInfo) {
+		widgets = append(widgets, GoogleChatWidget{DecoratedText: &GoogleChatDecoratedText{TopLabel: f.Name, Text: f.Value}})
+	}
+	if n.Options.ResultURL != "" {
+		widgets = append(widgets, GoogleChatWidget{DecoratedText: &GoogleChatDecoratedText{TopLabel: "Full log", Text: n.Options.ResultURL}})
+	}
+	widgets = append(widgets, GoogleChatWidget{TextParagraph: &GoogleChatTextParagraph{Text: notificationLogExcerpt(result.Log, n.Options.LogChars)}})
+
+	payload := GoogleChatPayload{
+		CardsV2: []GoogleChatCardWithID{
+			{
+				CardID: "migration-result",
+				Card: GoogleChatCard{
+					Header: GoogleChatCardHeader{
+						Title:    fmt.Sprintf("%s Migration %s", emoji, result.Status),
+						Subtitle: fmt.Sprintf("Version %s", version),
+					},
+					Sections: []GoogleChatSection{
+						{Widgets: widgets},
+					},
+				},
+			},
+		},
+	}
+
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal Google Chat payload: %w", err)
+	}
+
+	if err := postWebhook(ctx, n.Options.Webhook, n.WebhookURL, "Google Chat", jsonData); err != nil {
+		return err
+	}
+
+	slog.Info("Google Chat notification sent successfully")
+	return nil
+}
@@ -0,0 +1,182 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewNotifier(t *testing.T) {
+	tests := []struct {
+		name       string
+		kind       string
+		webhookURL string
+		expected   Notifier
+	}{
+		{
+			name:       "auto detects Slack",
+			kind:       NotifierAuto,
+			webhookURL: "https://hooks.slack.com/services/T000/B000/XXX",
+			expected:   &SlackNotifier{},
+		},
+		{
+			name:       "auto detects Teams",
+			kind:       NotifierAuto,
+			webhookURL: "https://example.webhook.office.com/webhookb2/abc",
+			expected:   &TeamsNotifier{},
+		},
+		{
+			name:       "auto detects Google Chat",
+			kind:       "",
+			webhookURL: "https://chat.googleapis.com/v1/spaces/AAA/messages?key=k&token=t",
+			expected:   &GoogleChatNotifier{},
+		},
+		{
+			name:       "auto falls back to Slack",
+			kind:       NotifierAuto,
+			webhookURL: "https://chat.example.com/hook",
+			expected:   &SlackNotifier{},
+		},
+		{
+			name:       "explicit kind overrides URL",
+			kind:       NotifierTeams,
+			webhookURL: "https://hooks.slack.com/services/T000/B000/XXX",
+			expected:   &TeamsNotifier{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notifier, err := NewNotifier(tt.kind, tt.webhookURL, NotifyOptions{})
+			require.NoError(t, err)
+			assert.IsType(t, tt.expected, notifier)
+		})
+	}
+
+	_, err := NewNotifier("irc", "https://example.com", NotifyOptions{})
+	assert.EqualError(t, err, "unknown notifier: irc")
+}
+
+func TestTeamsNotifier_Notify(t *testing.T) {
+	var received TeamsMessageCard
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(body, &received))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	result := &Result{Version: "20240101000000", Status: "failed", Log: strings.Repeat("x", 1500) + "ERROR: syntax error"}
+	notifier := &TeamsNotifier{
+		WebhookURL: server.URL,
+		Options:    NotifyOptions{ResultURL: "s3://bucket/migrations/20240101000000/result.json"},
+	}
+	err := notifier.Notify(context.Background(), "20240101000000", result)
+	require.NoError(t, err)
+
+	assert.Equal(t, "MessageCard", received.Type)
+	assert.Equal(t, "A30200", received.ThemeColor)
+	assert.Contains(t, received.Title, "❌")
+	require.Len(t, received.Sections, 1)
+	assert.Equal(t, []TeamsFact{
+		{Name: "Version", Value: "20240101000000"},
+		{Name: "Status", Value: "failed"},
+		{Name: "Full log", Value: "s3://bucket/migrations/20240101000000/result.json"},
+	}, received.Sections[0].Facts)
+	// The end of the log, where the error is, is kept
+	assert.Equal(t, "<pre>…"+strings.Repeat("x", 1000-len("ERROR: syntax error"))+"ERROR: syntax error</pre>", received.Sections[0].Text)
+}
+
+func TestGoogleChatNotifier_Notify(t *testing.T) {
+	var received GoogleChatPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(body, &received))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	result := &Result{Version: "20240101000000", Status: "success", Log: "done"}
+	err := (&GoogleChatNotifier{WebhookURL: server.URL}).Notify(context.Background(), "20240101000000", result)
+	require.NoError(t, err)
+
+	require.Len(t, received.CardsV2, 1)
+	card := received.CardsV2[0].Card
+	assert.Contains(t, card.Header.Title, "✅")
+	require.Len(t, card.Sections, 1)
+	widgets := card.Sections[0].Widgets
+	require.Len(t, widgets, 3)
+	assert.Equal(t, "20240101000000", widgets[0].DecoratedText.Text)
+	assert.Equal(t, "success", widgets[1].DecoratedText.Text)
+	assert.Equal(t, "done", widgets[2].TextParagraph.Text)
+}
+
+func TestGoogleChatNotifier_ServerError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("bad card"))
+	}))
+	defer server.Close()
+
+	err := (&GoogleChatNotifier{WebhookURL: server.URL}).Notify(context.Background(), "20240101000000", &Result{Status: "success"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "google chat API returned status 400: bad card")
+}
+
+func TestSlackNotifier_Notify(t *testing.T) {
+	var received SlackPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	notifier, err := NewNotifier(NotifierSlack, server.URL, NotifyOptions{
+		LogChars:  5,
+		ResultURL: "s3://bucket/migrations/20240101000000/result.json",
+	})
+	require.NoError(t, err)
+
+	result := &Result{Version: "20240101000000", Status: "failed", Log: "applying...\nboom!"}
+	require.NoError(t, notifier.Notify(context.Background(), "20240101000000", result))
+
+	require.Len(t, received.Attachments, 1)
+	attachment := received.Attachments[0]
+	assert.Equal(t, "```\n…boom!\n```", attachment.Text)
+	assert.Contains(t, attachment.Fields, SlackField{Title: "Full log", Value: "s3://bucket/migrations/20240101000000/result.json"})
+
+	// A log within the limit is sent whole, without an ellipsis
+	result = &Result{Version: "20240101000000", Status: "failed", Log: "boom!"}
+	require.NoError(t, notifier.Notify(context.Background(), "20240101000000", result))
+
+	require.Len(t, received.Attachments, 1)
+	assert.Equal(t, "```\nboom!\n```", received.Attachments[0].Text)
+}
+
+func TestNotificationLogExcerpt(t *testing.T) {
+	assert.Equal(t, "short", notificationLogExcerpt("short", 0))
+	assert.Equal(t, "…world", notificationLogExcerpt("hello world", 5))
+	assert.Equal(t, "…"+strings.Repeat("x", DefaultNotificationLogChars), notificationLogExcerpt(strings.Repeat("x", 2000), 0))
+
+	// Multi-byte characters at the boundary are kept whole
+	log := strings.Repeat("x", 10) + strings.Repeat("日本語🚀", 300)
+	excerpt := notificationLogExcerpt(log, 0)
+	assert.True(t, utf8.ValidString(excerpt))
+	assert.Equal(t, DefaultNotificationLogChars+1, utf8.RuneCountInString(excerpt))
+	assert.True(t, strings.HasSuffix(log, strings.TrimPrefix(excerpt, "…")))
+	assert.Equal(t, "…語🚀", notificationLogExcerpt("日本語🚀", 2))
+
+	// A log of exactly n characters is not truncated, however many bytes it takes
+	assert.Equal(t, "日本語🚀", notificationLogExcerpt("日本語🚀", 4))
+}
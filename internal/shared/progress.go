@@ -0,0 +1,146 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ProgressLogName is the object under a version holding the log of a migration while it runs,
+// written by watch --write-progress and followed by wait-and-notify --follow
+const ProgressLogName = "progress.log"
+
+// ProgressLogInterval is how often a growing progress log is uploaded
+const ProgressLogInterval = 5 * time.Second
+
+// ProgressLog collects a migration log and uploads it as <version>/progress.log every interval
+// while it grows. It is passed as MigrationOptions.LogWriter.
+type ProgressLog struct {
+	ctx    context.Context
+	client S3API
+	retry  S3RetryOptions
+	bucket string
+	key    string
+	opts   PutOptions
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	uploaded int // length of buf at the last upload
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// StartProgressLog starts uploading the log written to the returned ProgressLog every
+// interval, until Close
+func StartProgressLog(ctx context.Context, client S3API, settings Settings, bucket, prefix, version string, interval time.Duration, opts PutOptions) *ProgressLog {
+	p := &ProgressLog{
+		ctx:    ctx,
+		client: client,
+		retry:  settings.Retry,
+		bucket: bucket,
+		key:    path.Join(prefix, version, ProgressLogName),
+		opts:   opts,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				if err := p.flush(); err != nil {
+					slog.Warn("Failed to upload progress log", "key", p.key, "error", err)
+				}
+			}
+		}
+	}()
+	return p
+}
+
+// Write appends b to the log
+func (p *ProgressLog) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.buf.Write(b)
+}
+
+// Close stops the periodic uploads and uploads the complete log, so that a follower sees
+// every line before the result file appears
+func (p *ProgressLog) Close() error {
+	close(p.stop)
+	<-p.done
+	return p.flush()
+}
+
+// flush uploads the log if it grew since the last upload
+func (p *ProgressLog) flush() error {
+	p.mu.Lock()
+	if p.buf.Len() == p.uploaded {
+		p.mu.Unlock()
+		return nil
+	}
+	content := bytes.Clone(p.buf.Bytes())
+	p.mu.Unlock()
+
+	_, err := withS3Retry(p.ctx, p.retry, "PutObject", func() (*s3.PutObjectOutput, error) {
+		return p.client.PutObject(p.ctx, &s3.PutObjectInput{
+			Bucket:               aws.String(p.bucket),
+			Key:                  aws.String(p.key),
+			Body:                 bytes.NewReader(content),
+			ContentType:          aws.String("text/plain; charset=utf-8"),
+			ServerSideEncryption: p.opts.serverSideEncryption(),
+			SSEKMSKeyId:          p.opts.kmsKeyID(),
+			Tagging:              p.opts.tagging(),
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", ProgressLogName, err)
+	}
+
+	p.mu.Lock()
+	p.uploaded = max(p.uploaded, len(content))
+	p.mu.Unlock()
+	return nil
+}
+
+// DownloadProgressLog reads progress.log of a version. It returns "" if the version has none,
+// e.g. because the daemon runs without --write-progress or hasn't started on it yet.
+func DownloadProgressLog(ctx context.Context, client S3API, settings Settings, bucket, prefix, version string) (string, error) {
+	key := path.Join(prefix, version, ProgressLogName)
+
+	resp, err := withS3Retry(ctx, settings.Retry, "GetObject", func() (*s3.GetObjectOutput, error) {
+		return client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "NotFound") || strings.Contains(err.Error(), "NoSuchKey") {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get progress log from S3: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read progress log: %w", err)
+	}
+	return string(content), nil
+}
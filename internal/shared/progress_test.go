@@ -0,0 +1,48 @@
+package shared
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared/testhelpers"
+)
+
+func TestProgressLog(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+
+	// No progress log yet
+	log, err := DownloadProgressLog(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000")
+	require.NoError(t, err)
+	assert.Empty(t, log)
+
+	progress := StartProgressLog(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", time.Hour, PutOptions{})
+	_, err = progress.Write([]byte("Applying: 001_a.sql\n"))
+	require.NoError(t, err)
+	require.NoError(t, progress.flush())
+	log, err = DownloadProgressLog(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000")
+	require.NoError(t, err)
+	assert.Equal(t, "Applying: 001_a.sql\n", log)
+
+	// Close uploads the rest of the log
+	_, err = progress.Write([]byte("Applied: 001_a.sql\n"))
+	require.NoError(t, err)
+	require.NoError(t, progress.Close())
+	log, err = DownloadProgressLog(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000")
+	require.NoError(t, err)
+	assert.Equal(t, "Applying: 001_a.sql\nApplied: 001_a.sql\n", log)
+}
+
+func TestExecuteLocalMigration_LogWriter(t *testing.T) {
+	var progress strings.Builder
+	result := ExecuteLocalMigration(context.Background(), t.TempDir(), "local", "postgres://localhost/db", MigrationOptions{LogWriter: &progress})
+
+	// An empty directory fails, and the log writer sees the same log as the result
+	assert.Equal(t, "failed", result.Status)
+	assert.Equal(t, result.Log, progress.String())
+	assert.Contains(t, progress.String(), "Found 0 migration files")
+}
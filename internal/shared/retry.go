@@ -0,0 +1,198 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// Retry defaults for S3 calls
+const (
+	DefaultS3MaxAttempts    = 3
+	DefaultS3RetryBaseDelay = 200 * time.Millisecond
+	DefaultS3RetryMaxDelay  = 20 * time.Second
+)
+
+// S3RetryOptions controls how transient S3 errors are retried. Zero fields use the defaults.
+type S3RetryOptions struct {
+	// MaxAttempts is the number of attempts for each S3 call (default: DefaultS3MaxAttempts)
+	MaxAttempts int
+	// BaseDelay bounds the delay before the second attempt; the bound doubles after each retry
+	BaseDelay time.Duration
+	// MaxDelay caps the doubling bound
+	MaxDelay time.Duration
+	// MaxElapsed stops retrying once the next delay would end this long after the first
+	// attempt (0 means no limit)
+	MaxElapsed time.Duration
+}
+
+// withDefaults fills in the zero fields of o
+func (o S3RetryOptions) withDefaults() S3RetryOptions {
+	if o.MaxAttempts < 1 {
+		o.MaxAttempts = DefaultS3MaxAttempts
+	}
+	if o.BaseDelay <= 0 {
+		o.BaseDelay = DefaultS3RetryBaseDelay
+	}
+	if o.MaxDelay <= 0 {
+		o.MaxDelay = DefaultS3RetryMaxDelay
+	}
+	o.MaxDelay = max(o.BaseDelay, o.MaxDelay)
+	o.MaxElapsed = max(o.MaxElapsed, 0)
+	return o
+}
+
+var (
+	// retryRand draws the jittered delays; tests replace it with a seeded source
+	retryRand   = rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	retryRandMu sync.Mutex
+	// retryAfter waits for a delay; tests replace it to record the delays
+	retryAfter = time.After
+)
+
+// retryableS3ErrorCodes are S3 error codes worth retrying
+var retryableS3ErrorCodes = map[string]bool{
+	"SlowDown":                       true,
+	"Throttling":                     true,
+	"ThrottlingException":            true,
+	"RequestLimitExceeded":           true,
+	"TooManyRequestsException":       true,
+	"RequestTimeout":                 true,
+	"RequestTimeoutException":        true,
+	"InternalError":                  true,
+	"ServiceUnavailable":             true,
+	"OperationAborted":               true,
+	"ProvisionedThroughputExceeded":  true,
+	"BandwidthLimitExceeded":         true,
+	"EC2ThrottledException":          true,
+	"PriorRequestNotComplete":        true,
+	"TransactionInProgressException": true,
+}
+
+// permanentError stops retryWithBackoff early
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+
+func (e *permanentError) Unwrap() error { return e.err }
+
+// noRetry marks err as not worth retrying
+func noRetry(err error) error {
+	return &permanentError{err: err}
+}
+
+// retryWithBackoff calls fn until it succeeds, returns an error wrapped by noRetry, or
+// retry.MaxAttempts is reached. Between attempts it sleeps a random delay between 0 and a
+// bound that starts at retry.BaseDelay and doubles up to retry.MaxDelay ("full jitter"), so
+// replicas retrying the same failure don't hit S3 in lockstep. It gives up without sleeping
+// when the delay would end past retry.MaxElapsed or the deadline of ctx.
+func retryWithBackoff(ctx context.Context, op string, retry S3RetryOptions, fn func() error) error {
+	retry = retry.withDefaults()
+	bound := retry.BaseDelay
+	start := time.Now()
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if permanent, ok := err.(*permanentError); ok {
+			return permanent.err
+		}
+		if attempt >= retry.MaxAttempts {
+			return err
+		}
+
+		delay := jitter(bound)
+		if retry.MaxElapsed > 0 && time.Since(start)+delay > retry.MaxElapsed {
+			slog.Warn("Giving up retrying, max elapsed time reached",
+				"operation", op,
+				"attempt", attempt,
+				"max_elapsed", retry.MaxElapsed,
+				"error", err)
+			return err
+		}
+		// Sleeping past the deadline would only delay the same failure
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			slog.Warn("Giving up retrying, the backoff would outlast the deadline",
+				"operation", op,
+				"attempt", attempt,
+				"backoff", delay,
+				"error", err)
+			return err
+		}
+
+		slog.Warn("Transient error, retrying",
+			"operation", op,
+			"attempt", attempt,
+			"max_attempts", retry.MaxAttempts,
+			"backoff", delay,
+			"error", err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-retryAfter(delay):
+			bound = min(bound*2, retry.MaxDelay)
+		}
+	}
+}
+
+// jitter returns a random delay in [0, bound)
+func jitter(bound time.Duration) time.Duration {
+	if bound <= 0 {
+		return 0
+	}
+	retryRandMu.Lock()
+	defer retryRandMu.Unlock()
+	return time.Duration(retryRand.Int64N(int64(bound)))
+}
+
+// withS3Retry calls fn until it succeeds, returns a non-retryable error, or retry.MaxAttempts is reached
+func withS3Retry[T any](ctx context.Context, retry S3RetryOptions, op string, fn func() (T, error)) (T, error) {
+	var out T
+	err := retryWithBackoff(ctx, op, retry, func() error {
+		var err error
+		out, err = fn()
+		if err != nil && !isRetryableS3Error(err) {
+			return noRetry(err)
+		}
+		return err
+	})
+	return out, err
+}
+
+// isRetryableS3Error reports whether err is a transient S3 error (5xx, throttling or timeout).
+// Client errors such as NoSuchKey or AccessDenied are not retried.
+func isRetryableS3Error(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && retryableS3ErrorCodes[apiErr.ErrorCode()] {
+		return true
+	}
+
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) {
+		status := respErr.HTTPStatusCode()
+		return status >= 500 || status == 429
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,189 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared/testhelpers"
+)
+
+// fastRetry returns the default settings with a short retry backoff and maxAttempts attempts
+func fastRetry(maxAttempts int) Settings {
+	settings := DefaultSettings()
+	settings.Retry = S3RetryOptions{MaxAttempts: maxAttempts, BaseDelay: time.Millisecond}
+	return settings
+}
+
+func TestIsRetryableS3Error(t *testing.T) {
+	assert.True(t, isRetryableS3Error(&smithy.GenericAPIError{Code: "SlowDown"}))
+	assert.True(t, isRetryableS3Error(&smithy.GenericAPIError{Code: "InternalError"}))
+	assert.False(t, isRetryableS3Error(&smithy.GenericAPIError{Code: "AccessDenied"}))
+	assert.False(t, isRetryableS3Error(&types.NoSuchKey{}))
+	assert.False(t, isRetryableS3Error(context.Canceled))
+}
+
+func TestFindUnappliedVersions_RetriesThrottling(t *testing.T) {
+	settings := fastRetry(3)
+
+	mock := testhelpers.NewMockS3Client()
+	_, _ = mock.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String("test-bucket"),
+		Key:    aws.String("migrations/20240101000000/migrations/001_a.sql"),
+		Body:   io.NopCloser(bytes.NewBufferString("-- migrate:up")),
+	})
+	mock.InjectErrors("ListObjectsV2",
+		&smithy.GenericAPIError{Code: "SlowDown"},
+		&smithy.GenericAPIError{Code: "ServiceUnavailable"})
+
+	versions, err := FindUnappliedVersions(context.Background(), mock, settings, "test-bucket", "migrations/", "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"20240101000000"}, versions)
+}
+
+func TestDownloadMigrations_GivesUpAfterMaxAttempts(t *testing.T) {
+	settings := fastRetry(2)
+
+	mock := testhelpers.NewMockS3Client()
+	_, _ = mock.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String("test-bucket"),
+		Key:    aws.String("migrations/20240101000000/migrations/001_a.sql"),
+		Body:   io.NopCloser(bytes.NewBufferString("-- migrate:up")),
+	})
+	mock.InjectErrors("GetObject",
+		&smithy.GenericAPIError{Code: "InternalError"},
+		&smithy.GenericAPIError{Code: "InternalError"},
+		&smithy.GenericAPIError{Code: "InternalError"})
+
+	err := DownloadMigrations(context.Background(), mock, settings, "test-bucket", "migrations/20240101000000/migrations/", t.TempDir(), 0)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "InternalError")
+}
+
+func TestUploadResult_DoesNotRetryAccessDenied(t *testing.T) {
+	settings := fastRetry(3)
+
+	mock := testhelpers.NewMockS3Client()
+	mock.InjectErrors("PutObject", &smithy.GenericAPIError{Code: "AccessDenied"})
+
+	err := UploadResult(context.Background(), mock, settings, "test-bucket", "migrations/", "20240101000000", "", &Result{Status: "success"}, nil, PutOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "AccessDenied")
+	assert.False(t, mock.HasObject("test-bucket", "migrations/20240101000000/result.json"))
+}
+
+func TestDownloadResultWithRetry_DoesNotNestRetries(t *testing.T) {
+	settings := fastRetry(3)
+
+	mock := testhelpers.NewMockS3Client()
+	require.NoError(t, UploadResult(context.Background(), mock, settings, "test-bucket", "migrations/", "20240101000000", "", &Result{Status: "success"}, nil, PutOptions{}))
+
+	// GetObject gives up after the max attempts, and the download isn't started over
+	mock.InjectErrors("GetObject",
+		&smithy.GenericAPIError{Code: "InternalError"},
+		&smithy.GenericAPIError{Code: "InternalError"},
+		&smithy.GenericAPIError{Code: "InternalError"})
+	_, err := downloadResultWithRetry(context.Background(), mock, settings, "test-bucket", "migrations/", "20240101000000", "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "InternalError")
+
+	// A non-retryable error is returned at once
+	mock.InjectErrors("GetObject", &smithy.GenericAPIError{Code: "AccessDenied"})
+	_, err = downloadResultWithRetry(context.Background(), mock, settings, "test-bucket", "migrations/", "20240101000000", "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "AccessDenied")
+
+	result, err := downloadResultWithRetry(context.Background(), mock, settings, "test-bucket", "migrations/", "20240101000000", "")
+	require.NoError(t, err)
+	assert.Equal(t, "success", result.Status)
+}
+
+func TestRetryWithBackoff_FullJitter(t *testing.T) {
+	origRand, origAfter := retryRand, retryAfter
+	t.Cleanup(func() { retryRand, retryAfter = origRand, origAfter })
+
+	retryRand = rand.New(rand.NewPCG(1, 2))
+	var delays []time.Duration
+	retryAfter = func(d time.Duration) <-chan time.Time {
+		delays = append(delays, d)
+		return time.After(0)
+	}
+	retry := S3RetryOptions{MaxAttempts: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+
+	calls := 0
+	err := retryWithBackoff(context.Background(), "test", retry, func() error {
+		calls++
+		return errors.New("boom")
+	})
+	require.EqualError(t, err, "boom")
+	assert.Equal(t, 5, calls)
+
+	// Each delay is drawn between 0 and a bound doubling from the base delay up to the max delay
+	expected := rand.New(rand.NewPCG(1, 2))
+	var want []time.Duration
+	for _, bound := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond} {
+		want = append(want, time.Duration(expected.Int64N(int64(bound))))
+	}
+	assert.Equal(t, want, delays)
+}
+
+func TestRetryWithBackoff_NoRetry(t *testing.T) {
+	calls := 0
+	err := retryWithBackoff(context.Background(), "test", fastRetry(3).Retry, func() error {
+		calls++
+		return noRetry(errors.New("AccessDenied"))
+	})
+	require.EqualError(t, err, "AccessDenied")
+	assert.Equal(t, 1, calls)
+}
+
+func TestRetryWithBackoff_MaxElapsed(t *testing.T) {
+	origRand := retryRand
+	t.Cleanup(func() { retryRand = origRand })
+	// The seeded source draws a first delay of about 46m
+	retryRand = rand.New(rand.NewPCG(1, 2))
+	retry := S3RetryOptions{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour, MaxElapsed: time.Minute}
+
+	// A backoff ending after the max elapsed time is not slept
+	calls := 0
+	start := time.Now()
+	err := retryWithBackoff(context.Background(), "test", retry, func() error {
+		calls++
+		return errors.New("boom")
+	})
+	require.EqualError(t, err, "boom")
+	assert.Equal(t, 1, calls)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRetryWithBackoff_RespectsDeadline(t *testing.T) {
+	origRand := retryRand
+	t.Cleanup(func() { retryRand = origRand })
+	// The seeded source draws a first delay of about 46m
+	retryRand = rand.New(rand.NewPCG(1, 2))
+	retry := S3RetryOptions{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// A backoff ending after the deadline is not slept
+	calls := 0
+	start := time.Now()
+	err := retryWithBackoff(ctx, "test", retry, func() error {
+		calls++
+		return errors.New("boom")
+	})
+	require.EqualError(t, err, "boom")
+	assert.Equal(t, 1, calls)
+	assert.Less(t, time.Since(start), time.Second)
+}
@@ -2,235 +2,1322 @@ package shared
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// DefaultResultFile is the name of the per-version result marker
+const DefaultResultFile = "result.json"
+
+// DefaultMigrationsSubdir is the folder under each version that holds the migration files
+const DefaultMigrationsSubdir = "migrations"
+
+// ErrNoVersions is returned when the prefix holds no version directories at all
+var ErrNoVersions = errors.New("no versions found")
+
+// ErrNoUnappliedVersions is returned when every version under the prefix already has a result
+var ErrNoUnappliedVersions = errors.New("no unapplied versions found")
+
+// Policies for a version whose result file reports a failure, chosen with --on-failed
+const (
+	// OnFailedSkip keeps the failed result as final and moves on to newer versions
+	OnFailedSkip = "skip"
+	// OnFailedBlock holds back newer versions until the failed result is removed
+	OnFailedBlock = "block"
+	// OnFailedRetry treats the failed version as pending, so it is applied again
+	OnFailedRetry = "retry"
+)
+
+// ErrNoFailedVersion is returned by FindFailedVersion when the newest result is not a failure
+var ErrNoFailedVersion = errors.New("no failed version found")
+
+// ErrBucketNotFound is returned by CheckBucketAccess when the bucket doesn't exist
+var ErrBucketNotFound = errors.New("bucket not found")
+
+// ErrBucketAccessDenied is returned by CheckBucketAccess when the credentials can't use the bucket
+var ErrBucketAccessDenied = errors.New("bucket access denied")
+
+// Settings holds the options every command shares for reading and writing versions in S3.
+// Each command builds it from its flags and passes it down explicitly.
+type Settings struct {
+	// MigrationsSubdir is the folder under each version holding the migration files
+	// (empty: directly under the version)
+	MigrationsSubdir string
+	// VersionFormat is the format version directories must follow (default: VersionFormatTimestamp)
+	VersionFormat string
+	// Retry controls how transient S3 errors are retried
+	Retry S3RetryOptions
+}
+
+// DefaultSettings returns the settings used when no flags are given
+func DefaultSettings() Settings {
+	return Settings{MigrationsSubdir: DefaultMigrationsSubdir, VersionFormat: VersionFormatTimestamp}
+}
+
+// migrationsPrefix returns the S3 prefix holding the migration files of version, ending in /
+func (s Settings) migrationsPrefix(prefix, version string) string {
+	return path.Join(prefix, version, strings.Trim(s.MigrationsSubdir, "/")) + "/"
+}
+
+// MigrationKey returns the S3 key of a migration file of version
+func (s Settings) MigrationKey(prefix, version, fileName string) string {
+	return path.Join(prefix, version, strings.Trim(s.MigrationsSubdir, "/"), fileName)
+}
+
+// DefaultDownloadConcurrency is the default number of parallel migration file downloads
+const DefaultDownloadConcurrency = 8
+
+// resultFileName returns the result file name, falling back to DefaultResultFile
+func resultFileName(resultFile string) string {
+	if resultFile == "" {
+		return DefaultResultFile
+	}
+	return resultFile
+}
+
+// Server-side encryption modes accepted by PutOptions
+const (
+	SSEAES256 = "AES256"
+	SSEKMS    = "aws:kms"
+)
+
+// maxObjectTags is the number of tags S3 allows on one object
+const maxObjectTags = 10
+
+// PutOptions holds settings applied to every object the deployer uploads
+type PutOptions struct {
+	// ServerSideEncryption is "" (bucket default), SSEAES256 or SSEKMS
+	ServerSideEncryption string
+	// SSEKMSKeyID is the KMS key used with SSEKMS (empty uses the AWS managed key)
+	SSEKMSKeyID string
+	// Tags are S3 object tags, e.g. for lifecycle rules or cost allocation
+	Tags map[string]string
+}
+
+// ParseS3Tags parses key=value pairs given on the command line into object tags
+func ParseS3Tags(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	tags := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid S3 tag %q (expected key=value)", pair)
+		}
+		tags[key] = value
+	}
+	return tags, nil
+}
+
+// withTag returns a copy of o with the tag key set to value
+func (o PutOptions) withTag(key, value string) PutOptions {
+	tags := make(map[string]string, len(o.Tags)+1)
+	maps.Copy(tags, o.Tags)
+	tags[key] = value
+	o.Tags = tags
+	return o
+}
+
+// Validate checks that the encryption settings are consistent
+func (o PutOptions) Validate() error {
+	switch o.ServerSideEncryption {
+	case "", SSEAES256, SSEKMS:
+	default:
+		return fmt.Errorf("unsupported server-side encryption %q (expected %s or %s)", o.ServerSideEncryption, SSEAES256, SSEKMS)
+	}
+	if o.SSEKMSKeyID != "" && o.ServerSideEncryption != SSEKMS {
+		return fmt.Errorf("--sse-kms-key-id requires --sse=%s", SSEKMS)
+	}
+	// S3 allows 10 tags per object; results add their own status tag
+	if len(o.Tags) > maxObjectTags-1 {
+		return fmt.Errorf("too many S3 tags (%d, at most %d)", len(o.Tags), maxObjectTags-1)
+	}
+	return nil
+}
+
+func (o PutOptions) serverSideEncryption() types.ServerSideEncryption {
+	return types.ServerSideEncryption(o.ServerSideEncryption)
+}
+
+// tagging returns the tags URL-encoded for PutObjectInput.Tagging, or nil without tags
+func (o PutOptions) tagging() *string {
+	if len(o.Tags) == 0 {
+		return nil
+	}
+	values := url.Values{}
+	for key, value := range o.Tags {
+		values.Set(key, value)
+	}
+	return aws.String(values.Encode())
+}
+
+func (o PutOptions) kmsKeyID() *string {
+	if o.SSEKMSKeyID == "" {
+		return nil
+	}
+	return aws.String(o.SSEKMSKeyID)
+}
+
 // S3API defines the interface for S3 operations used in this application
 // This interface enables mocking for unit tests
 type S3API interface {
 	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
 	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
 	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
 	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// S3ClientOptions holds the settings CreateS3Client builds an S3 client from. The zero value
+// uses AWS S3 with the default credential chain.
+type S3ClientOptions struct {
+	// EndpointURL is the endpoint of an S3-compatible store (empty for AWS)
+	EndpointURL string
+	// Region overrides AWS_REGION and the shared config (empty keeps them)
+	Region string
+	// ForcePathStyle overrides the addressing style if non-nil. Path-style requests are used
+	// with a custom endpoint and virtual-hosted ones otherwise.
+	ForcePathStyle *bool
+	// Profile is the shared config profile to load credentials and settings from, e.g. an
+	// SSO profile (empty keeps the default chain)
+	Profile string
+	// ConfigFile replaces ~/.aws/config when set
+	ConfigFile string
+	// CredentialsFile replaces ~/.aws/credentials when set
+	CredentialsFile string
+	// AssumeRoleARN is an IAM role assumed with the loaded credentials, e.g. in the account
+	// holding the bucket (empty uses the credentials directly)
+	AssumeRoleARN string
+	// ExternalID is passed as the external ID when assuming AssumeRoleARN
+	ExternalID string
+	// CABundle is a PEM file of CAs trusted for the endpoint in addition to the system roots,
+	// e.g. for MinIO behind a corporate certificate
+	CABundle string
+	// InsecureSkipVerify disables TLS certificate verification; for development only
+	InsecureSkipVerify bool
+}
+
+// s3HTTPClient returns an HTTP client honoring the TLS options, or nil to keep the SDK default
+func s3HTTPClient(opts S3ClientOptions) (*awshttp.BuildableClient, error) {
+	if opts.CABundle == "" && !opts.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if opts.CABundle != "" {
+		pem, err := os.ReadFile(opts.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read S3 CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in S3 CA bundle %s", opts.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+		slog.Info("Using custom CA bundle for S3", "ca_bundle", opts.CABundle)
+	}
+	if opts.InsecureSkipVerify {
+		tlsConfig.InsecureSkipVerify = true
+		slog.Warn("TLS certificate verification is DISABLED for S3 (--s3-insecure-skip-verify); do not use this in production")
+	}
+
+	return awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		tr.TLSClientConfig = tlsConfig
+	}), nil
+}
+
+// CreateS3Client creates an S3 client from opts
+func CreateS3Client(ctx context.Context, opts S3ClientOptions) (*s3.Client, error) {
+	var loadOptions []func(*config.LoadOptions) error
+	if opts.Profile != "" {
+		loadOptions = append(loadOptions, config.WithSharedConfigProfile(opts.Profile))
+		slog.Info("Using AWS shared config profile", "profile", opts.Profile)
+	}
+	if opts.ConfigFile != "" {
+		loadOptions = append(loadOptions, config.WithSharedConfigFiles([]string{opts.ConfigFile}))
+		slog.Info("Using AWS shared config file", "path", opts.ConfigFile)
+	}
+	if opts.CredentialsFile != "" {
+		loadOptions = append(loadOptions, config.WithSharedCredentialsFiles([]string{opts.CredentialsFile}))
+		slog.Info("Using AWS shared credentials file", "path", opts.CredentialsFile)
+	}
+	if opts.Region != "" {
+		loadOptions = append(loadOptions, config.WithRegion(opts.Region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, loadOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	// Use the loaded credentials to assume a role, e.g. in the account holding the bucket
+	if opts.AssumeRoleARN != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), opts.AssumeRoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = "dbmate-deployer"
+			if opts.ExternalID != "" {
+				o.ExternalID = aws.String(opts.ExternalID)
+			}
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+		slog.Info("Assuming IAM role for S3 access", "role_arn", opts.AssumeRoleARN)
+	}
+
+	httpClient, err := s3HTTPClient(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// S3-compatible stores generally need path-style requests
+	usePathStyle := opts.EndpointURL != ""
+	if opts.ForcePathStyle != nil {
+		usePathStyle = *opts.ForcePathStyle
+	}
+
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if httpClient != nil {
+			o.HTTPClient = httpClient
+		}
+		if opts.EndpointURL != "" {
+			o.BaseEndpoint = aws.String(opts.EndpointURL)
+			slog.Info("Using custom S3 endpoint", "endpoint", opts.EndpointURL, "path_style", usePathStyle)
+		}
+		o.UsePathStyle = usePathStyle
+	}), nil
+}
+
+// CheckBucketAccess verifies that the bucket exists and that the prefix can be listed, so a
+// misspelled bucket or missing permission fails with an actionable error instead of looking
+// like an empty prefix. It reports whether the prefix holds no objects yet.
+func CheckBucketAccess(ctx context.Context, client S3API, settings Settings, bucket, prefix string) (empty bool, err error) {
+	_, err = withS3Retry(ctx, settings.Retry, "HeadBucket", func() (*s3.HeadBucketOutput, error) {
+		return client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	})
+	if err != nil {
+		switch s3ErrorKind(err) {
+		case http.StatusNotFound:
+			return false, fmt.Errorf("%w: s3://%s does not exist, check S3_BUCKET and the S3 region or endpoint: %w", ErrBucketNotFound, bucket, err)
+		case http.StatusForbidden:
+			return false, fmt.Errorf("%w: s3://%s exists but can't be accessed, check the credentials and that they allow s3:ListBucket: %w", ErrBucketAccessDenied, bucket, err)
+		}
+		return false, fmt.Errorf("failed to access bucket %s: %w", bucket, err)
+	}
+
+	resp, err := withS3Retry(ctx, settings.Retry, "ListObjectsV2", func() (*s3.ListObjectsV2Output, error) {
+		return client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:  aws.String(bucket),
+			Prefix:  aws.String(prefix),
+			MaxKeys: aws.Int32(1),
+		})
+	})
+	if err != nil {
+		if s3ErrorKind(err) == http.StatusForbidden {
+			return false, fmt.Errorf("%w: s3://%s/%s can't be listed, check that the credentials allow s3:ListBucket on this prefix: %w", ErrBucketAccessDenied, bucket, prefix, err)
+		}
+		return false, fmt.Errorf("failed to list s3://%s/%s: %w", bucket, prefix, err)
+	}
+	return len(resp.Contents) == 0, nil
+}
+
+// s3ErrorKind returns http.StatusNotFound or http.StatusForbidden if err says the resource is
+// missing or access is denied, and 0 otherwise. HeadBucket errors carry no body, so the HTTP
+// status is checked as well as the error code.
+func s3ErrorKind(err error) int {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NotFound", "NoSuchBucket":
+			return http.StatusNotFound
+		case "Forbidden", "AccessDenied":
+			return http.StatusForbidden
+		}
+	}
+
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) {
+		switch respErr.HTTPStatusCode() {
+		case http.StatusNotFound:
+			return http.StatusNotFound
+		case http.StatusForbidden:
+			return http.StatusForbidden
+		}
+	}
+	return 0
+}
+
+// s3CredentialErrorCodes are S3 error codes of credentials that don't work at all
+var s3CredentialErrorCodes = []string{"InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken", "InvalidToken"}
+
+// IsS3AccessError reports whether err says the bucket doesn't exist or the credentials can't
+// use it, which retrying won't fix
+func IsS3AccessError(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		if apiErr.ErrorCode() == "NoSuchBucket" || slices.Contains(s3CredentialErrorCodes, apiErr.ErrorCode()) {
+			return true
+		}
+	}
+	return s3ErrorKind(err) == http.StatusForbidden
+}
+
+// listAllCommonPrefixes lists every "directory" directly under the prefix, following continuation
+// tokens. A non-empty startAfter skips the keys up to and including it.
+func listAllCommonPrefixes(ctx context.Context, client S3API, settings Settings, bucket, prefix, startAfter string) ([]string, error) {
+	var prefixes []string
+	var token *string
+	for {
+		input := &s3.ListObjectsV2Input{
+			Bucket:            aws.String(bucket),
+			Prefix:            aws.String(prefix),
+			Delimiter:         aws.String("/"),
+			ContinuationToken: token,
+		}
+		if startAfter != "" {
+			input.StartAfter = aws.String(startAfter)
+		}
+		resp, err := withS3Retry(ctx, settings.Retry, "ListObjectsV2", func() (*s3.ListObjectsV2Output, error) {
+			return client.ListObjectsV2(ctx, input)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, cp := range resp.CommonPrefixes {
+			if cp.Prefix != nil {
+				prefixes = append(prefixes, *cp.Prefix)
+			}
+		}
+
+		if !aws.ToBool(resp.IsTruncated) || resp.NextContinuationToken == nil {
+			return prefixes, nil
+		}
+		token = resp.NextContinuationToken
+	}
+}
+
+// listAllObjects lists every object key under the prefix, following continuation tokens
+func listAllObjects(ctx context.Context, client S3API, settings Settings, bucket, prefix string) ([]string, error) {
+	var keys []string
+	var token *string
+	for {
+		resp, err := withS3Retry(ctx, settings.Retry, "ListObjectsV2", func() (*s3.ListObjectsV2Output, error) {
+			return client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+				Bucket:            aws.String(bucket),
+				Prefix:            aws.String(prefix),
+				ContinuationToken: token,
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range resp.Contents {
+			if obj.Key != nil {
+				keys = append(keys, *obj.Key)
+			}
+		}
+
+		if !aws.ToBool(resp.IsTruncated) || resp.NextContinuationToken == nil {
+			return keys, nil
+		}
+		token = resp.NextContinuationToken
+	}
+}
+
+// listVersions lists version directories under the prefix, sorted ascending
+func listVersions(ctx context.Context, client S3API, settings Settings, bucket, prefix string) ([]string, error) {
+	slog.Info("Listing versions from S3", "bucket", bucket, "prefix", prefix)
+
+	// List all version directories with the prefix
+	commonPrefixes, err := listAllCommonPrefixes(ctx, client, settings, bucket, prefix, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list S3 objects: %w", err)
+	}
+
+	// Extract version directories
+	var versions []string
+	for _, cp := range commonPrefixes {
+		// Extract version from prefix (e.g., "migrations/20260121010000/" -> "20260121010000")
+		versionPath := strings.TrimPrefix(cp, prefix)
+		versionPath = strings.TrimSuffix(versionPath, "/")
+		if versionPath == "" {
+			continue
+		}
+		// Stray folders (e.g. "backup/") must never be mistaken for the newest version
+		if !settings.isVersion(versionPath) {
+			slog.Warn("Skipping directory that is not a valid version", "prefix", cp, "version_format", settings.versionFormat())
+			continue
+		}
+		versions = append(versions, versionPath)
+	}
+
+	if len(versions) == 0 {
+		return nil, ErrNoVersions
+	}
+
+	slices.SortFunc(versions, CompareVersions)
+
+	slog.Info("Found versions", "count", len(versions), "versions", versions)
+	return versions, nil
+}
+
+// ListVersions lists the version directories under the prefix, sorted ascending.
+// It returns an empty list if there are none.
+func ListVersions(ctx context.Context, client S3API, settings Settings, bucket, prefix string) ([]string, error) {
+	versions, err := listVersions(ctx, client, settings, bucket, prefix)
+	if errors.Is(err, ErrNoVersions) {
+		return nil, nil
+	}
+	return versions, err
+}
+
+// ListVersionsAfter lists the version directories under the prefix that are newer than after,
+// sorted ascending. Timestamp versions sort like text, so the listing starts right after that
+// version and costs a single request when nothing newer was pushed. An empty after lists
+// every version.
+func ListVersionsAfter(ctx context.Context, client S3API, settings Settings, bucket, prefix, after string) ([]string, error) {
+	// "0" sorts after the "/" that follows after in the keys of its own directory
+	startAfter := ""
+	if after != "" && settings.versionFormat() == VersionFormatTimestamp {
+		startAfter = prefix + after + "0"
+	}
+
+	commonPrefixes, err := listAllCommonPrefixes(ctx, client, settings, bucket, prefix, startAfter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list S3 objects: %w", err)
+	}
+
+	var versions []string
+	for _, cp := range commonPrefixes {
+		version := strings.TrimSuffix(strings.TrimPrefix(cp, prefix), "/")
+		if !settings.isVersion(version) {
+			continue
+		}
+		if after == "" || CompareVersions(version, after) > 0 {
+			versions = append(versions, version)
+		}
+	}
+	slices.SortFunc(versions, CompareVersions)
+	return versions, nil
+}
+
+// FindUnappliedVersion finds the newest unapplied migration version
+// Kept for backward compatibility; use FindUnappliedVersions to also pick up older pending versions
+func FindUnappliedVersion(ctx context.Context, client S3API, settings Settings, bucket, prefix, resultFile string) (version string, err error) {
+	ctx, span := startSpan(ctx, "FindUnappliedVersion", attribute.String("s3.bucket", bucket), attribute.String("s3.prefix", prefix))
+	defer func() {
+		span.SetAttributes(attribute.String("version", version))
+		endSpan(span, err)
+	}()
+
+	versions, err := listVersions(ctx, client, settings, bucket, prefix)
+	if err != nil {
+		return "", err
+	}
+
+	// Check the newest version (last in sorted list)
+	newestVersion := versions[len(versions)-1]
+	exists, err := CheckResultExists(ctx, client, settings, bucket, prefix, newestVersion, resultFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to check %s for newest version %s: %w", resultFileName(resultFile), newestVersion, err)
+	}
+
+	if !exists {
+		slog.Info("Found unapplied newest version", "version", newestVersion)
+		return newestVersion, nil
+	}
+
+	slog.Info("Newest version already applied (result file exists)", "version", newestVersion, "result_file", resultFileName(resultFile))
+	return "", ErrNoUnappliedVersions
+}
+
+// FindUnappliedVersions finds all versions without a result file, sorted ascending
+func FindUnappliedVersions(ctx context.Context, client S3API, settings Settings, bucket, prefix, resultFile string) ([]string, error) {
+	return FindUnappliedVersionsUpTo(ctx, client, settings, bucket, prefix, resultFile, "")
+}
+
+// FindUnappliedVersionsUpTo finds the versions without a result file that are not newer than
+// targetVersion, sorted ascending. Newer versions are held back; an empty targetVersion means no cap.
+func FindUnappliedVersionsUpTo(ctx context.Context, client S3API, settings Settings, bucket, prefix, resultFile, targetVersion string) ([]string, error) {
+	return FindPendingVersions(ctx, client, settings, bucket, prefix, resultFile, targetVersion, OnFailedSkip)
+}
+
+// FindPendingVersions is FindUnappliedVersionsUpTo with onFailed deciding about versions whose
+// result reports a failure. Unless it is OnFailedSkip, every existing result is downloaded to
+// read its status: OnFailedRetry returns failed versions as pending, and OnFailedBlock stops at
+// the first failed version, holding back the newer ones.
+func FindPendingVersions(ctx context.Context, client S3API, settings Settings, bucket, prefix, resultFile, targetVersion, onFailed string) (pending []string, err error) {
+	ctx, span := startSpan(ctx, "FindUnappliedVersions", attribute.String("s3.bucket", bucket), attribute.String("s3.prefix", prefix))
+	defer func() {
+		span.SetAttributes(attribute.StringSlice("versions", pending))
+		endSpan(span, err)
+	}()
+
+	versions, err := listVersions(ctx, client, settings, bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	if targetVersion != "" {
+		// versions are sorted, so everything from the first newer version on is held back
+		for i, version := range versions {
+			if CompareVersions(version, targetVersion) > 0 {
+				slog.Info("Holding back versions newer than the target version", "target_version", targetVersion, "held_back", versions[i:])
+				versions = versions[:i]
+				break
+			}
+		}
+	}
+
+	for i, version := range versions {
+		exists, err := CheckResultExists(ctx, client, settings, bucket, prefix, version, resultFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check %s for version %s: %w", resultFileName(resultFile), version, err)
+		}
+		if !exists {
+			pending = append(pending, version)
+			continue
+		}
+		if onFailed != OnFailedRetry && onFailed != OnFailedBlock {
+			continue
+		}
+
+		result, err := downloadResult(ctx, client, settings, bucket, prefix, version, resultFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s for version %s: %w", resultFileName(resultFile), version, err)
+		}
+		if result.Status != "failed" {
+			continue
+		}
+		if onFailed == OnFailedRetry {
+			slog.Info("Retrying failed version", "version", version)
+			pending = append(pending, version)
+			continue
+		}
+		if held := versions[i+1:]; len(held) > 0 {
+			slog.Warn("Failed version blocks newer versions until its result is removed", "version", version, "held_back", held)
+		}
+		break
+	}
+
+	if len(pending) == 0 {
+		slog.Info("All versions already applied (result file exists)", "result_file", resultFileName(resultFile))
+		return nil, ErrNoUnappliedVersions
+	}
+
+	slog.Info("Found unapplied versions", "count", len(pending), "versions", pending)
+	return pending, nil
+}
+
+// FindFailedVersion returns the newest version with a result file, not newer than
+// targetVersion, if that result reports a failure. Pending versions are skipped; an older
+// failure followed by a successful version is superseded and returns ErrNoFailedVersion.
+func FindFailedVersion(ctx context.Context, client S3API, settings Settings, bucket, prefix, resultFile, targetVersion string) (string, error) {
+	versions, err := listVersions(ctx, client, settings, bucket, prefix)
+	if err != nil {
+		return "", err
+	}
+
+	for i := len(versions) - 1; i >= 0; i-- {
+		version := versions[i]
+		if targetVersion != "" && CompareVersions(version, targetVersion) > 0 {
+			continue
+		}
+		exists, err := CheckResultExists(ctx, client, settings, bucket, prefix, version, resultFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to check %s for version %s: %w", resultFileName(resultFile), version, err)
+		}
+		if !exists {
+			continue
+		}
+
+		result, err := downloadResult(ctx, client, settings, bucket, prefix, version, resultFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s for version %s: %w", resultFileName(resultFile), version, err)
+		}
+		if result.Status != "failed" {
+			slog.Info("Newest result is not a failure", "version", version, "status", result.Status)
+			return "", ErrNoFailedVersion
+		}
+		return version, nil
+	}
+	return "", ErrNoFailedVersion
+}
+
+// DeleteResult deletes the result file of a version, so that it is pending again
+func DeleteResult(ctx context.Context, client S3API, settings Settings, bucket, prefix, version, resultFile string) error {
+	key := path.Join(prefix, version, resultFileName(resultFile))
+
+	_, err := withS3Retry(ctx, settings.Retry, "DeleteObject", func() (*s3.DeleteObjectOutput, error) {
+		return client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+	return nil
+}
+
+// ResultURI returns the s3:// location of a version's result file
+func ResultURI(bucket, prefix, version, resultFile string) string {
+	return "s3://" + bucket + "/" + path.Join(prefix, version, resultFileName(resultFile))
+}
+
+// PresignResult returns a GET URL for a version's result file that is valid for expiry,
+// so the full log can be opened without S3 console access
+func PresignResult(ctx context.Context, client *s3.Client, bucket, prefix, version, resultFile string, expiry time.Duration) (string, error) {
+	key := path.Join(prefix, version, resultFileName(resultFile))
+
+	req, err := s3.NewPresignClient(client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(expiry))
+	if err != nil {
+		return "", fmt.Errorf("failed to presign %s: %w", key, err)
+	}
+	return req.URL, nil
+}
+
+// CheckResultExists checks if the result file (result.json by default) exists for a version
+func CheckResultExists(ctx context.Context, client S3API, settings Settings, bucket, prefix, version, resultFile string) (bool, error) {
+	key := path.Join(prefix, version, resultFileName(resultFile))
+
+	_, err := withS3Retry(ctx, settings.Retry, "HeadObject", func() (*s3.HeadObjectOutput, error) {
+		return client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+	})
+
+	if err != nil {
+		if strings.Contains(err.Error(), "NotFound") || strings.Contains(err.Error(), "NoSuchKey") {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ResultPending reports whether version still needs to be applied: it has no result file, or
+// its result reports a failure and onFailed is OnFailedRetry
+func ResultPending(ctx context.Context, client S3API, settings Settings, bucket, prefix, version, resultFile, onFailed string) (bool, error) {
+	exists, err := CheckResultExists(ctx, client, settings, bucket, prefix, version, resultFile)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		return true, nil
+	}
+	if onFailed != OnFailedRetry {
+		return false, nil
+	}
+
+	result, err := downloadResult(ctx, client, settings, bucket, prefix, version, resultFile)
+	if err != nil {
+		return false, err
+	}
+	return result.Status == "failed", nil
+}
+
+// CheckMigrationsExist reports whether a version has at least one migration file in S3
+func CheckMigrationsExist(ctx context.Context, client S3API, settings Settings, bucket, prefix, version string) (bool, error) {
+	resp, err := withS3Retry(ctx, settings.Retry, "ListObjectsV2", func() (*s3.ListObjectsV2Output, error) {
+		return client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:  aws.String(bucket),
+			Prefix:  aws.String(settings.migrationsPrefix(prefix, version)),
+			MaxKeys: aws.Int32(1),
+		})
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(resp.Contents) > 0, nil
+}
+
+// DownloadVersionMigrations downloads the migration files of version into localDir. If the
+// version's files.json records S3 VersionIds, exactly those object versions are downloaded,
+// and a file missing from either side fails the download.
+func DownloadVersionMigrations(ctx context.Context, client S3API, settings Settings, bucket, prefix, version, localDir string, concurrency int) error {
+	manifest, err := downloadFileManifest(ctx, client, settings, bucket, prefix, version)
+	if err != nil {
+		return err
+	}
+
+	var versionIDs map[string]string
+	if manifest != nil && len(manifest.VersionIDs) > 0 {
+		slog.Info("Pinning migration downloads to recorded object versions", "version", version, "count", len(manifest.VersionIDs))
+		versionIDs = manifest.VersionIDs
+	}
+	return downloadMigrations(ctx, client, settings, bucket, settings.migrationsPrefix(prefix, version), localDir, concurrency, versionIDs)
+}
+
+// DownloadMigrations downloads migration files from S3 to a local directory using up to
+// concurrency parallel downloads (DefaultDownloadConcurrency if not positive).
+// The first error cancels the remaining downloads.
+func DownloadMigrations(ctx context.Context, client S3API, settings Settings, bucket, prefix, localDir string, concurrency int) error {
+	return downloadMigrations(ctx, client, settings, bucket, prefix, localDir, concurrency, nil)
+}
+
+// downloadMigrations implements DownloadMigrations. With versionIDs, every listed migration
+// must have a recorded VersionId (keyed by local file name) and every recorded file must be listed.
+func downloadMigrations(ctx context.Context, client S3API, settings Settings, bucket, prefix, localDir string, concurrency int, versionIDs map[string]string) (err error) {
+	ctx, span := startSpan(ctx, "DownloadMigrations", attribute.String("s3.bucket", bucket), attribute.String("s3.prefix", prefix))
+	defer func() { endSpan(span, err) }()
+
+	if concurrency <= 0 {
+		concurrency = DefaultDownloadConcurrency
+	}
+
+	// List all migration files
+	keys, err := listAllObjects(ctx, client, settings, bucket, prefix)
+	if err != nil {
+		return err
+	}
+
+	// Skip directory markers and non-migration objects (result.json etc. share the prefix
+	// when migrations live directly under the version), and refuse keys that would map to
+	// the same local file
+	seen := make(map[string]string)
+	var downloads []string
+	bundle := ""
+	for _, key := range keys {
+		if isBundleKey(key) {
+			bundle = key
+			continue
+		}
+		if !isMigrationKey(key) {
+			continue
+		}
+		fileName := localMigrationName(key)
+		if other, ok := seen[fileName]; ok {
+			return fmt.Errorf("duplicate migration file name %s (%s and %s)", fileName, other, key)
+		}
+		seen[fileName] = key
+		downloads = append(downloads, key)
+	}
+
+	// A version pushed with --bundle holds all of its files in one tarball
+	if bundle != "" {
+		if len(downloads) > 0 {
+			return fmt.Errorf("found both %s and individual migration files under %s", BundleObjectName, prefix)
+		}
+		if versionIDs != nil {
+			if err := checkRecordedVersions(map[string]string{BundleObjectName: bundle}, versionIDs); err != nil {
+				return err
+			}
+		}
+		count, err := downloadBundle(ctx, client, settings, bucket, bundle, versionIDs[BundleObjectName], localDir)
+		span.SetAttributes(attribute.Int("file_count", count), attribute.Bool("bundle", true))
+		return err
+	}
+
+	if versionIDs != nil {
+		if err := checkRecordedVersions(seen, versionIDs); err != nil {
+			return err
+		}
+	}
+	span.SetAttributes(attribute.Int("file_count", len(downloads)))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	jobs := make(chan string)
+
+	for i := 0; i < concurrency && i < len(downloads); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range jobs {
+				if err := downloadMigrationFile(ctx, client, settings, bucket, key, versionIDs[localMigrationName(key)], localDir); err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+	for _, key := range downloads {
+		select {
+		case jobs <- key:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// checkRecordedVersions verifies that the listed migration files (local name -> key) and the
+// files with a recorded VersionId are the same set
+func checkRecordedVersions(listed map[string]string, versionIDs map[string]string) error {
+	var unrecorded, missing []string
+	for fileName := range listed {
+		if versionIDs[fileName] == "" {
+			unrecorded = append(unrecorded, fileName)
+		}
+	}
+	for fileName := range versionIDs {
+		if _, ok := listed[fileName]; !ok {
+			missing = append(missing, fileName)
+		}
+	}
+
+	if len(unrecorded) > 0 {
+		sort.Strings(unrecorded)
+		return fmt.Errorf("migration files without a recorded object version in %s: %s", FileManifestName, strings.Join(unrecorded, ", "))
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("migration files recorded in %s are missing from S3: %s", FileManifestName, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// compressedSuffix marks a gzip-compressed migration object (e.g. 001_init.sql.gz)
+const compressedSuffix = ".gz"
+
+// isMigrationKey reports whether key is a migration file rather than a directory marker, metadata
+// or a before.sql/after.sql hook
+func isMigrationKey(key string) bool {
+	if isHookKey(key) {
+		return false
+	}
+	return strings.HasSuffix(key, ".sql") || strings.HasSuffix(key, ".sql"+compressedSuffix)
+}
+
+// localMigrationName returns the file name a migration object is downloaded as,
+// with the compression suffix removed
+func localMigrationName(key string) string {
+	return strings.TrimSuffix(path.Base(key), compressedSuffix)
+}
+
+// MigrationObjectName returns the object name a local migration file is uploaded as
+func MigrationObjectName(fileName string, compress bool) string {
+	if compress {
+		return fileName + compressedSuffix
+	}
+	return fileName
+}
+
+// migrationContentType returns the Content-Type of a migration object, so that it opens as
+// text in the S3 console and downloads as a gzip file when compressed
+func migrationContentType(compress bool) string {
+	if compress {
+		return "application/gzip"
+	}
+	return "application/sql"
+}
+
+// migrationFileNames returns the local file names of the migration files among keys
+func migrationFileNames(keys []string) []string {
+	var files []string
+	for _, key := range keys {
+		if isMigrationKey(key) {
+			files = append(files, localMigrationName(key))
+		}
+	}
+	return files
 }
 
-// CreateS3Client creates an S3 client with optional custom endpoint
-func CreateS3Client(ctx context.Context, endpointURL string) (*s3.Client, error) {
-	cfg, err := config.LoadDefaultConfig(ctx)
+// downloadMigrationFile downloads a single object into localDir, decompressing .sql.gz objects.
+// A non-empty versionID downloads that version of the object.
+func downloadMigrationFile(ctx context.Context, client S3API, settings Settings, bucket, key, versionID, localDir string) error {
+	result, err := getMigrationObject(ctx, client, settings, bucket, key, versionID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+		return err
 	}
+	defer func() { _ = result.Body.Close() }()
 
-	if endpointURL != "" {
-		client := s3.NewFromConfig(cfg, func(o *s3.Options) {
-			o.BaseEndpoint = aws.String(endpointURL)
-			o.UsePathStyle = true
-		})
-		slog.Info("Using custom S3 endpoint", "endpoint", endpointURL)
-		return client, nil
+	var body io.Reader = result.Body
+	if strings.HasSuffix(key, compressedSuffix) {
+		gz, err := gzip.NewReader(result.Body)
+		if err != nil {
+			return fmt.Errorf("failed to decompress %s: %w", key, err)
+		}
+		defer func() { _ = gz.Close() }()
+		body = gz
 	}
 
-	return s3.NewFromConfig(cfg), nil
+	return writeMigrationFile(localDir, localMigrationName(key), body)
 }
 
-// FindUnappliedVersion finds the newest unapplied migration version
-func FindUnappliedVersion(ctx context.Context, client S3API, bucket, prefix string) (string, error) {
-	slog.Info("Listing versions from S3", "bucket", bucket, "prefix", prefix)
+// getMigrationObject gets an object holding migrations. A non-empty versionID gets that
+// version of the object and fails if S3 returns another one.
+func getMigrationObject(ctx context.Context, client S3API, settings Settings, bucket, key, versionID string) (*s3.GetObjectOutput, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
 
-	// List all objects with the prefix
-	resp, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
-		Bucket:    aws.String(bucket),
-		Prefix:    aws.String(prefix),
-		Delimiter: aws.String("/"),
+	result, err := withS3Retry(ctx, settings.Retry, "GetObject", func() (*s3.GetObjectOutput, error) {
+		return client.GetObject(ctx, input)
 	})
 	if err != nil {
-		return "", fmt.Errorf("failed to list S3 objects: %w", err)
-	}
-
-	// Extract version directories
-	var versions []string
-	for _, cp := range resp.CommonPrefixes {
-		if cp.Prefix == nil {
-			continue
-		}
-		// Extract version from prefix (e.g., "migrations/20260121010000/" -> "20260121010000")
-		versionPath := strings.TrimPrefix(*cp.Prefix, prefix)
-		versionPath = strings.TrimSuffix(versionPath, "/")
-		if versionPath != "" {
-			versions = append(versions, versionPath)
+		if versionID != "" {
+			return nil, fmt.Errorf("failed to download %s at recorded version %s: %w", key, versionID, err)
 		}
+		return nil, fmt.Errorf("failed to download %s: %w", key, err)
 	}
 
-	if len(versions) == 0 {
-		return "", fmt.Errorf("no versions found")
+	if versionID != "" && aws.ToString(result.VersionId) != versionID {
+		_ = result.Body.Close()
+		return nil, fmt.Errorf("downloaded %s at version %q, expected recorded version %s", key, aws.ToString(result.VersionId), versionID)
 	}
+	return result, nil
+}
 
-	// Sort versions numerically
-	sort.Strings(versions)
+// writeMigrationFile writes body to localDir/fileName
+func writeMigrationFile(localDir, fileName string, body io.Reader) error {
+	// O_EXCL guards against two downloads writing the same local file
+	localPath := path.Join(localDir, fileName)
+	file, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", localPath, err)
+	}
 
-	slog.Info("Found versions", "count", len(versions), "versions", versions)
+	_, err = io.Copy(file, body)
+	closeErr := file.Close()
 
-	// Check the newest version (last in sorted list)
-	newestVersion := versions[len(versions)-1]
-	exists, err := CheckResultExists(ctx, client, bucket, prefix, newestVersion)
 	if err != nil {
-		return "", fmt.Errorf("failed to check result.json for newest version %s: %w", newestVersion, err)
+		return fmt.Errorf("failed to write %s: %w", localPath, err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("failed to close %s: %w", localPath, closeErr)
 	}
 
-	if !exists {
-		slog.Info("Found unapplied newest version", "version", newestVersion)
-		return newestVersion, nil
+	return nil
+}
+
+// ListUploadedMigrations returns the object names (.sql, .sql.gz or the migrations.tar.gz
+// bundle) of the migration files already uploaded for version
+func ListUploadedMigrations(ctx context.Context, client S3API, settings Settings, bucket, prefix, version string) ([]string, error) {
+	keys, err := listAllObjects(ctx, client, settings, bucket, settings.migrationsPrefix(prefix, version))
+	if err != nil {
+		return nil, err
 	}
 
-	slog.Info("Newest version already applied (result.json exists)", "version", newestVersion)
-	return "", fmt.Errorf("no unapplied versions found")
+	var files []string
+	for _, key := range keys {
+		if isMigrationKey(key) || isBundleKey(key) {
+			files = append(files, path.Base(key))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
 }
 
-// CheckResultExists checks if result.json exists for a version
-func CheckResultExists(ctx context.Context, client S3API, bucket, prefix, version string) (bool, error) {
-	key := path.Join(prefix, version, "result.json")
+// DeleteUploadedMigrations deletes the named migration objects of version
+func DeleteUploadedMigrations(ctx context.Context, client S3API, settings Settings, bucket, prefix, version string, files []string) error {
+	for _, fileName := range files {
+		key := settings.MigrationKey(prefix, version, fileName)
+		_, err := withS3Retry(ctx, settings.Retry, "DeleteObject", func() (*s3.DeleteObjectOutput, error) {
+			return client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(key),
+			})
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete %s: %w", key, err)
+		}
+		slog.Info("Deleted stale migration", "key", key)
+	}
+	return nil
+}
 
-	_, err := client.HeadObject(ctx, &s3.HeadObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	})
+// DeleteVersion deletes every object under a version directory and returns how many were
+// deleted. The result file goes last, so an interrupted delete leaves the version marked as
+// applied instead of pending, where it would be applied again.
+func DeleteVersion(ctx context.Context, client S3API, settings Settings, bucket, prefix, version, resultFile string) (int, error) {
+	// An empty or malformed version would widen the delete to other versions
+	if err := settings.ValidateVersion(version); err != nil {
+		return 0, err
+	}
 
+	keys, err := listAllObjects(ctx, client, settings, bucket, path.Join(prefix, version)+"/")
 	if err != nil {
-		if strings.Contains(err.Error(), "NotFound") || strings.Contains(err.Error(), "NoSuchKey") {
-			return false, nil
-		}
-		return false, err
+		return 0, fmt.Errorf("failed to list objects of version %s: %w", version, err)
+	}
+	resultKey := path.Join(prefix, version, resultFileName(resultFile))
+	if i := slices.Index(keys, resultKey); i >= 0 {
+		keys = append(slices.Delete(keys, i, i+1), resultKey)
 	}
 
-	return true, nil
+	for i, key := range keys {
+		_, err := withS3Retry(ctx, settings.Retry, "DeleteObject", func() (*s3.DeleteObjectOutput, error) {
+			return client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(key),
+			})
+		})
+		if err != nil {
+			return i, fmt.Errorf("failed to delete %s: %w", key, err)
+		}
+	}
+	return len(keys), nil
 }
 
-// DownloadMigrations downloads migration files from S3 to a local directory
-func DownloadMigrations(ctx context.Context, client S3API, bucket, prefix, localDir string) error {
-	// List all migration files
-	resp, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
-		Bucket: aws.String(bucket),
-		Prefix: aws.String(prefix),
-	})
+// ChangedMigrations returns the files (paths relative to localDir, as given to UploadMigrations)
+// whose uploaded object for version is missing or has different content. Objects are compared
+// by the SHA-256 of their decompressed content, so a re-push of an identical set returns none.
+func ChangedMigrations(ctx context.Context, client S3API, settings Settings, bucket, prefix, version, localDir string, files []string, compress bool) ([]string, error) {
+	uploaded, err := ListUploadedMigrations(ctx, client, settings, bucket, prefix, version)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to list uploaded migrations: %w", err)
 	}
 
-	// Download each file
-	for _, obj := range resp.Contents {
-		if obj.Key == nil {
+	var changed []string
+	for _, file := range files {
+		objectName := MigrationObjectName(filepath.Base(file), compress)
+		if !slices.Contains(uploaded, objectName) {
+			changed = append(changed, file)
 			continue
 		}
 
-		key := *obj.Key
-		fileName := path.Base(key)
+		content, err := os.ReadFile(filepath.Join(localDir, file))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file %s: %w", file, err)
+		}
+		remote, err := migrationObjectChecksum(ctx, client, settings, bucket, settings.MigrationKey(prefix, version, objectName))
+		if err != nil {
+			return nil, err
+		}
+		if remote != sha256.Sum256(content) {
+			slog.Info("Uploaded migration differs from local file", "file", file)
+			changed = append(changed, file)
+		}
+	}
+	return changed, nil
+}
 
-		// Skip directory markers
-		if fileName == "" || strings.HasSuffix(key, "/") {
-			continue
+// MigrationVersionIDs returns the S3 VersionId of the current object of each file (paths
+// relative to the migrations directory, as given to UploadMigrations) by base name. Files whose
+// object has no VersionId, as in an unversioned bucket, are left out.
+func MigrationVersionIDs(ctx context.Context, client S3API, settings Settings, bucket, prefix, version string, files []string, compress bool) (map[string]string, error) {
+	versionIDs := make(map[string]string)
+	for _, file := range files {
+		fileName := filepath.Base(file)
+		key := settings.MigrationKey(prefix, version, MigrationObjectName(fileName, compress))
+		head, err := withS3Retry(ctx, settings.Retry, "HeadObject", func() (*s3.HeadObjectOutput, error) {
+			return client.HeadObject(ctx, &s3.HeadObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(key),
+			})
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get object version of %s: %w", key, err)
+		}
+		if head.VersionId != nil {
+			versionIDs[fileName] = *head.VersionId
 		}
+	}
+	return versionIDs, nil
+}
 
-		// Download file
-		result, err := client.GetObject(ctx, &s3.GetObjectInput{
+// migrationObjectChecksum returns the SHA-256 of a migration object's content, decompressing .sql.gz objects
+func migrationObjectChecksum(ctx context.Context, client S3API, settings Settings, bucket, key string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+
+	result, err := withS3Retry(ctx, settings.Retry, "GetObject", func() (*s3.GetObjectOutput, error) {
+		return client.GetObject(ctx, &s3.GetObjectInput{
 			Bucket: aws.String(bucket),
 			Key:    aws.String(key),
 		})
-		if err != nil {
-			return fmt.Errorf("failed to download %s: %w", key, err)
-		}
+	})
+	if err != nil {
+		return sum, fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	defer func() { _ = result.Body.Close() }()
 
-		// Write to local file
-		localPath := path.Join(localDir, fileName)
-		file, err := os.Create(localPath)
+	var body io.Reader = result.Body
+	if strings.HasSuffix(key, compressedSuffix) {
+		gz, err := gzip.NewReader(result.Body)
 		if err != nil {
-			_ = result.Body.Close()
-			return fmt.Errorf("failed to create %s: %w", localPath, err)
+			return sum, fmt.Errorf("failed to decompress %s: %w", key, err)
 		}
+		defer func() { _ = gz.Close() }()
+		body = gz
+	}
 
-		_, err = io.Copy(file, result.Body)
-		_ = result.Body.Close()
-		closeErr := file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return sum, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
 
+// FindMigrationFiles returns the .sql files in localDir as sorted paths relative to it.
+// With recursive, subdirectories are searched too; their files are flattened into one
+// S3 folder, so two files with the same name in different subdirectories are an error.
+func FindMigrationFiles(localDir string, recursive bool) ([]string, error) {
+	seen := make(map[string]string)
+	var files []string
+	err := filepath.WalkDir(localDir, func(p string, d os.DirEntry, err error) error {
 		if err != nil {
-			return fmt.Errorf("failed to write %s: %w", localPath, err)
+			return err
 		}
-		if closeErr != nil {
-			return fmt.Errorf("failed to close %s: %w", localPath, closeErr)
+		if d.IsDir() {
+			if p != localDir && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(d.Name(), ".sql") {
+			return nil
 		}
-	}
-
-	return nil
-}
 
-// UploadMigrations uploads migration files from a local directory to S3
-func UploadMigrations(ctx context.Context, client S3API, bucket, prefix, version, localDir string) error {
-	// Read directory entries
-	entries, err := os.ReadDir(localDir)
+		rel, err := filepath.Rel(localDir, p)
+		if err != nil {
+			return err
+		}
+		if other, ok := seen[d.Name()]; ok {
+			return fmt.Errorf("duplicate migration file name %s (%s and %s) would map to the same S3 key", d.Name(), other, rel)
+		}
+		seen[d.Name()] = rel
+		files = append(files, rel)
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to read directory: %w", err)
+		return nil, fmt.Errorf("failed to read directory: %w", err)
 	}
 
-	// Filter .sql files
-	var sqlFiles []string
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-		if strings.HasSuffix(entry.Name(), ".sql") {
-			sqlFiles = append(sqlFiles, entry.Name())
-		}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no .sql files found in directory: %s", localDir)
 	}
 
-	if len(sqlFiles) == 0 {
-		return fmt.Errorf("no .sql files found in directory: %s", localDir)
+	// Sort by file name, which is the order dbmate applies them in
+	sort.Slice(files, func(i, j int) bool {
+		return filepath.Base(files[i]) < filepath.Base(files[j])
+	})
+	return files, nil
+}
+
+// UploadMigrations uploads the migration files found by FindMigrationFiles to S3, each
+// under its base name. With compress, each file is gzipped and uploaded as <name>.sql.gz.
+// It returns the S3 VersionId of each uploaded file by base name; the map is empty if the
+// bucket is not versioned.
+func UploadMigrations(ctx context.Context, client S3API, settings Settings, bucket, prefix, version, localDir string, files []string, compress bool, opts PutOptions) (map[string]string, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no .sql files found in directory: %s", localDir)
 	}
 
-	slog.Info("Uploading migration files", "count", len(sqlFiles))
+	slog.Info("Uploading migration files", "count", len(files))
+
+	versionIDs := make(map[string]string)
 
 	// Upload each file
-	for _, fileName := range sqlFiles {
-		localPath := path.Join(localDir, fileName)
+	for _, file := range files {
+		fileName := filepath.Base(file)
 
 		// Read file content
-		content, err := os.ReadFile(localPath)
+		content, err := os.ReadFile(filepath.Join(localDir, file))
 		if err != nil {
-			return fmt.Errorf("failed to read file %s: %w", fileName, err)
+			return nil, fmt.Errorf("failed to read file %s: %w", file, err)
+		}
+
+		if compress {
+			if content, err = gzipBytes(content); err != nil {
+				return nil, fmt.Errorf("failed to compress %s: %w", fileName, err)
+			}
 		}
 
 		// Construct S3 key
-		s3Key := path.Join(prefix, version, "migrations", fileName)
+		s3Key := settings.MigrationKey(prefix, version, MigrationObjectName(fileName, compress))
 
 		// Upload to S3
-		_, err = client.PutObject(ctx, &s3.PutObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(s3Key),
-			Body:   bytes.NewReader(content),
+		output, err := withS3Retry(ctx, settings.Retry, "PutObject", func() (*s3.PutObjectOutput, error) {
+			return client.PutObject(ctx, &s3.PutObjectInput{
+				Bucket:               aws.String(bucket),
+				Key:                  aws.String(s3Key),
+				Body:                 bytes.NewReader(content),
+				ContentType:          aws.String(migrationContentType(compress)),
+				ServerSideEncryption: opts.serverSideEncryption(),
+				SSEKMSKeyId:          opts.kmsKeyID(),
+				Tagging:              opts.tagging(),
+			})
 		})
 		if err != nil {
-			return fmt.Errorf("failed to upload %s: %w", fileName, err)
+			return nil, fmt.Errorf("failed to upload %s: %w", fileName, err)
+		}
+		if output.VersionId != nil {
+			versionIDs[fileName] = *output.VersionId
 		}
 
 		slog.Info("Uploaded file", "file", fileName, "s3_key", s3Key)
 	}
 
-	return nil
+	return versionIDs, nil
+}
+
+// gzipBytes returns content compressed with gzip
+func gzipBytes(content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(content); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 // UploadPushInfo uploads push metadata as JSON to S3
-func UploadPushInfo(ctx context.Context, client S3API, bucket, prefix, version string, info *PushInfo) error {
+func UploadPushInfo(ctx context.Context, client S3API, settings Settings, bucket, prefix, version string, info *PushInfo, opts PutOptions) error {
 	key := path.Join(prefix, version, "push-info.json")
 
 	jsonData, err := json.MarshalIndent(info, "", "  ")
@@ -238,10 +1325,16 @@ func UploadPushInfo(ctx context.Context, client S3API, bucket, prefix, version s
 		return fmt.Errorf("failed to marshal push info: %w", err)
 	}
 
-	_, err = client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-		Body:   bytes.NewReader(jsonData),
+	_, err = withS3Retry(ctx, settings.Retry, "PutObject", func() (*s3.PutObjectOutput, error) {
+		return client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String(key),
+			Body:                 bytes.NewReader(jsonData),
+			ContentType:          aws.String("application/json"),
+			ServerSideEncryption: opts.serverSideEncryption(),
+			SSEKMSKeyId:          opts.kmsKeyID(),
+			Tagging:              opts.tagging(),
+		})
 	})
 
 	if err != nil {
@@ -252,19 +1345,66 @@ func UploadPushInfo(ctx context.Context, client S3API, bucket, prefix, version s
 	return nil
 }
 
-// UploadResult uploads the migration result as JSON to S3
-func UploadResult(ctx context.Context, client S3API, bucket, prefix, version string, result *Result) error {
-	key := path.Join(prefix, version, "result.json")
+// DownloadPushInfo reads push-info.json of a version. It returns nil if the version has none,
+// e.g. because it was pushed before push info was recorded.
+func DownloadPushInfo(ctx context.Context, client S3API, settings Settings, bucket, prefix, version string) (*PushInfo, error) {
+	key := path.Join(prefix, version, "push-info.json")
+
+	resp, err := withS3Retry(ctx, settings.Retry, "GetObject", func() (*s3.GetObjectOutput, error) {
+		return client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "NotFound") || strings.Contains(err.Error(), "NoSuchKey") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get push info from S3: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var info PushInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("failed to parse push info JSON: %w", err)
+	}
+
+	return &info, nil
+}
+
+// ResultMetadata returns the object metadata stamped on a result file, so that S3 event
+// consumers can react to a result without downloading and parsing its body. S3 exposes the
+// keys as x-amz-meta-status, x-amz-meta-version and x-amz-meta-migrations-applied.
+func ResultMetadata(result *Result) map[string]string {
+	return map[string]string{
+		"status":             result.Status,
+		"version":            result.Version,
+		"migrations-applied": strconv.Itoa(result.MigrationsApplied),
+	}
+}
+
+// UploadResult uploads the migration result as JSON to S3, tagged with status=<result status>.
+// metadata is set as user-defined object metadata (nil for none).
+func UploadResult(ctx context.Context, client S3API, settings Settings, bucket, prefix, version, resultFile string, result *Result, metadata map[string]string, opts PutOptions) error {
+	key := path.Join(prefix, version, resultFileName(resultFile))
+	opts = opts.withTag("status", result.Status)
 
 	jsonData, err := json.MarshalIndent(result, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal result: %w", err)
 	}
 
-	_, err = client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-		Body:   bytes.NewReader(jsonData),
+	_, err = withS3Retry(ctx, settings.Retry, "PutObject", func() (*s3.PutObjectOutput, error) {
+		return client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String(key),
+			Body:                 bytes.NewReader(jsonData),
+			ContentType:          aws.String("application/json"),
+			ServerSideEncryption: opts.serverSideEncryption(),
+			SSEKMSKeyId:          opts.kmsKeyID(),
+			Tagging:              opts.tagging(),
+			Metadata:             metadata,
+		})
 	})
 
 	if err != nil {
@@ -275,13 +1415,127 @@ func UploadResult(ctx context.Context, client S3API, bucket, prefix, version str
 	return nil
 }
 
-// downloadResult downloads and parses the result.json from S3
-func downloadResult(ctx context.Context, client S3API, bucket, prefix, version string) (*Result, error) {
-	key := path.Join(prefix, version, "result.json")
+// UploadSchema uploads the schema dumped after applying a version as version/schema.sql
+func UploadSchema(ctx context.Context, client S3API, settings Settings, bucket, prefix, version, schema string, opts PutOptions) error {
+	key := path.Join(prefix, version, "schema.sql")
+
+	_, err := withS3Retry(ctx, settings.Retry, "PutObject", func() (*s3.PutObjectOutput, error) {
+		return client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String(key),
+			Body:                 strings.NewReader(schema),
+			ContentType:          aws.String("application/sql"),
+			ServerSideEncryption: opts.serverSideEncryption(),
+			SSEKMSKeyId:          opts.kmsKeyID(),
+			Tagging:              opts.tagging(),
+		})
+	})
 
-	resp, err := client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
+	if err != nil {
+		return fmt.Errorf("failed to upload schema: %w", err)
+	}
+
+	slog.Info("Schema uploaded", "key", key)
+	return nil
+}
+
+// UploadAttempt keeps a copy of a result under version/attempts/<timestamp>.json so that
+// earlier attempts survive when result.json is overwritten
+func UploadAttempt(ctx context.Context, client S3API, settings Settings, bucket, prefix, version string, result *Result, opts PutOptions) error {
+	key := path.Join(prefix, version, "attempts", result.Timestamp+".json")
+	opts = opts.withTag("status", result.Status)
+
+	jsonData, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal attempt: %w", err)
+	}
+
+	_, err = withS3Retry(ctx, settings.Retry, "PutObject", func() (*s3.PutObjectOutput, error) {
+		return client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String(key),
+			Body:                 bytes.NewReader(jsonData),
+			ContentType:          aws.String("application/json"),
+			ServerSideEncryption: opts.serverSideEncryption(),
+			SSEKMSKeyId:          opts.kmsKeyID(),
+			Tagging:              opts.tagging(),
+		})
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to upload attempt: %w", err)
+	}
+
+	slog.Info("Attempt recorded", "key", key)
+	return nil
+}
+
+// UploadCurrentPointer writes the current pointer file (e.g. current.json) at the prefix root
+func UploadCurrentPointer(ctx context.Context, client S3API, settings Settings, bucket, prefix, fileName string, pointer *CurrentPointer, opts PutOptions) error {
+	key := path.Join(prefix, fileName)
+
+	jsonData, err := json.MarshalIndent(pointer, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal current pointer: %w", err)
+	}
+
+	_, err = withS3Retry(ctx, settings.Retry, "PutObject", func() (*s3.PutObjectOutput, error) {
+		return client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String(key),
+			Body:                 bytes.NewReader(jsonData),
+			ContentType:          aws.String("application/json"),
+			ServerSideEncryption: opts.serverSideEncryption(),
+			SSEKMSKeyId:          opts.kmsKeyID(),
+			Tagging:              opts.tagging(),
+		})
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to upload current pointer: %w", err)
+	}
+
+	slog.Info("Current pointer updated", "key", key, "version", pointer.Version)
+	return nil
+}
+
+// DownloadCurrentPointer reads the current pointer file from the prefix root
+func DownloadCurrentPointer(ctx context.Context, client S3API, settings Settings, bucket, prefix, fileName string) (*CurrentPointer, error) {
+	key := path.Join(prefix, fileName)
+
+	resp, err := withS3Retry(ctx, settings.Retry, "GetObject", func() (*s3.GetObjectOutput, error) {
+		return client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current pointer from S3: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var pointer CurrentPointer
+	if err := json.NewDecoder(resp.Body).Decode(&pointer); err != nil {
+		return nil, fmt.Errorf("failed to parse current pointer JSON: %w", err)
+	}
+
+	return &pointer, nil
+}
+
+// DownloadResult downloads and parses the result file of a version
+func DownloadResult(ctx context.Context, client S3API, settings Settings, bucket, prefix, version, resultFile string) (*Result, error) {
+	return downloadResult(ctx, client, settings, bucket, prefix, version, resultFile)
+}
+
+// downloadResult downloads and parses the result file from S3
+func downloadResult(ctx context.Context, client S3API, settings Settings, bucket, prefix, version, resultFile string) (*Result, error) {
+	key := path.Join(prefix, version, resultFileName(resultFile))
+
+	resp, err := withS3Retry(ctx, settings.Retry, "GetObject", func() (*s3.GetObjectOutput, error) {
+		return client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get result from S3: %w", err)
@@ -290,7 +1544,7 @@ func downloadResult(ctx context.Context, client S3API, bucket, prefix, version s
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read result body: %w", err)
+		return nil, fmt.Errorf("%w: %w", errReadResultBody, err)
 	}
 
 	var result Result
@@ -302,74 +1556,201 @@ func downloadResult(ctx context.Context, client S3API, bucket, prefix, version s
 	return &result, nil
 }
 
-// downloadResultWithRetry downloads result.json with exponential backoff retry
-func downloadResultWithRetry(ctx context.Context, client S3API, bucket, prefix, version string) (*Result, error) {
-	backoff := time.Second
-	maxRetries := 3
-
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		result, err := downloadResult(ctx, client, bucket, prefix, version)
-		if err == nil {
-			return result, nil
+// errReadResultBody marks a result whose body failed to stream after GetObject succeeded
+var errReadResultBody = errors.New("failed to read result body")
+
+// downloadResultWithRetry downloads the result file. GetObject already retries transient S3
+// errors, so only a body that fails to stream is downloaded again, with jittered backoff
+// that follows the S3 retry settings and never outlasts the deadline of ctx.
+func downloadResultWithRetry(ctx context.Context, client S3API, settings Settings, bucket, prefix, version, resultFile string) (*Result, error) {
+	var result *Result
+	err := retryWithBackoff(ctx, "DownloadResult", settings.Retry, func() error {
+		var err error
+		result, err = downloadResult(ctx, client, settings, bucket, prefix, version, resultFile)
+		if err != nil && !errors.Is(err, errReadResultBody) {
+			return noRetry(err)
 		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download result: %w", err)
+	}
+	return result, nil
+}
+
+// WaitForResult polls S3 for the result file until it appears or timeout occurs
+func WaitForResult(ctx context.Context, client S3API, settings Settings, bucket, prefix, version, resultFile string,
+	pollInterval, timeout time.Duration) (*Result, error) {
+	results, err := WaitForResults(ctx, client, settings, bucket, prefix, []string{version}, resultFile, pollInterval, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return results[version], nil
+}
+
+// WaitForPush polls S3 until every version has migration files (or already has a result
+// file, e.g. after its migrations were pruned) or timeout occurs. It lets a waiter that
+// starts before push has finished tell "not pushed yet" apart from "not applied yet".
+func WaitForPush(ctx context.Context, client S3API, settings Settings, bucket, prefix string, versions []string, resultFile string,
+	pollInterval, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-		if attempt < maxRetries {
-			slog.Warn("Failed to download result, retrying",
-				"attempt", attempt,
-				"max_retries", maxRetries,
-				"backoff", backoff,
-				"error", err)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	pushed := make(map[string]bool, len(versions))
+	attempt := 0
 
-			select {
-			case <-ctx.Done():
-				return nil, ctx.Err()
-			case <-time.After(backoff):
-				backoff *= 2
+	// check looks for the versions not seen yet and reports whether all of them were pushed
+	check := func() bool {
+		attempt++
+		for _, version := range versions {
+			if pushed[version] {
+				continue
+			}
+
+			exists, err := CheckMigrationsExist(ctx, client, settings, bucket, prefix, version)
+			if err == nil && !exists {
+				exists, err = CheckResultExists(ctx, client, settings, bucket, prefix, version, resultFile)
+			}
+			if err != nil {
+				slog.Warn("Error checking for pushed migrations", "version", version, "error", err)
+				continue // Retry on next interval
+			}
+			if exists {
+				slog.Info("Version pushed", "version", version, "attempts", attempt)
+				pushed[version] = true
 			}
 		}
+		return len(pushed) == len(versions)
+	}
+
+	if check() {
+		return nil
 	}
 
-	return nil, fmt.Errorf("failed to download result after %d attempts", maxRetries)
+	for {
+		select {
+		case <-ctx.Done():
+			var missing []string
+			for _, version := range versions {
+				if !pushed[version] {
+					missing = append(missing, version)
+				}
+			}
+			return fmt.Errorf("timeout waiting for version %s to be pushed after %v: no migrations under s3://%s/%s",
+				strings.Join(missing, ", "), timeout, bucket, settings.migrationsPrefix(prefix, missing[0]))
+		case <-ticker.C:
+			if check() {
+				return nil
+			}
+		}
+	}
 }
 
-// WaitForResult polls S3 for result.json until it appears or timeout occurs
-func WaitForResult(ctx context.Context, client S3API, bucket, prefix, version string,
-	pollInterval, timeout time.Duration) (*Result, error) {
+// WaitForResults polls S3 until every version has a result file or timeout occurs.
+// It returns as soon as any version reports a non-success status, so the returned map
+// then lacks the versions still pending.
+func WaitForResults(ctx context.Context, client S3API, settings Settings, bucket, prefix string, versions []string, resultFile string,
+	pollInterval, timeout time.Duration) (map[string]*Result, error) {
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	ticker := time.NewTicker(pollInterval)
 	defer ticker.Stop()
 
+	results := make(map[string]*Result, len(versions))
 	attempt := 0
 
+	// check looks for the results still missing and reports whether waiting is over
+	check := func() (bool, error) {
+		attempt++
+		for _, version := range versions {
+			if _, ok := results[version]; ok {
+				continue
+			}
+
+			slog.Info("Checking for result", "version", version, "attempt", attempt)
+			exists, err := CheckResultExists(ctx, client, settings, bucket, prefix, version, resultFile)
+			if err != nil {
+				slog.Warn("Error checking result existence", "version", version, "error", err)
+				continue // Retry on next interval
+			}
+			if !exists {
+				continue
+			}
+
+			slog.Info("Result found", "version", version, "attempts", attempt)
+			result, err := downloadResultWithRetry(ctx, client, settings, bucket, prefix, version, resultFile)
+			if err != nil {
+				return true, err
+			}
+			results[version] = result
+			if result.Status != "success" {
+				return true, nil
+			}
+		}
+		return len(results) == len(versions), nil
+	}
+
 	// Check immediately first (optimization)
-	attempt++
-	slog.Info("Checking for result", "version", version, "attempt", attempt)
-	if exists, _ := CheckResultExists(ctx, client, bucket, prefix, version); exists {
-		slog.Info("Result found immediately", "version", version)
-		return downloadResultWithRetry(ctx, client, bucket, prefix, version)
+	if done, err := check(); done {
+		return results, err
 	}
 
 	// Poll on interval
 	for {
 		select {
 		case <-ctx.Done():
-			return nil, fmt.Errorf("timeout waiting for result after %v (checked %d times)", timeout, attempt)
+			return results, fmt.Errorf("timeout waiting for result after %v (checked %d times)", timeout, attempt)
 		case <-ticker.C:
-			attempt++
-			slog.Info("Polling for result", "version", version, "attempt", attempt)
-
-			exists, err := CheckResultExists(ctx, client, bucket, prefix, version)
-			if err != nil {
-				slog.Warn("Error checking result existence", "error", err)
-				continue // Retry on next interval
+			if done, err := check(); done {
+				return results, err
 			}
+		}
+	}
+}
 
-			if exists {
-				slog.Info("Result found", "version", version, "attempts", attempt)
-				return downloadResultWithRetry(ctx, client, bucket, prefix, version)
+// CombineResults summarizes the results of several versions as one result for notifications.
+// The status is "success" only if every version succeeded; versions without a result are
+// reported as pending. The logs are concatenated under a header per version.
+func CombineResults(versions []string, results map[string]*Result) *Result {
+	combined := &Result{Status: "success"}
+	var logs []string
+	var errs []string
+	for _, version := range versions {
+		result, ok := results[version]
+		if !ok {
+			combined.Status = "failed"
+			logs = append(logs, fmt.Sprintf("== %s: pending ==", version))
+			continue
+		}
+		if result.Status != "success" {
+			combined.Status = "failed"
+			if result.Error != "" {
+				errs = append(errs, fmt.Sprintf("%s: %s", version, result.Error))
 			}
 		}
+		combined.MigrationsApplied += result.MigrationsApplied
+		combined.AppliedFiles = append(combined.AppliedFiles, result.AppliedFiles...)
+		logs = append(logs, fmt.Sprintf("== %s: %s ==\n%s", version, result.Status, result.Log))
+	}
+	combined.Version = strings.Join(versions, ", ")
+	combined.Error = strings.Join(errs, "; ")
+	combined.Log = strings.Join(logs, "\n")
+	return combined
+}
+
+// ResultsSummary describes each version with its status, e.g. "20240101000000: success, 20240102000000: pending"
+func ResultsSummary(versions []string, results map[string]*Result) string {
+	parts := make([]string, len(versions))
+	for i, version := range versions {
+		status := "pending"
+		if result, ok := results[version]; ok {
+			status = result.Status
+		}
+		parts[i] = fmt.Sprintf("%s: %s", version, status)
 	}
+	return strings.Join(parts, ", ")
 }
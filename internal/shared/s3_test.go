@@ -3,11 +3,23 @@ package shared
 import (
 	"bytes"
 	"context"
+	"encoding/pem"
+	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/tokuhirom/dbmate-deployer/internal/shared/testhelpers"
@@ -51,13 +63,51 @@ func TestCheckResultExists(t *testing.T) {
 			mock := testhelpers.NewMockS3Client()
 			tt.setup(mock)
 
-			exists, err := CheckResultExists(context.Background(), mock, tt.bucket, tt.prefix, tt.version)
+			exists, err := CheckResultExists(context.Background(), mock, DefaultSettings(), tt.bucket, tt.prefix, tt.version, "")
 			require.NoError(t, err)
 			assert.Equal(t, tt.expected, exists)
 		})
 	}
 }
 
+func TestCheckBucketAccess(t *testing.T) {
+	ctx := context.Background()
+
+	// An existing bucket with nothing under the prefix is empty, not an error
+	mock := testhelpers.NewMockS3Client()
+	empty, err := CheckBucketAccess(ctx, mock, DefaultSettings(), "test-bucket", "migrations/")
+	require.NoError(t, err)
+	assert.True(t, empty)
+
+	_, _ = mock.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("test-bucket"),
+		Key:    aws.String("migrations/20240101000000/migrations/001_a.sql"),
+		Body:   bytes.NewReader([]byte("-- migrate:up")),
+	})
+	empty, err = CheckBucketAccess(ctx, mock, DefaultSettings(), "test-bucket", "migrations/")
+	require.NoError(t, err)
+	assert.False(t, empty)
+
+	mock.InjectErrors("HeadBucket", &types.NotFound{})
+	_, err = CheckBucketAccess(ctx, mock, DefaultSettings(), "test-buckt", "migrations/")
+	assert.ErrorIs(t, err, ErrBucketNotFound)
+	assert.ErrorContains(t, err, "s3://test-buckt does not exist")
+
+	mock.InjectErrors("HeadBucket", &smithy.GenericAPIError{Code: "Forbidden"})
+	_, err = CheckBucketAccess(ctx, mock, DefaultSettings(), "test-bucket", "migrations/")
+	assert.ErrorIs(t, err, ErrBucketAccessDenied)
+
+	mock.InjectErrors("ListObjectsV2", &smithy.GenericAPIError{Code: "AccessDenied"})
+	_, err = CheckBucketAccess(ctx, mock, DefaultSettings(), "test-bucket", "migrations/")
+	assert.ErrorIs(t, err, ErrBucketAccessDenied)
+	assert.ErrorContains(t, err, "s3://test-bucket/migrations/ can't be listed")
+
+	mock.InjectErrors("HeadBucket", &smithy.GenericAPIError{Code: "InvalidBucketName"})
+	_, err = CheckBucketAccess(ctx, mock, DefaultSettings(), "bad_bucket", "migrations/")
+	assert.ErrorContains(t, err, "failed to access bucket bad_bucket")
+	assert.NotErrorIs(t, err, ErrBucketNotFound)
+}
+
 func TestFindUnappliedVersion(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -127,7 +177,7 @@ func TestFindUnappliedVersion(t *testing.T) {
 			mock := testhelpers.NewMockS3Client()
 			tt.setup(mock)
 
-			version, err := FindUnappliedVersion(context.Background(), mock, tt.bucket, tt.prefix)
+			version, err := FindUnappliedVersion(context.Background(), mock, DefaultSettings(), tt.bucket, tt.prefix, "")
 
 			if tt.expectError {
 				assert.Error(t, err)
@@ -139,6 +189,179 @@ func TestFindUnappliedVersion(t *testing.T) {
 	}
 }
 
+func TestFindUnappliedVersions(t *testing.T) {
+	putObject := func(mock *testhelpers.MockS3Client, key, body string) {
+		_, _ = mock.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String(key),
+			Body:   io.NopCloser(bytes.NewBufferString(body)),
+		})
+	}
+
+	tests := []struct {
+		name           string
+		setup          func(*testhelpers.MockS3Client)
+		expectVersions []string
+		expectError    string
+	}{
+		{
+			name: "returns all pending versions in ascending order",
+			setup: func(mock *testhelpers.MockS3Client) {
+				putObject(mock, "migrations/20240103000000/migrations/test.sql", "test")
+				putObject(mock, "migrations/20240101000000/migrations/test.sql", "test")
+				putObject(mock, "migrations/20240102000000/migrations/test.sql", "test")
+				putObject(mock, "migrations/20240101000000/result.json", `{"status":"success"}`)
+			},
+			expectVersions: []string{"20240102000000", "20240103000000"},
+		},
+		{
+			name: "older version pending while newest is applied",
+			setup: func(mock *testhelpers.MockS3Client) {
+				putObject(mock, "migrations/20240101000000/migrations/test.sql", "test")
+				putObject(mock, "migrations/20240102000000/migrations/test.sql", "test")
+				putObject(mock, "migrations/20240102000000/result.json", `{"status":"success"}`)
+			},
+			expectVersions: []string{"20240101000000"},
+		},
+		{
+			name: "all versions applied",
+			setup: func(mock *testhelpers.MockS3Client) {
+				putObject(mock, "migrations/20240101000000/migrations/test.sql", "test")
+				putObject(mock, "migrations/20240101000000/result.json", `{"status":"success"}`)
+			},
+			expectError: "no unapplied versions found",
+		},
+		{
+			name:        "no versions found",
+			setup:       func(mock *testhelpers.MockS3Client) {},
+			expectError: "no versions found",
+		},
+		{
+			name: "skips directories that are not 14-digit versions",
+			setup: func(mock *testhelpers.MockS3Client) {
+				putObject(mock, "migrations/20240101000000/migrations/test.sql", "test")
+				putObject(mock, "migrations/backup/migrations/test.sql", "test")
+				putObject(mock, "migrations/2024010100/migrations/test.sql", "test")
+				putObject(mock, "migrations/202401010000001/migrations/test.sql", "test")
+				putObject(mock, "migrations/2024010100000a/migrations/test.sql", "test")
+			},
+			expectVersions: []string{"20240101000000"},
+		},
+		{
+			name: "only malformed directories",
+			setup: func(mock *testhelpers.MockS3Client) {
+				putObject(mock, "migrations/backup/migrations/test.sql", "test")
+			},
+			expectError: "no versions found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := testhelpers.NewMockS3Client()
+			tt.setup(mock)
+
+			versions, err := FindUnappliedVersions(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "")
+
+			if tt.expectError != "" {
+				require.Error(t, err)
+				assert.Equal(t, tt.expectError, err.Error())
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tt.expectVersions, versions)
+			}
+		})
+	}
+}
+
+func TestFindFailedVersion(t *testing.T) {
+	putObject := func(mock *testhelpers.MockS3Client, key, body string) {
+		_, _ = mock.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String(key),
+			Body:   io.NopCloser(bytes.NewBufferString(body)),
+		})
+	}
+	ctx := context.Background()
+
+	mock := testhelpers.NewMockS3Client()
+	putObject(mock, "migrations/20240101000000/migrations/test.sql", "test")
+	putObject(mock, "migrations/20240101000000/result.json", `{"status":"success"}`)
+	putObject(mock, "migrations/20240102000000/migrations/test.sql", "test")
+	putObject(mock, "migrations/20240102000000/result.json", `{"status":"failed"}`)
+	putObject(mock, "migrations/20240103000000/migrations/test.sql", "test")
+
+	// The pending newest version is skipped
+	version, err := FindFailedVersion(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, "20240102000000", version)
+
+	// Versions newer than the target are ignored
+	_, err = FindFailedVersion(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "", "20240101000000")
+	assert.ErrorIs(t, err, ErrNoFailedVersion)
+
+	// Deleting the result makes the version pending again
+	require.NoError(t, DeleteResult(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240102000000", ""))
+	pending, err := FindUnappliedVersions(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"20240102000000", "20240103000000"}, pending)
+
+	// A failure superseded by a newer successful version isn't retried
+	putObject(mock, "migrations/20240102000000/result.json", `{"status":"failed"}`)
+	putObject(mock, "migrations/20240103000000/result.json", `{"status":"success"}`)
+	_, err = FindFailedVersion(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "", "")
+	assert.ErrorIs(t, err, ErrNoFailedVersion)
+}
+
+func TestFindPendingVersions_OnFailed(t *testing.T) {
+	putObject := func(mock *testhelpers.MockS3Client, key, body string) {
+		_, _ = mock.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String(key),
+			Body:   io.NopCloser(bytes.NewBufferString(body)),
+		})
+	}
+	ctx := context.Background()
+
+	mock := testhelpers.NewMockS3Client()
+	putObject(mock, "migrations/20240101000000/migrations/test.sql", "test")
+	putObject(mock, "migrations/20240101000000/result.json", `{"status":"success"}`)
+	putObject(mock, "migrations/20240102000000/migrations/test.sql", "test")
+	putObject(mock, "migrations/20240102000000/result.json", `{"status":"failed"}`)
+	putObject(mock, "migrations/20240103000000/migrations/test.sql", "test")
+
+	tests := []struct {
+		onFailed       string
+		expectVersions []string
+		expectPending  bool
+	}{
+		{onFailed: OnFailedSkip, expectVersions: []string{"20240103000000"}},
+		{onFailed: OnFailedRetry, expectVersions: []string{"20240102000000", "20240103000000"}, expectPending: true},
+		{onFailed: OnFailedBlock},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.onFailed, func(t *testing.T) {
+			versions, err := FindPendingVersions(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "", "", tt.onFailed)
+			if tt.expectVersions == nil {
+				assert.ErrorIs(t, err, ErrNoUnappliedVersions)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tt.expectVersions, versions)
+			}
+
+			pending, err := ResultPending(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240102000000", "", tt.onFailed)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectPending, pending)
+		})
+	}
+
+	// A successful result is never pending
+	pending, err := ResultPending(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", "", OnFailedRetry)
+	require.NoError(t, err)
+	assert.False(t, pending)
+}
+
 func TestUploadResult(t *testing.T) {
 	mock := testhelpers.NewMockS3Client()
 
@@ -150,7 +373,7 @@ func TestUploadResult(t *testing.T) {
 		Log:               "Migration completed",
 	}
 
-	err := UploadResult(context.Background(), mock, "test-bucket", "migrations/", "20240101000000", result)
+	err := UploadResult(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", "", result, nil, PutOptions{})
 	require.NoError(t, err)
 
 	// Verify the result was uploaded
@@ -164,6 +387,66 @@ func TestUploadResult(t *testing.T) {
 	assert.Contains(t, content, `"version": "20240101000000"`)
 }
 
+func TestUploadResult_Metadata(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+
+	result := &Result{Version: "20240101000000", Status: "failed", MigrationsApplied: 2}
+	err := UploadResult(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", "", result, ResultMetadata(result), PutOptions{})
+	require.NoError(t, err)
+
+	input := mock.PutInputs["test-bucket/migrations/20240101000000/result.json"]
+	require.NotNil(t, input)
+	assert.Equal(t, map[string]string{
+		"status":             "failed",
+		"version":            "20240101000000",
+		"migrations-applied": "2",
+	}, input.Metadata)
+}
+
+func TestCustomResultFile(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+
+	_, _ = mock.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String("test-bucket"),
+		Key:    aws.String("migrations/20240101000000/migrations/test.sql"),
+		Body:   io.NopCloser(bytes.NewBufferString("test")),
+	})
+
+	// Staging has applied the version, production has not
+	result := &Result{Version: "20240101000000", Status: "success"}
+	err := UploadResult(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", "result.staging.json", result, nil, PutOptions{})
+	require.NoError(t, err)
+	assert.True(t, mock.HasObject("test-bucket", "migrations/20240101000000/result.staging.json"))
+	assert.False(t, mock.HasObject("test-bucket", "migrations/20240101000000/result.json"))
+
+	_, err = FindUnappliedVersions(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "result.staging.json")
+	assert.ErrorIs(t, err, ErrNoUnappliedVersions)
+
+	versions, err := FindUnappliedVersions(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "result.prod.json")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"20240101000000"}, versions)
+}
+
+func TestUploadCurrentPointer(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+
+	pointer := &CurrentPointer{
+		Version:   "20240101000000",
+		AppliedAt: "2024-01-01T00:00:00Z",
+	}
+
+	err := UploadCurrentPointer(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "current.json", pointer, PutOptions{})
+	require.NoError(t, err)
+
+	// Pointer lives at the prefix root, not inside a version directory
+	assert.True(t, mock.HasObject("test-bucket", "migrations/current.json"))
+
+	// Read it back
+	got, err := DownloadCurrentPointer(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "current.json")
+	require.NoError(t, err)
+	assert.Equal(t, pointer, got)
+}
+
 func TestUploadPushInfo(t *testing.T) {
 	mock := testhelpers.NewMockS3Client()
 
@@ -181,7 +464,7 @@ func TestUploadPushInfo(t *testing.T) {
 		},
 	}
 
-	err := UploadPushInfo(context.Background(), mock, "test-bucket", "migrations/", "20240101000000", pushInfo)
+	err := UploadPushInfo(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", pushInfo, PutOptions{})
 	require.NoError(t, err)
 
 	// Verify the push info was uploaded
@@ -207,7 +490,7 @@ func TestUploadPushInfo_Local(t *testing.T) {
 		},
 	}
 
-	err := UploadPushInfo(context.Background(), mock, "test-bucket", "migrations/", "20240101000000", pushInfo)
+	err := UploadPushInfo(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", pushInfo, PutOptions{})
 	require.NoError(t, err)
 
 	// Verify the content
@@ -218,6 +501,26 @@ func TestUploadPushInfo_Local(t *testing.T) {
 	assert.NotContains(t, content, `"repository"`)
 }
 
+func TestDownloadPushInfo(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+
+	pushInfo := &PushInfo{
+		PushedAt: "2024-01-01T00:00:00Z",
+		Source:   PushSource{Type: "github_actions", Repository: "tokuhirom/dbmate-deployer", Actor: "tokuhirom", SHA: "abc123"},
+	}
+	require.NoError(t, UploadPushInfo(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", pushInfo, PutOptions{}))
+
+	got, err := DownloadPushInfo(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000")
+	require.NoError(t, err)
+	assert.Equal(t, pushInfo, got)
+
+	// Versions pushed without push info have none
+	got, err = DownloadPushInfo(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240102000000")
+	require.NoError(t, err)
+	assert.Nil(t, got)
+}
+
 func TestDownloadMigrations(t *testing.T) {
 	mock := testhelpers.NewMockS3Client()
 
@@ -236,10 +539,10 @@ func TestDownloadMigrations(t *testing.T) {
 	// Download to temp directory
 	tempDir := t.TempDir()
 
-	err := DownloadMigrations(context.Background(), mock,
+	err := DownloadMigrations(context.Background(), mock, DefaultSettings(),
 		"test-bucket",
 		"migrations/20240101000000/migrations/",
-		tempDir)
+		tempDir, 0)
 	require.NoError(t, err)
 
 	// Verify files were downloaded
@@ -258,11 +561,13 @@ func TestUploadMigrations(t *testing.T) {
 	require.NoError(t, err)
 
 	// Upload migrations
-	err = UploadMigrations(context.Background(), mock,
+	files, err := FindMigrationFiles(tempDir, false)
+	require.NoError(t, err)
+	_, err = UploadMigrations(context.Background(), mock, DefaultSettings(),
 		"test-bucket",
 		"migrations/",
 		"20240101000000",
-		tempDir)
+		tempDir, files, false, PutOptions{})
 	require.NoError(t, err)
 
 	// Verify files were uploaded
@@ -285,12 +590,845 @@ func TestUploadMigrations_NoSQLFiles(t *testing.T) {
 	err := testhelpers.WriteFile(tempDir, "README.md", "Not a migration")
 	require.NoError(t, err)
 
+	// Discovery should fail
+	_, err = FindMigrationFiles(tempDir, false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no .sql files found")
+
 	// Upload should fail
-	err = UploadMigrations(context.Background(), mock,
+	_, err = UploadMigrations(context.Background(), mock, DefaultSettings(),
 		"test-bucket",
 		"migrations/",
 		"20240101000000",
-		tempDir)
+		tempDir, nil, false, PutOptions{})
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "no .sql files found")
 }
+
+func TestFindMigrationFiles_Recursive(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, testhelpers.WriteFile(dir, "002_b.sql", "SELECT 2;"))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "users"), 0o755))
+	require.NoError(t, testhelpers.WriteFile(filepath.Join(dir, "users"), "001_a.sql", "SELECT 1;"))
+	require.NoError(t, testhelpers.WriteFile(filepath.Join(dir, "users"), "notes.md", "not a migration"))
+
+	files, err := FindMigrationFiles(dir, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"002_b.sql"}, files)
+
+	// Sorted by file name, not by path
+	files, err = FindMigrationFiles(dir, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join("users", "001_a.sql"), "002_b.sql"}, files)
+
+	mock := testhelpers.NewMockS3Client()
+	_, err = UploadMigrations(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", dir, files, false, PutOptions{})
+	require.NoError(t, err)
+	content, _ := mock.GetObjectContent("test-bucket", "migrations/20240101000000/migrations/001_a.sql")
+	assert.Equal(t, "SELECT 1;", content)
+}
+
+func TestFindMigrationFiles_Collision(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"a", "b"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, sub), 0o755))
+		require.NoError(t, testhelpers.WriteFile(filepath.Join(dir, sub), "001_init.sql", "SELECT 1;"))
+	}
+
+	_, err := FindMigrationFiles(dir, true)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "duplicate migration file name 001_init.sql")
+	assert.Contains(t, err.Error(), filepath.Join("a", "001_init.sql"))
+	assert.Contains(t, err.Error(), filepath.Join("b", "001_init.sql"))
+}
+
+func TestFindUnappliedVersions_Paginated(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	mock.MaxKeys = 2
+
+	versions := []string{"20240101000000", "20240102000000", "20240103000000", "20240104000000", "20240105000000"}
+	for _, version := range versions {
+		_, _ = mock.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String("migrations/" + version + "/migrations/test.sql"),
+			Body:   io.NopCloser(bytes.NewBufferString("test")),
+		})
+	}
+
+	pending, err := FindUnappliedVersions(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "")
+	require.NoError(t, err)
+
+	// All versions must be found even though each page holds only two
+	assert.Equal(t, versions, pending)
+	assert.Equal(t, 3, mock.ListCalls)
+}
+
+func TestDownloadMigrations_Paginated(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	mock.MaxKeys = 2
+
+	fileNames := []string{"001_a.sql", "002_b.sql", "003_c.sql", "004_d.sql", "005_e.sql"}
+	for _, fileName := range fileNames {
+		_, _ = mock.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String("migrations/20240101000000/migrations/" + fileName),
+			Body:   io.NopCloser(bytes.NewBufferString("-- " + fileName)),
+		})
+	}
+
+	tempDir := t.TempDir()
+	err := DownloadMigrations(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/20240101000000/migrations/", tempDir, 0)
+	require.NoError(t, err)
+
+	for _, fileName := range fileNames {
+		content, err := os.ReadFile(filepath.Join(tempDir, fileName))
+		require.NoError(t, err, "%s should be downloaded", fileName)
+		assert.Equal(t, "-- "+fileName, string(content))
+	}
+}
+
+func TestDownloadMigrations_Concurrent(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+
+	var fileNames []string
+	for i := 0; i < 30; i++ {
+		fileName := fmt.Sprintf("%03d_migration.sql", i)
+		fileNames = append(fileNames, fileName)
+		_, _ = mock.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String("migrations/20240101000000/migrations/" + fileName),
+			Body:   io.NopCloser(bytes.NewBufferString("-- " + fileName)),
+		})
+	}
+
+	tempDir := t.TempDir()
+	err := DownloadMigrations(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/20240101000000/migrations/", tempDir, 4)
+	require.NoError(t, err)
+
+	// Every file must land regardless of the order downloads finish in
+	entries, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, len(fileNames))
+	for _, fileName := range fileNames {
+		content, err := os.ReadFile(filepath.Join(tempDir, fileName))
+		require.NoError(t, err, "%s should be downloaded", fileName)
+		assert.Equal(t, "-- "+fileName, string(content))
+	}
+}
+
+func TestDownloadMigrations_DuplicateFileName(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	for _, key := range []string{
+		"migrations/20240101000000/migrations/001_a.sql",
+		"migrations/20240101000000/migrations/sub/001_a.sql",
+	} {
+		_, _ = mock.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String(key),
+			Body:   io.NopCloser(bytes.NewBufferString("-- migrate:up")),
+		})
+	}
+
+	err := DownloadMigrations(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/20240101000000/migrations/", t.TempDir(), 0)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "duplicate migration file name 001_a.sql")
+}
+
+func TestUploadMigrations_CompressedRoundTrip(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+
+	srcDir := t.TempDir()
+	require.NoError(t, testhelpers.WriteFile(srcDir, "001_create_users.sql", "CREATE TABLE users (id INT);"))
+
+	_, err := UploadMigrations(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", srcDir, []string{"001_create_users.sql"}, true, PutOptions{})
+	require.NoError(t, err)
+	assert.False(t, mock.HasObject("test-bucket", "migrations/20240101000000/migrations/001_create_users.sql"))
+	require.True(t, mock.HasObject("test-bucket", "migrations/20240101000000/migrations/001_create_users.sql.gz"))
+
+	// A plain file next to the compressed one is downloaded as is
+	_, _ = mock.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("test-bucket"),
+		Key:    aws.String("migrations/20240101000000/migrations/002_create_posts.sql"),
+		Body:   io.NopCloser(bytes.NewBufferString("CREATE TABLE posts (id INT);")),
+	})
+
+	dstDir := t.TempDir()
+	err = DownloadMigrations(ctx, mock, DefaultSettings(), "test-bucket", "migrations/20240101000000/migrations/", dstDir, 0)
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(filepath.Join(dstDir, "001_create_users.sql"))
+	require.NoError(t, err)
+	assert.Equal(t, "CREATE TABLE users (id INT);", string(content))
+	content, err = os.ReadFile(filepath.Join(dstDir, "002_create_posts.sql"))
+	require.NoError(t, err)
+	assert.Equal(t, "CREATE TABLE posts (id INT);", string(content))
+
+	files, err := ListUploadedMigrations(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"001_create_users.sql.gz", "002_create_posts.sql"}, files)
+}
+
+func TestDownloadMigrations_CompressedDuplicate(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	for _, key := range []string{
+		"migrations/20240101000000/migrations/001_a.sql",
+		"migrations/20240101000000/migrations/001_a.sql.gz",
+	} {
+		_, _ = mock.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String(key),
+			Body:   io.NopCloser(bytes.NewBufferString("-- migrate:up")),
+		})
+	}
+
+	err := DownloadMigrations(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/20240101000000/migrations/", t.TempDir(), 0)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "duplicate migration file name 001_a.sql")
+}
+
+func TestDownloadVersionMigrations_PinnedVersions(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	mock.Versioning = true
+	ctx := context.Background()
+
+	srcDir := t.TempDir()
+	require.NoError(t, testhelpers.WriteFile(srcDir, "001_a.sql", "CREATE TABLE a (id INT);"))
+	require.NoError(t, testhelpers.WriteFile(srcDir, "002_b.sql", "CREATE TABLE b (id INT);"))
+	files := []string{"001_a.sql", "002_b.sql"}
+
+	versionIDs, err := UploadMigrations(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", srcDir, files, false, PutOptions{})
+	require.NoError(t, err)
+	require.Len(t, versionIDs, 2)
+	require.NoError(t, UploadFileManifest(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", files, versionIDs, PutOptions{}))
+
+	current, err := MigrationVersionIDs(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", files, false)
+	require.NoError(t, err)
+	assert.Equal(t, versionIDs, current)
+
+	// An object overwritten after the push is still downloaded as recorded
+	_, err = mock.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("test-bucket"),
+		Key:    aws.String("migrations/20240101000000/migrations/001_a.sql"),
+		Body:   bytes.NewReader([]byte("DROP TABLE users;")),
+	})
+	require.NoError(t, err)
+
+	dstDir := t.TempDir()
+	require.NoError(t, DownloadVersionMigrations(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", dstDir, 0))
+	content, err := os.ReadFile(filepath.Join(dstDir, "001_a.sql"))
+	require.NoError(t, err)
+	assert.Equal(t, "CREATE TABLE a (id INT);", string(content))
+
+	// A recorded version that no longer exists fails the download
+	broken := map[string]string{"001_a.sql": versionIDs["001_a.sql"], "002_b.sql": "deleted"}
+	require.NoError(t, UploadFileManifest(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", files, broken, PutOptions{}))
+	err = DownloadVersionMigrations(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", t.TempDir(), 0)
+	assert.ErrorContains(t, err, "at recorded version deleted")
+
+	// Files must match the recorded set in both directions
+	require.NoError(t, UploadFileManifest(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", files[:1],
+		map[string]string{"001_a.sql": versionIDs["001_a.sql"]}, PutOptions{}))
+	err = DownloadVersionMigrations(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", t.TempDir(), 0)
+	assert.ErrorContains(t, err, "without a recorded object version in files.json: 002_b.sql")
+
+	_, err = mock.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String("test-bucket"),
+		Key:    aws.String("migrations/20240101000000/migrations/002_b.sql"),
+	})
+	require.NoError(t, err)
+	require.NoError(t, UploadFileManifest(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", files, versionIDs, PutOptions{}))
+	err = DownloadVersionMigrations(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", t.TempDir(), 0)
+	assert.ErrorContains(t, err, "recorded in files.json are missing from S3: 002_b.sql")
+}
+
+func TestUploadMigrations_UnversionedBucket(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	srcDir := t.TempDir()
+	require.NoError(t, testhelpers.WriteFile(srcDir, "001_a.sql", "SELECT 1;"))
+
+	versionIDs, err := UploadMigrations(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", srcDir, []string{"001_a.sql"}, false, PutOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, versionIDs)
+
+	// Without recorded versions the manifest stays as before
+	require.NoError(t, UploadFileManifest(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", []string{"001_a.sql"}, versionIDs, PutOptions{}))
+	content, _ := mock.GetObjectContent("test-bucket", "migrations/20240101000000/files.json")
+	assert.JSONEq(t, `{"files":["001_a.sql"]}`, content)
+}
+
+func TestPutOptions_Encryption(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	opts := PutOptions{ServerSideEncryption: SSEKMS, SSEKMSKeyID: "arn:aws:kms:us-east-1:123456789012:key/test"}
+
+	err := UploadResult(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", "", &Result{Status: "success"}, nil, opts)
+	require.NoError(t, err)
+
+	input := mock.PutInputs["test-bucket/migrations/20240101000000/result.json"]
+	require.NotNil(t, input)
+	assert.Equal(t, types.ServerSideEncryptionAwsKms, input.ServerSideEncryption)
+	assert.Equal(t, "arn:aws:kms:us-east-1:123456789012:key/test", aws.ToString(input.SSEKMSKeyId))
+
+	// No SSE by default
+	err = UploadResult(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "20240102000000", "", &Result{Status: "success"}, nil, PutOptions{})
+	require.NoError(t, err)
+	input = mock.PutInputs["test-bucket/migrations/20240102000000/result.json"]
+	assert.Empty(t, input.ServerSideEncryption)
+	assert.Nil(t, input.SSEKMSKeyId)
+}
+
+func TestPutOptions_Validate(t *testing.T) {
+	assert.NoError(t, PutOptions{}.Validate())
+	assert.NoError(t, PutOptions{ServerSideEncryption: SSEAES256}.Validate())
+	assert.NoError(t, PutOptions{ServerSideEncryption: SSEKMS, SSEKMSKeyID: "key"}.Validate())
+	assert.EqualError(t, PutOptions{ServerSideEncryption: SSEAES256, SSEKMSKeyID: "key"}.Validate(), "--sse-kms-key-id requires --sse=aws:kms")
+	assert.Error(t, PutOptions{ServerSideEncryption: "aws:kms:dsse"}.Validate())
+}
+
+func TestCreateS3Client_AssumeRole(t *testing.T) {
+	t.Setenv("AWS_REGION", "us-east-1")
+	client, err := CreateS3Client(context.Background(), S3ClientOptions{
+		EndpointURL:   "http://localhost:9000",
+		AssumeRoleARN: "arn:aws:iam::123456789012:role/migrations",
+		ExternalID:    "external",
+	})
+	require.NoError(t, err)
+
+	// Credentials come from the cached AssumeRole provider and the custom endpoint is kept
+	assert.True(t, aws.IsCredentialsProvider(client.Options().Credentials, (*stscreds.AssumeRoleProvider)(nil)))
+	assert.Equal(t, "http://localhost:9000", aws.ToString(client.Options().BaseEndpoint))
+	assert.True(t, client.Options().UsePathStyle)
+}
+
+func TestCreateS3Client_AWSProfile(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config")
+	require.NoError(t, os.WriteFile(configFile, []byte("[profile staging]\nregion = eu-west-1\n"), 0644))
+	t.Setenv("AWS_CONFIG_FILE", configFile)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+
+	client, err := CreateS3Client(context.Background(), S3ClientOptions{Profile: "staging"})
+	require.NoError(t, err)
+	assert.Equal(t, "eu-west-1", client.Options().Region)
+
+	_, err = CreateS3Client(context.Background(), S3ClientOptions{Profile: "missing"})
+	assert.ErrorContains(t, err, "failed to load AWS config")
+}
+
+func TestCreateS3Client_AWSSharedFiles(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "mounted-config")
+	credentialsFile := filepath.Join(dir, "mounted-credentials")
+	require.NoError(t, os.WriteFile(configFile, []byte("[profile staging]\nregion = ap-northeast-1\n"), 0644))
+	require.NoError(t, os.WriteFile(credentialsFile, []byte("[staging]\naws_access_key_id = AKIDMOUNTED\naws_secret_access_key = secret\n"), 0644))
+	// The default locations point elsewhere, so only the flags can make this work
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+
+	client, err := CreateS3Client(context.Background(), S3ClientOptions{
+		Profile:         "staging",
+		ConfigFile:      configFile,
+		CredentialsFile: credentialsFile,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "ap-northeast-1", client.Options().Region)
+
+	creds, err := client.Options().Credentials.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "AKIDMOUNTED", creds.AccessKeyID)
+}
+
+func TestCreateS3Client_Addressing(t *testing.T) {
+	t.Setenv("AWS_REGION", "us-east-1")
+
+	// Path-style by default with a custom endpoint, virtual-hosted against AWS
+	client, err := CreateS3Client(context.Background(), S3ClientOptions{EndpointURL: "http://localhost:9000"})
+	require.NoError(t, err)
+	assert.True(t, client.Options().UsePathStyle)
+	assert.Equal(t, "us-east-1", client.Options().Region)
+
+	client, err = CreateS3Client(context.Background(), S3ClientOptions{})
+	require.NoError(t, err)
+	assert.False(t, client.Options().UsePathStyle)
+
+	// Both can be overridden
+	client, err = CreateS3Client(context.Background(), S3ClientOptions{
+		EndpointURL:    "https://account.r2.cloudflarestorage.com",
+		Region:         "auto",
+		ForcePathStyle: aws.Bool(false),
+	})
+	require.NoError(t, err)
+	assert.False(t, client.Options().UsePathStyle)
+	assert.Equal(t, "auto", client.Options().Region)
+
+	client, err = CreateS3Client(context.Background(), S3ClientOptions{ForcePathStyle: aws.Bool(true)})
+	require.NoError(t, err)
+	assert.True(t, client.Options().UsePathStyle)
+}
+
+func TestCreateS3Client_CABundle(t *testing.T) {
+	t.Setenv("AWS_REGION", "us-east-1")
+
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600))
+
+	client, err := CreateS3Client(context.Background(), S3ClientOptions{EndpointURL: srv.URL, CABundle: bundle})
+	require.NoError(t, err)
+	httpClient, ok := client.Options().HTTPClient.(*awshttp.BuildableClient)
+	require.True(t, ok)
+	transport := httpClient.GetTransport()
+	require.NotNil(t, transport.TLSClientConfig)
+	assert.False(t, transport.TLSClientConfig.InsecureSkipVerify)
+
+	// The server's self-signed certificate is trusted through the bundle
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+	resp, err := httpClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	client, err = CreateS3Client(context.Background(), S3ClientOptions{EndpointURL: srv.URL, InsecureSkipVerify: true})
+	require.NoError(t, err)
+	assert.True(t, client.Options().HTTPClient.(*awshttp.BuildableClient).GetTransport().TLSClientConfig.InsecureSkipVerify)
+
+	invalid := filepath.Join(t.TempDir(), "invalid.pem")
+	require.NoError(t, os.WriteFile(invalid, []byte("not a certificate"), 0o600))
+	_, err = CreateS3Client(context.Background(), S3ClientOptions{EndpointURL: srv.URL, CABundle: invalid})
+	assert.ErrorContains(t, err, "no certificates found in S3 CA bundle")
+}
+
+func TestUploadSchema(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+
+	schema := "CREATE TABLE users (id integer);\n"
+	require.NoError(t, UploadSchema(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", schema, PutOptions{}))
+
+	content, found := mock.GetObjectContent("test-bucket", "migrations/20240101000000/schema.sql")
+	require.True(t, found)
+	assert.Equal(t, schema, content)
+}
+
+func TestUploadAttempt(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+
+	failed := &Result{Version: "20240101000000", Status: "failed", Timestamp: "2024-01-01T00:00:00Z"}
+	succeeded := &Result{Version: "20240101000000", Status: "success", Timestamp: "2024-01-01T01:00:00Z"}
+	require.NoError(t, UploadAttempt(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", failed, PutOptions{}))
+	require.NoError(t, UploadAttempt(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", succeeded, PutOptions{}))
+
+	// Each attempt is kept under its own key
+	content, found := mock.GetObjectContent("test-bucket", "migrations/20240101000000/attempts/2024-01-01T00:00:00Z.json")
+	require.True(t, found)
+	assert.Contains(t, content, `"status": "failed"`)
+	assert.True(t, mock.HasObject("test-bucket", "migrations/20240101000000/attempts/2024-01-01T01:00:00Z.json"))
+
+	// Attempt files don't affect version detection
+	_, err := FindUnappliedVersions(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "")
+	assert.NoError(t, err)
+}
+
+func TestListAndDeleteUploadedMigrations(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+
+	for _, key := range []string{
+		"migrations/20240101000000/migrations/002_b.sql",
+		"migrations/20240101000000/migrations/001_a.sql",
+		"migrations/20240101000000/migrations/README.md",
+		"migrations/20240101000000/push-info.json",
+		"migrations/20240102000000/migrations/003_c.sql",
+	} {
+		_, _ = mock.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String(key),
+			Body:   io.NopCloser(bytes.NewBufferString("-- migrate:up")),
+		})
+	}
+
+	files, err := ListUploadedMigrations(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"001_a.sql", "002_b.sql"}, files)
+
+	files, err = ListUploadedMigrations(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240103000000")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	err = DeleteUploadedMigrations(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", []string{"001_a.sql"})
+	require.NoError(t, err)
+	assert.False(t, mock.HasObject("test-bucket", "migrations/20240101000000/migrations/001_a.sql"))
+	assert.True(t, mock.HasObject("test-bucket", "migrations/20240101000000/migrations/002_b.sql"))
+}
+
+func TestDeleteVersion(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+	for _, key := range []string{
+		"migrations/20240101000000/migrations/001_a.sql",
+		"migrations/20240101000000/result.json",
+		"migrations/202401010000001/migrations/001_a.sql",
+		"migrations/20240102000000/migrations/002_b.sql",
+	} {
+		_, err := mock.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader([]byte("-- migrate:up")),
+		})
+		require.NoError(t, err)
+	}
+
+	// The result file is deleted last, so a failure leaves the version applied
+	mock.InjectErrors("DeleteObject", nil, &smithy.GenericAPIError{Code: "AccessDenied"})
+	deleted, err := DeleteVersion(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", "")
+	require.Error(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.False(t, mock.HasObject("test-bucket", "migrations/20240101000000/migrations/001_a.sql"))
+	assert.True(t, mock.HasObject("test-bucket", "migrations/20240101000000/result.json"))
+
+	deleted, err = DeleteVersion(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.False(t, mock.HasObject("test-bucket", "migrations/20240101000000/result.json"))
+	// Directories sharing the version as a name prefix are left alone
+	assert.True(t, mock.HasObject("test-bucket", "migrations/202401010000001/migrations/001_a.sql"))
+	assert.True(t, mock.HasObject("test-bucket", "migrations/20240102000000/migrations/002_b.sql"))
+
+	_, err = DeleteVersion(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "", "")
+	assert.Error(t, err)
+}
+
+func TestChangedMigrations(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	require.NoError(t, testhelpers.WriteFile(dir, "001_a.sql", "CREATE TABLE a (id INT);"))
+	require.NoError(t, testhelpers.WriteFile(dir, "002_b.sql", "CREATE TABLE b (id INT);"))
+	require.NoError(t, testhelpers.WriteFile(dir, "003_c.sql", "CREATE TABLE c (id INT);"))
+	files := []string{"001_a.sql", "002_b.sql", "003_c.sql"}
+
+	// A partial push uploaded 001 intact, 002 with other content and 003 not at all
+	_, err := UploadMigrations(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", dir, files[:1], true, PutOptions{})
+	require.NoError(t, err)
+	outdated, err := gzipBytes([]byte("CREATE TABLE b (id BIGINT);"))
+	require.NoError(t, err)
+	_, _ = mock.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("test-bucket"),
+		Key:    aws.String("migrations/20240101000000/migrations/002_b.sql.gz"),
+		Body:   io.NopCloser(bytes.NewReader(outdated)),
+	})
+
+	changed, err := ChangedMigrations(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", dir, files, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"002_b.sql", "003_c.sql"}, changed)
+
+	// Once everything is uploaded, nothing is left to push
+	_, err = UploadMigrations(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", dir, changed, true, PutOptions{})
+	require.NoError(t, err)
+	changed, err = ChangedMigrations(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", dir, files, true)
+	require.NoError(t, err)
+	assert.Empty(t, changed)
+
+	// Uncompressed objects don't match a compressed upload of the same files
+	changed, err = ChangedMigrations(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", dir, files, false)
+	require.NoError(t, err)
+	assert.Equal(t, files, changed)
+}
+
+func TestMigrationsSubdir_Flat(t *testing.T) {
+	// An empty subdir puts the migration files directly under the version
+	flat := Settings{}
+	assert.Equal(t, "migrations/20240101000000/001_a.sql", flat.MigrationKey("migrations/", "20240101000000", "001_a.sql"))
+	assert.Equal(t, "migrations/20240101000000/", flat.migrationsPrefix("migrations/", "20240101000000"))
+
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+	for _, key := range []string{
+		"migrations/20240101000000/001_a.sql",
+		"migrations/20240101000000/002_b.sql",
+		"migrations/20240101000000/result.json",
+		"migrations/20240101000000/attempts/20240101000000.json",
+		"migrations/20240101000000/push-info.json",
+		"migrations/20240101000000/before.sql",
+	} {
+		_, _ = mock.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String(key),
+			Body:   io.NopCloser(bytes.NewBufferString("-- migrate:up")),
+		})
+	}
+
+	// Metadata and hooks sharing the version prefix are not downloaded
+	tempDir := t.TempDir()
+	require.NoError(t, DownloadMigrations(ctx, mock, flat, "test-bucket", flat.migrationsPrefix("migrations/", "20240101000000"), tempDir, 0))
+	entries, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"001_a.sql", "002_b.sql"}, names)
+
+	files, err := ListUploadedMigrations(ctx, mock, flat, "test-bucket", "migrations/", "20240101000000")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"001_a.sql", "002_b.sql"}, files)
+}
+
+func TestSettings_MigrationsSubdir(t *testing.T) {
+	sql := Settings{MigrationsSubdir: "/sql/"}
+	assert.Equal(t, "migrations/20240101000000/sql/001_a.sql", sql.MigrationKey("migrations/", "20240101000000", "001_a.sql"))
+
+	assert.Equal(t, "migrations/20240101000000/migrations/", DefaultSettings().migrationsPrefix("migrations/", "20240101000000"))
+}
+
+func TestFindUnappliedVersionsUpTo(t *testing.T) {
+	putObject := func(mock *testhelpers.MockS3Client, key, body string) {
+		_, _ = mock.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String(key),
+			Body:   io.NopCloser(bytes.NewBufferString(body)),
+		})
+	}
+
+	mock := testhelpers.NewMockS3Client()
+	for _, version := range []string{"20240101000000", "20240102000000", "20240103000000", "20240104000000"} {
+		putObject(mock, "migrations/"+version+"/migrations/001.sql", "-- migrate:up")
+	}
+	putObject(mock, "migrations/20240101000000/result.json", `{"status":"success"}`)
+
+	pending, err := FindUnappliedVersionsUpTo(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "", "20240103000000")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"20240102000000", "20240103000000"}, pending)
+
+	// Everything up to the target is applied; newer versions don't count
+	_, err = FindUnappliedVersionsUpTo(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "", "20240101000000")
+	assert.EqualError(t, err, "no unapplied versions found")
+
+	pending, err = FindUnappliedVersionsUpTo(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"20240102000000", "20240103000000", "20240104000000"}, pending)
+}
+
+func TestListVersionsAfter(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	for _, key := range []string{
+		"migrations/20240101000000/migrations/001.sql",
+		"migrations/20240101000000/result.json",
+		"migrations/20240102000000/migrations/002.sql",
+		"migrations/backup/old.sql",
+	} {
+		_, err := mock.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader([]byte("-- migrate:up")),
+		})
+		require.NoError(t, err)
+	}
+
+	versions, err := ListVersionsAfter(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"20240101000000", "20240102000000"}, versions)
+
+	versions, err = ListVersionsAfter(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"20240102000000"}, versions)
+
+	// Nothing newer than the newest version
+	versions, err = ListVersionsAfter(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "20240102000000")
+	require.NoError(t, err)
+	assert.Empty(t, versions)
+}
+
+func TestPresignResult(t *testing.T) {
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	client, err := CreateS3Client(context.Background(), S3ClientOptions{EndpointURL: "http://localhost:9000"})
+	require.NoError(t, err)
+
+	presigned, err := PresignResult(context.Background(), client, "test-bucket", "migrations/", "20240101000000", "", 2*time.Hour)
+	require.NoError(t, err)
+
+	u, err := url.Parse(presigned)
+	require.NoError(t, err)
+	assert.Equal(t, "/test-bucket/migrations/20240101000000/result.json", u.Path)
+	assert.Equal(t, "7200", u.Query().Get("X-Amz-Expires"))
+	assert.NotEmpty(t, u.Query().Get("X-Amz-Signature"))
+}
+
+func TestWaitForResults(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+	versions := []string{"20240101000000", "20240102000000"}
+
+	for _, version := range versions {
+		err := UploadResult(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", version, "", &Result{Version: version, Status: "success", MigrationsApplied: 1, Log: "ok"}, nil, PutOptions{})
+		require.NoError(t, err)
+	}
+
+	results, err := WaitForResults(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", versions, "", 10*time.Millisecond, time.Second)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+
+	combined := CombineResults(versions, results)
+	assert.Equal(t, "success", combined.Status)
+	assert.Equal(t, 2, combined.MigrationsApplied)
+	assert.Equal(t, "20240101000000: success, 20240102000000: success", ResultsSummary(versions, results))
+}
+
+func TestWaitForResults_FailsFast(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+	versions := []string{"20240101000000", "20240102000000"}
+
+	// The second version never gets a result, but the first one's failure ends the wait
+	err := UploadResult(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", versions[0], "", &Result{Version: versions[0], Status: "failed", Error: "syntax error"}, nil, PutOptions{})
+	require.NoError(t, err)
+
+	results, err := WaitForResults(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", versions, "", 10*time.Millisecond, time.Second)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+
+	combined := CombineResults(versions, results)
+	assert.Equal(t, "failed", combined.Status)
+	assert.Equal(t, "20240101000000: syntax error", combined.Error)
+	assert.Contains(t, combined.Log, "== 20240102000000: pending ==")
+	assert.Equal(t, "20240101000000: failed, 20240102000000: pending", ResultsSummary(versions, results))
+}
+
+func TestWaitForResults_Timeout(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+
+	err := UploadResult(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", "", &Result{Status: "success"}, nil, PutOptions{})
+	require.NoError(t, err)
+
+	results, err := WaitForResults(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", []string{"20240101000000", "20240102000000"}, "", 10*time.Millisecond, 50*time.Millisecond)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "timeout waiting for result")
+	assert.Len(t, results, 1)
+}
+
+func TestWaitForPush(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+
+	// One version has migrations, the other only a result (its migrations were pruned)
+	_, err := mock.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("test-bucket"),
+		Key:    aws.String("migrations/20240101000000/migrations/001_init.sql"),
+		Body:   bytes.NewBufferString("CREATE TABLE t (id int);"),
+	})
+	require.NoError(t, err)
+	err = UploadResult(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240102000000", "", &Result{Status: "success"}, nil, PutOptions{})
+	require.NoError(t, err)
+
+	err = WaitForPush(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", []string{"20240101000000", "20240102000000"}, "", 10*time.Millisecond, time.Second)
+	assert.NoError(t, err)
+}
+
+func TestWaitForPush_Timeout(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+	_, err := mock.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("test-bucket"),
+		Key:    aws.String("migrations/20240101000000/migrations/001_init.sql"),
+		Body:   bytes.NewBufferString("CREATE TABLE t (id int);"),
+	})
+	require.NoError(t, err)
+
+	err = WaitForPush(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", []string{"20240101000000", "20240102000000"}, "", 10*time.Millisecond, 50*time.Millisecond)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "timeout waiting for version 20240102000000 to be pushed")
+	assert.Contains(t, err.Error(), "s3://test-bucket/migrations/20240102000000/migrations/")
+}
+
+func TestParseS3Tags(t *testing.T) {
+	tags, err := ParseS3Tags([]string{"team=db", "cost-center=1234", "empty="})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"team": "db", "cost-center": "1234", "empty": ""}, tags)
+
+	tags, err = ParseS3Tags(nil)
+	require.NoError(t, err)
+	assert.Nil(t, tags)
+
+	_, err = ParseS3Tags([]string{"team"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid S3 tag "team"`)
+
+	_, err = ParseS3Tags([]string{"=db"})
+	require.Error(t, err)
+}
+
+func TestPutOptions_Tags(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+	opts := PutOptions{Tags: map[string]string{"team": "db", "note": "a b&c"}}
+
+	tempDir := t.TempDir()
+	require.NoError(t, testhelpers.WriteFile(tempDir, "001_a.sql", "SELECT 1;"))
+	_, err := UploadMigrations(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", tempDir, []string{"001_a.sql"}, false, opts)
+	require.NoError(t, err)
+
+	input := mock.PutInputs["test-bucket/migrations/20240101000000/migrations/001_a.sql"]
+	require.NotNil(t, input)
+	assert.Equal(t, "note=a+b%26c&team=db", aws.ToString(input.Tagging))
+
+	// Results are tagged with their status on top of the configured tags
+	require.NoError(t, UploadResult(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", "", &Result{Status: "failed"}, nil, opts))
+	input = mock.PutInputs["test-bucket/migrations/20240101000000/result.json"]
+	require.NotNil(t, input)
+	assert.Equal(t, "note=a+b%26c&status=failed&team=db", aws.ToString(input.Tagging))
+	assert.Len(t, opts.Tags, 2, "the caller's tags must not be modified")
+
+	// Without configured tags only the status is set
+	require.NoError(t, UploadResult(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240102000000", "", &Result{Status: "success"}, nil, PutOptions{}))
+	input = mock.PutInputs["test-bucket/migrations/20240102000000/result.json"]
+	require.NotNil(t, input)
+	assert.Equal(t, "status=success", aws.ToString(input.Tagging))
+}
+
+func TestUpload_ContentType(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+
+	tempDir := t.TempDir()
+	require.NoError(t, testhelpers.WriteFile(tempDir, "001_a.sql", "SELECT 1;"))
+	_, err := UploadMigrations(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", tempDir, []string{"001_a.sql"}, false, PutOptions{})
+	require.NoError(t, err)
+	_, err = UploadMigrations(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240102000000", tempDir, []string{"001_a.sql"}, true, PutOptions{})
+	require.NoError(t, err)
+	require.NoError(t, UploadPushInfo(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", &PushInfo{}, PutOptions{}))
+	require.NoError(t, UploadResult(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "20240101000000", "", &Result{Status: "success"}, nil, PutOptions{}))
+
+	for key, contentType := range map[string]string{
+		"migrations/20240101000000/migrations/001_a.sql":    "application/sql",
+		"migrations/20240102000000/migrations/001_a.sql.gz": "application/gzip",
+		"migrations/20240101000000/push-info.json":          "application/json",
+		"migrations/20240101000000/result.json":             "application/json",
+	} {
+		input := mock.PutInputs["test-bucket/"+key]
+		require.NotNil(t, input, key)
+		assert.Equal(t, contentType, aws.ToString(input.ContentType), key)
+	}
+}
+
+func TestPutOptions_TooManyTags(t *testing.T) {
+	tags := make(map[string]string)
+	for i := range 10 {
+		tags[fmt.Sprintf("k%d", i)] = "v"
+	}
+	err := PutOptions{Tags: tags}.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "too many S3 tags")
+}
@@ -8,11 +8,109 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
 	"time"
+	"unicode/utf8"
 )
 
+// DefaultNotificationLogChars is the default number of log characters included in notifications
+const DefaultNotificationLogChars = 1000
+
+// notificationLogExcerpt keeps the last n characters of the log (DefaultNotificationLogChars if n <= 0),
+// since the error that failed a migration is usually at the end. A truncated log starts with an
+// ellipsis. Characters are counted as runes, so a multi-byte character is never cut in half.
+func notificationLogExcerpt(log string, n int) string {
+	if n <= 0 {
+		n = DefaultNotificationLogChars
+	}
+	if utf8.RuneCountInString(log) <= n {
+		return log
+	}
+	start := len(log)
+	for i := 0; i < n; i++ {
+		_, size := utf8.DecodeLastRuneInString(log[:start])
+		start -= size
+	}
+	return "…" + log[start:]
+}
+
 // SendSlackNotification sends a notification to Slack webhook
-func SendSlackNotification(ctx context.Context, webhookURL string, version string, result *Result) error {
+func SendSlackNotification(ctx context.Context, webhook WebhookOptions, webhookURL string, version string, result *Result) error {
+	return (&SlackNotifier{WebhookURL: webhookURL, Options: NotifyOptions{Webhook: webhook}}).Notify(ctx, version, result)
+}
+
+// SlackTemplateData is the data a Slack template is executed with
+type SlackTemplateData struct {
+	// Version is the version (or summary of versions) the notification is about
+	Version string
+	// Result is the migration result
+	Result *Result
+	// LogExcerpt is the end of the migration log, as in the built-in layout
+	LogExcerpt string
+	// ResultURL links to the full result (empty if not set)
+	ResultURL string
+	// PushInfo is the provenance recorded by push (nil if not recorded)
+	PushInfo *PushInfo
+}
+
+// slackTemplateFuncs are the functions available in Slack templates. json encodes a value as
+// JSON, so that strings such as the log can be embedded with their quotes and newlines escaped.
+var slackTemplateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// ParseSlackTemplate parses a text/template file rendering the JSON payload of Slack notifications
+func ParseSlackTemplate(path string) (*template.Template, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Slack template: %w", err)
+	}
+	tmpl, err := template.New(filepath.Base(path)).Funcs(slackTemplateFuncs).Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Slack template %s: %w", path, err)
+	}
+	return tmpl, nil
+}
+
+// renderSlackTemplate executes tmpl and checks that the output is a JSON payload
+func renderSlackTemplate(tmpl *template.Template, data SlackTemplateData) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to render Slack template: %w", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("slack template %s rendered invalid JSON: %s", tmpl.Name(), buf.String())
+	}
+	return buf.Bytes(), nil
+}
+
+// Notify sends the result as a Slack attachment, or as rendered by Options.SlackTemplate
+func (n *SlackNotifier) Notify(ctx context.Context, version string, result *Result) error {
+	if n.Options.SlackTemplate != nil {
+		jsonData, err := renderSlackTemplate(n.Options.SlackTemplate, SlackTemplateData{
+			Version:    version,
+			Result:     result,
+			LogExcerpt: notificationLogExcerpt(result.Log, n.Options.LogChars),
+			ResultURL:  n.Options.ResultURL,
+			PushInfo:   n.Options.PushInfo,
+		})
+		if err != nil {
+			return err
+		}
+		if err := postWebhook(ctx, n.Options.Webhook, n.WebhookURL, "Slack", jsonData); err != nil {
+			return err
+		}
+		slog.Info("Slack notification sent successfully", "template", n.Options.SlackTemplate.Name())
+		return nil
+	}
+
 	// Determine color and emoji
 	color := "good"
 	emoji := "✅"
@@ -21,11 +119,7 @@ func SendSlackNotification(ctx context.Context, webhookURL string, version strin
 		emoji = "❌"
 	}
 
-	// Truncate log to 1000 chars (same as shell script)
-	logExcerpt := result.Log
-	if len(logExcerpt) > 1000 {
-		logExcerpt = logExcerpt[:1000]
-	}
+	logExcerpt := notificationLogExcerpt(result.Log, n.Options.LogChars)
 
 	payload := SlackPayload{
 		Attachments: []SlackAttachment{
@@ -40,30 +134,152 @@ func SendSlackNotification(ctx context.Context, webhookURL string, version strin
 			},
 		},
 	}
+	for _, f := range pushInfoFacts(n.Options.PushInfo) {
+		payload.Attachments[0].Fields = append(payload.Attachments[0].Fields,
+			SlackField{Title: f.Name, Value: f.Value, Short: true})
+	}
+	if n.Options.ResultURL != "" {
+		payload.Attachments[0].Fields = append(payload.Attachments[0].Fields,
+			SlackField{Title: "Full log", Value: n.Options.ResultURL})
+	}
+
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal Slack payload: %w", err)
+	}
+
+	if err := postWebhook(ctx, n.Options.Webhook, n.WebhookURL, "Slack", jsonData); err != nil {
+		return err
+	}
+
+	slog.Info("Slack notification sent successfully")
+	return nil
+}
+
+// SendSlackMessage sends a plain status message (not tied to a migration result) to a Slack webhook.
+// color is a Slack attachment color such as "good", "warning" or "danger".
+func SendSlackMessage(ctx context.Context, webhook WebhookOptions, webhookURL, color, title, text string) error {
+	payload := SlackPayload{
+		Attachments: []SlackAttachment{
+			{
+				Color:  color,
+				Title:  title,
+				Fields: []SlackField{},
+				Text:   text,
+			},
+		},
+	}
 
 	jsonData, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("failed to marshal Slack payload: %w", err)
 	}
 
+	if err := postWebhook(ctx, webhook, webhookURL, "Slack", jsonData); err != nil {
+		return err
+	}
+
+	slog.Info("Slack message sent successfully", "title", title)
+	return nil
+}
+
+// Defaults for webhook delivery
+const (
+	DefaultWebhookTimeout     = 10 * time.Second
+	DefaultWebhookMaxAttempts = 3
+)
+
+// WebhookOptions controls how Slack, Teams and Google Chat webhook requests are made. Zero
+// fields use the defaults.
+type WebhookOptions struct {
+	// Timeout is the HTTP timeout for each request (default: DefaultWebhookTimeout)
+	Timeout time.Duration
+	// MaxAttempts is the number of attempts for each post (default: DefaultWebhookMaxAttempts)
+	MaxAttempts int
+}
+
+// webhookRetryBaseDelay is the backoff before the second attempt; it doubles after each retry
+var webhookRetryBaseDelay = time.Second
+
+// postWebhook posts a JSON payload to an incoming webhook and checks the response status.
+// Network errors and 5xx responses are retried with exponential backoff; 429 responses wait
+// for the Retry-After header if the service sent one.
+func postWebhook(ctx context.Context, opts WebhookOptions, webhookURL, service string, jsonData []byte) error {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultWebhookTimeout
+	}
+	if opts.MaxAttempts < 1 {
+		opts.MaxAttempts = DefaultWebhookMaxAttempts
+	}
+	client := &http.Client{Timeout: opts.Timeout}
+	backoff := webhookRetryBaseDelay
+
+	for attempt := 1; ; attempt++ {
+		retryAfter, retryable, err := postWebhookOnce(ctx, client, webhookURL, service, jsonData)
+		if err == nil || !retryable || attempt >= opts.MaxAttempts {
+			return err
+		}
+
+		delay := retryAfter
+		if delay <= 0 {
+			delay = backoff
+			backoff *= 2
+		}
+		slog.Warn("Webhook request failed, retrying",
+			"service", service,
+			"attempt", attempt,
+			"max_attempts", opts.MaxAttempts,
+			"backoff", delay,
+			"error", err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// postWebhookOnce makes a single webhook request. It reports whether a failure is worth
+// retrying and, for 429 responses, how long the service asked to wait.
+func postWebhookOnce(ctx context.Context, client *http.Client, webhookURL, service string, jsonData []byte) (time.Duration, bool, error) {
 	req, err := http.NewRequestWithContext(ctx, "POST", webhookURL, bytes.NewReader(jsonData))
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return 0, false, fmt.Errorf("failed to create request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Timeout: 10 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to send Slack notification: %w", err)
+		return 0, ctx.Err() == nil, fmt.Errorf("failed to send %s notification: %w", service, err)
 	}
 	defer func() { _ = resp.Body.Close() }()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		return fmt.Errorf("slack API returned status %d: %s", resp.StatusCode, string(body))
+		err := fmt.Errorf("%s API returned status %d: %s", strings.ToLower(service), resp.StatusCode, string(body))
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return parseRetryAfter(resp.Header.Get("Retry-After")), true, err
+		}
+		return 0, resp.StatusCode >= 500, err
 	}
 
-	slog.Info("Slack notification sent successfully")
-	return nil
+	return 0, false, nil
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date.
+// It returns 0 if the header is missing or invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
 }
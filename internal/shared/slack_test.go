@@ -6,13 +6,28 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// withFastWebhookRetry shortens the webhook retry backoff for the duration of a test and
+// returns webhook options making maxAttempts attempts
+func withFastWebhookRetry(t *testing.T, maxAttempts int) WebhookOptions {
+	t.Helper()
+	origDelay := webhookRetryBaseDelay
+	webhookRetryBaseDelay = time.Millisecond
+	t.Cleanup(func() { webhookRetryBaseDelay = origDelay })
+	return WebhookOptions{MaxAttempts: maxAttempts}
+}
+
 func TestSendSlackNotification_Success(t *testing.T) {
 	// Create test server to receive webhook
 	var receivedPayload SlackPayload
@@ -40,7 +55,7 @@ func TestSendSlackNotification_Success(t *testing.T) {
 		Log:               "Migration completed successfully",
 	}
 
-	err := SendSlackNotification(context.Background(), server.URL, "20240101000000", result)
+	err := SendSlackNotification(context.Background(), WebhookOptions{}, server.URL, "20240101000000", result)
 	require.NoError(t, err)
 
 	// Verify payload
@@ -83,7 +98,7 @@ func TestSendSlackNotification_Error(t *testing.T) {
 		Log:       "Error log content",
 	}
 
-	err := SendSlackNotification(context.Background(), server.URL, "20240101000000", result)
+	err := SendSlackNotification(context.Background(), WebhookOptions{}, server.URL, "20240101000000", result)
 	require.NoError(t, err)
 
 	// Verify payload for error case
@@ -119,7 +134,7 @@ func TestSendSlackNotification_LogTruncation(t *testing.T) {
 		Log:       longLog,
 	}
 
-	err := SendSlackNotification(context.Background(), server.URL, "20240101000000", result)
+	err := SendSlackNotification(context.Background(), WebhookOptions{}, server.URL, "20240101000000", result)
 	require.NoError(t, err)
 
 	// Verify log was truncated in the text field
@@ -128,11 +143,40 @@ func TestSendSlackNotification_LogTruncation(t *testing.T) {
 	textContent := strings.TrimPrefix(attachment.Text, "```\n")
 	textContent = strings.TrimSuffix(textContent, "\n```")
 
-	// Should be truncated to 1000 characters
-	assert.LessOrEqual(t, len(textContent), 1000)
+	// Should be truncated to 1000 characters after the ellipsis
+	assert.True(t, strings.HasPrefix(textContent, "…"))
+	assert.Equal(t, 1001, utf8.RuneCountInString(textContent))
+}
+
+func TestSendSlackNotification_LogTruncationMultiByte(t *testing.T) {
+	var receivedPayload SlackPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.True(t, utf8.Valid(body), "payload must be valid UTF-8")
+		require.NoError(t, json.Unmarshal(body, &receivedPayload))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	// 4-byte emoji and 3-byte CJK characters straddle the 1000-byte mark
+	result := &Result{
+		Version: "20240101000000",
+		Status:  "failed",
+		Log:     "x" + strings.Repeat("構文エラー🚀", 250),
+	}
+	require.NoError(t, SendSlackNotification(context.Background(), WebhookOptions{}, server.URL, "20240101000000", result))
+
+	textContent := strings.TrimSuffix(strings.TrimPrefix(receivedPayload.Attachments[0].Text, "```\n"), "\n```")
+	assert.True(t, utf8.ValidString(textContent))
+	assert.True(t, strings.HasPrefix(textContent, "…"))
+	assert.Equal(t, 1001, utf8.RuneCountInString(textContent))
+	assert.True(t, strings.HasSuffix(textContent, "構文エラー🚀"))
 }
 
 func TestSendSlackNotification_ServerError(t *testing.T) {
+	webhook := withFastWebhookRetry(t, 3)
+
 	// Create test server that returns error
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -147,13 +191,15 @@ func TestSendSlackNotification_ServerError(t *testing.T) {
 		Log:       "Test log",
 	}
 
-	err := SendSlackNotification(context.Background(), server.URL, "20240101000000", result)
+	err := SendSlackNotification(context.Background(), webhook, server.URL, "20240101000000", result)
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "slack API returned status 500")
 	assert.Contains(t, err.Error(), "Internal Server Error")
 }
 
 func TestSendSlackNotification_InvalidURL(t *testing.T) {
+	webhook := withFastWebhookRetry(t, 1)
+
 	result := &Result{
 		Version:   "20240101000000",
 		Status:    "success",
@@ -162,7 +208,7 @@ func TestSendSlackNotification_InvalidURL(t *testing.T) {
 	}
 
 	// Test with invalid URL that will cause network error
-	err := SendSlackNotification(context.Background(), "http://invalid-host-that-does-not-exist-12345.com", "20240101000000", result)
+	err := SendSlackNotification(context.Background(), webhook, "http://invalid-host-that-does-not-exist-12345.com", "20240101000000", result)
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "failed to send Slack notification")
 }
@@ -186,11 +232,82 @@ func TestSendSlackNotification_ContextCancellation(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	cancel() // Cancel immediately
 
-	err := SendSlackNotification(ctx, server.URL, "20240101000000", result)
+	err := SendSlackNotification(ctx, WebhookOptions{}, server.URL, "20240101000000", result)
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "failed to send Slack notification")
 }
 
+func TestSlackNotifier_PushInfo(t *testing.T) {
+	var receivedPayload SlackPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(body, &receivedPayload))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	notifier := &SlackNotifier{
+		WebhookURL: server.URL,
+		Options: NotifyOptions{PushInfo: &PushInfo{
+			Source: PushSource{Type: "github_actions", Repository: "tokuhirom/dbmate-deployer", Actor: "tokuhirom", SHA: "abc123"},
+		}},
+	}
+	result := &Result{Version: "20240101000000", Status: "success", Log: "done"}
+	require.NoError(t, notifier.Notify(context.Background(), "20240101000000", result))
+
+	require.Len(t, receivedPayload.Attachments, 1)
+	assert.Equal(t, []SlackField{
+		{Title: "Version", Value: "20240101000000", Short: true},
+		{Title: "Status", Value: "success", Short: true},
+		{Title: "Repository", Value: "tokuhirom/dbmate-deployer", Short: true},
+		{Title: "Actor", Value: "tokuhirom", Short: true},
+		{Title: "Commit", Value: "abc123", Short: true},
+	}, receivedPayload.Attachments[0].Fields)
+}
+
+func TestSlackNotifier_Template(t *testing.T) {
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		received = string(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "slack.tmpl")
+	require.NoError(t, os.WriteFile(path, []byte(`{"channel": "#deploys", "text": {{ printf "<!here> %s %s: %s" .Version .Result.Status .Result.Error | json }}}`), 0644))
+	tmpl, err := ParseSlackTemplate(path)
+	require.NoError(t, err)
+
+	notifier, err := NewNotifier(NotifierSlack, server.URL, NotifyOptions{SlackTemplate: tmpl})
+	require.NoError(t, err)
+	result := &Result{Version: "20240101000000", Status: "failed", Error: `relation "users" already exists`}
+	require.NoError(t, notifier.Notify(context.Background(), "20240101000000", result))
+	assert.JSONEq(t, `{"channel": "#deploys", "text": "<!here> 20240101000000 failed: relation \"users\" already exists"}`, received)
+
+	// Output that isn't JSON is not sent
+	received = ""
+	require.NoError(t, os.WriteFile(path, []byte(`{"text": "{{ .Result.Error }}"}`), 0644))
+	tmpl, err = ParseSlackTemplate(path)
+	require.NoError(t, err)
+	notifier, err = NewNotifier(NotifierSlack, server.URL, NotifyOptions{SlackTemplate: tmpl})
+	require.NoError(t, err)
+	err = notifier.Notify(context.Background(), "20240101000000", result)
+	assert.ErrorContains(t, err, "rendered invalid JSON")
+	assert.Empty(t, received)
+
+	// Templates are Slack only
+	_, err = NewNotifier(NotifierTeams, server.URL, NotifyOptions{SlackTemplate: tmpl})
+	assert.ErrorContains(t, err, "can't be used with the teams notifier")
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"text": "{{ .Version "}`), 0644))
+	_, err = ParseSlackTemplate(path)
+	assert.ErrorContains(t, err, "failed to parse Slack template")
+}
+
 func TestSlackPayloadFormat(t *testing.T) {
 	// Test that the payload structure can be properly marshaled
 	payload := SlackPayload{
@@ -219,3 +336,69 @@ func TestSlackPayloadFormat(t *testing.T) {
 	assert.Equal(t, payload.Attachments[0].Title, decoded.Attachments[0].Title)
 	assert.Len(t, decoded.Attachments[0].Fields, 2)
 }
+
+func TestPostWebhook_RetriesServerError(t *testing.T) {
+	webhook := withFastWebhookRetry(t, 3)
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	err := postWebhook(context.Background(), webhook, server.URL, "Slack", []byte(`{}`))
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestPostWebhook_HonorsRetryAfter(t *testing.T) {
+	webhook := withFastWebhookRetry(t, 2)
+
+	var calls atomic.Int32
+	var first time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			first = time.Now()
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		assert.GreaterOrEqual(t, time.Since(first), time.Second)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	err := postWebhook(context.Background(), webhook, server.URL, "Slack", []byte(`{}`))
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestPostWebhook_NoRetryOnClientError(t *testing.T) {
+	webhook := withFastWebhookRetry(t, 3)
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("no_service"))
+	}))
+	defer server.Close()
+
+	err := postWebhook(context.Background(), webhook, server.URL, "Slack", []byte(`{}`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "slack API returned status 404: no_service")
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, 30*time.Second, parseRetryAfter("30"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(""))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon"))
+
+	d := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.Greater(t, d, 50*time.Second)
+}
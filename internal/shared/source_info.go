@@ -14,11 +14,23 @@ func CollectPushInfo() PushInfo {
 	}
 }
 
+// ciSources are the CI environments push-info understands, in the order they are checked
+var ciSources = []struct {
+	detect  func() bool
+	collect func() PushSource
+}{
+	{detect: func() bool { return os.Getenv("GITHUB_ACTIONS") == "true" }, collect: collectGitHubActionsSource},
+	{detect: func() bool { return os.Getenv("GITLAB_CI") == "true" }, collect: collectGitLabCISource},
+	{detect: func() bool { return os.Getenv("CIRCLECI") == "true" }, collect: collectCircleCISource},
+	{detect: func() bool { return os.Getenv("JENKINS_URL") != "" }, collect: collectJenkinsSource},
+}
+
 // collectPushSource detects the execution environment and collects relevant info
 func collectPushSource() PushSource {
-	// Check if running in GitHub Actions
-	if os.Getenv("GITHUB_ACTIONS") == "true" {
-		return collectGitHubActionsSource()
+	for _, source := range ciSources {
+		if source.detect() {
+			return source.collect()
+		}
 	}
 
 	// Default to local execution
@@ -49,3 +61,40 @@ func collectGitHubActionsSource() PushSource {
 		Ref:        os.Getenv("GITHUB_REF"),
 	}
 }
+
+// collectGitLabCISource collects GitLab CI specific information
+func collectGitLabCISource() PushSource {
+	return PushSource{
+		Type:       "gitlab_ci",
+		Repository: os.Getenv("CI_PROJECT_PATH"),
+		RunID:      os.Getenv("CI_PIPELINE_ID"),
+		RunURL:     os.Getenv("CI_PIPELINE_URL"),
+		Actor:      os.Getenv("GITLAB_USER_LOGIN"),
+		SHA:        os.Getenv("CI_COMMIT_SHA"),
+		Ref:        os.Getenv("CI_COMMIT_REF_NAME"),
+	}
+}
+
+// collectCircleCISource collects CircleCI specific information
+func collectCircleCISource() PushSource {
+	return PushSource{
+		Type:       "circleci",
+		Repository: os.Getenv("CIRCLE_PROJECT_REPONAME"),
+		RunID:      os.Getenv("CIRCLE_BUILD_NUM"),
+		RunURL:     os.Getenv("CIRCLE_BUILD_URL"),
+		SHA:        os.Getenv("CIRCLE_SHA1"),
+		Ref:        os.Getenv("CIRCLE_BRANCH"),
+	}
+}
+
+// collectJenkinsSource collects Jenkins specific information
+func collectJenkinsSource() PushSource {
+	return PushSource{
+		Type:     "jenkins",
+		Workflow: os.Getenv("JOB_NAME"),
+		RunID:    os.Getenv("BUILD_NUMBER"),
+		RunURL:   os.Getenv("BUILD_URL"),
+		SHA:      os.Getenv("GIT_COMMIT"),
+		Ref:      os.Getenv("GIT_BRANCH"),
+	}
+}
@@ -10,7 +10,7 @@ import (
 func TestCollectPushInfo_Local(t *testing.T) {
 	// Use t.Setenv which automatically restores on cleanup
 	// Setting to empty string effectively unsets for our detection logic
-	t.Setenv("GITHUB_ACTIONS", "")
+	clearCIEnv(t)
 
 	info := CollectPushInfo()
 
@@ -61,6 +61,148 @@ func TestCollectPushInfo_GitHubActions_PartialEnv(t *testing.T) {
 	assert.Empty(t, info.Source.RunURL) // URL should be empty when components are missing
 }
 
+func TestCollectPushInfo_GitLabCI(t *testing.T) {
+	t.Setenv("GITHUB_ACTIONS", "")
+	t.Setenv("GITLAB_CI", "true")
+	t.Setenv("CI_PROJECT_PATH", "tokuhirom/dbmate-deployer")
+	t.Setenv("CI_PIPELINE_ID", "987654")
+	t.Setenv("CI_PIPELINE_URL", "https://gitlab.com/tokuhirom/dbmate-deployer/-/pipelines/987654")
+	t.Setenv("GITLAB_USER_LOGIN", "tokuhirom")
+	t.Setenv("CI_COMMIT_SHA", "abc123def456")
+	t.Setenv("CI_COMMIT_REF_NAME", "main")
+
+	info := CollectPushInfo()
+
+	assert.NotEmpty(t, info.PushedAt)
+	assert.Equal(t, "gitlab_ci", info.Source.Type)
+	assert.Equal(t, "tokuhirom/dbmate-deployer", info.Source.Repository)
+	assert.Empty(t, info.Source.Workflow)
+	assert.Equal(t, "987654", info.Source.RunID)
+	assert.Equal(t, "https://gitlab.com/tokuhirom/dbmate-deployer/-/pipelines/987654", info.Source.RunURL)
+	assert.Equal(t, "tokuhirom", info.Source.Actor)
+	assert.Equal(t, "abc123def456", info.Source.SHA)
+	assert.Equal(t, "main", info.Source.Ref)
+}
+
+func TestCollectPushInfo_GitLabCI_PartialEnv(t *testing.T) {
+	t.Setenv("GITHUB_ACTIONS", "")
+	t.Setenv("GITLAB_CI", "true")
+	t.Setenv("CI_PROJECT_PATH", "")
+	t.Setenv("CI_PIPELINE_ID", "")
+	t.Setenv("CI_PIPELINE_URL", "")
+	t.Setenv("GITLAB_USER_LOGIN", "")
+	t.Setenv("CI_COMMIT_SHA", "")
+	t.Setenv("CI_COMMIT_REF_NAME", "")
+
+	info := CollectPushInfo()
+
+	assert.Equal(t, "gitlab_ci", info.Source.Type)
+	assert.Empty(t, info.Source.Repository)
+	assert.Empty(t, info.Source.RunURL)
+}
+
+// clearCIEnv unsets the variables used to detect a CI environment
+func clearCIEnv(t *testing.T) {
+	t.Helper()
+	for _, name := range []string{"GITHUB_ACTIONS", "GITLAB_CI", "CIRCLECI", "JENKINS_URL"} {
+		t.Setenv(name, "")
+	}
+}
+
+func TestCollectPushInfo_CIProviders(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		expected PushSource
+	}{
+		{
+			name: "CircleCI",
+			env: map[string]string{
+				"CIRCLECI":                "true",
+				"CIRCLE_PROJECT_REPONAME": "dbmate-deployer",
+				"CIRCLE_BUILD_NUM":        "42",
+				"CIRCLE_BUILD_URL":        "https://circleci.com/gh/tokuhirom/dbmate-deployer/42",
+				"CIRCLE_SHA1":             "abc123def456",
+				"CIRCLE_BRANCH":           "main",
+			},
+			expected: PushSource{
+				Type:       "circleci",
+				Repository: "dbmate-deployer",
+				RunID:      "42",
+				RunURL:     "https://circleci.com/gh/tokuhirom/dbmate-deployer/42",
+				SHA:        "abc123def456",
+				Ref:        "main",
+			},
+		},
+		{
+			name: "Jenkins",
+			env: map[string]string{
+				"JENKINS_URL":  "https://jenkins.example.com/",
+				"JOB_NAME":     "deploy-migrations",
+				"BUILD_NUMBER": "7",
+				"BUILD_URL":    "https://jenkins.example.com/job/deploy-migrations/7/",
+				"GIT_COMMIT":   "abc123def456",
+				"GIT_BRANCH":   "origin/main",
+			},
+			expected: PushSource{
+				Type:     "jenkins",
+				Workflow: "deploy-migrations",
+				RunID:    "7",
+				RunURL:   "https://jenkins.example.com/job/deploy-migrations/7/",
+				SHA:      "abc123def456",
+				Ref:      "origin/main",
+			},
+		},
+		{
+			name: "GitLab CI takes priority over Jenkins",
+			env: map[string]string{
+				"GITLAB_CI":       "true",
+				"CI_PROJECT_PATH": "tokuhirom/dbmate-deployer",
+				"JENKINS_URL":     "https://jenkins.example.com/",
+				"JOB_NAME":        "deploy-migrations",
+			},
+			expected: PushSource{
+				Type:       "gitlab_ci",
+				Repository: "tokuhirom/dbmate-deployer",
+			},
+		},
+		{
+			name: "CircleCI takes priority over Jenkins",
+			env: map[string]string{
+				"CIRCLECI":    "true",
+				"JENKINS_URL": "https://jenkins.example.com/",
+			},
+			expected: PushSource{Type: "circleci"},
+		},
+		{
+			name:     "local",
+			env:      map[string]string{},
+			expected: PushSource{Type: "local"},
+		},
+	}
+
+	// Variables read by any provider, cleared so only the case's env applies
+	vars := []string{
+		"CI_PROJECT_PATH", "CI_PIPELINE_ID", "CI_PIPELINE_URL", "GITLAB_USER_LOGIN", "CI_COMMIT_SHA", "CI_COMMIT_REF_NAME",
+		"CIRCLE_PROJECT_REPONAME", "CIRCLE_BUILD_NUM", "CIRCLE_BUILD_URL", "CIRCLE_SHA1", "CIRCLE_BRANCH",
+		"JOB_NAME", "BUILD_NUMBER", "BUILD_URL", "GIT_COMMIT", "GIT_BRANCH",
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearCIEnv(t)
+			for _, name := range vars {
+				t.Setenv(name, "")
+			}
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			assert.Equal(t, tt.expected, CollectPushInfo().Source)
+		})
+	}
+}
+
 func TestCollectPushInfo_Timestamp(t *testing.T) {
 	info := CollectPushInfo()
 
@@ -0,0 +1,127 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+)
+
+// SQL check outcomes of a migration file in VerifyMigrationSQL
+const (
+	SQLCheckPassed  = "passed"
+	SQLCheckFailed  = "failed"
+	SQLCheckSkipped = "skipped"
+)
+
+// SQLCheck is the outcome of running the up section of one migration file
+type SQLCheck struct {
+	File   string
+	Status string
+	// Reason explains why a file was skipped
+	Reason string
+	// Err is the database error of a failed file
+	Err error
+}
+
+// ValidateMigrationSQL runs the up section of every migration in dir not yet recorded in
+// migrationsTable (DefaultMigrationsTable if empty) inside a single transaction, then rolls
+// it back. Syntax errors and references to missing objects surface here instead of at apply
+// time. Only PostgreSQL is supported, since MySQL commits DDL implicitly and can't roll it back.
+func ValidateMigrationSQL(ctx context.Context, databaseURL, migrationsTable, dir string) error {
+	checks, err := VerifyMigrationSQL(ctx, databaseURL, migrationsTable, dir)
+	if err != nil {
+		return err
+	}
+
+	validated := 0
+	for _, check := range checks {
+		switch check.Status {
+		case SQLCheckFailed:
+			return fmt.Errorf("SQL validation failed for %s: %w", check.File, check.Err)
+		case SQLCheckPassed:
+			validated++
+		}
+	}
+
+	slog.Info("Migration SQL validated and rolled back", "validated", validated)
+	return nil
+}
+
+// VerifyMigrationSQL runs the up section of every migration in dir not yet recorded in
+// migrationsTable inside a single transaction that is always rolled back, and reports each file.
+// Every file runs under its own savepoint, so a failure doesn't stop the files after it;
+// those may still fail if they depend on the failed one. Only PostgreSQL is supported.
+func VerifyMigrationSQL(ctx context.Context, databaseURL, migrationsTable, dir string) ([]SQLCheck, error) {
+	if err := ValidateDatabaseURL(databaseURL); err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(databaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse database URL: %w", err)
+	}
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return nil, fmt.Errorf("SQL validation requires a PostgreSQL database (got scheme %q)", u.Scheme)
+	}
+
+	db := newDB(u, migrationsTable)
+	db.MigrationsDir = []string{dir}
+
+	// Files already recorded in schema_migrations would fail on re-run, so skip them
+	migrations, err := db.FindMigrations()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find migrations: %w", err)
+	}
+
+	drv, err := db.Driver()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database driver: %w", err)
+	}
+	sqlDB, err := drv.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer func() { _ = sqlDB.Close() }()
+
+	tx, err := sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	// Never commit: the transaction only exists to be rolled back
+	defer func() { _ = tx.Rollback() }()
+
+	checks := make([]SQLCheck, 0, len(migrations))
+	for _, migration := range migrations {
+		if migration.Applied {
+			slog.Debug("Skipping SQL validation of applied migration", "file", migration.FileName)
+			checks = append(checks, SQLCheck{File: migration.FileName, Status: SQLCheckSkipped, Reason: "already applied"})
+			continue
+		}
+
+		parsed, err := migration.Parse()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", migration.FileName, err)
+		}
+		if !parsed.UpOptions.Transaction() {
+			slog.Warn("Skipping SQL validation of migration that runs outside a transaction", "file", migration.FileName)
+			checks = append(checks, SQLCheck{File: migration.FileName, Status: SQLCheckSkipped, Reason: "runs outside a transaction"})
+			continue
+		}
+
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT dbmate_deployer_check"); err != nil {
+			return nil, fmt.Errorf("failed to create savepoint: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, parsed.Up); err != nil {
+			checks = append(checks, SQLCheck{File: migration.FileName, Status: SQLCheckFailed, Err: err})
+			// Leave the aborted state so the next file can run
+			if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT dbmate_deployer_check"); err != nil {
+				return nil, fmt.Errorf("failed to roll back to savepoint: %w", err)
+			}
+			continue
+		}
+		checks = append(checks, SQLCheck{File: migration.FileName, Status: SQLCheckPassed})
+	}
+
+	return checks, nil
+}
@@ -0,0 +1,78 @@
+//go:build integration
+
+package shared
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/amacneil/dbmate/v2/pkg/dbmate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared/testhelpers"
+)
+
+func TestValidateMigrationSQL(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx := context.Background()
+	container, databaseURL := testhelpers.SetupPostgresContainer(ctx, t)
+	t.Cleanup(func() { _ = container.Terminate(ctx) })
+
+	// Later files alter tables created by earlier ones, so they must run in order
+	validDir := filepath.Join("..", "testdata", "migrations", "valid")
+	require.NoError(t, ValidateMigrationSQL(ctx, databaseURL, "", validDir))
+
+	// Nothing is committed
+	u, err := url.Parse(databaseURL)
+	require.NoError(t, err)
+	db := dbmate.New(u)
+	db.MigrationsDir = []string{validDir}
+	migrations, err := db.FindMigrations()
+	require.NoError(t, err)
+	require.Len(t, migrations, 3)
+	for _, m := range migrations {
+		assert.False(t, m.Applied, "%s should not be applied", m.FileName)
+	}
+
+	// A syntax error is reported with the file name
+	invalidDir := t.TempDir()
+	content, err := os.ReadFile(filepath.Join("..", "testdata", "migrations", "invalid", "20240202000000_syntax_error.sql"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(invalidDir, "20240202000000_syntax_error.sql"), content, 0o644))
+
+	err = ValidateMigrationSQL(ctx, databaseURL, "", invalidDir)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "SQL validation failed for 20240202000000_syntax_error.sql")
+}
+
+func TestVerifyMigrationSQL(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	ctx := context.Background()
+	container, databaseURL := testhelpers.SetupPostgresContainer(ctx, t)
+	t.Cleanup(func() { _ = container.Terminate(ctx) })
+
+	// A failing file doesn't keep the files after it from being checked
+	dir := t.TempDir()
+	require.NoError(t, testhelpers.WriteFile(dir, "20240101000000_create_users.sql", testhelpers.ValidMigration("users")))
+	require.NoError(t, testhelpers.WriteFile(dir, "20240102000000_syntax_error.sql", testhelpers.InvalidMigrationSyntaxError()))
+	require.NoError(t, testhelpers.WriteFile(dir, "20240103000000_create_posts.sql", testhelpers.ValidMigration("posts")))
+	require.NoError(t, testhelpers.WriteFile(dir, "20240104000000_no_transaction.sql", "-- migrate:up transaction:false\nCREATE INDEX CONCURRENTLY idx_users_name ON users (name);\n\n-- migrate:down\n"))
+
+	checks, err := VerifyMigrationSQL(ctx, databaseURL, "", dir)
+	require.NoError(t, err)
+	require.Len(t, checks, 4)
+	assert.Equal(t, SQLCheck{File: "20240101000000_create_users.sql", Status: SQLCheckPassed}, checks[0])
+	assert.Equal(t, SQLCheckFailed, checks[1].Status)
+	assert.Error(t, checks[1].Err)
+	assert.Equal(t, SQLCheck{File: "20240103000000_create_posts.sql", Status: SQLCheckPassed}, checks[2])
+	assert.Equal(t, SQLCheck{File: "20240104000000_no_transaction.sql", Status: SQLCheckSkipped, Reason: "runs outside a transaction"}, checks[3])
+}
@@ -0,0 +1,234 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/amacneil/dbmate/v2/pkg/dbmate"
+)
+
+// SQLRule is a pattern matched against each statement of the up section of a migration file
+type SQLRule struct {
+	Pattern *regexp.Regexp
+	// Unless exempts a matching statement that also matches it, e.g. DROP TABLE IF EXISTS
+	Unless *regexp.Regexp
+	// Reason is reported with a violation
+	Reason string
+}
+
+// SQLPolicy is checked by push validation: a statement matching a Deny rule fails the
+// validation, one matching a Warn rule is only logged. If Allow is not empty, a statement
+// matching none of its rules fails the validation too.
+type SQLPolicy struct {
+	Allow []SQLRule
+	Deny  []SQLRule
+	Warn  []SQLRule
+}
+
+// defaultSQLPolicy holds the rules applied unless --no-sql-defaults is set
+var defaultSQLPolicy = SQLPolicy{
+	Deny: []SQLRule{
+		{Pattern: regexp.MustCompile(`(?i)\bTRUNCATE\b`), Reason: "TRUNCATE deletes every row"},
+		{Pattern: regexp.MustCompile(`(?i)\bDROP\s+DATABASE\b`), Reason: "DROP DATABASE drops the whole database"},
+		{
+			Pattern: regexp.MustCompile(`(?i)^\s*DELETE\s+FROM\b`),
+			Unless:  regexp.MustCompile(`(?i)\bWHERE\b`),
+			Reason:  "DELETE without WHERE deletes every row",
+		},
+	},
+	Warn: []SQLRule{
+		{
+			Pattern: regexp.MustCompile(`(?i)\bDROP\s+TABLE\b`),
+			Unless:  regexp.MustCompile(`(?i)\bDROP\s+TABLE\s+IF\s+EXISTS\b`),
+			Reason:  "DROP TABLE without IF EXISTS",
+		},
+	},
+}
+
+// NewSQLPolicy returns the built-in rules (unless noDefaults) plus a rule for each of the
+// allow, deny and warn patterns. Patterns are regular expressions matched case-insensitively.
+func NewSQLPolicy(allow, deny, warn []string, noDefaults bool) (*SQLPolicy, error) {
+	policy := &SQLPolicy{}
+	if !noDefaults {
+		policy.Deny = append(policy.Deny, defaultSQLPolicy.Deny...)
+		policy.Warn = append(policy.Warn, defaultSQLPolicy.Warn...)
+	}
+
+	for _, pattern := range allow {
+		rule, err := patternRule(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow pattern: %w", err)
+		}
+		policy.Allow = append(policy.Allow, rule)
+	}
+
+	for _, pattern := range deny {
+		rule, err := patternRule(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deny pattern: %w", err)
+		}
+		policy.Deny = append(policy.Deny, rule)
+	}
+	for _, pattern := range warn {
+		rule, err := patternRule(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid warn pattern: %w", err)
+		}
+		policy.Warn = append(policy.Warn, rule)
+	}
+	return policy, nil
+}
+
+// patternRule compiles a user pattern into a rule
+func patternRule(pattern string) (SQLRule, error) {
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return SQLRule{}, err
+	}
+	return SQLRule{Pattern: re, Reason: fmt.Sprintf("matches %q", pattern)}, nil
+}
+
+// sqlStatement is a statement of an up section, with comment lines blanked out
+type sqlStatement struct {
+	text   string
+	offset int // byte offset of text in the file
+}
+
+// Check matches the statements of the up section of a migration file against the policy. It
+// logs the Warn matches and returns an error naming the first line matching a Deny rule or,
+// with an allow-list, matching no Allow rule. A file without a down block, which dbmate
+// refuses to run, fails the check once its up section passed.
+func (p *SQLPolicy) Check(filePath string) error {
+	if p == nil || (len(p.Allow) == 0 && len(p.Deny) == 0 && len(p.Warn) == 0) {
+		return nil
+	}
+
+	fileName := path.Base(filePath)
+	content, statements, err := upStatements(filePath)
+	missingDown := errors.Is(err, dbmate.ErrParseMissingDown)
+	if err != nil && !missingDown {
+		return fmt.Errorf("failed to parse %s: %w", fileName, err)
+	}
+
+	for _, stmt := range statements {
+		if len(p.Allow) > 0 && !p.allows(stmt) {
+			line, text := lineAt(content, stmt.start())
+			return fmt.Errorf("%s, line %d: not in the allow-list: %s", fileName, line, text)
+		}
+		for _, rule := range p.Warn {
+			if offset, ok := rule.match(stmt); ok {
+				line, text := lineAt(content, offset)
+				slog.Warn("Migration statement matches a warn rule", "file", fileName, "line", line, "reason", rule.Reason, "sql", text)
+			}
+		}
+		for _, rule := range p.Deny {
+			if offset, ok := rule.match(stmt); ok {
+				line, text := lineAt(content, offset)
+				return fmt.Errorf("%s, line %d: %s: %s", fileName, line, rule.Reason, text)
+			}
+		}
+	}
+	if missingDown {
+		return fmt.Errorf("%s: missing '-- migrate:down' block, which dbmate requires even if it is empty", fileName)
+	}
+	return nil
+}
+
+// allows reports whether stmt matches one of the Allow rules
+func (p *SQLPolicy) allows(stmt sqlStatement) bool {
+	for _, rule := range p.Allow {
+		if _, ok := rule.match(stmt); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// start returns the file offset of the first non-blank character of the statement
+func (s sqlStatement) start() int {
+	return s.offset + len(s.text) - len(strings.TrimLeft(s.text, " \t\r\n"))
+}
+
+// match returns the file offset of the first match of the rule in stmt
+func (r SQLRule) match(stmt sqlStatement) (int, bool) {
+	loc := r.Pattern.FindStringIndex(stmt.text)
+	if loc == nil {
+		return 0, false
+	}
+	if r.Unless != nil && r.Unless.MatchString(stmt.text) {
+		return 0, false
+	}
+	// Report the line of the first non-blank character of the match
+	matched := stmt.text[loc[0]:loc[1]]
+	return stmt.offset + loc[0] + len(matched) - len(strings.TrimLeft(matched, " \t\r\n")), true
+}
+
+// upMarkerPattern finds the up block directive like dbmate's parser does
+var upMarkerPattern = regexp.MustCompile(`(?m)^--\s*migrate:up(\s*$|\s+\S+)`)
+
+// upStatements returns the content of a migration file and the statements of its up section.
+// For a file without a down block, whose up section runs to the end of the file, the
+// statements are returned along with dbmate.ErrParseMissingDown.
+func upStatements(filePath string) (string, []sqlStatement, error) {
+	migration := dbmate.Migration{FileName: path.Base(filePath), FilePath: filePath}
+	parsed, parseErr := migration.Parse()
+	if parseErr != nil && !errors.Is(parseErr, dbmate.ErrParseMissingDown) {
+		return "", nil, parseErr
+	}
+	raw, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", nil, err
+	}
+	content := string(raw)
+
+	var up string
+	if parsed != nil {
+		up = parsed.Up
+	} else {
+		up = content[upMarkerPattern.FindStringIndex(content)[0]:]
+	}
+
+	// Offsets are reported in the file, falling back to the up section alone
+	base := strings.Index(content, up)
+	if base < 0 {
+		content, base = up, 0
+	}
+
+	var statements []sqlStatement
+	offset := base
+	for _, piece := range strings.SplitAfter(up, ";") {
+		if isStatement(piece) {
+			statements = append(statements, sqlStatement{text: blankComments(piece), offset: offset})
+		}
+		offset += len(piece)
+	}
+	return content, statements, parseErr
+}
+
+// blankComments replaces comment lines with spaces, keeping the offsets of the other lines
+func blankComments(stmt string) string {
+	lines := strings.Split(stmt, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines[i] = strings.Repeat(" ", len(line))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// lineAt returns the 1-based line number of offset in content and that line, trimmed
+func lineAt(content string, offset int) (int, string) {
+	start := strings.LastIndex(content[:offset], "\n") + 1
+	end := strings.Index(content[offset:], "\n")
+	if end < 0 {
+		end = len(content)
+	} else {
+		end += offset
+	}
+	return strings.Count(content[:offset], "\n") + 1, strings.TrimSpace(content[start:end])
+}
@@ -0,0 +1,139 @@
+package shared
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared/testhelpers"
+)
+
+func TestSQLPolicy_Check(t *testing.T) {
+	policy, err := NewSQLPolicy(nil, nil, nil, false)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		content  string
+		errorMsg string
+	}{
+		{
+			name:    "safe statements",
+			content: "-- migrate:up\nCREATE TABLE users (id INT);\nDELETE FROM users WHERE id = 1;\nDROP TABLE IF EXISTS old_users;\n\n-- migrate:down\nTRUNCATE users;\nDROP TABLE users;\n",
+		},
+		{
+			name:     "truncate",
+			content:  "-- migrate:up\nCREATE TABLE users (id INT);\ntruncate users;\n\n-- migrate:down\n",
+			errorMsg: "line 3: TRUNCATE deletes every row: truncate users;",
+		},
+		{
+			name:     "delete without where",
+			content:  "-- migrate:up\nSELECT 1;\nDELETE FROM users;\n\n-- migrate:down\n",
+			errorMsg: "line 3: DELETE without WHERE deletes every row: DELETE FROM users;",
+		},
+		{
+			name:    "where on the next line",
+			content: "-- migrate:up\nDELETE FROM users\n  WHERE id = 1;\n\n-- migrate:down\n",
+		},
+		{
+			name:    "comment lines are ignored",
+			content: "-- migrate:up\n-- TRUNCATE users;\nSELECT 1;\n\n-- migrate:down\n",
+		},
+		{
+			name:    "drop table only warns",
+			content: "-- migrate:up\nDROP TABLE users;\n\n-- migrate:down\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			require.NoError(t, testhelpers.WriteFile(dir, "20240101000000_test.sql", tt.content))
+
+			err := policy.Check(filepath.Join(dir, "20240101000000_test.sql"))
+			if tt.errorMsg == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "20240101000000_test.sql, "+tt.errorMsg)
+		})
+	}
+}
+
+func TestNewSQLPolicy(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, testhelpers.WriteFile(dir, "20240101000000_test.sql", "-- migrate:up\nTRUNCATE users;\nALTER TABLE users DROP COLUMN email;\n\n-- migrate:down\n"))
+	file := filepath.Join(dir, "20240101000000_test.sql")
+
+	// Without the defaults only the custom patterns apply, case-insensitively
+	policy, err := NewSQLPolicy(nil, []string{`drop\s+column`}, nil, true)
+	require.NoError(t, err)
+	require.Len(t, policy.Deny, 1)
+	assert.Empty(t, policy.Warn)
+	err = policy.Check(file)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `line 3: matches "drop\\s+column": ALTER TABLE users DROP COLUMN email;`)
+
+	// A custom warn pattern doesn't fail the check
+	policy, err = NewSQLPolicy(nil, nil, []string{`drop\s+column`}, true)
+	require.NoError(t, err)
+	assert.NoError(t, policy.Check(file))
+
+	// A nil policy checks nothing
+	assert.NoError(t, (*SQLPolicy)(nil).Check(file))
+
+	_, err = NewSQLPolicy(nil, []string{"("}, nil, false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid deny pattern")
+	_, err = NewSQLPolicy([]string{"("}, nil, nil, false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid allow pattern")
+}
+
+func TestSQLPolicy_Allow(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "20240101000000_test.sql")
+	policy, err := NewSQLPolicy([]string{`^\s*CREATE\s+TABLE\b`, `^\s*CREATE\s+INDEX\b`}, nil, nil, false)
+	require.NoError(t, err)
+
+	// Every statement of the up section is on the allow-list; the down section isn't checked
+	require.NoError(t, testhelpers.WriteFile(dir, "20240101000000_test.sql",
+		"-- migrate:up\n-- a comment\nCREATE TABLE users (id INT);\ncreate index idx_users_id on users (id);\n\n-- migrate:down\nDROP TABLE users;\n"))
+	assert.NoError(t, policy.Check(file))
+
+	// A statement matching no allow pattern fails, even if no deny rule matches it
+	require.NoError(t, testhelpers.WriteFile(dir, "20240101000000_test.sql",
+		"-- migrate:up\nCREATE TABLE users (id INT);\n\nALTER TABLE users ADD COLUMN email TEXT;\n\n-- migrate:down\n"))
+	err = policy.Check(file)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "20240101000000_test.sql, line 4: not in the allow-list: ALTER TABLE users ADD COLUMN email TEXT;")
+
+	// Deny rules still apply to allowed statements
+	policy, err = NewSQLPolicy([]string{`.`}, nil, nil, false)
+	require.NoError(t, err)
+	require.NoError(t, testhelpers.WriteFile(dir, "20240101000000_test.sql", "-- migrate:up\nTRUNCATE users;\n\n-- migrate:down\n"))
+	err = policy.Check(file)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 2: TRUNCATE deletes every row")
+}
+
+func TestSQLPolicy_MissingDown(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "20240101000000_test.sql")
+	policy, err := NewSQLPolicy(nil, nil, nil, false)
+	require.NoError(t, err)
+
+	// The missing down block is reported on its own
+	require.NoError(t, testhelpers.WriteFile(dir, "20240101000000_test.sql", "-- migrate:up\nCREATE TABLE users (id INT);\n"))
+	err = policy.Check(file)
+	require.Error(t, err)
+	assert.EqualError(t, err, "20240101000000_test.sql: missing '-- migrate:down' block, which dbmate requires even if it is empty")
+
+	// The up section is still checked, and a violation in it is reported first
+	require.NoError(t, testhelpers.WriteFile(dir, "20240101000000_test.sql", "-- migrate:up\nCREATE TABLE users (id INT);\nTRUNCATE users;\n"))
+	err = policy.Check(file)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "20240101000000_test.sql, line 3: TRUNCATE deletes every row: TRUNCATE users;")
+}
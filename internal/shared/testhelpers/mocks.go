@@ -3,31 +3,80 @@ package testhelpers
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 	"sync"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 )
 
 // MockS3Client is an in-memory mock implementation of S3 client for unit tests
 type MockS3Client struct {
 	mu      sync.RWMutex
 	objects map[string][]byte // key -> content
+
+	// MaxKeys caps the page size of ListObjectsV2 when the request doesn't set one (0 means 1000)
+	MaxKeys int32
+	// ListCalls counts ListObjectsV2 calls
+	ListCalls int
+	// PutInputs holds the last PutObject input for each key (bucket/key)
+	PutInputs map[string]*s3.PutObjectInput
+	// Versioning makes the mock behave like a versioned bucket: every PutObject returns a new
+	// VersionId and earlier versions stay readable with GetObjectInput.VersionId
+	Versioning bool
+
+	versions       map[string]map[string][]byte // key -> version ID -> content
+	currentVersion map[string]string            // key -> version ID of the current content
+	versionSeq     int
+
+	errMu    sync.Mutex
+	injected map[string][]error // operation -> errors returned by the next calls
 }
 
 // NewMockS3Client creates a new mock S3 client
 func NewMockS3Client() *MockS3Client {
 	return &MockS3Client{
-		objects: make(map[string][]byte),
+		objects:   make(map[string][]byte),
+		PutInputs: make(map[string]*s3.PutObjectInput),
+	}
+}
+
+// InjectErrors makes the next calls of an operation (e.g. "GetObject") return errs, one per call
+func (m *MockS3Client) InjectErrors(op string, errs ...error) {
+	m.errMu.Lock()
+	defer m.errMu.Unlock()
+
+	if m.injected == nil {
+		m.injected = make(map[string][]error)
 	}
+	m.injected[op] = append(m.injected[op], errs...)
+}
+
+// nextError pops the next injected error for an operation
+func (m *MockS3Client) nextError(op string) error {
+	m.errMu.Lock()
+	defer m.errMu.Unlock()
+
+	if len(m.injected[op]) == 0 {
+		return nil
+	}
+	err := m.injected[op][0]
+	m.injected[op] = m.injected[op][1:]
+	return err
 }
 
 // PutObject stores an object in the mock storage
 func (m *MockS3Client) PutObject(ctx context.Context, input *s3.PutObjectInput, opts ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if err := m.nextError("PutObject"); err != nil {
+		return nil, err
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -42,13 +91,60 @@ func (m *MockS3Client) PutObject(ctx context.Context, input *s3.PutObjectInput,
 	}
 
 	key := *input.Bucket + "/" + *input.Key
+
+	// Honor conditional writes (If-None-Match: * and If-Match: <etag>)
+	existing, exists := m.objects[key]
+	if input.IfNoneMatch != nil && *input.IfNoneMatch == "*" && exists {
+		return nil, errPreconditionFailed
+	}
+	if input.IfMatch != nil && (!exists || *input.IfMatch != etag(existing)) {
+		return nil, errPreconditionFailed
+	}
+
 	m.objects[key] = content
+	m.PutInputs[key] = input
+
+	output := &s3.PutObjectOutput{ETag: aws.String(etag(content))}
+	if m.Versioning {
+		if m.versions == nil {
+			m.versions = make(map[string]map[string][]byte)
+			m.currentVersion = make(map[string]string)
+		}
+		if m.versions[key] == nil {
+			m.versions[key] = make(map[string][]byte)
+		}
+		m.versionSeq++
+		versionID := fmt.Sprintf("v%d", m.versionSeq)
+		m.versions[key][versionID] = content
+		m.currentVersion[key] = versionID
+		output.VersionId = aws.String(versionID)
+	}
+	return output, nil
+}
+
+// errNoSuchVersion is returned when GetObject asks for a version that doesn't exist
+var errNoSuchVersion = &smithy.GenericAPIError{
+	Code:    "NoSuchVersion",
+	Message: "The specified version does not exist",
+}
+
+// errPreconditionFailed is returned when a conditional write doesn't hold
+var errPreconditionFailed = &smithy.GenericAPIError{
+	Code:    "PreconditionFailed",
+	Message: "At least one of the pre-conditions you specified did not hold",
+}
 
-	return &s3.PutObjectOutput{}, nil
+// etag returns the quoted MD5 of content, as S3 does for single-part uploads
+func etag(content []byte) string {
+	return fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(content)))
 }
 
 // GetObject retrieves an object from the mock storage
 func (m *MockS3Client) GetObject(ctx context.Context, input *s3.GetObjectInput, opts ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if err := m.nextError("GetObject"); err != nil {
+		return nil, err
+	}
+
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
@@ -57,6 +153,18 @@ func (m *MockS3Client) GetObject(ctx context.Context, input *s3.GetObjectInput,
 	}
 
 	key := *input.Bucket + "/" + *input.Key
+	if input.VersionId != nil {
+		content, exists := m.versions[key][*input.VersionId]
+		if !exists {
+			return nil, errNoSuchVersion
+		}
+		return &s3.GetObjectOutput{
+			Body:      io.NopCloser(bytes.NewReader(content)),
+			ETag:      aws.String(etag(content)),
+			VersionId: input.VersionId,
+		}, nil
+	}
+
 	content, exists := m.objects[key]
 	if !exists {
 		return nil, &types.NoSuchKey{
@@ -65,12 +173,37 @@ func (m *MockS3Client) GetObject(ctx context.Context, input *s3.GetObjectInput,
 	}
 
 	return &s3.GetObjectOutput{
-		Body: io.NopCloser(bytes.NewReader(content)),
+		Body:      io.NopCloser(bytes.NewReader(content)),
+		ETag:      aws.String(etag(content)),
+		VersionId: m.versionID(key),
 	}, nil
 }
 
+// versionID returns the VersionId of the current content of key, or nil without versioning
+func (m *MockS3Client) versionID(key string) *string {
+	if id, ok := m.currentVersion[key]; ok {
+		return aws.String(id)
+	}
+	return nil
+}
+
+// HeadBucket succeeds for any bucket unless an error was injected with InjectErrors("HeadBucket", ...)
+func (m *MockS3Client) HeadBucket(ctx context.Context, input *s3.HeadBucketInput, opts ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	if err := m.nextError("HeadBucket"); err != nil {
+		return nil, err
+	}
+	if input.Bucket == nil {
+		return nil, fmt.Errorf("bucket is required")
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
 // HeadObject checks if an object exists in the mock storage
 func (m *MockS3Client) HeadObject(ctx context.Context, input *s3.HeadObjectInput, opts ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	if err := m.nextError("HeadObject"); err != nil {
+		return nil, err
+	}
+
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
@@ -86,13 +219,19 @@ func (m *MockS3Client) HeadObject(ctx context.Context, input *s3.HeadObjectInput
 		}
 	}
 
-	return &s3.HeadObjectOutput{}, nil
+	return &s3.HeadObjectOutput{VersionId: m.versionID(key)}, nil
 }
 
 // ListObjectsV2 lists objects with a given prefix in the mock storage
 func (m *MockS3Client) ListObjectsV2(ctx context.Context, input *s3.ListObjectsV2Input, opts ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+	if err := m.nextError("ListObjectsV2"); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ListCalls++
 
 	if input.Bucket == nil {
 		return nil, fmt.Errorf("bucket is required")
@@ -109,7 +248,7 @@ func (m *MockS3Client) ListObjectsV2(ctx context.Context, input *s3.ListObjectsV
 	}
 
 	bucketPrefix := *input.Bucket + "/"
-	var contents []types.Object
+	sizes := make(map[string]int64)
 	commonPrefixes := make(map[string]bool)
 
 	for key, content := range m.objects {
@@ -141,29 +280,74 @@ func (m *MockS3Client) ListObjectsV2(ctx context.Context, input *s3.ListObjectsV
 			}
 		}
 
-		// Add to contents
-		contents = append(contents, types.Object{
-			Key:  aws.String(objectKey),
-			Size: aws.Int64(int64(len(content))),
-		})
+		sizes[objectKey] = int64(len(content))
 	}
 
-	// Convert common prefixes map to slice
-	var commonPrefixesSlice []types.CommonPrefix
+	// Merge keys and common prefixes in lexicographic order, like S3 does
+	var entries []string
+	for key := range sizes {
+		entries = append(entries, key)
+	}
 	for cp := range commonPrefixes {
-		commonPrefixesSlice = append(commonPrefixesSlice, types.CommonPrefix{
-			Prefix: aws.String(cp),
+		entries = append(entries, cp)
+	}
+	sort.Strings(entries)
+
+	// Skip entries up to StartAfter
+	if input.StartAfter != nil {
+		start := sort.SearchStrings(entries, *input.StartAfter)
+		if start < len(entries) && entries[start] == *input.StartAfter {
+			start++
+		}
+		entries = entries[start:]
+	}
+
+	// Skip entries up to the continuation token (the last entry of the previous page)
+	if input.ContinuationToken != nil {
+		start := sort.SearchStrings(entries, *input.ContinuationToken)
+		if start < len(entries) && entries[start] == *input.ContinuationToken {
+			start++
+		}
+		entries = entries[start:]
+	}
+
+	// Apply MaxKeys (S3 defaults to 1000)
+	maxKeys := 1000
+	if m.MaxKeys > 0 {
+		maxKeys = int(m.MaxKeys)
+	}
+	if input.MaxKeys != nil && *input.MaxKeys > 0 {
+		maxKeys = int(*input.MaxKeys)
+	}
+	output := &s3.ListObjectsV2Output{}
+	if len(entries) > maxKeys {
+		entries = entries[:maxKeys]
+		output.IsTruncated = aws.Bool(true)
+		output.NextContinuationToken = aws.String(entries[len(entries)-1])
+	}
+
+	for _, entry := range entries {
+		if commonPrefixes[entry] {
+			output.CommonPrefixes = append(output.CommonPrefixes, types.CommonPrefix{
+				Prefix: aws.String(entry),
+			})
+			continue
+		}
+		output.Contents = append(output.Contents, types.Object{
+			Key:  aws.String(entry),
+			Size: aws.Int64(sizes[entry]),
 		})
 	}
 
-	return &s3.ListObjectsV2Output{
-		Contents:       contents,
-		CommonPrefixes: commonPrefixesSlice,
-	}, nil
+	return output, nil
 }
 
 // DeleteObject removes an object from the mock storage
 func (m *MockS3Client) DeleteObject(ctx context.Context, input *s3.DeleteObjectInput, opts ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	if err := m.nextError("DeleteObject"); err != nil {
+		return nil, err
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -172,7 +356,14 @@ func (m *MockS3Client) DeleteObject(ctx context.Context, input *s3.DeleteObjectI
 	}
 
 	key := *input.Bucket + "/" + *input.Key
+
+	// Honor conditional deletes (If-Match: <etag>)
+	if existing, exists := m.objects[key]; input.IfMatch != nil && (!exists || *input.IfMatch != etag(existing)) {
+		return nil, errPreconditionFailed
+	}
+
 	delete(m.objects, key)
+	delete(m.currentVersion, key)
 
 	return &s3.DeleteObjectOutput{}, nil
 }
@@ -182,6 +373,9 @@ func (m *MockS3Client) Clear() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.objects = make(map[string][]byte)
+	m.PutInputs = make(map[string]*s3.PutObjectInput)
+	m.versions = nil
+	m.currentVersion = nil
 }
 
 // ObjectCount returns the number of objects in the mock storage
@@ -0,0 +1,88 @@
+package shared
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// migrationTimer wraps dbmate's log writer and times each migration file from its
+// "Applying: <file>" line until the next one (or until finish is called)
+type migrationTimer struct {
+	mu        sync.Mutex
+	w         io.Writer
+	partial   []byte
+	current   string
+	startedAt time.Time
+	now       func() time.Time
+
+	durations map[string]float64
+}
+
+func newMigrationTimer(w io.Writer) *migrationTimer {
+	return &migrationTimer{
+		w:         w,
+		now:       time.Now,
+		durations: make(map[string]float64),
+	}
+}
+
+// Write passes p through to the underlying writer and scans complete lines for "Applying:"
+func (t *migrationTimer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.partial = append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(t.partial[:i])
+		t.partial = t.partial[i+1:]
+
+		if file, ok := strings.CutPrefix(line, "Applying: "); ok {
+			t.stop()
+			t.current = strings.TrimSpace(file)
+			t.startedAt = t.now()
+		}
+	}
+
+	return t.w.Write(p)
+}
+
+// stop records the duration of the migration currently running, if any
+func (t *migrationTimer) stop() {
+	if t.current == "" {
+		return
+	}
+	t.durations[t.current] = t.now().Sub(t.startedAt).Seconds()
+	t.current = ""
+}
+
+// finish stops the last migration and returns the duration of each file in seconds
+func (t *migrationTimer) finish() map[string]float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stop()
+	return t.durations
+}
+
+// running returns the migration file dbmate is applying (or failed on), or "" if none
+func (t *migrationTimer) running() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.current
+}
+
+// detach discards further output, for a dbmate run that is abandoned after a timeout
+func (t *migrationTimer) detach() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.w = io.Discard
+}
@@ -0,0 +1,31 @@
+package shared
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrationTimer(t *testing.T) {
+	var buf bytes.Buffer
+	timer := newMigrationTimer(&buf)
+
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	timer.now = func() time.Time { return clock }
+
+	_, _ = fmt.Fprintf(timer, "Applying: 001_a.sql\n")
+	clock = clock.Add(2 * time.Second)
+	_, _ = fmt.Fprintf(timer, "Rows affected: 0\n")
+	// A line split across writes is still recognized
+	_, _ = timer.Write([]byte("Apply"))
+	_, _ = timer.Write([]byte("ing: 002_b.sql\n"))
+	clock = clock.Add(500 * time.Millisecond)
+
+	durations := timer.finish()
+
+	assert.Equal(t, map[string]float64{"001_a.sql": 2, "002_b.sql": 0.5}, durations)
+	assert.Equal(t, "Applying: 001_a.sql\nRows affected: 0\nApplying: 002_b.sql\n", buf.String())
+}
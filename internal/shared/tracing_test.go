@@ -0,0 +1,81 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared/testhelpers"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// withSpanRecorder installs a tracer provider that records finished spans for the test
+func withSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func TestSetupTracing_Disabled(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+
+	shutdown, err := SetupTracing(context.Background())
+	require.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+}
+
+func TestTracing_Spans(t *testing.T) {
+	recorder := withSpanRecorder(t)
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+
+	for _, key := range []string{
+		"migrations/20240101000000/migrations/001_a.sql",
+		"migrations/20240101000000/migrations/002_b.sql",
+	} {
+		_, _ = mock.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String(key),
+			Body:   io.NopCloser(bytes.NewBufferString("-- migrate:up")),
+		})
+	}
+
+	version, err := FindUnappliedVersion(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "")
+	require.NoError(t, err)
+	require.NoError(t, DownloadMigrations(ctx, mock, DefaultSettings(), "test-bucket", "migrations/20240101000000/migrations/", t.TempDir(), 2))
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+
+	assert.Equal(t, "FindUnappliedVersion", spans[0].Name())
+	assert.Contains(t, spans[0].Attributes(), attribute.String("s3.bucket", "test-bucket"))
+	assert.Contains(t, spans[0].Attributes(), attribute.String("version", version))
+
+	assert.Equal(t, "DownloadMigrations", spans[1].Name())
+	assert.Contains(t, spans[1].Attributes(), attribute.Int("file_count", 2))
+	assert.Equal(t, codes.Unset, spans[1].Status().Code)
+}
+
+func TestTracing_SpanRecordsError(t *testing.T) {
+	recorder := withSpanRecorder(t)
+	mock := testhelpers.NewMockS3Client()
+
+	_, err := FindUnappliedVersions(context.Background(), mock, DefaultSettings(), "test-bucket", "migrations/", "")
+	require.Error(t, err)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 1)
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.Equal(t, err.Error(), spans[0].Status().Description)
+}
@@ -0,0 +1,170 @@
+package shared
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Version formats accepted as Settings.VersionFormat
+const (
+	// VersionFormatTimestamp requires 14-digit YYYYMMDDHHMMSS versions
+	VersionFormatTimestamp = "timestamp"
+	// VersionFormatNumeric accepts any non-negative integer, e.g. 42
+	VersionFormatNumeric = "numeric"
+	// VersionFormatFree accepts any S3-safe name, e.g. v1.2.0
+	VersionFormatFree = "free"
+)
+
+// versionFormat returns the configured version format, VersionFormatTimestamp unless it is
+// numeric or free
+func (s Settings) versionFormat() string {
+	switch s.VersionFormat {
+	case VersionFormatNumeric, VersionFormatFree:
+		return s.VersionFormat
+	default:
+		return VersionFormatTimestamp
+	}
+}
+
+// isTimestamp reports whether s is a 14-digit YYYYMMDDHHMMSS timestamp
+func isTimestamp(s string) bool {
+	return len(s) == 14 && isDigits(s)
+}
+
+// isDigits reports whether s is a non-empty string of ASCII digits
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isFreeVersion reports whether s is usable as a single S3 key segment:
+// letters, digits, '.', '_' and '-', but not "." or ".."
+func isFreeVersion(s string) bool {
+	if s == "" || s == "." || s == ".." {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isVersion reports whether v is a version in the configured format
+func (s Settings) isVersion(v string) bool {
+	switch s.VersionFormat {
+	case VersionFormatNumeric:
+		return isDigits(v)
+	case VersionFormatFree:
+		return isFreeVersion(v)
+	default:
+		return isTimestamp(v)
+	}
+}
+
+// ValidateVersion checks that a version matches the configured format
+// (a 14-digit timestamp YYYYMMDDHHMMSS by default)
+func (s Settings) ValidateVersion(version string) error {
+	switch s.VersionFormat {
+	case VersionFormatNumeric:
+		if !isDigits(version) {
+			return fmt.Errorf("version must be a non-negative integer: %s", version)
+		}
+	case VersionFormatFree:
+		if !isFreeVersion(version) {
+			return fmt.Errorf("version may only contain letters, digits, '.', '_' and '-': %s", version)
+		}
+	default:
+		if len(version) != 14 {
+			return fmt.Errorf("version must be 14 digits (YYYYMMDDHHMMSS): %s", version)
+		}
+		if !isTimestamp(version) {
+			return fmt.Errorf("version must contain only digits: %s", version)
+		}
+	}
+	return nil
+}
+
+// validateMigrationFileName checks the name of a migration file. With timestamp versions
+// it must be YYYYMMDDHHMMSS_description.sql; otherwise any numeric prefix followed by an
+// underscore is accepted, which is what dbmate itself requires.
+func (s Settings) validateMigrationFileName(fileName string) error {
+	if s.versionFormat() != VersionFormatTimestamp {
+		prefix, _, ok := strings.Cut(fileName, "_")
+		if !ok || !isDigits(prefix) {
+			return fmt.Errorf("filename must start with a number followed by an underscore: %s", fileName)
+		}
+		return nil
+	}
+
+	// Check if filename starts with timestamp (14 digits)
+	if len(fileName) < 15 { // YYYYMMDDHHMMSS + _ + at least 1 char + .sql
+		return fmt.Errorf("filename too short, expected format: YYYYMMDDHHMMSS_description.sql: %s", fileName)
+	}
+
+	// Check first 14 characters are digits
+	if !isTimestamp(fileName[:14]) {
+		return fmt.Errorf("filename must start with 14-digit timestamp (YYYYMMDDHHMMSS): %s", fileName)
+	}
+
+	// Check underscore after timestamp
+	if fileName[14] != '_' {
+		return fmt.Errorf("filename must have underscore after timestamp: %s", fileName)
+	}
+	return nil
+}
+
+// CompareVersions orders versions naturally: runs of digits compare by numeric value and
+// everything else byte by byte, so 9 < 10 and v1.9.0 < v1.10.0. For timestamps and plain
+// integers this is the numeric order. It returns -1, 0 or 1.
+func CompareVersions(a, b string) int {
+	for a != "" && b != "" {
+		var ca, cb string
+		if isDigitByte(a[0]) && isDigitByte(b[0]) {
+			ca, a = splitDigits(a)
+			cb, b = splitDigits(b)
+			// Without leading zeros, the longer run of digits is the larger number
+			na, nb := strings.TrimLeft(ca, "0"), strings.TrimLeft(cb, "0")
+			if len(na) != len(nb) {
+				if len(na) < len(nb) {
+					return -1
+				}
+				return 1
+			}
+			if c := strings.Compare(na, nb); c != 0 {
+				return c
+			}
+			continue
+		}
+
+		ca, a = a[:1], a[1:]
+		cb, b = b[:1], b[1:]
+		if c := strings.Compare(ca, cb); c != 0 {
+			return c
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+func isDigitByte(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// splitDigits splits s after its leading run of digits
+func splitDigits(s string) (string, string) {
+	i := 0
+	for i < len(s) && isDigitByte(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
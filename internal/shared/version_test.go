@@ -0,0 +1,88 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared/testhelpers"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"20240101000000", "20240102000000", -1},
+		{"20240101000000", "20240101000000", 0},
+		{"9", "10", -1},
+		{"010", "9", 1},
+		{"v1.9.0", "v1.10.0", -1},
+		{"v1.10.0", "v1.9.0", 1},
+		{"v1.2", "v1.2.1", -1},
+		{"release-a", "release-b", -1},
+		{"99999999999999999999999", "100000000000000000000000", -1},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, CompareVersions(tt.a, tt.b), "%s vs %s", tt.a, tt.b)
+	}
+}
+
+func TestValidateVersion_Formats(t *testing.T) {
+	numeric := Settings{VersionFormat: VersionFormatNumeric}
+	assert.NoError(t, numeric.ValidateVersion("42"))
+	assert.EqualError(t, numeric.ValidateVersion("v42"), "version must be a non-negative integer: v42")
+
+	free := Settings{VersionFormat: VersionFormatFree}
+	assert.NoError(t, free.ValidateVersion("v1.2.0-rc_1"))
+	assert.Error(t, free.ValidateVersion("a/b"))
+	assert.Error(t, free.ValidateVersion(".."))
+	assert.Error(t, free.ValidateVersion(""))
+}
+
+func TestValidateMigrationFile_NumericFormat(t *testing.T) {
+	numeric := Settings{VersionFormat: VersionFormatNumeric}
+	dir := t.TempDir()
+
+	valid := filepath.Join(dir, "001_create_users.sql")
+	require.NoError(t, os.WriteFile(valid, []byte("-- migrate:up\nSELECT 1;\n-- migrate:down\n"), 0o644))
+	assert.NoError(t, numeric.ValidateMigrationFile(valid, nil))
+
+	invalid := filepath.Join(dir, "create_users.sql")
+	require.NoError(t, os.WriteFile(invalid, []byte("-- migrate:up\n"), 0o644))
+	assert.ErrorContains(t, numeric.ValidateMigrationFile(invalid, nil), "must start with a number followed by an underscore")
+}
+
+func TestFindUnappliedVersions_FreeFormat(t *testing.T) {
+	free := DefaultSettings()
+	free.VersionFormat = VersionFormatFree
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+
+	for _, version := range []string{"v1.10.0", "v1.2.0", "v1.9.0"} {
+		_, _ = mock.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String("migrations/" + version + "/migrations/001_a.sql"),
+			Body:   io.NopCloser(bytes.NewBufferString("-- migrate:up")),
+		})
+	}
+
+	versions, err := FindUnappliedVersions(ctx, mock, free, "test-bucket", "migrations/", "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v1.2.0", "v1.9.0", "v1.10.0"}, versions)
+
+	versions, err = FindUnappliedVersionsUpTo(ctx, mock, free, "test-bucket", "migrations/", "", "v1.9.0")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v1.2.0", "v1.9.0"}, versions)
+
+	// The default timestamp format skips all of them
+	_, err = FindUnappliedVersions(ctx, mock, DefaultSettings(), "test-bucket", "migrations/", "")
+	assert.ErrorIs(t, err, ErrNoVersions)
+}
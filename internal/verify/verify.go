@@ -0,0 +1,117 @@
+package verify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/tokuhirom/dbmate-deployer/internal/shared"
+)
+
+// Cmd runs the pending migrations in a rolled-back transaction to prove they would apply
+type Cmd struct {
+	DatabaseURL         string `help:"Database to verify against (PostgreSQL); use a throwaway or staging database" env:"DATABASE_URL" required:""`
+	S3Bucket            string `help:"S3 bucket name" env:"S3_BUCKET" required:"" name:"s3-bucket"`
+	S3PathPrefix        string `help:"S3 path prefix (e.g. 'migrations/')" env:"S3_PATH_PREFIX" required:"" name:"s3-path-prefix"`
+	ResultFile          string `help:"Name of the per-version result file marking a version as applied" env:"RESULT_FILE" name:"result-file" default:"result.json"`
+	Version             string `help:"Version to verify (default: the newest version without a result)" name:"version" short:"v"`
+	DownloadConcurrency int    `help:"Number of migration files downloaded in parallel" env:"DOWNLOAD_CONCURRENCY" name:"download-concurrency" default:"8"`
+	WorkDir             string `help:"Directory in which migrations are downloaded (default: the OS temp directory)" env:"WORK_DIR" name:"work-dir" type:"path"`
+
+	// Settings holds the S3 layout, version format and S3 retry settings
+	Settings shared.Settings `kong:"-"`
+	// MigrationsTable is the table dbmate records applied migrations in (empty for the dbmate default)
+	MigrationsTable string `kong:"-"`
+}
+
+// Execute verifies the migrations of one version and prints the outcome of each file.
+// Nothing is committed and no result file is written.
+func Execute(ctx context.Context, c *Cmd, s3Opts shared.S3ClientOptions) error {
+	// Ensure prefix ends with /
+	s3Prefix := c.S3PathPrefix
+	if !strings.HasSuffix(s3Prefix, "/") {
+		s3Prefix += "/"
+	}
+
+	if c.Version != "" {
+		if err := c.Settings.ValidateVersion(c.Version); err != nil {
+			return err
+		}
+	}
+
+	// Fail fast on a DATABASE_URL no compiled-in driver can handle
+	if err := shared.ValidateDatabaseURL(c.DatabaseURL); err != nil {
+		return err
+	}
+
+	// Fail fast on a work directory migrations can't be downloaded to
+	if err := shared.ValidateWorkDir(c.WorkDir); err != nil {
+		return err
+	}
+
+	// Create S3 client
+	s3Client, err := shared.CreateS3Client(ctx, s3Opts)
+	if err != nil {
+		return fmt.Errorf("failed to create S3 client: %w", err)
+	}
+
+	// Versions are cumulative, so the newest pending one holds every file still to apply
+	version := c.Version
+	if version == "" {
+		versions, err := shared.FindUnappliedVersions(ctx, s3Client, c.Settings, c.S3Bucket, s3Prefix, c.ResultFile)
+		if errors.Is(err, shared.ErrNoUnappliedVersions) || errors.Is(err, shared.ErrNoVersions) {
+			slog.Info("No pending versions to verify")
+			fmt.Println("Nothing to verify: no pending versions")
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to find unapplied versions: %w", err)
+		}
+		version = versions[len(versions)-1]
+	}
+
+	migrationsDir, err := os.MkdirTemp(c.WorkDir, "verify-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer func() { _ = os.RemoveAll(migrationsDir) }()
+
+	slog.Info("Downloading migrations", "version", version)
+	if err := shared.DownloadVersionMigrations(ctx, s3Client, c.Settings, c.S3Bucket, s3Prefix, version, migrationsDir, c.DownloadConcurrency); err != nil {
+		return fmt.Errorf("failed to download migrations of version %s: %w", version, err)
+	}
+
+	slog.Info("Verifying migrations in a rolled-back transaction", "version", version)
+	checks, err := shared.VerifyMigrationSQL(ctx, c.DatabaseURL, c.MigrationsTable, migrationsDir)
+	if err != nil {
+		return fmt.Errorf("failed to verify version %s: %w", version, err)
+	}
+
+	return report(os.Stdout, version, checks)
+}
+
+// report prints one line per migration file and returns an error if any of them failed
+func report(w io.Writer, version string, checks []shared.SQLCheck) error {
+	failed := 0
+	for _, check := range checks {
+		switch check.Status {
+		case shared.SQLCheckPassed:
+			_, _ = fmt.Fprintf(w, "PASS %s\n", check.File)
+		case shared.SQLCheckFailed:
+			failed++
+			_, _ = fmt.Fprintf(w, "FAIL %s: %v\n", check.File, check.Err)
+		case shared.SQLCheckSkipped:
+			_, _ = fmt.Fprintf(w, "SKIP %s (%s)\n", check.File, check.Reason)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("verification failed for %d of %d migration files of version %s", failed, len(checks), version)
+	}
+	_, _ = fmt.Fprintf(w, "Version %s verified, nothing committed\n", version)
+	return nil
+}
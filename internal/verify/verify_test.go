@@ -0,0 +1,31 @@
+package verify
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared"
+)
+
+func TestReport(t *testing.T) {
+	var out bytes.Buffer
+	err := report(&out, "20240103000000", []shared.SQLCheck{
+		{File: "20240101000000_create_users.sql", Status: shared.SQLCheckSkipped, Reason: "already applied"},
+		{File: "20240102000000_add_email.sql", Status: shared.SQLCheckPassed},
+		{File: "20240103000000_add_index.sql", Status: shared.SQLCheckFailed, Err: errors.New(`pq: column "emial" does not exist`)},
+	})
+	assert.EqualError(t, err, "verification failed for 1 of 3 migration files of version 20240103000000")
+	assert.Equal(t, `SKIP 20240101000000_create_users.sql (already applied)
+PASS 20240102000000_add_email.sql
+FAIL 20240103000000_add_index.sql: pq: column "emial" does not exist
+`, out.String())
+
+	out.Reset()
+	err = report(&out, "20240102000000", []shared.SQLCheck{
+		{File: "20240102000000_add_email.sql", Status: shared.SQLCheckPassed},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "PASS 20240102000000_add_email.sql\nVersion 20240102000000 verified, nothing committed\n", out.String())
+}
@@ -0,0 +1,89 @@
+package wait
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/tokuhirom/dbmate-deployer/internal/shared"
+)
+
+// follower prints the lines added to the progress logs of versions, like tail -f
+type follower struct {
+	client   shared.S3API
+	settings shared.Settings
+	bucket   string
+	prefix   string
+	versions []string
+	w        io.Writer
+
+	printed map[string]int // bytes of each version's log already printed
+	last    string         // version printed last, to head a switch between versions
+}
+
+func newFollower(client shared.S3API, settings shared.Settings, bucket, prefix string, versions []string, w io.Writer) *follower {
+	return &follower{
+		client:   client,
+		settings: settings,
+		bucket:   bucket,
+		prefix:   prefix,
+		versions: versions,
+		w:        w,
+		printed:  make(map[string]int),
+	}
+}
+
+// poll prints what was added to each progress log since the last poll
+func (f *follower) poll(ctx context.Context) {
+	for _, version := range f.versions {
+		log, err := shared.DownloadProgressLog(ctx, f.client, f.settings, f.bucket, f.prefix, version)
+		if err != nil {
+			slog.Warn("Failed to read progress log", "version", version, "error", err)
+			continue
+		}
+
+		// A shorter log was restarted, e.g. by a retry of the version
+		if len(log) < f.printed[version] {
+			f.printed[version] = 0
+		}
+		if len(log) == f.printed[version] {
+			continue
+		}
+
+		if len(f.versions) > 1 && f.last != version {
+			_, _ = fmt.Fprintf(f.w, "==> %s <==\n", version)
+		}
+		_, _ = io.WriteString(f.w, log[f.printed[version]:])
+		f.printed[version] = len(log)
+		f.last = version
+	}
+}
+
+// start polls every interval until the returned stop function is called. stop polls a last
+// time, so that the lines uploaded just before the results are printed too.
+func (f *follower) start(ctx context.Context, interval time.Duration) (stop func()) {
+	pollCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			f.poll(pollCtx)
+			select {
+			case <-pollCtx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+		f.poll(ctx)
+	}
+}
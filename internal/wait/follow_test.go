@@ -0,0 +1,75 @@
+package wait
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared/testhelpers"
+)
+
+func putProgressLog(t *testing.T, mock *testhelpers.MockS3Client, version, log string) {
+	t.Helper()
+	_, err := mock.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String("test-bucket"),
+		Key:    aws.String("migrations/" + version + "/progress.log"),
+		Body:   io.NopCloser(strings.NewReader(log)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFollower_PrintsNewLines(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+	var out bytes.Buffer
+	f := newFollower(mock, shared.DefaultSettings(), "test-bucket", "migrations/", []string{"20240101000000"}, &out)
+
+	// Nothing uploaded yet
+	f.poll(ctx)
+	assert.Empty(t, out.String())
+
+	putProgressLog(t, mock, "20240101000000", "line 1\n")
+	f.poll(ctx)
+	putProgressLog(t, mock, "20240101000000", "line 1\nline 2\n")
+	f.poll(ctx)
+	f.poll(ctx)
+	assert.Equal(t, "line 1\nline 2\n", out.String())
+
+	// A restarted log is printed from its start
+	putProgressLog(t, mock, "20240101000000", "retry\n")
+	f.poll(ctx)
+	assert.Equal(t, "line 1\nline 2\nretry\n", out.String())
+}
+
+func TestFollower_HeadsEachVersion(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	ctx := context.Background()
+	var out bytes.Buffer
+	f := newFollower(mock, shared.DefaultSettings(), "test-bucket", "migrations/", []string{"20240101000000", "20240102000000"}, &out)
+
+	putProgressLog(t, mock, "20240101000000", "first\n")
+	f.poll(ctx)
+	putProgressLog(t, mock, "20240102000000", "second\n")
+	f.poll(ctx)
+	assert.Equal(t, "==> 20240101000000 <==\nfirst\n==> 20240102000000 <==\nsecond\n", out.String())
+}
+
+func TestFollower_StopPollsOnceMore(t *testing.T) {
+	mock := testhelpers.NewMockS3Client()
+	var out bytes.Buffer
+	f := newFollower(mock, shared.DefaultSettings(), "test-bucket", "migrations/", []string{"20240101000000"}, &out)
+
+	stop := f.start(context.Background(), time.Hour)
+	putProgressLog(t, mock, "20240101000000", "done\n")
+	stop()
+	assert.Equal(t, "done\n", out.String())
+}
@@ -4,61 +4,164 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"os"
+	"slices"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/tokuhirom/dbmate-deployer/internal/shared"
 )
 
-// Cmd waits for migration completion and optionally sends Slack notification
+// Cmd waits for migration completion and optionally sends a chat notification
 type Cmd struct {
 	S3Bucket             string        `help:"S3 bucket name" env:"S3_BUCKET" required:"" name:"s3-bucket"`
 	S3PathPrefix         string        `help:"S3 path prefix (e.g. 'migrations/')" env:"S3_PATH_PREFIX" required:"" name:"s3-path-prefix"`
-	MigrationVersion     string        `help:"Migration version to wait for (YYYYMMDDHHMMSS)" short:"v" required:""`
+	ResultFile           string        `help:"Name of the per-version result file marking a version as applied" env:"RESULT_FILE" name:"result-file" default:"result.json"`
+	MigrationVersion     []string      `help:"Migration version to wait for (YYYYMMDDHHMMSS); repeat to wait for a batch" short:"v" required:""`
 	SlackIncomingWebhook string        `help:"Slack incoming webhook URL (optional)" env:"SLACK_INCOMING_WEBHOOK"`
-	Timeout              time.Duration `help:"Maximum wait time" default:"10m"`
+	WebhookURL           string        `help:"Chat webhook URL for Slack, Microsoft Teams or Google Chat (optional, overrides --slack-incoming-webhook)" env:"WEBHOOK_URL" name:"webhook-url"`
+	Notifier             string        `help:"Notification service (auto detects it from the webhook URL)" env:"NOTIFIER" enum:"auto,slack,teams,googlechat" default:"auto"`
+	SlackLogChars        int           `help:"Number of characters from the end of the migration log included in the notification" env:"SLACK_LOG_CHARS" name:"slack-log-chars" default:"1000"`
+	SlackTemplate        string        `help:"Go text/template file rendering the Slack webhook JSON payload instead of the built-in layout (Slack only)" env:"SLACK_TEMPLATE" name:"slack-template" type:"existingfile"`
+	PresignResults       bool          `help:"Link a presigned URL for result.json in the notification instead of its s3:// location" env:"PRESIGN_RESULTS" name:"presign-results"`
+	PresignExpiry        time.Duration `help:"How long the presigned result URL stays valid (at most 7 days)" env:"PRESIGN_EXPIRY" name:"presign-expiry" default:"24h"`
+	NotifyOn             string        `help:"Which results are notified: always, failure or success" env:"NOTIFY_ON" name:"notify-on" enum:"always,failure,success" default:"always"`
+	PushTimeout          time.Duration `help:"Maximum wait for the versions' migrations to appear in S3 before waiting for results (0 skips this phase)" env:"PUSH_TIMEOUT" name:"push-timeout" default:"5m"`
+	Timeout              time.Duration `help:"Maximum wait time for the results once the versions are pushed" default:"10m"`
 	PollInterval         time.Duration `help:"Polling interval" default:"5s"`
-}
+	OnlyIfRecent         time.Duration `help:"Fail if a version's result is older than this, e.g. left over from an earlier deploy cycle (0 disables)" env:"ONLY_IF_RECENT" name:"only-if-recent" default:"0s"`
+	Follow               bool          `help:"Print the migration log while waiting, as the daemon uploads it with --write-progress" env:"FOLLOW" name:"follow"`
 
-// Execute waits for migration completion and optionally notifies Slack
-func Execute(c *Cmd, s3EndpointURL, metricsAddr string) error {
-	ctx := context.Background()
+	// Settings holds the S3 layout, version format and S3 retry settings
+	Settings shared.Settings `kong:"-"`
+	// Webhook sets the timeout and attempts of each webhook notification
+	Webhook shared.WebhookOptions `kong:"-"`
+}
 
+// Execute waits for migration completion and optionally sends a chat notification
+func Execute(ctx context.Context, c *Cmd, s3Opts shared.S3ClientOptions, metricsAddr string) error {
 	// Ensure prefix ends with /
 	s3Prefix := c.S3PathPrefix
 	if !strings.HasSuffix(s3Prefix, "/") {
 		s3Prefix += "/"
 	}
 
+	// Fail fast on a broken template rather than after the wait
+	var slackTemplate *template.Template
+	if c.SlackTemplate != "" {
+		tmpl, err := shared.ParseSlackTemplate(c.SlackTemplate)
+		if err != nil {
+			return err
+		}
+		slackTemplate = tmpl
+	}
+
 	// Create S3 client
-	s3Client, err := shared.CreateS3Client(ctx, s3EndpointURL)
+	s3Client, err := shared.CreateS3Client(ctx, s3Opts)
 	if err != nil {
 		return fmt.Errorf("failed to create S3 client: %w", err)
 	}
 
-	hasSlackWebhook := c.SlackIncomingWebhook != ""
+	// Wait for results, oldest version first
+	versions := slices.Clone(c.MigrationVersion)
+	slices.SortFunc(versions, shared.CompareVersions)
+	versions = slices.Compact(versions)
+	if len(versions) == 0 {
+		return fmt.Errorf("at least one migration version is required")
+	}
 
 	slog.Info("Starting wait-and-notify",
-		"version", c.MigrationVersion,
-		"slack_notification", hasSlackWebhook,
+		"versions", versions,
+		"push_timeout", c.PushTimeout,
 		"timeout", c.Timeout,
 		"poll_interval", c.PollInterval)
 
-	// Wait for result
-	result, err := shared.WaitForResult(ctx, s3Client, c.S3Bucket, s3Prefix,
-		c.MigrationVersion, c.PollInterval, c.Timeout)
+	// wait-and-notify may start before push has finished uploading the versions
+	if c.PushTimeout > 0 {
+		if err := shared.WaitForPush(ctx, s3Client, c.Settings, c.S3Bucket, s3Prefix,
+			versions, c.ResultFile, c.PollInterval, c.PushTimeout); err != nil {
+			return err
+		}
+	}
+
+	// Logs go to stderr, so the followed migration log can be piped on its own
+	stopFollow := func() {}
+	if c.Follow {
+		stopFollow = newFollower(s3Client, c.Settings, c.S3Bucket, s3Prefix, versions, os.Stdout).start(ctx, c.PollInterval)
+	}
+
+	results, err := shared.WaitForResults(ctx, s3Client, c.Settings, c.S3Bucket, s3Prefix,
+		versions, c.ResultFile, c.PollInterval, c.Timeout)
+	stopFollow()
 	if err != nil {
-		return err
+		return fmt.Errorf("versions were pushed but not applied: %w", err)
+	}
+
+	// A result from an earlier deploy cycle says nothing about the deploy being waited on
+	if c.OnlyIfRecent > 0 {
+		if err := checkRecent(versions, results, c.OnlyIfRecent, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	// A single version is reported as is; a batch is summarized as one combined result
+	// that links the first failed version, or the newest one if all succeeded
+	reportVersion := versions[len(versions)-1]
+	notifyVersion := reportVersion
+	result := results[reportVersion]
+	if len(versions) > 1 {
+		for _, version := range versions {
+			if r, ok := results[version]; ok && r.Status != "success" {
+				reportVersion = version
+				break
+			}
+		}
+		notifyVersion = shared.ResultsSummary(versions, results)
+		result = shared.CombineResults(versions, results)
 	}
 
-	// Send Slack notification if webhook URL provided
-	if hasSlackWebhook {
-		if err := shared.SendSlackNotification(ctx, c.SlackIncomingWebhook, c.MigrationVersion, result); err != nil {
-			slog.Warn("Failed to send Slack notification", "error", err)
+	webhookURL := c.WebhookURL
+	if webhookURL == "" {
+		webhookURL = c.SlackIncomingWebhook
+	}
+
+	// Send notification if webhook URL provided
+	if webhookURL != "" && !shouldNotify(c.NotifyOn, result.Status) {
+		slog.Info("Skipping notification", "status", result.Status, "notify_on", c.NotifyOn)
+	} else if webhookURL != "" {
+		resultURL := shared.ResultURI(c.S3Bucket, s3Prefix, reportVersion, c.ResultFile)
+		if c.PresignResults {
+			presigned, err := shared.PresignResult(ctx, s3Client, c.S3Bucket, s3Prefix, reportVersion, c.ResultFile, c.PresignExpiry)
+			if err != nil {
+				slog.Warn("Failed to presign result URL, linking the S3 location instead", "error", err)
+			} else {
+				resultURL = presigned
+			}
+		}
+
+		// Versions pushed before push-info.json existed are reported without provenance
+		pushInfo, err := shared.DownloadPushInfo(ctx, s3Client, c.Settings, c.S3Bucket, s3Prefix, reportVersion)
+		if err != nil {
+			slog.Warn("Failed to read push info, notifying without it", "error", err)
+		}
+
+		notifier, err := shared.NewNotifier(c.Notifier, webhookURL, shared.NotifyOptions{
+			LogChars:      c.SlackLogChars,
+			ResultURL:     resultURL,
+			PushInfo:      pushInfo,
+			SlackTemplate: slackTemplate,
+			Webhook:       c.Webhook,
+		})
+		if err != nil {
+			return err
+		}
+		if err := notifier.Notify(ctx, notifyVersion, result); err != nil {
+			slog.Warn("Failed to send notification", "error", err)
 			// Continue - notification failure shouldn't fail the command
 		}
 	} else {
-		slog.Info("Slack webhook not configured, skipping notification")
+		slog.Info("Webhook not configured, skipping notification")
 	}
 
 	// Exit with appropriate status
@@ -66,6 +169,37 @@ func Execute(c *Cmd, s3EndpointURL, metricsAddr string) error {
 		return fmt.Errorf("migration failed: %s", result.Error)
 	}
 
-	slog.Info("Migration completed successfully", "version", c.MigrationVersion)
+	slog.Info("Migration completed successfully", "versions", versions)
 	return nil
 }
+
+// checkRecent returns an error if the result of any version was recorded more than window before now
+func checkRecent(versions []string, results map[string]*shared.Result, window time.Duration, now time.Time) error {
+	for _, version := range versions {
+		result, ok := results[version]
+		if !ok {
+			continue
+		}
+		recordedAt, err := time.Parse(time.RFC3339, result.Timestamp)
+		if err != nil {
+			return fmt.Errorf("cannot tell when version %s was applied: invalid result timestamp %q", version, result.Timestamp)
+		}
+		if age := now.Sub(recordedAt); age > window {
+			return fmt.Errorf("result of version %s is from %s, %s ago, older than --only-if-recent %s; it was likely applied in an earlier deploy cycle",
+				version, result.Timestamp, age.Truncate(time.Second), window)
+		}
+	}
+	return nil
+}
+
+// shouldNotify reports whether a result with status is notified under the --notify-on setting
+func shouldNotify(notifyOn, status string) bool {
+	switch notifyOn {
+	case "failure":
+		return status != "success"
+	case "success":
+		return status == "success"
+	default:
+		return true
+	}
+}
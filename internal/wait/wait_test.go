@@ -0,0 +1,48 @@
+package wait
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared"
+)
+
+func TestShouldNotify(t *testing.T) {
+	tests := []struct {
+		notifyOn string
+		status   string
+		expected bool
+	}{
+		{notifyOn: "always", status: "success", expected: true},
+		{notifyOn: "always", status: "failed", expected: true},
+		{notifyOn: "failure", status: "success", expected: false},
+		{notifyOn: "failure", status: "failed", expected: true},
+		{notifyOn: "success", status: "success", expected: true},
+		{notifyOn: "success", status: "failed", expected: false},
+		{notifyOn: "", status: "failed", expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.notifyOn+"/"+tt.status, func(t *testing.T) {
+			assert.Equal(t, tt.expected, shouldNotify(tt.notifyOn, tt.status))
+		})
+	}
+}
+
+func TestCheckRecent(t *testing.T) {
+	now := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	results := map[string]*shared.Result{
+		"20240101000000": {Status: "success", Timestamp: "2024-01-02T11:55:00Z"},
+		"20240102000000": {Status: "success", Timestamp: "2024-01-01T12:00:00Z"},
+		"20240103000000": {Status: "success", Timestamp: "yesterday"},
+	}
+
+	assert.NoError(t, checkRecent([]string{"20240101000000"}, results, 10*time.Minute, now))
+
+	err := checkRecent([]string{"20240101000000", "20240102000000"}, results, 10*time.Minute, now)
+	assert.ErrorContains(t, err, "result of version 20240102000000 is from 2024-01-01T12:00:00Z, 24h0m0s ago")
+
+	err = checkRecent([]string{"20240103000000"}, results, 10*time.Minute, now)
+	assert.ErrorContains(t, err, `invalid result timestamp "yesterday"`)
+}
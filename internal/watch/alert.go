@@ -0,0 +1,109 @@
+package watch
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/tokuhirom/dbmate-deployer/internal/shared"
+)
+
+// alerter posts watcher events to Slack. It reports a failing version once and a failing
+// check (e.g. S3 unreachable) once per streak, then posts a recovery message, so that
+// polling doesn't repeat the same alert every interval. A nil alerter does nothing.
+type alerter struct {
+	webhookURL string
+	webhook    shared.WebhookOptions
+	prefix     string
+
+	// failures counts failed versions and checks since the last recovery
+	failures int
+	// failedVersion is the version whose failure was reported; cleared by a successful apply
+	failedVersion string
+	// checkFailing is set once a failed check was reported; cleared by the next clean check
+	checkFailing bool
+}
+
+// newAlerter returns an alerter posting to webhookURL with webhook, or nil if no webhook
+// is configured
+func newAlerter(webhookURL string, webhook shared.WebhookOptions, prefix string) *alerter {
+	if webhookURL == "" {
+		return nil
+	}
+	return &alerter{webhookURL: webhookURL, webhook: webhook, prefix: prefix}
+}
+
+// started reports that the watcher is running
+func (a *alerter) started(ctx context.Context, pollInterval time.Duration) {
+	if a == nil {
+		return
+	}
+	a.send(ctx, "good", "🚀 Migration watcher started",
+		fmt.Sprintf("Watching %s every %s", a.prefix, pollInterval))
+}
+
+// migrationFailed reports a failed version unless it was already reported
+func (a *alerter) migrationFailed(ctx context.Context, version string, result *shared.Result) {
+	if a == nil {
+		return
+	}
+	a.failures++
+	if version == a.failedVersion {
+		return
+	}
+	a.failedVersion = version
+	if err := shared.SendSlackNotification(ctx, a.webhook, a.webhookURL, version, result); err != nil {
+		slog.Warn("Failed to send Slack alert", "error", err)
+	}
+}
+
+// migrationSucceeded reports a recovery if anything failed before
+func (a *alerter) migrationSucceeded(ctx context.Context, version string) {
+	if a == nil || a.failures == 0 {
+		return
+	}
+	a.send(ctx, "good", "✅ Migrations recovered",
+		fmt.Sprintf("Version %s applied successfully after %d failure(s)", version, a.failures))
+	a.reset()
+}
+
+// checkFailed reports the first failed check of a streak
+func (a *alerter) checkFailed(ctx context.Context, err error) {
+	if a == nil {
+		return
+	}
+	a.failures++
+	if a.checkFailing {
+		return
+	}
+	a.checkFailing = true
+	a.send(ctx, "danger", "❌ Migration check failing", err.Error())
+}
+
+// checkSucceeded reports a recovery after failed checks. A failed version stays failed
+// until a later version is applied, so it doesn't count as recovered here.
+func (a *alerter) checkSucceeded(ctx context.Context) {
+	if a == nil || !a.checkFailing {
+		return
+	}
+	a.checkFailing = false
+	if a.failedVersion != "" {
+		return
+	}
+	a.send(ctx, "good", "✅ Migration check recovered",
+		fmt.Sprintf("Checking %s succeeds again after %d failure(s)", a.prefix, a.failures))
+	a.reset()
+}
+
+func (a *alerter) reset() {
+	a.failures = 0
+	a.failedVersion = ""
+	a.checkFailing = false
+}
+
+func (a *alerter) send(ctx context.Context, color, title, text string) {
+	if err := shared.SendSlackMessage(ctx, a.webhook, a.webhookURL, color, title, text); err != nil {
+		slog.Warn("Failed to send Slack alert", "error", err)
+	}
+}
@@ -0,0 +1,79 @@
+package watch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared"
+)
+
+// recordSlack starts a webhook server collecting the titles of posted messages
+func recordSlack(t *testing.T) (string, *[]string) {
+	var titles []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload shared.SlackPayload
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		require.Len(t, payload.Attachments, 1)
+		titles = append(titles, payload.Attachments[0].Title)
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, &titles
+}
+
+func TestAlerter_MigrationFailureAndRecovery(t *testing.T) {
+	url, titles := recordSlack(t)
+	ctx := context.Background()
+	a := newAlerter(url, shared.WebhookOptions{}, "s3://bucket/migrations/")
+
+	a.started(ctx, 30*time.Second)
+	failed := &shared.Result{Version: "20240101000000", Status: "failed"}
+	a.migrationFailed(ctx, "20240101000000", failed)
+	// The failed version stays failed on later polls; that's neither news nor a recovery
+	a.migrationFailed(ctx, "20240101000000", failed)
+	a.checkSucceeded(ctx)
+	a.migrationSucceeded(ctx, "20240102000000")
+	// Nothing failed since the recovery
+	a.migrationSucceeded(ctx, "20240103000000")
+
+	assert.Equal(t, []string{
+		"🚀 Migration watcher started",
+		"❌ Migration failed",
+		"✅ Migrations recovered",
+	}, *titles)
+}
+
+func TestAlerter_CheckFailureStreak(t *testing.T) {
+	url, titles := recordSlack(t)
+	ctx := context.Background()
+	a := newAlerter(url, shared.WebhookOptions{}, "s3://bucket/migrations/")
+
+	for i := 0; i < 3; i++ {
+		a.checkFailed(ctx, errors.New("connection refused"))
+	}
+	a.checkSucceeded(ctx)
+	a.checkSucceeded(ctx)
+
+	assert.Equal(t, []string{
+		"❌ Migration check failing",
+		"✅ Migration check recovered",
+	}, *titles)
+	assert.Zero(t, a.failures)
+}
+
+func TestAlerter_Disabled(t *testing.T) {
+	a := newAlerter("", shared.WebhookOptions{}, "s3://bucket/migrations/")
+	require.Nil(t, a)
+
+	// A nil alerter is safe to use
+	a.started(context.Background(), time.Second)
+	a.checkFailed(context.Background(), errors.New("boom"))
+	a.migrationSucceeded(context.Background(), "20240101000000")
+}
@@ -0,0 +1,61 @@
+package watch
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// health tracks the outcome of the latest check for the /healthz and /readyz probes
+type health struct {
+	mu sync.Mutex
+	// checked is set once the first check has finished
+	checked bool
+	// ok is the outcome of the latest check
+	ok        bool
+	lastCheck time.Time
+}
+
+// record stores the outcome of a check
+func (h *health) record(ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checked = true
+	h.ok = ok
+	h.lastCheck = time.Now()
+}
+
+// handler serves /healthz, which succeeds while the process runs, and /readyz, which
+// succeeds only while the latest check succeeded
+func (h *health) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		h.mu.Lock()
+		checked, ok, lastCheck := h.checked, h.ok, h.lastCheck
+		h.mu.Unlock()
+
+		switch {
+		case !checked:
+			http.Error(w, "not ready: no check has finished yet", http.StatusServiceUnavailable)
+		case !ok:
+			http.Error(w, fmt.Sprintf("not ready: last check failed at %s", lastCheck.UTC().Format(time.RFC3339)), http.StatusServiceUnavailable)
+		default:
+			_, _ = fmt.Fprintf(w, "ok: last check succeeded at %s\n", lastCheck.UTC().Format(time.RFC3339))
+		}
+	})
+	return mux
+}
+
+// startHealthServer serves the health probes on addr
+func startHealthServer(addr string, h *health) {
+	slog.Info("Starting health server", "addr", addr)
+
+	if err := http.ListenAndServe(addr, h.handler()); err != nil {
+		slog.Error("Health server failed", "error", err)
+	}
+}
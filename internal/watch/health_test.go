@@ -0,0 +1,39 @@
+package watch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealth(t *testing.T) {
+	h := &health{}
+	server := httptest.NewServer(h.handler())
+	defer server.Close()
+
+	status := func(path string) int {
+		resp, err := http.Get(server.URL + path)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Alive but not ready until the first check finishes
+	assert.Equal(t, http.StatusOK, status("/healthz"))
+	assert.Equal(t, http.StatusServiceUnavailable, status("/readyz"))
+
+	h.record(true)
+	assert.Equal(t, http.StatusOK, status("/readyz"))
+
+	// A failing check makes the watcher unready, but it stays alive
+	h.record(false)
+	assert.Equal(t, http.StatusServiceUnavailable, status("/readyz"))
+	assert.Equal(t, http.StatusOK, status("/healthz"))
+
+	h.record(true)
+	assert.Equal(t, http.StatusOK, status("/readyz"))
+}
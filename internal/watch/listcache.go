@@ -0,0 +1,116 @@
+package watch
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/tokuhirom/dbmate-deployer/internal/shared"
+)
+
+// listingCacheRefresh is how many polls the listing cache may answer in a row before a full
+// check, which also picks up a version pushed with an older timestamp than the newest one
+const listingCacheRefresh = 10
+
+// listingCache lets a stream skip the full check (listing every version and looking up each
+// result file) while nothing changed. Once a check found every version applied, it remembers
+// the newest version; later polls only look for a newer version and for the newest result
+// file still being there.
+type listingCache struct {
+	client        shared.S3API
+	settings      shared.Settings
+	bucket        string
+	prefix        string
+	resultFile    string
+	targetVersion string
+
+	newest string // newest version, applied; empty until filled
+	hits   int
+}
+
+// newListingCache returns the listing cache of a stream, or nil if caching is disabled
+func newListingCache(enabled bool, client shared.S3API, settings shared.Settings, bucket, prefix, resultFile, targetVersion string) *listingCache {
+	if !enabled {
+		return nil
+	}
+	return &listingCache{client: client, settings: settings, bucket: bucket, prefix: prefix, resultFile: resultFile, targetVersion: targetVersion}
+}
+
+// unchanged reports whether every version is still applied, according to a cheap probe. A
+// change, an error or too many hits in a row empty the cache so that the caller runs the full check.
+func (l *listingCache) unchanged(ctx context.Context) bool {
+	if l == nil || l.newest == "" {
+		return false
+	}
+	if l.hits >= listingCacheRefresh {
+		slog.Debug("Listing cache expired, running a full check", "prefix", l.prefix)
+		l.invalidate()
+		return false
+	}
+
+	newer, err := l.versionsAfter(ctx, l.newest)
+	if err != nil {
+		slog.Warn("Failed to probe for new versions, running a full check", "prefix", l.prefix, "error", err)
+		l.invalidate()
+		return false
+	}
+	if len(newer) > 0 {
+		slog.Info("New version found, running a full check", "prefix", l.prefix, "versions", newer)
+		l.invalidate()
+		return false
+	}
+
+	// A deleted result file asks for the version to be applied again
+	exists, err := shared.CheckResultExists(ctx, l.client, l.settings, l.bucket, l.prefix, l.newest, l.resultFile)
+	if err != nil || !exists {
+		slog.Info("Result of the newest version changed, running a full check", "prefix", l.prefix, "version", l.newest)
+		l.invalidate()
+		return false
+	}
+
+	l.hits++
+	slog.Info("No new versions since the last check", "prefix", l.prefix, "newest", l.newest)
+	return true
+}
+
+// fill remembers the newest version after a full check found every version applied. A
+// version pushed since that check has no result yet and is left to the next full check.
+func (l *listingCache) fill(ctx context.Context) {
+	if l == nil {
+		return
+	}
+	l.invalidate()
+
+	versions, err := l.versionsAfter(ctx, "")
+	if err != nil || len(versions) == 0 {
+		return
+	}
+	newest := versions[len(versions)-1]
+	exists, err := shared.CheckResultExists(ctx, l.client, l.settings, l.bucket, l.prefix, newest, l.resultFile)
+	if err != nil || !exists {
+		return
+	}
+	l.newest = newest
+}
+
+// invalidate empties the cache
+func (l *listingCache) invalidate() {
+	l.newest = ""
+	l.hits = 0
+}
+
+// versionsAfter lists the versions newer than after, leaving out those held back by --target-version
+func (l *listingCache) versionsAfter(ctx context.Context, after string) ([]string, error) {
+	versions, err := shared.ListVersionsAfter(ctx, l.client, l.settings, l.bucket, l.prefix, after)
+	if err != nil {
+		return nil, err
+	}
+	if l.targetVersion == "" {
+		return versions, nil
+	}
+	for i, version := range versions {
+		if shared.CompareVersions(version, l.targetVersion) > 0 {
+			return versions[:i], nil
+		}
+	}
+	return versions, nil
+}
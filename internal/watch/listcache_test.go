@@ -0,0 +1,91 @@
+package watch
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared/testhelpers"
+)
+
+func TestListingCache(t *testing.T) {
+	ctx := context.Background()
+	mock := testhelpers.NewMockS3Client()
+	put := func(key string) {
+		_, err := mock.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader([]byte("-- migrate:up")),
+		})
+		require.NoError(t, err)
+	}
+	put("migrations/20240101000000/migrations/001.sql")
+	put("migrations/20240101000000/result.json")
+
+	cache := newListingCache(true, mock, shared.DefaultSettings(), "test-bucket", "migrations/", "", "")
+	assert.False(t, cache.unchanged(ctx), "an empty cache needs a full check")
+
+	cache.fill(ctx)
+	assert.Equal(t, "20240101000000", cache.newest)
+	assert.True(t, cache.unchanged(ctx))
+
+	// A new version invalidates the cache
+	put("migrations/20240102000000/migrations/002.sql")
+	assert.False(t, cache.unchanged(ctx))
+	assert.Empty(t, cache.newest)
+
+	// The newest version has no result yet, so nothing is cached
+	cache.fill(ctx)
+	assert.Empty(t, cache.newest)
+
+	put("migrations/20240102000000/result.json")
+	cache.fill(ctx)
+	require.True(t, cache.unchanged(ctx))
+
+	// A deleted result file invalidates the cache
+	_, err := mock.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String("test-bucket"), Key: aws.String("migrations/20240102000000/result.json")})
+	require.NoError(t, err)
+	assert.False(t, cache.unchanged(ctx))
+
+	// The cache answers a bounded number of polls in a row
+	put("migrations/20240102000000/result.json")
+	cache.fill(ctx)
+	for i := 0; i < listingCacheRefresh; i++ {
+		require.True(t, cache.unchanged(ctx))
+	}
+	assert.False(t, cache.unchanged(ctx))
+
+	// A disabled cache never skips the full check
+	var disabled *listingCache
+	assert.False(t, disabled.unchanged(ctx))
+	disabled.fill(ctx)
+	assert.Nil(t, newListingCache(false, mock, shared.DefaultSettings(), "test-bucket", "migrations/", "", ""))
+}
+
+func TestListingCache_TargetVersion(t *testing.T) {
+	ctx := context.Background()
+	mock := testhelpers.NewMockS3Client()
+	for _, key := range []string{
+		"migrations/20240101000000/migrations/001.sql",
+		"migrations/20240101000000/result.json",
+		"migrations/20240102000000/migrations/002.sql",
+	} {
+		_, err := mock.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader([]byte("-- migrate:up")),
+		})
+		require.NoError(t, err)
+	}
+
+	// Versions held back by the target version don't count as changes
+	cache := newListingCache(true, mock, shared.DefaultSettings(), "test-bucket", "migrations/", "", "20240101000000")
+	cache.fill(ctx)
+	assert.Equal(t, "20240101000000", cache.newest)
+	assert.True(t, cache.unchanged(ctx))
+}
@@ -0,0 +1,78 @@
+package watch
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/tokuhirom/dbmate-deployer/internal/shared"
+)
+
+// staticConfigKeys are config file keys that cannot be changed without a restart
+var staticConfigKeys = []string{"database_url", "s3_bucket", "s3_path_prefix", "s3_endpoint_url", "metrics_addr", "result_file"}
+
+// reloadConfig re-reads the config file and applies the settings that are safe to change at runtime
+// (poll interval and log level). It returns the poll interval to use from now on. A poll interval
+// failing the startup checks against the other flags is rejected.
+func reloadConfig(c *Cmd, pollInterval time.Duration) (time.Duration, error) {
+	data, err := os.ReadFile(c.ConfigFile)
+	if err != nil {
+		return pollInterval, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var values map[string]any
+	if err := json.Unmarshal(data, &values); err != nil {
+		return pollInterval, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	// Validate everything before applying anything
+	newInterval := pollInterval
+	if raw, ok := values["poll_interval"]; ok {
+		s, ok := raw.(string)
+		if !ok {
+			return pollInterval, fmt.Errorf("poll_interval must be a duration string (e.g. \"30s\")")
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return pollInterval, fmt.Errorf("invalid poll_interval %q", s)
+		}
+		newInterval = d
+		if err := c.validatePollJitter(newInterval); err != nil {
+			return pollInterval, err
+		}
+		if err := c.validateLeaderTTL(newInterval); err != nil {
+			return pollInterval, err
+		}
+	}
+
+	logLevel := ""
+	var level slog.Level
+	if raw, ok := values["log_level"]; ok {
+		s, ok := raw.(string)
+		if !ok {
+			return pollInterval, fmt.Errorf("log_level must be a string")
+		}
+		if level, err = shared.ParseLogLevel(s); err != nil {
+			return pollInterval, err
+		}
+		logLevel = s
+	}
+
+	if newInterval != pollInterval {
+		slog.Info("Config reloaded: poll interval changed", "old", pollInterval, "new", newInterval)
+	}
+	if logLevel != "" && c.LogLevel != nil {
+		c.LogLevel.Set(level)
+		slog.Info("Config reloaded: log level applied", "log_level", logLevel)
+	}
+
+	for _, key := range staticConfigKeys {
+		if _, ok := values[key]; ok {
+			slog.Warn("Config reloaded: setting cannot be changed at runtime, restart to apply", "key", key)
+		}
+	}
+
+	return newInterval, nil
+}
@@ -0,0 +1,89 @@
+package watch
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadConfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		content      string
+		expectPoll   time.Duration
+		expectLevel  slog.Level
+		expectErrMsg string
+	}{
+		{
+			name:        "poll interval changed",
+			content:     `{"poll_interval": "10s", "log_level": "debug"}`,
+			expectPoll:  10 * time.Second,
+			expectLevel: slog.LevelDebug,
+		},
+		{
+			name:       "static settings are ignored",
+			content:    `{"database_url": "postgres://other", "s3_bucket": "other"}`,
+			expectPoll: 30 * time.Second,
+		},
+		{
+			name:         "invalid poll interval keeps current settings",
+			content:      `{"poll_interval": "soon"}`,
+			expectPoll:   30 * time.Second,
+			expectErrMsg: `invalid poll_interval "soon"`,
+		},
+		{
+			name:         "invalid log level keeps current settings",
+			content:      `{"poll_interval": "10s", "log_level": "loud"}`,
+			expectPoll:   30 * time.Second,
+			expectErrMsg: `invalid log level "loud"`,
+		},
+		{
+			name:         "poll interval below the jitter keeps current settings",
+			content:      `{"poll_interval": "3s"}`,
+			expectPoll:   30 * time.Second,
+			expectErrMsg: "--poll-jitter (5s) must be between 0 and the poll interval (3s)",
+		},
+		{
+			name:         "poll interval above the leader TTL keeps current settings",
+			content:      `{"poll_interval": "2m"}`,
+			expectPoll:   30 * time.Second,
+			expectErrMsg: "--leader-ttl (1m0s) must be longer than the poll interval (2m0s)",
+		},
+		{
+			name:         "malformed JSON",
+			content:      `{`,
+			expectPoll:   30 * time.Second,
+			expectErrMsg: "failed to parse config file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configFile := filepath.Join(t.TempDir(), "config.json")
+			require.NoError(t, os.WriteFile(configFile, []byte(tt.content), 0644))
+
+			c := &Cmd{
+				ConfigFile: configFile,
+				LogLevel:   new(slog.LevelVar),
+				PollJitter: 5 * time.Second,
+				HAMode:     true,
+				LeaderTTL:  time.Minute,
+			}
+			poll, err := reloadConfig(c, 30*time.Second)
+
+			if tt.expectErrMsg != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.expectErrMsg)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tt.expectPoll, poll)
+			assert.Equal(t, tt.expectLevel, c.LogLevel.Level())
+		})
+	}
+}
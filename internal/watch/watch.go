@@ -2,102 +2,639 @@ package watch
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math/rand/v2"
+	"os"
+	"os/signal"
+	"slices"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/tokuhirom/dbmate-deployer/internal/shared"
+	"github.com/tokuhirom/dbmate-deployer/pkg/deployer"
 )
 
 // Cmd watches S3 for new migrations and applies them
 type Cmd struct {
-	DatabaseURL  string        `help:"PostgreSQL connection string" env:"DATABASE_URL" required:""`
-	S3Bucket     string        `help:"S3 bucket name" env:"S3_BUCKET" required:"" name:"s3-bucket"`
-	S3PathPrefix string        `help:"S3 path prefix (e.g. 'migrations/')" env:"S3_PATH_PREFIX" required:"" name:"s3-path-prefix"`
-	PollInterval time.Duration `help:"Polling interval for checking new versions" env:"POLL_INTERVAL" default:"30s"`
+	DatabaseURL          string        `help:"Database connection string (postgres:// or mysql://); required unless --database-url-env is set" env:"DATABASE_URL"`
+	DatabaseURLEnv       string        `help:"Name of the environment variable holding the database connection string, instead of DATABASE_URL" env:"DATABASE_URL_ENV" name:"database-url-env"`
+	S3Bucket             string        `help:"S3 bucket name" env:"S3_BUCKET" required:"" name:"s3-bucket"`
+	S3PathPrefix         []string      `help:"S3 path prefix (e.g. 'migrations/'); repeat to watch several migration streams" env:"S3_PATH_PREFIX" required:"" name:"s3-path-prefix"`
+	ResultFile           string        `help:"Name of the per-version result file marking a version as applied" env:"RESULT_FILE" name:"result-file" default:"result.json"`
+	PollInterval         time.Duration `help:"Polling interval for checking new versions" env:"POLL_INTERVAL" default:"30s"`
+	MaxPollInterval      time.Duration `help:"Upper bound for the poll interval, which doubles after each failed check (0 disables backoff)" env:"MAX_POLL_INTERVAL" name:"max-poll-interval" default:"5m"`
+	PollJitter           time.Duration `help:"Wait a random delay up to this long before the first poll and each later one, so replicas started together don't poll in sync (0 disables)" env:"POLL_JITTER" name:"poll-jitter" default:"0s"`
+	CurrentPointer       string        `help:"File name of the pointer to the latest applied version, written at the prefix root (empty to disable)" env:"CURRENT_POINTER" default:"current.json"`
+	EmbedSQL             bool          `help:"Embed migration file contents in result.json" env:"EMBED_SQL" name:"embed-sql"`
+	EmbedSQLMaxBytes     int           `help:"Truncate each embedded migration file to this many bytes (0 for no limit)" env:"EMBED_SQL_MAX_BYTES" name:"embed-sql-max-bytes" default:"0"`
+	IncompletePolicy     string        `help:"What to do when a version's migration set looks incomplete (fail or warn)" env:"INCOMPLETE_POLICY" enum:"fail,warn" default:"fail"`
+	LockTTL              time.Duration `help:"How long a version lock is honored before it is considered stale (0 disables locking)" env:"LOCK_TTL" name:"lock-ttl" default:"30m"`
+	DownloadConcurrency  int           `help:"Number of migration files downloaded in parallel" env:"DOWNLOAD_CONCURRENCY" name:"download-concurrency" default:"8"`
+	WorkDir              string        `help:"Directory in which migrations are downloaded (default: the OS temp directory)" env:"WORK_DIR" name:"work-dir" type:"path"`
+	DryRun               bool          `help:"Download and inspect pending migrations without running them or uploading results" env:"DRY_RUN" name:"dry-run"`
+	MigrationTimeout     time.Duration `help:"Fail a version whose migration runs longer than this (0 for no limit)" env:"MIGRATION_TIMEOUT" name:"migration-timeout" default:"30m"`
+	ShutdownTimeout      time.Duration `help:"How long to wait for an in-flight migration after SIGINT/SIGTERM before cancelling it" env:"SHUTDOWN_TIMEOUT" name:"shutdown-timeout" default:"5m"`
+	SSE                  string        `help:"Server-side encryption for uploaded objects (AES256 or aws:kms, empty for the bucket default)" env:"S3_SSE" name:"sse" enum:",AES256,aws:kms" default:""`
+	SSEKMSKeyID          string        `help:"KMS key ID used with --sse=aws:kms" env:"S3_SSE_KMS_KEY_ID" name:"sse-kms-key-id"`
+	KeepAttempts         bool          `help:"Also keep every result under <version>/attempts/<timestamp>.json" env:"KEEP_ATTEMPTS" name:"keep-attempts"`
+	DumpSchema           bool          `help:"Dump the database schema after a successful migration and upload it as <version>/schema.sql" env:"DUMP_SCHEMA" name:"dump-schema"`
+	FailOnDirty          bool          `help:"Refuse to migrate (status dirty) when schema_migrations has versions missing from the migration files" env:"FAIL_ON_DIRTY" name:"fail-on-dirty"`
+	VerifyApplied        bool          `help:"When nothing is pending, check the newest successful version against schema_migrations and re-apply it if migrations are missing" env:"VERIFY_APPLIED" name:"verify-applied"`
+	TargetVersion        string        `help:"Only apply versions up to and including this version (YYYYMMDDHHMMSS); newer ones are held back" env:"TARGET_VERSION" name:"target-version"`
+	OnFailed             string        `help:"What to do with a version whose result reports a failure: skip it and apply newer versions, block newer versions until it is resolved, or retry it on every run" env:"ON_FAILED" name:"on-failed" enum:"skip,block,retry" default:"skip"`
+	SlackIncomingWebhook string        `help:"Slack incoming webhook URL for startup, failure and recovery alerts (optional)" env:"SLACK_INCOMING_WEBHOOK"`
+	HAMode               bool          `help:"Elect one leader among replicas via leader.json; only the leader applies migrations" env:"HA_MODE" name:"ha-mode"`
+	LeaderTTL            time.Duration `help:"How long a leader's heartbeat is honored before another replica takes over (must exceed the poll interval)" env:"LEADER_TTL" name:"leader-ttl" default:"15m"`
+	HealthAddr           string        `help:"Address for the /healthz and /readyz probe endpoints (e.g. ':8080', optional)" env:"HEALTH_ADDR" name:"health-addr"`
+	EventLogKey          string        `help:"S3 key of an NDJSON log of poll and migration events, written daily to <key>-YYYYMMDD.ndjson (empty disables)" env:"EVENT_LOG_KEY" name:"event-log-key"`
+	EventLogMaxBytes     int           `help:"Size cap of each daily event log object; the oldest events are dropped beyond it" env:"EVENT_LOG_MAX_BYTES" name:"event-log-max-bytes" default:"1048576"`
+	CacheListings        bool          `help:"Between full checks, only probe for a version newer than the newest applied one instead of listing every version and result file" env:"CACHE_LISTINGS" name:"cache-listings"`
+	WriteProgress        bool          `help:"Upload the log of a running migration to <version>/progress.log every few seconds, for wait-and-notify --follow" env:"WRITE_PROGRESS" name:"write-progress"`
+	FailFastOnStart      bool          `help:"Exit with an error if the first poll fails on S3 access or the database connection, instead of logging it and polling on" env:"FAIL_FAST_ON_START" name:"fail-fast-on-start"`
+
+	// ConfigFile is the JSON config file re-read on SIGHUP (empty disables reloading)
+	ConfigFile string `kong:"-"`
+	// DeployerVersion is the build version recorded in each result
+	DeployerVersion string `kong:"-"`
+	// Settings holds the S3 layout, version format and S3 retry settings
+	Settings shared.Settings `kong:"-"`
+	// MigrationsTable is the table dbmate records applied migrations in (empty for the dbmate default)
+	MigrationsTable string `kong:"-"`
+	// LogTimestampFormat is the Go time layout of the migration log timestamps (empty for the default)
+	LogTimestampFormat string `kong:"-"`
+	// Webhook sets the timeout and attempts of each webhook notification
+	Webhook shared.WebhookOptions `kong:"-"`
+	// LogLevel is the level of the process logger, changed when a reload sets log_level
+	LogLevel *slog.LevelVar `kong:"-"`
+}
+
+// putOptions returns the settings applied to uploaded objects
+func (c *Cmd) putOptions() shared.PutOptions {
+	return shared.PutOptions{ServerSideEncryption: c.SSE, SSEKMSKeyID: c.SSEKMSKeyID}
 }
 
-// Execute runs the watcher with periodic polling
-func Execute(c *Cmd, s3EndpointURL, metricsAddr string) error {
-	ctx := context.Background()
+// Execute runs the watcher with periodic polling until ctx is cancelled
+func Execute(ctx context.Context, c *Cmd, s3Opts shared.S3ClientOptions, metricsAddr string) error {
+	// ctx is cancelled on SIGINT/SIGTERM (or a caller's deadline); workCtx outlives it so
+	// that an in-flight migration can finish and upload its result, up to ShutdownTimeout
+	workCtx, cancelWork := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelWork()
+	go func() {
+		<-ctx.Done()
+		select {
+		case <-workCtx.Done():
+		case <-time.After(c.ShutdownTimeout):
+			slog.Warn("Shutdown timeout exceeded, cancelling in-flight migration", "timeout", c.ShutdownTimeout)
+			cancelWork()
+		}
+	}()
 
 	// Start metrics server if address is specified
+	registry := shared.NewMetricsRegistry()
+	metrics := shared.NewMetrics(registry)
 	if metricsAddr != "" {
-		go shared.StartMetricsServer(metricsAddr)
+		go shared.StartMetricsServer(metricsAddr, registry)
+	}
+
+	s3Prefixes, err := normalizePrefixes(c.S3PathPrefix)
+	if err != nil {
+		return err
+	}
+
+	// Streams sharing a database see each other's migrations as out-of-band changes
+	if c.FailOnDirty && len(s3Prefixes) > 1 {
+		return fmt.Errorf("--fail-on-dirty cannot be used with more than one --s3-path-prefix")
+	}
+
+	if c.TargetVersion != "" {
+		if err := c.Settings.ValidateVersion(c.TargetVersion); err != nil {
+			return fmt.Errorf("invalid --target-version: %w", err)
+		}
+	}
+
+	databaseURL, err := shared.ResolveDatabaseURL(c.DatabaseURL, c.DatabaseURLEnv)
+	if err != nil {
+		return err
 	}
+	c.DatabaseURL = databaseURL
 
-	// Ensure prefix ends with /
-	s3Prefix := c.S3PathPrefix
-	if !strings.HasSuffix(s3Prefix, "/") {
-		s3Prefix += "/"
+	// Fail fast on a DATABASE_URL no compiled-in driver can handle
+	if err := shared.ValidateDatabaseURL(c.DatabaseURL); err != nil {
+		return err
+	}
+
+	// Fail fast on a work directory migrations can't be downloaded to
+	if err := shared.ValidateWorkDir(c.WorkDir); err != nil {
+		return err
+	}
+
+	// Fail fast on inconsistent encryption settings
+	if err := c.putOptions().Validate(); err != nil {
+		return err
+	}
+
+	if err := c.validateLeaderTTL(c.PollInterval); err != nil {
+		return err
+	}
+
+	if err := c.validatePollJitter(c.PollInterval); err != nil {
+		return err
 	}
 
 	// Create S3 client
-	s3Client, err := shared.CreateS3Client(ctx, s3EndpointURL)
+	s3Client, err := shared.CreateS3Client(workCtx, s3Opts)
 	if err != nil {
 		return fmt.Errorf("failed to create S3 client: %w", err)
 	}
 
-	slog.Info("Starting migration watcher", "poll_interval", c.PollInterval)
+	// A wrong bucket would otherwise be polled forever as if nothing had been pushed.
+	// The check runs on ctx, so a shutdown during startup doesn't wait for S3 retries.
+	for _, prefix := range s3Prefixes {
+		empty, err := shared.CheckBucketAccess(ctx, s3Client, c.Settings, c.S3Bucket, prefix)
+		if ctx.Err() != nil {
+			slog.Info("Shutting down migration watcher")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if empty {
+			slog.Warn("Nothing has been pushed under the S3 prefix yet, check S3_PATH_PREFIX", "bucket", c.S3Bucket, "prefix", prefix)
+		}
+	}
+
+	// An audit trail of daemon activity, beyond the final state in each result file
+	var events *shared.EventLog
+	if c.EventLogKey != "" {
+		events = shared.NewEventLog(s3Client, c.Settings, c.S3Bucket, c.EventLogKey, c.EventLogMaxBytes, c.putOptions())
+		slog.Info("Recording events", "key", c.EventLogKey)
+	}
+
+	slog.Info("Starting migration watcher", "prefixes", s3Prefixes, "poll_interval", c.PollInterval, "dry_run", c.DryRun)
+
+	// Each stream has its own alert state and metrics series
+	streams := make([]stream, 0, len(s3Prefixes))
+	for _, prefix := range s3Prefixes {
+		s := stream{
+			prefix:  prefix,
+			metrics: metrics.WithPrefix(prefix),
+			alerts:  newAlerter(c.SlackIncomingWebhook, c.Webhook, "s3://"+c.S3Bucket+"/"+prefix),
+			listing: newListingCache(c.CacheListings, s3Client, c.Settings, c.S3Bucket, prefix, c.ResultFile, c.TargetVersion),
+		}
+		s.alerts.started(workCtx, c.PollInterval)
+		streams = append(streams, s)
+	}
+
+	// In HA mode only the leader runs checks; the others just keep polling leader.json.
+	// One leader serves all streams, elected under the first prefix.
+	leaderPrefix := s3Prefixes[0]
+	instanceID := shared.InstanceID()
+	check := func() error {
+		if c.HAMode {
+			leader, err := shared.RefreshLeadership(workCtx, s3Client, c.Settings, c.S3Bucket, leaderPrefix, instanceID, c.LeaderTTL, c.putOptions())
+			if err != nil {
+				slog.Error("Failed to refresh leadership", "error", err)
+				for _, s := range streams {
+					s.alerts.checkFailed(workCtx, err)
+				}
+				return fmt.Errorf("failed to refresh leadership: %w", err)
+			}
+			if !leader {
+				slog.Info("Not the leader, skipping migration check")
+				return nil
+			}
+		}
+
+		events.Record(workCtx, shared.Event{Event: shared.EventPollStarted})
+
+		// A failing stream doesn't keep the others from being checked in the same poll
+		var errs []error
+		for _, s := range streams {
+			if ctx.Err() != nil {
+				break
+			}
+			if err := runMigrationCheck(ctx, workCtx, c, s3Client, s.metrics, s.prefix, s.alerts, events, s.listing); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", s.prefix, err))
+			}
+		}
+		return errors.Join(errs...)
+	}
+	if c.HAMode {
+		slog.Info("HA mode enabled", "instance_id", instanceID, "leader_ttl", c.LeaderTTL)
+		defer func() {
+			if err := shared.ReleaseLeadership(workCtx, s3Client, c.Settings, c.S3Bucket, leaderPrefix, instanceID); err != nil {
+				slog.Warn("Failed to release leadership", "error", err)
+			}
+		}()
+	}
 
 	// Create ticker for periodic polling
-	ticker := time.NewTicker(c.PollInterval)
+	pollInterval := c.PollInterval
+	ticker := time.NewTicker(pollInterval)
 	defer ticker.Stop()
 
-	// Run immediately on startup
-	runMigrationCheck(ctx, s3Client, c.S3Bucket, s3Prefix, c.DatabaseURL)
+	// Reload safe-to-change settings from the config file on SIGHUP
+	hup := make(chan os.Signal, 1)
+	if c.ConfigFile != "" {
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+	}
+
+	// Readiness follows the latest check
+	probes := &health{}
+	if c.HealthAddr != "" {
+		go startHealthServer(c.HealthAddr, probes)
+	}
+
+	// Back off while checks keep failing (e.g. the database is down), reset after a success
+	failures := 0
+	effectiveInterval := pollInterval
+	recordCheck := func(ok bool) {
+		probes.record(ok)
+		if ok {
+			failures = 0
+		} else {
+			failures++
+		}
+		next := nextPollInterval(pollInterval, c.MaxPollInterval, failures)
+		if next != effectiveInterval {
+			slog.Info("Poll interval changed", "interval", next, "consecutive_failures", failures)
+			effectiveInterval = next
+			ticker.Reset(effectiveInterval)
+		}
+	}
+
+	// Run on startup, staggered when many replicas start at once
+	if !waitJitter(ctx, c.PollJitter) {
+		slog.Info("Shutting down migration watcher")
+		return nil
+	}
+	// Later polls log failures and keep going, but a first poll failing on a misconfiguration
+	// would otherwise leave a daemon that looks alive and never applies anything
+	err = check()
+	if c.FailFastOnStart && isFatalStartError(err) {
+		return fmt.Errorf("first poll failed: %w", err)
+	}
+	recordCheck(err == nil)
 
 	// Then run on ticker
-	for range ticker.C {
-		runMigrationCheck(ctx, s3Client, c.S3Bucket, s3Prefix, c.DatabaseURL)
+	for {
+		if ctx.Err() != nil {
+			slog.Info("Shutting down migration watcher")
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			slog.Info("Shutting down migration watcher")
+			return nil
+		case <-ticker.C:
+			if !waitJitter(ctx, c.PollJitter) {
+				continue
+			}
+			recordCheck(check() == nil)
+		case <-hup:
+			slog.Info("Received SIGHUP, reloading config", "config", c.ConfigFile)
+			newInterval, err := reloadConfig(c, pollInterval)
+			if err != nil {
+				slog.Error("Failed to reload config, keeping current settings", "error", err)
+				continue
+			}
+			if newInterval != pollInterval {
+				pollInterval = newInterval
+				effectiveInterval = nextPollInterval(pollInterval, c.MaxPollInterval, failures)
+				ticker.Reset(effectiveInterval)
+			}
+		}
 	}
+}
 
-	return nil
+// stream is one S3 prefix watched for versions
+type stream struct {
+	prefix  string
+	metrics *shared.Metrics
+	alerts  *alerter
+	listing *listingCache
+}
+
+// migrationError is the error of a version whose migration (or dry run) failed
+type migrationError struct {
+	version string
+	result  *shared.Result
+}
+
+func (e *migrationError) Error() string {
+	return fmt.Sprintf("migration of version %s failed: %s", e.version, e.result.Error)
 }
 
-func runMigrationCheck(ctx context.Context, s3Client *s3.Client, bucket, prefix, databaseURL string) {
-	slog.Info("Checking for unapplied migrations")
+// isFatalStartError reports whether err, the error of the first poll, points at a
+// misconfiguration that later polls won't fix: S3 credentials or permissions that don't
+// work, or a database that can't be connected to. "Nothing to do" is not an error at all,
+// and a migration failing on its SQL is recorded in its result like on any other poll.
+func isFatalStartError(err error) bool {
+	if err == nil {
+		return false
+	}
+	// The streams of a poll are checked one after the other, so their errors come joined
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return slices.ContainsFunc(joined.Unwrap(), isFatalStartError)
+	}
+	var migErr *migrationError
+	if errors.As(err, &migErr) {
+		return migErr.result.ErrorType == shared.ErrorTypeConnectionFailed
+	}
+	return shared.IsS3AccessError(err)
+}
 
-	// Find unapplied version
-	version, err := shared.FindUnappliedVersion(ctx, s3Client, bucket, prefix)
+// normalizePrefixes adds the trailing slash to each prefix and rejects duplicates,
+// which would apply the same versions twice
+func normalizePrefixes(prefixes []string) ([]string, error) {
+	normalized := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		if slices.Contains(normalized, prefix) {
+			return nil, fmt.Errorf("duplicate --s3-path-prefix %q", prefix)
+		}
+		normalized = append(normalized, prefix)
+	}
+	if len(normalized) == 0 {
+		return nil, fmt.Errorf("at least one --s3-path-prefix is required")
+	}
+	return normalized, nil
+}
+
+// waitJitter waits a random delay below jitter (not at all for 0). It returns false if
+// ctx is cancelled meanwhile.
+func waitJitter(ctx context.Context, jitter time.Duration) bool {
+	if jitter <= 0 {
+		return true
+	}
+	delay := rand.N(jitter)
+	slog.Debug("Delaying poll", "jitter", delay)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// nextPollInterval returns base doubled for each consecutive failure, capped at maxInterval.
+// A maxInterval at or below base disables the backoff.
+func nextPollInterval(base, maxInterval time.Duration, failures int) time.Duration {
+	if maxInterval <= base {
+		return base
+	}
+	interval := base
+	for i := 0; i < failures && interval < maxInterval; i++ {
+		interval *= 2
+	}
+	return min(interval, maxInterval)
+}
+
+// runMigrationCheck applies pending versions using workCtx. It stops before starting
+// another version once shutdownCtx is cancelled. It returns the error of the check or of
+// the failed migration, nil when all went well or nothing was pending. Every call is
+// counted in dbmate_poll_total by outcome.
+func runMigrationCheck(shutdownCtx, ctx context.Context, c *Cmd, s3Client *s3.Client, metrics *shared.Metrics, prefix string, alerts *alerter, events *shared.EventLog, listing *listingCache) error {
+	slog.Info("Checking for unapplied migrations", "prefix", prefix)
+
+	// Nothing pending, either per the listing cache or the full check
+	upToDate := func() error {
+		metrics.RecordPendingVersions(0)
+		alerts.checkSucceeded(ctx)
+		if c.VerifyApplied {
+			return verifyApplied(ctx, c, s3Client, metrics, prefix, alerts, events)
+		}
+		metrics.RecordPoll("noop")
+		return nil
+	}
+	if listing.unchanged(ctx) {
+		return upToDate()
+	}
+
+	// Find unapplied versions
+	versions, err := shared.FindPendingVersions(ctx, s3Client, c.Settings, c.S3Bucket, prefix, c.ResultFile, c.TargetVersion, c.OnFailed)
 	if err != nil {
-		if err.Error() == "no unapplied versions found" {
-			slog.Info("All versions are already applied")
-			return
+		if errors.Is(err, shared.ErrNoUnappliedVersions) || errors.Is(err, shared.ErrNoVersions) {
+			slog.Info("All versions are already applied", "prefix", prefix)
+			listing.fill(ctx)
+			return upToDate()
 		}
-		slog.Error("Failed to find unapplied version", "error", err)
-		return
+		slog.Error("Failed to find unapplied versions", "prefix", prefix, "error", err)
+		metrics.RecordPoll("error")
+		err = fmt.Errorf("failed to find unapplied versions: %w", err)
+		alerts.checkFailed(ctx, err)
+		return err
 	}
 
-	slog.Info("Found unapplied version", "version", version)
+	slog.Info("Found unapplied versions", "prefix", prefix, "count", len(versions), "versions", versions)
+	metrics.RecordPendingVersions(float64(len(versions)))
+	alerts.checkSucceeded(ctx)
+
+	// Apply pending versions in order, stopping at the first failure
+	for i, version := range versions {
+		if shutdownCtx.Err() != nil {
+			slog.Info("Shutdown requested, leaving remaining versions pending", "version", version)
+			if i == 0 {
+				metrics.RecordPoll("noop")
+			} else {
+				metrics.RecordPoll("applied")
+			}
+			return nil
+		}
+		events.Record(ctx, shared.Event{Event: shared.EventVersionSelected, Prefix: prefix, Version: version})
+		err := applyVersion(ctx, c, s3Client, metrics, prefix, version, false, alerts, events)
+		if errors.Is(err, deployer.ErrVersionLocked) {
+			slog.Info("Version is being applied by another deployer, stopping", "prefix", prefix, "version", version)
+			if i == 0 {
+				metrics.RecordPoll("noop")
+			} else {
+				metrics.RecordPoll("applied")
+			}
+			return nil
+		}
+		if err != nil {
+			metrics.RecordPoll("error")
+			return err
+		}
+		if !c.DryRun {
+			metrics.RecordPendingVersions(float64(len(versions) - i - 1))
+		}
+	}
+	metrics.RecordPoll("applied")
+	return nil
+}
 
-	// Execute migration with timing
-	startTime := time.Now()
-	result := shared.ExecuteMigration(ctx, s3Client, bucket, prefix, version, databaseURL)
-	duration := time.Since(startTime).Seconds()
+// verifyApplied re-applies the newest successful version if schema_migrations lacks some of
+// its migrations, e.g. because its result file was copied from another bucket
+func verifyApplied(ctx context.Context, c *Cmd, s3Client *s3.Client, metrics *shared.Metrics, prefix string, alerts *alerter, events *shared.EventLog) error {
+	version, missing, err := shared.VerifyLatestApplied(ctx, s3Client, c.Settings, c.S3Bucket, prefix, c.ResultFile, c.DatabaseURL, c.MigrationsTable)
+	if err != nil {
+		slog.Error("Failed to verify applied migrations", "prefix", prefix, "error", err)
+		metrics.RecordPoll("error")
+		err = fmt.Errorf("failed to verify applied migrations: %w", err)
+		alerts.checkFailed(ctx, err)
+		return err
+	}
+	if len(missing) == 0 {
+		metrics.RecordPoll("noop")
+		return nil
+	}
 
-	// Record metrics
-	shared.RecordMigrationDuration(duration)
-	shared.RecordLastMigrationTimestamp(float64(time.Now().Unix()))
-	if result.Status == "success" {
-		shared.RecordMigrationAttempt("success")
-		shared.RecordCurrentVersion(version)
-	} else {
-		shared.RecordMigrationAttempt("failed")
+	slog.Warn("Result file reports success but migrations are missing from schema_migrations, re-applying",
+		"version", version, "missing", missing)
+	events.Record(ctx, shared.Event{Event: shared.EventVersionSelected, Prefix: prefix, Version: version})
+	err = applyVersion(ctx, c, s3Client, metrics, prefix, version, true, alerts, events)
+	if errors.Is(err, deployer.ErrVersionLocked) {
+		slog.Info("Version is being re-applied by another deployer", "prefix", prefix, "version", version)
+		metrics.RecordPoll("noop")
+		return nil
 	}
+	if err != nil {
+		metrics.RecordPoll("error")
+		return err
+	}
+	metrics.RecordPoll("applied")
+	return nil
+}
 
-	// Upload result (both success and failure)
-	if err := shared.UploadResult(ctx, s3Client, bucket, prefix, version, result); err != nil {
-		slog.Error("Failed to upload result", "error", err)
-		return
+// applyVersion executes the migration for a single version and uploads its result.
+// It returns nil if the migration succeeded and its result was uploaded, a
+// *migrationError if the migration failed, or deployer.ErrVersionLocked if another replica
+// holds the version lock. reapply runs a version that already has a result file.
+func applyVersion(ctx context.Context, c *Cmd, s3Client *s3.Client, metrics *shared.Metrics, prefix, version string, reapply bool, alerts *alerter, events *shared.EventLog) error {
+	if c.DryRun {
+		return dryRunVersion(ctx, c, s3Client, prefix, version)
 	}
 
-	if result.Status != "success" {
+	d := c.newDeployer(ctx, s3Client, metrics, prefix, events)
+	apply := d.Apply
+	if reapply {
+		apply = d.Reapply
+	}
+	result, err := apply(ctx, version)
+	switch {
+	case errors.Is(err, deployer.ErrVersionLocked):
+		return err
+	case errors.Is(err, deployer.ErrMigrationFailed):
 		slog.Error("Migration failed", "version", version)
-		return
+		alerts.migrationFailed(ctx, version, result)
+		return &migrationError{version: version, result: result}
+	case err != nil:
+		slog.Error("Failed to apply version", "version", version, "error", err)
+		alerts.checkFailed(ctx, err)
+		return err
+	case result == nil:
+		// Applied by another deployer while we waited for the lock
+		return nil
 	}
+	alerts.migrationSucceeded(ctx, version)
+	return nil
+}
 
-	slog.Info("Migration completed successfully", "version", version)
+// validateLeaderTTL checks the leader TTL against pollInterval in HA mode, at startup and on a
+// reload that changes the interval. The leader renews its heartbeat once per poll, so a TTL
+// below the longest poll interval would hand leadership back and forth.
+func (c *Cmd) validateLeaderTTL(pollInterval time.Duration) error {
+	if c.HAMode && c.LeaderTTL <= max(pollInterval, c.MaxPollInterval) {
+		return fmt.Errorf("--leader-ttl (%s) must be longer than the poll interval (%s) and --max-poll-interval (%s)",
+			c.LeaderTTL, pollInterval, c.MaxPollInterval)
+	}
+	return nil
+}
+
+// validatePollJitter checks the poll jitter against pollInterval, at startup and on a reload
+// that changes the interval. A jitter as long as the interval would make polls skip ticks.
+func (c *Cmd) validatePollJitter(pollInterval time.Duration) error {
+	if c.PollJitter < 0 || (c.PollJitter > 0 && c.PollJitter >= pollInterval) {
+		return fmt.Errorf("--poll-jitter (%s) must be between 0 and the poll interval (%s)", c.PollJitter, pollInterval)
+	}
+	return nil
+}
+
+// newDeployer builds the deployer that applies versions of prefix, recording metrics and events
+func (c *Cmd) newDeployer(ctx context.Context, s3Client *s3.Client, metrics *shared.Metrics, prefix string, events *shared.EventLog) *deployer.Deployer {
+	return deployer.NewWithClient(s3Client, deployer.Config{
+		Bucket:         c.S3Bucket,
+		Prefix:         prefix,
+		Settings:       &c.Settings,
+		DatabaseURL:    c.DatabaseURL,
+		ResultFile:     c.ResultFile,
+		CurrentPointer: c.CurrentPointer,
+		LockTTL:        c.LockTTL,
+		OnFailed:       c.OnFailed,
+		KeepAttempts:   c.KeepAttempts,
+		WriteProgress:  c.WriteProgress,
+		Migration: shared.MigrationOptions{
+			EmbedSQL:            c.EmbedSQL,
+			EmbedSQLMaxBytes:    c.EmbedSQLMaxBytes,
+			IncompletePolicy:    c.IncompletePolicy,
+			DownloadConcurrency: c.DownloadConcurrency,
+			Timeout:             c.MigrationTimeout,
+			WorkDir:             c.WorkDir,
+			DeployerVersion:     c.DeployerVersion,
+			MigrationsTable:     c.MigrationsTable,
+			LogTimestampFormat:  c.LogTimestampFormat,
+			DumpSchema:          c.DumpSchema,
+			FailOnDirty:         c.FailOnDirty,
+		},
+		Put: c.putOptions(),
+		OnStart: func(version string) {
+			events.Record(ctx, shared.Event{Event: shared.EventMigrationStarted, Prefix: prefix, Version: version})
+			metrics.RecordMigrationStarted(float64(time.Now().Unix()))
+		},
+		OnResult: func(version string, result *shared.Result, duration time.Duration) {
+			metrics.RecordMigrationFinished()
+			if result.Status == "success" {
+				events.Record(ctx, shared.Event{Event: shared.EventMigrationSucceeded, Prefix: prefix, Version: version,
+					DurationSeconds: duration.Seconds()})
+			} else {
+				events.Record(ctx, shared.Event{Event: shared.EventMigrationFailed, Prefix: prefix, Version: version,
+					DurationSeconds: duration.Seconds(), Error: result.Error, ErrorType: result.ErrorType})
+			}
+
+			metrics.RecordMigrationDuration(duration.Seconds())
+			metrics.RecordMigrationFileDurations(result.Durations)
+			metrics.RecordLastMigrationTimestamp(float64(time.Now().Unix()))
+			if result.Status == "success" {
+				metrics.RecordMigrationAttempt("success", "")
+				metrics.RecordCurrentVersion(version)
+			} else {
+				metrics.RecordMigrationAttempt("failed", result.ErrorType)
+			}
+		},
+	})
+}
+
+// dryRunVersion downloads and inspects a version's migrations without touching the database or S3 results.
+// It returns a *migrationError if the version couldn't be inspected.
+func dryRunVersion(ctx context.Context, c *Cmd, s3Client *s3.Client, prefix, version string) error {
+	slog.Info("Dry run: inspecting version", "version", version)
+
+	result := shared.ExecuteMigration(ctx, s3Client, c.Settings, c.S3Bucket, prefix, version, c.DatabaseURL, shared.MigrationOptions{
+		IncompletePolicy:    c.IncompletePolicy,
+		DownloadConcurrency: c.DownloadConcurrency,
+		DryRun:              true,
+		WorkDir:             c.WorkDir,
+		DeployerVersion:     c.DeployerVersion,
+		MigrationsTable:     c.MigrationsTable,
+		LogTimestampFormat:  c.LogTimestampFormat,
+	})
+	if result.Status != "dry-run" {
+		slog.Error("Dry run failed", "version", version, "error", result.Error)
+		return &migrationError{version: version, result: result}
+	}
+
+	slog.Info("Dry run: version would be applied, result not uploaded", "version", version)
+	return nil
 }
@@ -0,0 +1,297 @@
+// Package deployer applies dbmate migrations pushed to S3 with `dbmate-deployer push`.
+// It is the library behind the once and watch commands, for deployment programs that embed the
+// migration step instead of running the CLI.
+package deployer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared"
+)
+
+// Result is the outcome of applying a version, as stored in its result file
+type Result = shared.Result
+
+// MigrationOptions holds optional settings for running dbmate on a version
+type MigrationOptions = shared.MigrationOptions
+
+// PutOptions holds settings applied to every object the deployer uploads
+type PutOptions = shared.PutOptions
+
+// Settings holds the S3 layout, version format and S3 retry settings
+type Settings = shared.Settings
+
+// S3ClientOptions holds the settings the S3 client is created from
+type S3ClientOptions = shared.S3ClientOptions
+
+// S3RetryOptions controls how transient S3 errors are retried
+type S3RetryOptions = shared.S3RetryOptions
+
+// DefaultSettings returns the settings of the CLI without flags: migration files under
+// <version>/migrations/ and timestamp versions
+func DefaultSettings() Settings {
+	return shared.DefaultSettings()
+}
+
+// Policies for a version whose result reports a failure, set as Config.OnFailed
+const (
+	// OnFailedSkip keeps the failed result as final and applies newer versions (the default)
+	OnFailedSkip = shared.OnFailedSkip
+	// OnFailedBlock holds back newer versions until the failed result is removed
+	OnFailedBlock = shared.OnFailedBlock
+	// OnFailedRetry applies a failed version again
+	OnFailedRetry = shared.OnFailedRetry
+)
+
+// ErrVersionLocked is returned by Apply when another deployer holds the version lock
+var ErrVersionLocked = errors.New("version is locked by another deployer")
+
+// ErrMigrationFailed is returned by Apply, together with the result, when the migration failed
+var ErrMigrationFailed = errors.New("migration failed")
+
+// Config holds the settings of a Deployer
+type Config struct {
+	// Bucket is the S3 bucket holding the versions (required)
+	Bucket string
+	// Prefix is the S3 path prefix of the versions, e.g. "migrations/" (required)
+	Prefix string
+	// S3 holds the options the S3 client is created from; the zero value uses AWS S3 with
+	// the default credential chain
+	S3 S3ClientOptions
+	// Settings holds the S3 layout, version format and S3 retry settings (nil for DefaultSettings())
+	Settings *Settings
+	// DatabaseURL is the database to migrate, postgres:// or mysql:// (required)
+	DatabaseURL string
+	// ResultFile is the per-version result file marking a version as applied (default: result.json)
+	ResultFile string
+	// CurrentPointer is the file name of the latest applied version pointer at the prefix root (empty to disable)
+	CurrentPointer string
+	// LockTTL is how long a version lock is honored before it is considered stale (0 disables locking)
+	LockTTL time.Duration
+	// TargetVersion holds back versions newer than this one (empty for no limit)
+	TargetVersion string
+	// OnFailed is what to do with a version whose result reports a failure (default: OnFailedSkip)
+	OnFailed string
+	// KeepAttempts also keeps every result under <version>/attempts/<timestamp>.json
+	KeepAttempts bool
+	// WriteProgress uploads the log of a running migration to <version>/progress.log every few seconds
+	WriteProgress bool
+	// Migration holds the options used to run dbmate on each version
+	Migration MigrationOptions
+	// Put holds the settings applied to uploaded objects
+	Put PutOptions
+	// OnStart, if set, is called right before dbmate runs on a version
+	OnStart func(version string)
+	// OnResult, if set, is called with each result and how long dbmate ran before the result is uploaded
+	OnResult func(version string, result *Result, duration time.Duration)
+}
+
+// settings returns cfg.Settings, or DefaultSettings() if it is not set
+func (cfg Config) settings() Settings {
+	if cfg.Settings == nil {
+		return DefaultSettings()
+	}
+	return *cfg.Settings
+}
+
+// Deployer applies the pending versions of one S3 prefix to one database
+type Deployer struct {
+	cfg      Config
+	settings Settings
+	client   *s3.Client
+}
+
+// New validates cfg and returns a Deployer with an S3 client created like the CLI's
+func New(ctx context.Context, cfg Config) (*Deployer, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("bucket is required")
+	}
+	if cfg.Prefix == "" {
+		return nil, fmt.Errorf("prefix is required")
+	}
+	if err := shared.ValidateDatabaseURL(cfg.DatabaseURL); err != nil {
+		return nil, err
+	}
+	if cfg.TargetVersion != "" {
+		if err := cfg.settings().ValidateVersion(cfg.TargetVersion); err != nil {
+			return nil, fmt.Errorf("invalid target version: %w", err)
+		}
+	}
+	if cfg.Migration.MigrationsTable != "" {
+		if err := shared.ValidateMigrationsTable(cfg.Migration.MigrationsTable); err != nil {
+			return nil, err
+		}
+	}
+	switch cfg.OnFailed {
+	case "", OnFailedSkip, OnFailedBlock, OnFailedRetry:
+	default:
+		return nil, fmt.Errorf("invalid on-failed policy %q (supported: skip, block, retry)", cfg.OnFailed)
+	}
+	if err := cfg.Put.Validate(); err != nil {
+		return nil, err
+	}
+
+	client, err := shared.CreateS3Client(ctx, cfg.S3)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+	return NewWithClient(client, cfg), nil
+}
+
+// NewWithClient returns a Deployer using client, without validating cfg
+func NewWithClient(client *s3.Client, cfg Config) *Deployer {
+	if !strings.HasSuffix(cfg.Prefix, "/") {
+		cfg.Prefix += "/"
+	}
+	if cfg.ResultFile == "" {
+		cfg.ResultFile = shared.DefaultResultFile
+	}
+	return &Deployer{cfg: cfg, settings: cfg.settings(), client: client}
+}
+
+// PendingVersions returns the versions without a result file, oldest first, up to the
+// target version and subject to the OnFailed policy. It returns an empty list if there are none.
+func (d *Deployer) PendingVersions(ctx context.Context) ([]string, error) {
+	versions, err := shared.FindPendingVersions(ctx, d.client, d.settings, d.cfg.Bucket, d.cfg.Prefix, d.cfg.ResultFile, d.cfg.TargetVersion, d.cfg.OnFailed)
+	if errors.Is(err, shared.ErrNoUnappliedVersions) || errors.Is(err, shared.ErrNoVersions) {
+		return nil, nil
+	}
+	return versions, err
+}
+
+// ApplyPending applies the pending versions in order and returns their results. It stops at
+// the first failed version, and without an error when another deployer holds a version lock.
+func (d *Deployer) ApplyPending(ctx context.Context) ([]*Result, error) {
+	versions, err := d.PendingVersions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find unapplied versions: %w", err)
+	}
+
+	var results []*Result
+	for _, version := range versions {
+		result, err := d.Apply(ctx, version)
+		if result != nil {
+			results = append(results, result)
+		}
+		if errors.Is(err, ErrVersionLocked) {
+			slog.Info("Version is being applied by another deployer, stopping", "version", version)
+			return results, nil
+		}
+		if err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// Apply runs the migrations of version and uploads its result. The result is nil if
+// another deployer applied the version meanwhile. A failed migration returns its result
+// together with an error wrapping ErrMigrationFailed.
+func (d *Deployer) Apply(ctx context.Context, version string) (*Result, error) {
+	return d.apply(ctx, version, false)
+}
+
+// Reapply is Apply for a version that already has a result file, e.g. one recorded as applied
+// whose migrations are missing from the database
+func (d *Deployer) Reapply(ctx context.Context, version string) (*Result, error) {
+	return d.apply(ctx, version, true)
+}
+
+// apply runs the migrations of version; reapply runs it even if its result file exists
+func (d *Deployer) apply(ctx context.Context, version string, reapply bool) (*Result, error) {
+	cfg := d.cfg
+	slog.Info("Applying version", "version", version)
+
+	// Take the version lock so that replicas don't apply the same version
+	if cfg.LockTTL > 0 {
+		acquired, lockETag, err := shared.AcquireVersionLock(ctx, d.client, cfg.Bucket, cfg.Prefix, version, cfg.LockTTL, cfg.Put)
+		if err != nil {
+			return nil, fmt.Errorf("failed to acquire lock for version %s: %w", version, err)
+		}
+		if !acquired {
+			return nil, ErrVersionLocked
+		}
+		defer func() {
+			if err := shared.ReleaseVersionLock(ctx, d.client, cfg.Bucket, cfg.Prefix, version, lockETag); err != nil {
+				slog.Warn("Failed to release version lock", "version", version, "error", err)
+			}
+		}()
+
+		// Another replica may have finished the version before we got the lock
+		pending, err := shared.ResultPending(ctx, d.client, d.settings, cfg.Bucket, cfg.Prefix, version, cfg.ResultFile, cfg.OnFailed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check result for version %s: %w", version, err)
+		}
+		if !pending && !reapply {
+			slog.Info("Version was applied by another deployer", "version", version)
+			return nil, nil
+		}
+	}
+
+	if cfg.OnStart != nil {
+		cfg.OnStart(version)
+	}
+
+	opts := cfg.Migration
+	var progress *shared.ProgressLog
+	if cfg.WriteProgress {
+		progress = shared.StartProgressLog(ctx, d.client, d.settings, cfg.Bucket, cfg.Prefix, version, shared.ProgressLogInterval, cfg.Put)
+		opts.LogWriter = progress
+	}
+	startTime := time.Now()
+	result := shared.ExecuteMigration(ctx, d.client, d.settings, cfg.Bucket, cfg.Prefix, version, cfg.DatabaseURL, opts)
+	duration := time.Since(startTime)
+
+	// The complete log is uploaded before the result, so followers don't miss its last lines
+	if progress != nil {
+		if err := progress.Close(); err != nil {
+			slog.Warn("Failed to upload progress log", "version", version, "error", err)
+		}
+	}
+	if cfg.OnResult != nil {
+		cfg.OnResult(version, result, duration)
+	}
+
+	// Upload result (both success and failure)
+	if err := shared.UploadResult(ctx, d.client, d.settings, cfg.Bucket, cfg.Prefix, version, cfg.ResultFile, result, shared.ResultMetadata(result), cfg.Put); err != nil {
+		slog.Error("Failed to upload result", "error", err)
+		return result, fmt.Errorf("failed to upload result for version %s: %w", version, err)
+	}
+	if cfg.KeepAttempts {
+		if err := shared.UploadAttempt(ctx, d.client, d.settings, cfg.Bucket, cfg.Prefix, version, result, cfg.Put); err != nil {
+			slog.Warn("Failed to record attempt", "error", err)
+		}
+	}
+
+	if result.Status != "success" {
+		return result, fmt.Errorf("%w for version %s", ErrMigrationFailed, version)
+	}
+
+	if result.Schema != "" {
+		if err := shared.UploadSchema(ctx, d.client, d.settings, cfg.Bucket, cfg.Prefix, version, result.Schema, cfg.Put); err != nil {
+			slog.Warn("Failed to upload schema", "error", err)
+		}
+	}
+
+	// Update the current pointer only after the result has been recorded
+	if cfg.CurrentPointer != "" {
+		pointer := &shared.CurrentPointer{Version: version, AppliedAt: result.Timestamp}
+		if err := shared.UploadCurrentPointer(ctx, d.client, d.settings, cfg.Bucket, cfg.Prefix, cfg.CurrentPointer, pointer, cfg.Put); err != nil {
+			slog.Warn("Failed to update current pointer", "error", err)
+		}
+	}
+
+	slog.Info("Migration completed successfully", "version", version)
+	return result, nil
+}
+
+// WaitForResult polls S3 until the result file of version appears or timeout elapses
+func (d *Deployer) WaitForResult(ctx context.Context, version string, pollInterval, timeout time.Duration) (*Result, error) {
+	return shared.WaitForResult(ctx, d.client, d.settings, d.cfg.Bucket, d.cfg.Prefix, version, d.cfg.ResultFile, pollInterval, timeout)
+}
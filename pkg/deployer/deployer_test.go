@@ -0,0 +1,113 @@
+package deployer
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tokuhirom/dbmate-deployer/internal/shared/testhelpers"
+)
+
+// newTestDeployer returns a Deployer on an empty bucket of an in-memory S3 server
+func newTestDeployer(t *testing.T) (*Deployer, *s3.Client) {
+	t.Helper()
+	ctx := context.Background()
+
+	server, _, client := testhelpers.SetupFakeS3(ctx, t)
+	t.Cleanup(server.Close)
+	_, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String("test-bucket")})
+	require.NoError(t, err)
+
+	return NewWithClient(client, Config{
+		Bucket:      "test-bucket",
+		Prefix:      "migrations",
+		DatabaseURL: "postgres://localhost/db",
+	}), client
+}
+
+// putObject stores content under key in the test bucket
+func putObject(t *testing.T, client *s3.Client, key, content string) {
+	t.Helper()
+	_, err := client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String("test-bucket"),
+		Key:    aws.String(key),
+		Body:   strings.NewReader(content),
+	})
+	require.NoError(t, err)
+}
+
+func TestNew_Validation(t *testing.T) {
+	valid := Config{Bucket: "test-bucket", Prefix: "migrations/", DatabaseURL: "postgres://localhost/db"}
+
+	tests := []struct {
+		name        string
+		modify      func(*Config)
+		expectError string
+	}{
+		{name: "missing bucket", modify: func(c *Config) { c.Bucket = "" }, expectError: "bucket is required"},
+		{name: "missing prefix", modify: func(c *Config) { c.Prefix = "" }, expectError: "prefix is required"},
+		{name: "unsupported database", modify: func(c *Config) { c.DatabaseURL = "sqlite:///tmp/db" }, expectError: "unsupported database scheme"},
+		{name: "invalid target version", modify: func(c *Config) { c.TargetVersion = "latest" }, expectError: "invalid target version"},
+		{name: "invalid on-failed policy", modify: func(c *Config) { c.OnFailed = "ignore" }, expectError: "invalid on-failed policy"},
+		{name: "invalid migrations table", modify: func(c *Config) { c.Migration.MigrationsTable = "drop table" }, expectError: "invalid migrations table"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid
+			tt.modify(&cfg)
+			_, err := New(context.Background(), cfg)
+			assert.ErrorContains(t, err, tt.expectError)
+		})
+	}
+}
+
+func TestNewWithClient_Defaults(t *testing.T) {
+	d := NewWithClient(nil, Config{Bucket: "test-bucket", Prefix: "migrations"})
+	assert.Equal(t, "migrations/", d.cfg.Prefix)
+	assert.Equal(t, "result.json", d.cfg.ResultFile)
+	assert.Equal(t, DefaultSettings(), d.settings)
+
+	flat := Settings{}
+	d = NewWithClient(nil, Config{Bucket: "test-bucket", Prefix: "migrations", Settings: &flat})
+	assert.Equal(t, flat, d.settings)
+}
+
+func TestDeployer_PendingVersions(t *testing.T) {
+	d, client := newTestDeployer(t)
+	ctx := context.Background()
+
+	// An empty prefix has nothing pending rather than an error
+	versions, err := d.PendingVersions(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, versions)
+
+	putObject(t, client, "migrations/20240101000000/migrations/001_a.sql", testhelpers.ValidMigration("a"))
+	putObject(t, client, "migrations/20240101000000/result.json", testhelpers.SuccessResult("20240101000000", "applied"))
+	putObject(t, client, "migrations/20240102000000/migrations/002_b.sql", testhelpers.ValidMigration("b"))
+	putObject(t, client, "migrations/20240103000000/migrations/003_c.sql", testhelpers.ValidMigration("c"))
+
+	versions, err = d.PendingVersions(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"20240102000000", "20240103000000"}, versions)
+
+	d.cfg.TargetVersion = "20240102000000"
+	versions, err = d.PendingVersions(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"20240102000000"}, versions)
+}
+
+func TestDeployer_WaitForResult(t *testing.T) {
+	d, client := newTestDeployer(t)
+	putObject(t, client, "migrations/20240101000000/result.json", testhelpers.SuccessResult("20240101000000", "applied"))
+
+	result, err := d.WaitForResult(context.Background(), "20240101000000", 10*time.Millisecond, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "success", result.Status)
+	assert.Equal(t, "20240101000000", result.Version)
+}